@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// alertMessage is the body of the SNS notification published when a run has matches
+type alertMessage struct {
+	Source       string                  `json:"source"`
+	LinesMatched int                     `json:"linesMatched"`
+	Rules        map[string]*ruleSummary `json:"rules"`
+}
+
+// publishAlert publishes a single summary of the run's matches - which rules (source IP addresses)
+// were hit and how many bytes they sent - rather than one message per match, and only when the
+// matches exceed ALERT_THRESHOLD so a noisy source doesn't flood the topic
+func publishAlert(source string, result Result, runSummaries *summaries) error {
+	if result.LinesMatched <= alertThreshold {
+		return nil
+	}
+
+	message, err := json.Marshal(alertMessage{Source: source, LinesMatched: result.LinesMatched, Rules: runSummaries.rules})
+	if err != nil {
+		return err
+	}
+
+	snsClient, err := getSNSClient()
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("%d outbound VPC logs matched", result.LinesMatched)
+	_, err = snsClient.Publish(&sns.PublishInput{
+		TopicArn: aws.String(alertSNSTopic),
+		Subject:  aws.String(subject),
+		Message:  aws.String(string(message)),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published alert to %s: %s\n", alertSNSTopic, subject)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	f.published = append(f.published, input)
+	return &sns.PublishOutput{MessageId: aws.String("message-1")}, nil
+}
+
+// useFakeSNS makes getSNSClient return fake for the rest of the test
+func useFakeSNS(t *testing.T, fake *fakeSNS) {
+	t.Helper()
+	snsClientOnce = sync.Once{}
+	snsClientOnce.Do(func() { cachedSNSClient = fake })
+	t.Cleanup(func() { snsClientOnce = sync.Once{} })
+}
+
+func TestPublishAlertAboveThreshold(t *testing.T) {
+	fake := &fakeSNS{}
+	useFakeSNS(t, fake)
+	setForTest(t, &alertSNSTopic, "arn:aws:sns:us-east-1:123456789012:alerts")
+	setForTest(t, &alertThreshold, 1)
+
+	runSummaries := newSummaries()
+	for _, bytes := range []string{"100", "250"} {
+		runSummaries.add([]string{"10.0.0.0/8"}, parseTestRecord(t, recordLine("bytes="+bytes)))
+	}
+	if err := publishAlert("s3://src/in.log", Result{LinesMatched: 2}, runSummaries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.published) != 1 {
+		t.Fatalf("published %d alerts, want a single summary", len(fake.published))
+	}
+	input := fake.published[0]
+	if aws.StringValue(input.TopicArn) != alertSNSTopic {
+		t.Errorf("published to %s", aws.StringValue(input.TopicArn))
+	}
+	var message alertMessage
+	if err := json.Unmarshal([]byte(aws.StringValue(input.Message)), &message); err != nil {
+		t.Fatal(err)
+	}
+	rule := message.Rules["10.0.0.0/8"]
+	if message.Source != "s3://src/in.log" || message.LinesMatched != 2 || rule == nil || rule.Matches != 2 || rule.Bytes != 350 {
+		t.Errorf("alert message %s", aws.StringValue(input.Message))
+	}
+}
+
+func TestPublishAlertSkippedAtThreshold(t *testing.T) {
+	fake := &fakeSNS{}
+	useFakeSNS(t, fake)
+	setForTest(t, &alertSNSTopic, "arn:aws:sns:us-east-1:123456789012:alerts")
+	setForTest(t, &alertThreshold, 2)
+
+	if err := publishAlert("s3://src/in.log", Result{LinesMatched: 2}, newSummaries()); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.published) != 0 {
+		t.Fatalf("alert published for matches not exceeding ALERT_THRESHOLD")
+	}
+}
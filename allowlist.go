@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// cachedAllowlist is the last ALLOWLIST_PATH object read by this container, kept across warm
+// invocations with its ETag so it is only downloaded again when it changes
+var cachedAllowlist struct {
+	etag  string
+	rules []sourceRule
+}
+
+// loadAllowlist reads the entries of the ALLOWLIST_PATH object - one IP address or CIDR block per
+// line, with blank lines and "#" comments ignored. Warm invocations send the cached ETag in a
+// conditional GET and reuse the cached entries when S3 answers 304 Not Modified.
+func loadAllowlist(sourceS3Client s3iface.S3API) ([]sourceRule, error) {
+	bucket, key, err := parseBucketAndKeyFromFilePath(allowlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	getObjectInput := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if cachedAllowlist.etag != "" {
+		getObjectInput.IfNoneMatch = aws.String(cachedAllowlist.etag)
+	}
+
+	object, err := sourceS3Client.GetObject(getObjectInput)
+	if isNotModified(err) {
+		log.Printf("Allowlist s3://%s/%s is unchanged - using the cached %d entries\n", bucket, key, len(cachedAllowlist.rules))
+		return cachedAllowlist.rules, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read allowlist s3://%s/%s: %v", bucket, key, err)
+	}
+	defer object.Body.Close()
+
+	rules, err := parseAllowlist("Allowlist", object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read allowlist s3://%s/%s: %v", bucket, key, err)
+	}
+
+	cachedAllowlist.etag, cachedAllowlist.rules = aws.StringValue(object.ETag), rules
+	log.Printf("Loaded %d entries from allowlist s3://%s/%s\n", len(rules), bucket, key)
+	return rules, nil
+}
+
+// embeddedAllowlist is allowlist.txt, built into the binary for deployments that cannot read a list
+// at runtime. Its entries are matched when ALLOWLIST_PATH is not set.
+//
+//go:embed allowlist.txt
+var embeddedAllowlist string
+
+// embeddedAllowlistRules are the parsed entries of the embedded allowlist
+var embeddedAllowlistRules = mustParseEmbeddedAllowlist()
+
+func mustParseEmbeddedAllowlist() []sourceRule {
+	if allowlistPath != "" {
+		return nil
+	}
+	rules, err := parseAllowlist("Embedded allowlist", strings.NewReader(embeddedAllowlist))
+	fatalIf(err)
+	return rules
+}
+
+// parseAllowlist parses an allowlist - one IP address or CIDR block per line, with blank lines and
+// "#" comments ignored. source names where the list came from in errors.
+func parseAllowlist(source string, r io.Reader) ([]sourceRule, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseSourceRules(source, entries)
+}
+
+// isNotModified reports whether err is S3's 304 response to a conditional GET
+func isNotModified(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok {
+		return aerr.StatusCode() == http.StatusNotModified
+	}
+	return false
+}
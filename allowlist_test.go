@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAllowlistCachedByETag(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &allowlistPath, "config/allowlist.txt")
+	previous := cachedAllowlist
+	cachedAllowlist.etag, cachedAllowlist.rules = "", nil
+	t.Cleanup(func() { cachedAllowlist = previous })
+
+	var conditional []string
+	fake.fail = func(r *http.Request) int {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		return 0
+	}
+	fake.put("config", "allowlist.txt", "10.0.0.1\n# office\n10.1.0.0/16\n")
+
+	load := func() []sourceRule {
+		t.Helper()
+		rules, err := loadAllowlist(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+	first := load()
+	if len(first) != 2 || first[1].Name != "10.1.0.0/16" {
+		t.Fatalf("loaded %v", first)
+	}
+
+	// Unchanged - S3 answers 304 and the cached entries are used
+	if second := load(); len(second) != 2 || &second[0] != &first[0] {
+		t.Errorf("unchanged allowlist loaded as %v, want the cached entries", second)
+	}
+
+	fake.put("config", "allowlist.txt", "10.0.0.2\n")
+	third := load()
+	if len(third) != 1 || third[0].Name != "10.0.0.2" {
+		t.Errorf("changed allowlist loaded as %v", third)
+	}
+
+	if len(conditional) != 3 || conditional[0] != "" || conditional[1] == "" || conditional[1] != conditional[2] {
+		t.Errorf("conditional GETs sent with ETags %q", conditional)
+	}
+	if cachedAllowlist.etag != fake.objects["config/allowlist.txt"].etag() {
+		t.Errorf("cached ETag %s, want the changed object's", cachedAllowlist.etag)
+	}
+}
+
+func TestEmbeddedAllowlist(t *testing.T) {
+	setForTest(t, &allowlistPath, "")
+	if _, err := parseAllowlist("Embedded allowlist", strings.NewReader(embeddedAllowlist)); err != nil {
+		t.Fatalf("the allowlist.txt built into the binary does not parse: %v", err)
+	}
+
+	setForTest(t, &embeddedAllowlist, "# Office egress\n203.0.113.7\n\n10.20.0.0/16 # VPN\n")
+	rules := mustParseEmbeddedAllowlist()
+	if got := ruleNames(rules); got != "203.0.113.7,10.20.0.0/16" {
+		t.Fatalf("embedded allowlist rules %q", got)
+	}
+	if !rules[0].matches("203.0.113.7") || !rules[1].matches("10.20.3.4") || rules[1].matches("10.21.0.1") {
+		t.Errorf("embedded allowlist rules do not match their entries")
+	}
+
+	setForTest(t, &allowlistPath, "lists/allowlist.txt")
+	if rules := mustParseEmbeddedAllowlist(); rules != nil {
+		t.Errorf("embedded allowlist used with ALLOWLIST_PATH set: %q", ruleNames(rules))
+	}
+}
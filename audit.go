@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEvent is the AUDIT_LOG summary of a run. Its fields are a stable schema for CloudWatch Logs
+// Insights queries (e.g. `filter event = "vpclogfilter.run" and outcome = "failure"`): fields are
+// only ever added, and schemaVersion goes up if one has to change.
+type auditEvent struct {
+	Event         string `json:"event"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Timestamp     string `json:"timestamp"`
+	RequestID     string `json:"requestId,omitempty"`
+	FunctionName  string `json:"functionName"`
+	ConfigHash    string `json:"configHash"`
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+
+	// Outcome is "success", "failure", "truncated" or "skipped"
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"durationMs"`
+
+	ObjectsProcessed      int `json:"objectsProcessed"`
+	LinesScanned          int `json:"linesScanned"`
+	LinesMatched          int `json:"linesMatched"`
+	ParseFailures         int `json:"parseFailures"`
+	InvalidRecords        int `json:"invalidRecords"`
+	SerializationFailures int `json:"serializationFailures"`
+}
+
+// emitAuditEvent prints the run's audit event as the last line of the invocation. As with EMF, it
+// is printed as a bare JSON line rather than logged, so Logs Insights discovers its fields.
+func emitAuditEvent(ctx context.Context, started time.Time, result Result, runErr error) {
+	finished := clock.Now()
+	event := auditEvent{
+		Event:         "vpclogfilter.run",
+		SchemaVersion: 1,
+		Timestamp:     finished.UTC().Format(time.RFC3339Nano),
+		RequestID:     invocationRequestID(ctx),
+		FunctionName:  functionName,
+		ConfigHash:    configHash(),
+		Source:        sourceBucketName,
+		Destination:   destBucketName,
+		Outcome:       "success",
+		DurationMS:    finished.Sub(started).Milliseconds(),
+
+		ObjectsProcessed:      result.ObjectsProcessed,
+		LinesScanned:          result.LinesScanned,
+		LinesMatched:          result.LinesMatched,
+		ParseFailures:         result.ParseFailures,
+		InvalidRecords:        result.InvalidRecords,
+		SerializationFailures: result.SerializationFailures,
+	}
+	if sourceURL != "" {
+		event.Source = redactURL(sourceURL)
+	}
+	switch {
+	case runErr != nil:
+		event.Outcome, event.Error = "failure", runErr.Error()
+	case result.Skipped:
+		event.Outcome = "skipped"
+	case result.Truncated:
+		event.Outcome = "truncated"
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(line))
+}
+
+var (
+	configHashOnce  sync.Once
+	configHashValue string
+)
+
+// configHash identifies the function's configuration: the first 16 hex digits of the SHA-256 of
+// its sorted environment variables, leaving out the ones set by the Lambda runtime (AWS_*, _*,
+// LAMBDA_* and the system ones), which differ between containers of the same configuration, and
+// the secrets, which a hash printed to the logs could be checked against
+func configHash() string {
+	configHashOnce.Do(func() {
+		var config []string
+		for _, variable := range os.Environ() {
+			name := strings.SplitN(variable, "=", 2)[0]
+			if isRuntimeVariable(name) || isSecretVariable(name) {
+				continue
+			}
+			config = append(config, variable)
+		}
+		sort.Strings(config)
+
+		sum := sha256.Sum256([]byte(strings.Join(config, "\n")))
+		configHashValue = hex.EncodeToString(sum[:8])
+	})
+	return configHashValue
+}
+
+func isRuntimeVariable(name string) bool {
+	switch name {
+	case "PATH", "LD_LIBRARY_PATH", "LANG", "TZ", "HOME", "PWD", "SHLVL":
+		return true
+	}
+	return strings.HasPrefix(name, "AWS_") || strings.HasPrefix(name, "_") || strings.HasPrefix(name, "LAMBDA_")
+}
+
+func isSecretVariable(name string) bool {
+	switch name {
+	case "ACCESS_KEY", "SECRET_ACCESS_KEY", "REDACT_SALT", "OTEL_EXPORTER_OTLP_HEADERS":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestRunEmitsFailureAuditEvent(t *testing.T) {
+	_, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &auditLog, true)
+
+	output := captureStdout(t, func() {
+		run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+			return nil, errors.New("listing failed")
+		})
+	})
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	var event auditEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &event); err != nil {
+		t.Fatalf("last line %q is not an audit event: %v", lines[len(lines)-1], err)
+	}
+	if event.Event != "vpclogfilter.run" || event.Outcome != "failure" || event.Error != "listing failed" {
+		t.Fatalf("audit event %+v, want the listing failure", event)
+	}
+}
+
+func TestConfigHashIgnoresSecrets(t *testing.T) {
+	hash := func() string {
+		configHashOnce = sync.Once{}
+		return configHash()
+	}
+	t.Cleanup(func() { configHashOnce = sync.Once{} })
+
+	t.Setenv("DEST_BUCKET_NAME", "dest/out.log")
+	base := hash()
+	for _, name := range []string{"ACCESS_KEY", "SECRET_ACCESS_KEY", "REDACT_SALT", "AWS_REQUEST_ID"} {
+		t.Setenv(name, "changed")
+		if got := hash(); got != base {
+			t.Errorf("setting %s changed the config hash", name)
+		}
+	}
+
+	t.Setenv("DEST_BUCKET_NAME", "dest/other.log")
+	if hash() == base {
+		t.Error("changing DEST_BUCKET_NAME left the config hash unchanged")
+	}
+}
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	captured := make(chan string)
+	go func() {
+		output, _ := io.ReadAll(reader)
+		captured <- string(output)
+	}()
+	f()
+	writer.Close()
+	return <-captured
+}
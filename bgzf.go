@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// bgzfMaxBlockData is the most uncompressed data in a BGZF block. It keeps every compressed block
+// under the 64KB limit, even for data that does not compress and is stored as is.
+const bgzfMaxBlockData = 0xff00
+
+// bgzfEOF is the empty block that ends a BGZF file, so readers can tell a complete file from a
+// truncated one
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00,
+	0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// bgzfWriter compresses to BGZF (blocked gzip, as specified with the SAM/BAM formats): a series of
+// gzip members of at most 64KB each, with each member's compressed size in a "BC" extra field.
+// Readers that know the format can seek to any block and decompress from there, so a large
+// output can be split between parallel readers; to anything else it is a multi-member gzip file.
+type bgzfWriter struct {
+	w          io.Writer
+	block      []byte
+	compressed bytes.Buffer
+	flate      *flate.Writer
+}
+
+func newBGZFWriter(w io.Writer) *bgzfWriter {
+	flateWriter, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return &bgzfWriter{w: w, block: make([]byte, 0, bgzfMaxBlockData), flate: flateWriter}
+}
+
+func (b *bgzfWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.block[len(b.block):cap(b.block)], p)
+		b.block = b.block[:len(b.block)+n]
+		p, written = p[n:], written+n
+
+		if len(b.block) == cap(b.block) {
+			if err := b.writeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeBlock compresses the buffered data into one gzip member
+func (b *bgzfWriter) writeBlock() error {
+	b.compressed.Reset()
+	b.flate.Reset(&b.compressed)
+	if _, err := b.flate.Write(b.block); err != nil {
+		return err
+	}
+	if err := b.flate.Close(); err != nil {
+		return err
+	}
+
+	// Header with the FEXTRA flag and the BC subfield, whose value is the block size minus 1
+	const headerSize, footerSize = 18, 8
+	header := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0x00, 0xff, 0x06, 0x00, 'B', 'C', 0x02, 0x00, 0, 0}
+	binary.LittleEndian.PutUint16(header[16:], uint16(headerSize+b.compressed.Len()+footerSize-1))
+
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint32(footer[0:], crc32.ChecksumIEEE(b.block))
+	binary.LittleEndian.PutUint32(footer[4:], uint32(len(b.block)))
+
+	for _, part := range [][]byte{header, b.compressed.Bytes(), footer} {
+		if _, err := b.w.Write(part); err != nil {
+			return err
+		}
+	}
+	b.block = b.block[:0]
+	return nil
+}
+
+// Close writes the last, partial block and the EOF block
+func (b *bgzfWriter) Close() error {
+	if len(b.block) > 0 {
+		if err := b.writeBlock(); err != nil {
+			return err
+		}
+	}
+	_, err := b.w.Write(bgzfEOF)
+	return err
+}
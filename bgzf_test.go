@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// bgzfFixture is about 300KB of flow log lines followed by 100KB that does not compress
+func bgzfFixture() []byte {
+	var data bytes.Buffer
+	for i := 0; data.Len() < 300<<10; i++ {
+		data.WriteString(flowLogLine("eni-1", "10.0."+strings.Repeat("1", i%3+1)+".1", "8.8.8.8") + "\n")
+	}
+	random := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	data.Write(random)
+	return data.Bytes()
+}
+
+func writeBGZF(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var output bytes.Buffer
+	writer := newBGZFWriter(&output)
+	// Written in uneven pieces, as records are
+	for len(data) > 0 {
+		n := 1000 + len(data)%777
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := writer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return output.Bytes()
+}
+
+func TestBGZFReadsAsGzip(t *testing.T) {
+	data := bgzfFixture()
+	reader, err := gzip.NewReader(bytes.NewReader(writeBGZF(t, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("gzip read back %d bytes, want the %d written", len(got), len(data))
+	}
+}
+
+func TestBGZFBlocksDecompressIndependently(t *testing.T) {
+	data := bgzfFixture()
+	output := writeBGZF(t, data)
+	if !bytes.HasSuffix(output, bgzfEOF) {
+		t.Fatal("output does not end with the BGZF EOF block")
+	}
+
+	// Walk the blocks by the sizes in their BC fields, decompressing each on its own as a reader
+	// seeking to it would
+	var blocks int
+	var got bytes.Buffer
+	for offset := 0; offset < len(output); blocks++ {
+		block := output[offset:]
+		if len(block) < 18 || block[3]&0x04 == 0 || block[12] != 'B' || block[13] != 'C' {
+			t.Fatalf("block %d at offset %d has no BC field", blocks, offset)
+		}
+		size := int(binary.LittleEndian.Uint16(block[16:])) + 1
+		if size > 64<<10 || size > len(block) {
+			t.Fatalf("block %d at offset %d is %d bytes", blocks, offset, size)
+		}
+
+		reader, err := gzip.NewReader(bytes.NewReader(block[:size]))
+		if err != nil {
+			t.Fatalf("block %d: %v", blocks, err)
+		}
+		reader.Multistream(false)
+		if _, err := io.Copy(&got, reader); err != nil {
+			t.Fatalf("block %d: %v", blocks, err)
+		}
+		offset += size
+	}
+
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("blocks decompressed to %d bytes, want the %d written", got.Len(), len(data))
+	}
+	if want := (len(data)+bgzfMaxBlockData-1)/bgzfMaxBlockData + 1; blocks != want {
+		t.Errorf("%d blocks, want %d data blocks and the EOF block", blocks, want-1)
+	}
+}
+
+func TestBGZFOutputRoundTrip(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &outputCompression, outputCompressionBGZF)
+	lines := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8") + "\n" + flowLogLine("eni-2", "10.0.0.2", "8.8.8.8") + "\n"
+	fake.put("src", "in.log", lines)
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := fake.keys("dest")
+	if len(keys) != 1 {
+		t.Fatalf("wrote %v, want one output", keys)
+	}
+	output, _ := fake.get("dest", keys[0])
+	if !strings.HasSuffix(output, string(bgzfEOF)) {
+		t.Fatalf("output %s is not BGZF", keys[0])
+	}
+	reader, err := gzip.NewReader(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(reader); err != nil || string(got) != lines {
+		t.Errorf("output read back as %q, %v, want the matched lines", got, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// bufferedSinkWriter hands records to a slow sink (Firehose) through a buffer of SINK_BUFFER_SIZE
+// records, sent by a background goroutine, so the scan carries on while a batch is in flight.
+// When the buffer is full the scan blocks until the sink catches up, which bounds the memory held
+// for the sink however slow it is. A send error fails the next Write, Flush or Close.
+type bufferedSinkWriter struct {
+	sink outputWriter
+	ops  chan sinkOp
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// sinkOp is a record to write, or a flush request answered on flushed
+type sinkOp struct {
+	vpcLog  *VPCFlowLog
+	flushed chan error
+}
+
+func newBufferedSinkWriter(sink outputWriter, size int) *bufferedSinkWriter {
+	b := &bufferedSinkWriter{sink: sink, ops: make(chan sinkOp, size), done: make(chan struct{})}
+	go b.send()
+	return b
+}
+
+// send writes the buffered records to the sink in order. After an error, the remaining records
+// are dropped.
+func (b *bufferedSinkWriter) send() {
+	defer close(b.done)
+	for op := range b.ops {
+		err := b.failure()
+		if op.flushed != nil {
+			if err == nil {
+				err = b.sink.Flush()
+				b.fail(err)
+			}
+			op.flushed <- err
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// As in the scan loop, records that cannot be serialized are left to DEADLETTER_KEY
+		var serializationErr *SerializationError
+		if err := b.sink.Write(op.vpcLog); err != nil && !(errors.As(err, &serializationErr) && deadletterKey != "") {
+			b.fail(err)
+		}
+	}
+}
+
+func (b *bufferedSinkWriter) fail(err error) {
+	if err == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *bufferedSinkWriter) failure() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *bufferedSinkWriter) Write(vpcLog *VPCFlowLog) error {
+	if err := b.failure(); err != nil {
+		return err
+	}
+	b.ops <- sinkOp{vpcLog: vpcLog}
+	return nil
+}
+
+// Flush waits for the buffered records to be sent, then flushes the sink
+func (b *bufferedSinkWriter) Flush() error {
+	flushed := make(chan error, 1)
+	b.ops <- sinkOp{flushed: flushed}
+	return <-flushed
+}
+
+// Close sends the buffered records and closes the sink
+func (b *bufferedSinkWriter) Close() error {
+	close(b.ops)
+	<-b.done
+	if err := b.failure(); err != nil {
+		return b.sink.Abort(err)
+	}
+	return b.sink.Close()
+}
+
+// Abort drops the buffered records and aborts the sink
+func (b *bufferedSinkWriter) Abort(err error) error {
+	b.fail(err)
+	close(b.ops)
+	<-b.done
+	return b.sink.Abort(err)
+}
+
+func (b *bufferedSinkWriter) Objects() []outputObject {
+	return b.sink.Objects()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowSink takes a millisecond to send each record, failing from the record numbered failAt (from 1)
+type slowSink struct {
+	fakeSink
+	delivered atomic.Int64
+	failAt    int64
+}
+
+func (s *slowSink) Write(vpcLog *VPCFlowLog) error {
+	time.Sleep(time.Millisecond)
+	if s.failAt > 0 && s.delivered.Load()+1 >= s.failAt {
+		return errors.New("stream throttled")
+	}
+	s.delivered.Add(1)
+	return s.fakeSink.Write(vpcLog)
+}
+
+func TestBufferedSinkWriterBoundsBuffer(t *testing.T) {
+	const size, records = 10, 200
+	sink := &slowSink{}
+	writer := newBufferedSinkWriter(sink, size)
+
+	var accepted, maxHeld int64
+	for i := 0; i < records; i++ {
+		if err := writer.Write(parseTestRecord(t, testFlowLogLine)); err != nil {
+			t.Fatal(err)
+		}
+		accepted++
+		// The buffer, plus the record being sent
+		if held := accepted - sink.delivered.Load(); held > maxHeld {
+			maxHeld = held
+		}
+	}
+	if maxHeld > size+1 {
+		t.Errorf("%d records held for the sink, want at most SINK_BUFFER_SIZE+1 = %d", maxHeld, size+1)
+	}
+	if maxHeld < size {
+		t.Errorf("at most %d records held, want the scan to run ahead of the slow sink", maxHeld)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if delivered := sink.delivered.Load(); delivered != records || len(sink.records) != records || !sink.closed {
+		t.Errorf("%d records delivered (closed %v), want all %d", delivered, sink.closed, records)
+	}
+}
+
+func TestBufferedSinkWriterFlushWaits(t *testing.T) {
+	sink := &slowSink{}
+	writer := newBufferedSinkWriter(sink, 50)
+	for i := 0; i < 20; i++ {
+		if err := writer.Write(parseTestRecord(t, testFlowLogLine)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if delivered := sink.delivered.Load(); delivered != 20 {
+		t.Errorf("%d records delivered when Flush returned, want 20", delivered)
+	}
+	writer.Close()
+}
+
+func TestBufferedSinkWriterSendError(t *testing.T) {
+	sink := &slowSink{failAt: 3}
+	writer := newBufferedSinkWriter(sink, 5)
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = writer.Write(parseTestRecord(t, testFlowLogLine))
+	}
+	if err == nil || err.Error() != "stream throttled" {
+		t.Fatalf("writes after the sink failed returned %v, want its error", err)
+	}
+	if err := writer.Close(); err == nil || sink.aborted == nil || sink.closed {
+		t.Errorf("close returned %v (sink aborted with %v, closed %v), want the sink aborted", err, sink.aborted, sink.closed)
+	}
+}
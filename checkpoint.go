@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// checkpointStore keeps the last source key processed for a source in the CHECKPOINT_TABLE
+// DynamoDB table, whose partition key is the string attribute "checkpointKey", so a large prefix
+// can be worked through over several invocations
+type checkpointStore struct {
+	client dynamodbiface.DynamoDBAPI
+	key    string
+}
+
+// load returns the checkpointed key, or "" when nothing has been processed yet
+func (c *checkpointStore) load() (string, error) {
+	output, err := c.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(checkpointTable),
+		Key:            map[string]*dynamodb.AttributeValue{"checkpointKey": {S: aws.String(c.key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to read checkpoint %s from %s: %v", c.key, checkpointTable, err)
+	}
+
+	lastKey, ok := output.Item["lastKey"]
+	if !ok {
+		return "", nil
+	}
+	return aws.StringValue(lastKey.S), nil
+}
+
+// save records lastKey as the last source key processed
+func (c *checkpointStore) save(lastKey string) error {
+	_, err := c.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(checkpointTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"checkpointKey": {S: aws.String(c.key)},
+			"lastKey":       {S: aws.String(lastKey)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to save checkpoint %s to %s: %v", c.key, checkpointTable, err)
+	}
+	return nil
+}
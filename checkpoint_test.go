@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeCheckpointTable is a CHECKPOINT_TABLE keeping the last key saved per checkpoint key
+type fakeCheckpointTable struct {
+	dynamodbiface.DynamoDBAPI
+	lastKeys map[string]string
+}
+
+func (f *fakeCheckpointTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	lastKey, ok := f.lastKeys[aws.StringValue(input.Key["checkpointKey"].S)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"lastKey": {S: aws.String(lastKey)}}}, nil
+}
+
+func (f *fakeCheckpointTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.lastKeys[aws.StringValue(input.Item["checkpointKey"].S)] = aws.StringValue(input.Item["lastKey"].S)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestCheckpointResumesAfterLastKey(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	table := &fakeCheckpointTable{lastKeys: map[string]string{}}
+	useFakeDynamoDB(t, table)
+	matchAllSources(t)
+
+	const logs = "AWSLogs/123456789012/vpcflowlogs/us-east-1/"
+	start, end := parseDateRange("2024-03-01/2024-03-02")
+	setForTest(t, &dateRangeStart, start)
+	setForTest(t, &dateRangeEnd, end)
+	setForTest(t, &sourceBucketName, "src/"+logs)
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &checkpointTable, "checkpoints")
+	setForTest(t, &checkpointKey, "flow-logs")
+
+	fake.put("src", logs+"2024/03/01/a.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	fake.put("src", logs+"2024/03/01/b.log", flowLogLine("eni-1", "10.0.0.2", "8.8.8.8")+"\n")
+
+	if _, err := HandleRequest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lastKey := table.lastKeys["flow-logs"]; lastKey != logs+"2024/03/01/b.log" {
+		t.Fatalf("checkpointed %q after the first run, want the last key processed", lastKey)
+	}
+
+	// Delivered after the first run, later in the day and on the next day
+	fake.put("src", logs+"2024/03/01/c.log", flowLogLine("eni-1", "10.0.0.3", "8.8.8.8")+"\n")
+	fake.put("src", logs+"2024/03/02/d.log", flowLogLine("eni-1", "10.0.0.4", "8.8.8.8")+"\n")
+
+	result, err := HandleRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LinesScanned != 2 {
+		t.Errorf("second run scanned %d lines, want the 2 of the files after the checkpoint", result.LinesScanned)
+	}
+	output, _ := fake.get("dest", "out.log")
+	if strings.Contains(output, "10.0.0.1") || strings.Contains(output, "10.0.0.2") || !strings.Contains(output, "10.0.0.3") || !strings.Contains(output, "10.0.0.4") {
+		t.Errorf("second run output %q, want only the files after the checkpoint", output)
+	}
+	if lastKey := table.lastKeys["flow-logs"]; lastKey != logs+"2024/03/02/d.log" {
+		t.Errorf("checkpointed %q after the second run", lastKey)
+	}
+}
+
+func TestCheckpointNotSavedOnFailedRun(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	table := &fakeCheckpointTable{lastKeys: map[string]string{}}
+	useFakeDynamoDB(t, table)
+	matchAllSources(t)
+
+	const logs = "AWSLogs/123456789012/vpcflowlogs/us-east-1/"
+	start, end := parseDateRange("2024-03-01/2024-03-01")
+	setForTest(t, &dateRangeStart, start)
+	setForTest(t, &dateRangeEnd, end)
+	setForTest(t, &sourceBucketName, "src/"+logs)
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &checkpointTable, "checkpoints")
+	setForTest(t, &checkpointKey, "flow-logs")
+	setForTest(t, &ifNoneMatch, true)
+
+	fake.put("src", logs+"2024/03/01/a.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	fake.put("dest", "out.log", "existing output\n")
+
+	if _, err := HandleRequest(context.Background()); err == nil {
+		t.Fatal("run over an existing output succeeded")
+	}
+	if lastKey, ok := table.lastKeys["flow-logs"]; ok {
+		t.Errorf("checkpointed %q though the output was not committed", lastKey)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"log"
+	"path"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	checksumSHA256 = "sha256"
+	checksumCRC32C = "crc32c"
+)
+
+func parseChecksumAlgo(algo string) string {
+	switch algo {
+	case "", checksumSHA256, checksumCRC32C:
+		return algo
+	default:
+		log.Fatalf("CHECKSUM_ALGO %s not supported - expected one of sha256, crc32c", algo)
+		return ""
+	}
+}
+
+func newChecksum(algo string) hash.Hash {
+	if algo == checksumCRC32C {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return sha256.New()
+}
+
+// writeChecksumSidecars writes a "<key>.<algo>" sidecar next to each output object with the
+// checksum computed while the object was streamed. The sidecar uses the sha256sum format
+// ("<hex digest>  <file name>"), so a downloaded object can be checked with e.g. `sha256sum -c`.
+func writeChecksumSidecars(destS3Client s3iface.S3API, objects []outputObject) error {
+	for _, object := range objects {
+		body := fmt.Sprintf("%s  %s\n", object.Checksum, path.Base(object.Key))
+		_, err := destS3Client.PutObject(newDestPutObjectInput(object.Bucket, object.Key+"."+checksumAlgo, []byte(body)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
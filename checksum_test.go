@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestChecksumSidecarMatchesOutput(t *testing.T) {
+	for _, algo := range []string{checksumSHA256, checksumCRC32C} {
+		t.Run(algo, func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			matchAllSources(t)
+			setForTest(t, &sourceBucketName, "src")
+			setForTest(t, &destBucketName, "dest/out/vpc.log")
+			setForTest(t, &checksumAlgo, algo)
+			// The checksum is of the object as stored, so of the compressed bytes
+			setForTest(t, &outputCompression, outputCompressionGzip)
+			fake.put("src", "in.log", testFlowLogLine+"\n"+flowLogLine("eni-2", "10.0.0.2", "8.8.8.8")+"\n")
+
+			_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, ok := fake.get("dest", "out/vpc.log.gz")
+			if !ok {
+				t.Fatalf("no output in %v", fake.keys("dest"))
+			}
+			checksum := newChecksum(algo)
+			checksum.Write([]byte(output))
+			want := hex.EncodeToString(checksum.Sum(nil)) + "  vpc.log.gz\n"
+			if sidecar, _ := fake.get("dest", "out/vpc.log.gz."+algo); sidecar != want {
+				t.Errorf("sidecar %q, want %q", sidecar, want)
+			}
+		})
+	}
+}
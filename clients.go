@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// The AWS session and clients are created on the first invocation that needs them and reused by
+// warm invocations, so they keep their HTTP connection pool instead of paying for a new session
+// and TLS handshakes on every run. All of their config comes from env vars, which cannot change
+// for the lifetime of the container.
+var (
+	awsSessionOnce sync.Once
+	awsSession     *session.Session
+	awsSessionErr  error
+
+	s3ClientsOnce                            sync.Once
+	cachedSourceS3Client, cachedDestS3Client s3iface.S3API
+
+	firehoseClientOnce   sync.Once
+	cachedFirehoseClient firehoseiface.FirehoseAPI
+
+	snsClientOnce   sync.Once
+	cachedSNSClient snsiface.SNSAPI
+
+	glueClientOnce   sync.Once
+	cachedGlueClient glueiface.GlueAPI
+
+	dynamoDBClientOnce   sync.Once
+	cachedDynamoDBClient dynamodbiface.DynamoDBAPI
+
+	ec2ClientOnce   sync.Once
+	cachedEC2Client ec2iface.EC2API
+)
+
+func getAWSSession() (*session.Session, error) {
+	awsSessionOnce.Do(func() {
+		config := &aws.Config{
+			Region:                         aws.String(sourceRegion),
+			Credentials:                    credentials.NewStaticCredentials(accessKey, secretAccessKey, ""),
+			DisableRestProtocolURICleaning: aws.Bool(preserveDoubleSlash), // Needed to address "//" keys, see formatKey
+			HTTPClient:                     newHTTPClient(),
+		}
+
+		awsSession, awsSessionErr = session.NewSession(config)
+		if awsSessionErr == nil {
+			limitSends(&awsSession.Handlers)
+		}
+	})
+
+	return awsSession, awsSessionErr
+}
+
+// newHTTPClient returns the HTTP client of the AWS session. Its timeouts bound each step of a
+// request (connecting, the TLS handshake and waiting for the response headers) rather than the
+// whole request, so a slow endpoint fails the request while long transfers (source downloads,
+// output uploads) are left alone. Idle connections are kept per host so warm invocations reuse them.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(httpDialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = time.Duration(httpTLSHandshakeTimeout) * time.Second
+	transport.ResponseHeaderTimeout = time.Duration(httpResponseHeaderTimeout) * time.Second
+	transport.MaxIdleConns = httpMaxIdleConns
+	transport.MaxIdleConnsPerHost = httpMaxIdleConns
+
+	return &http.Client{Transport: transport}
+}
+
+func getS3Clients() (s3iface.S3API, s3iface.S3API, error) {
+	awsSession, err := getAWSSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s3ClientsOnce.Do(func() {
+		cachedSourceS3Client, cachedDestS3Client = newS3Clients(awsSession)
+	})
+	return cachedSourceS3Client, cachedDestS3Client, nil
+}
+
+// newS3Clients returns the clients used to read from the source bucket and write to the destination
+// bucket. Each client is pinned to its bucket's region; a single client is shared when both
+// buckets are in the same region.
+func newS3Clients(awsSession *session.Session) (s3iface.S3API, s3iface.S3API) {
+	sourceS3Client := s3.New(awsSession, aws.NewConfig().WithRegion(sourceRegion))
+	if destRegion == sourceRegion {
+		return sourceS3Client, sourceS3Client
+	}
+
+	return sourceS3Client, s3.New(awsSession, aws.NewConfig().WithRegion(destRegion))
+}
+
+// getFirehoseClient returns the client for the Firehose output sink, in the function's own region
+func getFirehoseClient() (firehoseiface.FirehoseAPI, error) {
+	awsSession, err := getAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	firehoseClientOnce.Do(func() {
+		cachedFirehoseClient = firehose.New(awsSession, aws.NewConfig().WithRegion(defaultRegion))
+	})
+	return cachedFirehoseClient, nil
+}
+
+// getSNSClient returns the client for publishing alerts. The region is taken from the topic ARN.
+func getSNSClient() (snsiface.SNSAPI, error) {
+	awsSession, err := getAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	snsClientOnce.Do(func() {
+		region := defaultRegion
+		if topicARN, err := arn.Parse(alertSNSTopic); err == nil {
+			region = topicARN.Region
+		}
+		cachedSNSClient = sns.New(awsSession, aws.NewConfig().WithRegion(region))
+	})
+	return cachedSNSClient, nil
+}
+
+// getGlueClient returns the client for registering output partitions. The Glue catalog is expected
+// in the destination bucket's region, which is where Athena queries the output.
+func getGlueClient() (glueiface.GlueAPI, error) {
+	awsSession, err := getAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	glueClientOnce.Do(func() {
+		cachedGlueClient = glue.New(awsSession, aws.NewConfig().WithRegion(destRegion))
+	})
+	return cachedGlueClient, nil
+}
+
+// getDynamoDBClient returns the client for the lock table, in the function's own region
+func getDynamoDBClient() (dynamodbiface.DynamoDBAPI, error) {
+	awsSession, err := getAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	dynamoDBClientOnce.Do(func() {
+		cachedDynamoDBClient = dynamodb.New(awsSession, aws.NewConfig().WithRegion(defaultRegion))
+	})
+	return cachedDynamoDBClient, nil
+}
+
+// getEC2Client returns the client for resolving interface names, in the function's own region
+func getEC2Client() (ec2iface.EC2API, error) {
+	awsSession, err := getAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	ec2ClientOnce.Do(func() {
+		cachedEC2Client = ec2.New(awsSession, aws.NewConfig().WithRegion(defaultRegion))
+	})
+	return cachedEC2Client, nil
+}
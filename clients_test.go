@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func clientRegion(client interface{}) string {
+	return aws.StringValue(client.(*s3.S3).Config.Region)
+}
+
+func TestS3ClientsPinnedToBucketRegions(t *testing.T) {
+	awsSession := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+
+	setForTest(t, &sourceRegion, "us-east-1")
+	setForTest(t, &destRegion, "eu-west-1")
+	source, dest := newS3Clients(awsSession)
+	if clientRegion(source) != "us-east-1" || clientRegion(dest) != "eu-west-1" {
+		t.Fatalf("clients in %s and %s, want us-east-1 and eu-west-1", clientRegion(source), clientRegion(dest))
+	}
+
+	setForTest(t, &destRegion, "us-east-1")
+	source, dest = newS3Clients(awsSession)
+	if source != dest {
+		t.Fatal("buckets in the same region got separate clients")
+	}
+}
+
+func TestS3ClientsReusedAcrossInvocations(t *testing.T) {
+	awsSessionOnce, s3ClientsOnce = sync.Once{}, sync.Once{}
+	t.Cleanup(func() { awsSessionOnce, s3ClientsOnce = sync.Once{}, sync.Once{} })
+
+	source, dest, err := getS3Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSession := awsSession
+	for invocation := 2; invocation <= 3; invocation++ {
+		nextSource, nextDest, err := getS3Clients()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nextSource != source || nextDest != dest || awsSession != firstSession {
+			t.Fatalf("invocation %d constructed new clients", invocation)
+		}
+	}
+}
+
+func TestAWSSessionHTTPClientTimeouts(t *testing.T) {
+	awsSessionOnce = sync.Once{}
+	t.Cleanup(func() { awsSessionOnce = sync.Once{} })
+	setForTest(t, &httpTLSHandshakeTimeout, 3)
+	setForTest(t, &httpResponseHeaderTimeout, 12)
+	setForTest(t, &httpMaxIdleConns, 40)
+
+	awsSession, err := getAWSSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := awsSession.Config.HTTPClient
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("session HTTP transport is %T, want an *http.Transport", client.Transport)
+	}
+
+	if transport.TLSHandshakeTimeout != 3*time.Second || transport.ResponseHeaderTimeout != 12*time.Second {
+		t.Errorf("TLS handshake timeout %v and response header timeout %v, want 3s and 12s", transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout)
+	}
+	if transport.MaxIdleConns != 40 || transport.MaxIdleConnsPerHost != 40 {
+		t.Errorf("%d idle connections, %d per host, want 40", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.DialContext == nil || transport.Proxy == nil {
+		t.Error("transport lost the dialer or the proxy settings of the default transport")
+	}
+	// Transfers are only bounded by the step timeouts, not a timeout on the whole request
+	if client.Timeout != 0 {
+		t.Errorf("client timeout %v, want none", client.Timeout)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// maxDeleteBatch is the most keys a DeleteObjects request can take
+const maxDeleteBatch = 1000
+
+// compactOutputs merges the small output objects under the destination prefix into a single
+// object, for COMPACT mode. Objects smaller than COMPACT_SMALL_BYTES with the output extension are
+// merged, in listing order, until COMPACT_MAX_BYTES; the rest are left for the next run. Each
+// object is decompressed and rewritten with the current OUTPUT_COMPRESSION, and only the first
+// CSV header is kept. With COMPACT_DELETE the merged objects are deleted once the compacted object
+// has been written.
+func compactOutputs(destS3Client s3iface.S3API) (Result, error) {
+	bucket, prefix, err := compactPrefix()
+	if err != nil {
+		return Result{}, err
+	}
+
+	objects, err := listCompactable(destS3Client, bucket, prefix)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(objects) < 2 {
+		log.Printf("Found %d small output files under s3://%s/%s - nothing to compact\n", len(objects), bucket, prefix)
+		return Result{}, nil
+	}
+
+	key := fmt.Sprintf("%scompacted-%s%s", prefix, clock.Now().UTC().Format("20060102T150405Z"), outputExtension())
+	uploader := newUploader(destS3Client)
+	upload, err := startStreamingUpload(uploader, newDestUploadInput(bucket, key), outputCompression)
+	if err != nil {
+		return Result{}, err
+	}
+
+	for i, object := range objects {
+		if err := copyCompacted(destS3Client, bucket, object, upload, i > 0 && outputFormat == outputFormatCSV); err != nil {
+			return Result{}, upload.Abort(err)
+		}
+	}
+	if err := upload.Close(); err != nil {
+		return Result{}, err
+	}
+	log.Printf("Compacted %d output files into s3://%s/%s\n", len(objects), bucket, key)
+
+	if compactDelete {
+		if err := deleteObjects(destS3Client, bucket, objects); err != nil {
+			return Result{}, err
+		}
+	}
+	return Result{ObjectsProcessed: len(objects)}, nil
+}
+
+// compactPrefix is the directory of the output key, up to the first [[...]] placeholder, so runs
+// writing under changing timestamped names are compacted together
+func compactPrefix() (string, string, error) {
+	bucket, key, err := parseBucketAndKeyFromFilePath(destBucketName)
+	if err != nil {
+		return "", "", err
+	}
+	if i := strings.Index(key, "[["); i >= 0 {
+		key = key[:i]
+	}
+	return bucket, key[:strings.LastIndex(key, "/")+1], nil
+}
+
+// listCompactable lists the small output objects directly under the prefix
+func listCompactable(destS3Client s3iface.S3API, bucket, prefix string) ([]string, error) {
+	var keys []string
+	var total int64
+	err := destS3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key, size := aws.StringValue(object.Key), aws.Int64Value(object.Size)
+			if !strings.HasSuffix(key, outputExtension()) || size >= int64(compactSmallBytes) {
+				continue
+			}
+			if total+size > int64(compactMaxBytes) {
+				return false
+			}
+			keys = append(keys, key)
+			total += size
+		}
+		return true
+	})
+	return keys, err
+}
+
+// copyCompacted appends the decompressed content of an output object to the upload, dropping its
+// first line when skipHeader is set
+func copyCompacted(destS3Client s3iface.S3API, bucket, key string, upload io.Writer, skipHeader bool) error {
+	object, err := destS3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("Unable to read output file s3://%s/%s: %v", bucket, key, err)
+	}
+	defer object.Body.Close()
+
+	reader, err := newSourceReader(object.Body)
+	if err != nil {
+		return err
+	}
+	if skipHeader {
+		buffered := bufio.NewReader(reader)
+		if _, err := buffered.ReadString('\n'); err != nil && err != io.EOF {
+			return err
+		}
+		reader = buffered
+	}
+
+	_, err = io.Copy(upload, reader)
+	return err
+}
+
+// deleteObjects deletes the keys in batches of up to maxDeleteBatch
+func deleteObjects(destS3Client s3iface.S3API, bucket string, keys []string) error {
+	for start := 0; start < len(keys); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var identifiers []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			identifiers = append(identifiers, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		output, err := destS3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: identifiers, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("Unable to delete %d compacted output files, e.g. %s: %s", len(output.Errors), aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+		}
+	}
+	return nil
+}
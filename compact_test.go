@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestCompactSmallOutputs(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &destBucketName, "dest/out/[[timestamp]].log")
+	setForTest(t, &compactMode, true)
+	setForTest(t, &compactSmallBytes, 100)
+	setForTest(t, &compactMaxBytes, 1000)
+	setForTest(t, &compactDelete, true)
+	setForTest[Clock](t, &clock, &fakeClock{now: time.Date(2024, 3, 5, 10, 15, 0, 0, time.UTC)})
+
+	fake.put("dest", "out/1-3-2024.log", "first\n")
+	fake.put("dest", "out/2-3-2024.log", "second\n")
+	fake.put("dest", "out/3-3-2024.log", "third\n")
+	// Too big to compact, another format, and not directly under the prefix
+	fake.put("dest", "out/4-3-2024.log", strings.Repeat("x", 200)+"\n")
+	fake.put("dest", "out/summary.json", "{}\n")
+	fake.put("dest", "out/archive/5-3-2024.log", "archived\n")
+
+	result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		t.Error("sources listed in COMPACT mode")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ObjectsProcessed != 3 {
+		t.Errorf("compacted %d files, want 3", result.ObjectsProcessed)
+	}
+
+	compacted, ok := fake.get("dest", "out/compacted-20240305T101500Z.log")
+	if !ok || compacted != "first\nsecond\nthird\n" {
+		t.Fatalf("compacted file %q", compacted)
+	}
+	want := "out/4-3-2024.log out/archive/5-3-2024.log out/compacted-20240305T101500Z.log out/summary.json"
+	if keys := strings.Join(fake.keys("dest"), " "); keys != want {
+		t.Errorf("left %s, want the merged files deleted", keys)
+	}
+}
+
+func TestCompactStopsAtMaxBytes(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &destBucketName, "dest/out/[[timestamp]].log")
+	setForTest(t, &compactSmallBytes, 100)
+	setForTest(t, &compactMaxBytes, 13)
+	fake.put("dest", "out/1-3-2024.log", "first\n")
+	fake.put("dest", "out/2-3-2024.log", "second\n")
+	fake.put("dest", "out/3-3-2024.log", "third\n")
+
+	// The first two files are 13 bytes, leaving the third for the next run
+	keys, err := listCompactable(client, "dest", "out/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "out/1-3-2024.log out/2-3-2024.log" {
+		t.Errorf("compacting %v", keys)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// contentHashMetadata is the user metadata key the output's content hash is stored under
+const contentHashMetadata = "content-hash"
+
+// contentHashWriter writes the output to a single S3 object, unless the object already at its key
+// has the same content hash (CONTENT_HASH_SKIP). The serialized output is spooled to a temporary
+// file until Close, so the hash is known when the upload starts and is stored in the metadata it
+// is created with.
+//
+// The hash is the lane-wise sum (mod 2^64) of the SHA-256 digests of the records as serialized in
+// the output format, followed by the record count and OUTPUT_COMPRESSION: a hash of the multiset of
+// output records, so it does not depend on the order of the source files or of the records in them
+// and, unlike an XOR, counts duplicate records. A retry that writes the same records computes the
+// same hash, and one that writes them differently (another format, fields or redaction, or other
+// enrichment values) does not. Being a sum it is only meant to detect unchanged output, not to
+// resist records crafted to collide with it.
+type contentHashWriter struct {
+	recordWriter
+	hash contentHash
+
+	// record holds each record serialized on its own, for hashing
+	record bytes.Buffer
+
+	spool      *os.File
+	compressor io.WriteCloser
+
+	uploader    *s3manager.Uploader
+	client      s3iface.S3API
+	bucket, key string
+	upload      *streamingUpload
+	committed   bool
+
+	// unchanged is set by Close when the object at key already had the output's hash
+	unchanged bool
+}
+
+// newContentHashWriter opens the spool for the output at key in the destination bucket
+func newContentHashWriter(destS3Client s3iface.S3API, bucket, key string) (*contentHashWriter, error) {
+	if err := reserveOutputObject(key); err != nil {
+		return nil, err
+	}
+	spool, err := os.CreateTemp("", "output-*")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create a file to spool the output to: %v", err)
+	}
+
+	writer := &contentHashWriter{spool: spool, uploader: newUploader(destS3Client), client: destS3Client, bucket: bucket, key: key}
+	var w io.Writer = spool
+	if writer.compressor = newCompressor(spool, outputCompression); writer.compressor != nil {
+		w = writer.compressor
+	}
+	if writer.recordWriter, err = newRecordWriter(outputFormat, w); err != nil {
+		return nil, writer.Abort(err)
+	}
+	return writer, nil
+}
+
+func (c *contentHashWriter) Write(vpcLog *VPCFlowLog) error {
+	// Serialized by a writer of its own, so e.g. every CSV record is hashed with the header
+	c.record.Reset()
+	serializer, err := newRecordWriter(outputFormat, &c.record)
+	if err != nil {
+		return err
+	}
+	if err := serializer.Write(vpcLog); err != nil {
+		return err
+	}
+	if err := serializer.Close(); err != nil {
+		return err
+	}
+
+	if err := c.recordWriter.Write(vpcLog); err != nil {
+		return err
+	}
+	c.hash.add(c.record.Bytes())
+	return nil
+}
+
+// Close uploads the spooled output with its hash in the object's metadata, unless the object at
+// key already has the same hash
+func (c *contentHashWriter) Close() error {
+	if err := c.recordWriter.Close(); err != nil {
+		return c.Abort(err)
+	}
+	if c.compressor != nil {
+		if err := c.compressor.Close(); err != nil {
+			return c.Abort(err)
+		}
+	}
+	defer c.removeSpool()
+	hash := c.hash.String()
+
+	head, err := c.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(c.key)})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("Unable to read the content hash of s3://%s/%s: %v", c.bucket, c.key, err)
+	}
+	if err == nil && metadataValue(head.Metadata, contentHashMetadata) == hash {
+		log.Printf("Output s3://%s/%s already has content hash %s - not writing it again\n", c.bucket, c.key, hash)
+		c.unchanged = true
+		return nil
+	}
+
+	input := newDestUploadInput(c.bucket, c.key)
+	input.Metadata = map[string]*string{contentHashMetadata: aws.String(hash)}
+	for name, value := range outputMetadata {
+		input.Metadata[name] = value
+	}
+	// Already compressed in the spool
+	if c.upload, err = startStreamingUpload(c.uploader, input, ""); err != nil {
+		return err
+	}
+	if _, err := c.spool.Seek(0, io.SeekStart); err != nil {
+		return c.upload.Abort(err)
+	}
+	if _, err := io.Copy(c.upload, c.spool); err != nil {
+		return c.upload.Abort(err)
+	}
+	if err := c.upload.Close(); err != nil {
+		return err
+	}
+	c.committed = true
+	return nil
+}
+
+func (c *contentHashWriter) Abort(err error) error {
+	c.removeSpool()
+	if c.upload != nil {
+		c.upload.Abort(err)
+	}
+	return err
+}
+
+func (c *contentHashWriter) Objects() []outputObject {
+	if !c.committed {
+		return nil
+	}
+	return []outputObject{c.upload.object}
+}
+
+func (c *contentHashWriter) removeSpool() {
+	c.spool.Close()
+	os.Remove(c.spool.Name())
+}
+
+// contentHash is the multiset hash of the output records (see contentHashWriter)
+type contentHash struct {
+	sum   [4]uint64
+	count uint64
+}
+
+func (h *contentHash) add(record []byte) {
+	digest := sha256.Sum256(record)
+	for i := range h.sum {
+		h.sum[i] += binary.BigEndian.Uint64(digest[i*8:])
+	}
+	h.count++
+}
+
+// String returns the hex content hash of the records added so far
+func (h *contentHash) String() string {
+	var hash [40]byte
+	for i, lane := range h.sum {
+		binary.BigEndian.PutUint64(hash[i*8:], lane)
+	}
+	binary.BigEndian.PutUint64(hash[32:], h.count)
+	encoded := hex.EncodeToString(hash[:])
+	if outputCompression != "" {
+		encoded += "-" + outputCompression
+	}
+	return encoded
+}
+
+// metadataValue returns the object's user metadata value for name. The SDK returns metadata keys
+// in canonical header form (e.g. "Content-Hash"), so they are matched without regard to case.
+func metadataValue(metadata map[string]*string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// parseContentHashSkip parses CONTENT_HASH_SKIP, which only applies to output written to a single
+// S3 object
+func parseContentHashSkip(name string) bool {
+	if !envBool(name) {
+		return false
+	}
+	singleObject := rollMaxBytes == 0 && rollMaxSeconds == 0 && splitBy == "" && destKeyRegexp == nil &&
+		(outputSink == "" || outputSink == outputSinkS3) &&
+		(len(outputSinks) == 0 || len(outputSinks) == 1 && outputSinks[0] == outputSinkS3)
+	if !singleObject {
+		log.Fatalf("%s requires the output to be a single S3 object - it cannot be combined with ROLL_MAX_BYTES, ROLL_MAX_SECONDS, SPLIT_BY, DEST_KEY_REGEX or other output sinks", name)
+	}
+	return true
+}
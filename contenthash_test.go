@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestContentHashSkipsUnchangedOutput(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &contentHashSkip, true)
+	listSources := func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	}
+	destPuts := func() int {
+		n := 0
+		for _, request := range fake.requests {
+			if request == "PUT /dest/out.log" {
+				n++
+			}
+		}
+		return n
+	}
+
+	fake.put("src", "in.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n"+flowLogLine("eni-2", "10.0.0.2", "8.8.4.4")+"\n")
+	if _, err := processSources(context.Background(), listSources); err != nil {
+		t.Fatal(err)
+	}
+	hash := fake.metadata("dest", "out.log")[contentHashMetadata]
+	if hash == "" {
+		t.Fatal("no content hash stored on the output")
+	}
+	puts := destPuts()
+
+	// The same records in another order are unchanged output
+	fake.put("src", "in.log", flowLogLine("eni-2", "10.0.0.2", "8.8.4.4")+"\n"+flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	result, err := processSources(context.Background(), listSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OutputUnchanged || destPuts() != puts {
+		t.Fatalf("retry with the same records rewrote the output (%d puts, was %d)", destPuts(), puts)
+	}
+
+	fake.put("src", "in.log", flowLogLine("eni-3", "10.0.0.3", "1.1.1.1")+"\n")
+	result, err = processSources(context.Background(), listSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := fake.get("dest", "out.log")
+	if result.OutputUnchanged || !strings.Contains(body, "eni-3") || fake.metadata("dest", "out.log")[contentHashMetadata] == hash {
+		t.Fatalf("changed records did not rewrite the output: %q", body)
+	}
+}
+
+func TestContentHashCountsDuplicates(t *testing.T) {
+	hash := func(records ...string) string {
+		var hash contentHash
+		for _, record := range records {
+			hash.add([]byte(record))
+		}
+		return hash.String()
+	}
+	if hash("a", "b") != hash("b", "a") {
+		t.Error("hash depends on the order of the records")
+	}
+	if hash("a", "a") == hash("a") || hash("a", "a", "b") == hash("b") {
+		t.Error("hash does not count duplicate records")
+	}
+}
+
+func TestContentHashCoversOutputConfig(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &contentHashSkip, true)
+	fake.put("src", "in.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	var copies int
+	fake.fail = func(r *http.Request) int {
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			copies++
+		}
+		return 0
+	}
+	listSources := func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	}
+
+	if _, err := processSources(context.Background(), listSources); err != nil {
+		t.Fatal(err)
+	}
+	hash := fake.metadata("dest", "out.log")[contentHashMetadata]
+
+	// The same records redacted are different output
+	setForTest(t, &redactFields, map[string]bool{"interface-id": true})
+	result, err := processSources(context.Background(), listSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := fake.get("dest", "out.log")
+	if result.OutputUnchanged || strings.Contains(body, "eni-1") || fake.metadata("dest", "out.log")[contentHashMetadata] == hash {
+		t.Fatalf("redacting the output did not rewrite it: %q", body)
+	}
+
+	// As is the same output compressed, to the same key
+	setForTest(t, &outputCompression, outputCompressionGzip)
+	setForTest(t, &outputExtensionOverride, "log")
+	if result, err = processSources(context.Background(), listSources); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := fake.get("dest", "out.log"); result.OutputUnchanged || !strings.HasPrefix(body, "\x1f\x8b") {
+		t.Fatal("compressing the output did not rewrite it")
+	}
+	if copies != 0 {
+		t.Errorf("content hash stored with %d copies, want it in the upload's metadata", copies)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// sourceKeyWriter writes the records of each source file to a key derived from the source key by
+// DEST_KEY_REGEX / DEST_KEY_REPLACE, e.g. "AWSLogs/(.+)/flow/(.+)" and "filtered/$1/$2". Source
+// files whose key does not match go to the output key. Each key's object is opened when the first
+// source mapped to it is set, and shared by the sources mapped to it - so, as with a single output,
+// a source without matches still gets its (empty) object.
+type sourceKeyWriter struct {
+	open       func(key string) (outputWriter, error)
+	defaultKey string
+	rewrite    func(key string) string
+
+	writers map[string]outputWriter
+	keys    []string
+	current outputWriter
+}
+
+func newSourceKeyWriter(defaultKey string, rewrite func(key string) string, open func(key string) (outputWriter, error)) *sourceKeyWriter {
+	return &sourceKeyWriter{open: open, defaultKey: defaultKey, rewrite: rewrite, writers: map[string]outputWriter{}}
+}
+
+// setSource routes the records written next to the destination of the source file, opening it if
+// it is the first source mapped there
+func (s *sourceKeyWriter) setSource(source sourceObject) error {
+	return s.use(destKeyFor(source.Key, s.defaultKey, s.rewrite))
+}
+
+func (s *sourceKeyWriter) use(key string) error {
+	writer, ok := s.writers[key]
+	if !ok {
+		var err error
+		writer, err = s.open(key)
+		if err != nil {
+			return err
+		}
+		s.writers[key] = writer
+		s.keys = append(s.keys, key)
+	}
+	s.current = writer
+	return nil
+}
+
+func (s *sourceKeyWriter) Write(vpcLog *VPCFlowLog) error {
+	if s.current == nil {
+		if err := s.use(s.defaultKey); err != nil {
+			return err
+		}
+	}
+	return s.current.Write(vpcLog)
+}
+
+func (s *sourceKeyWriter) Flush() error {
+	for _, key := range s.keys {
+		if err := s.writers[key].Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close commits every destination. If one fails, those not committed yet are aborted.
+func (s *sourceKeyWriter) Close() error {
+	for i, key := range s.keys {
+		if err := s.writers[key].Close(); err != nil {
+			for _, rest := range s.keys[i+1:] {
+				s.writers[rest].Abort(err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sourceKeyWriter) Abort(err error) error {
+	for _, key := range s.keys {
+		s.writers[key].Abort(err)
+	}
+	return err
+}
+
+func (s *sourceKeyWriter) Objects() []outputObject {
+	var objects []outputObject
+	for _, key := range s.keys {
+		objects = append(objects, s.writers[key].Objects()...)
+	}
+	return objects
+}
+
+// destKeyFor is the destination of a source key: the substitution of DEST_KEY_REPLACE when it
+// matches DEST_KEY_REGEX (passed through rewrite, e.g. to expand the key placeholders), otherwise
+// the default output key
+func destKeyFor(sourceKey, defaultKey string, rewrite func(key string) string) string {
+	if !destKeyRegexp.MatchString(sourceKey) {
+		return defaultKey
+	}
+	return rewrite(destKeyRegexp.ReplaceAllString(sourceKey, destKeyReplace))
+}
+
+// InPlaceError is returned when the output of a run would overwrite one of its source files, unless
+// ALLOW_INPLACE is set
+type InPlaceError struct {
+	Source sourceObject
+}
+
+func (e *InPlaceError) Error() string {
+	return fmt.Sprintf("Output would overwrite source file %s - set ALLOW_INPLACE to allow it", e.Source)
+}
+
+// checkNotInPlace fails with an InPlaceError when a source file is also one of the objects the run
+// writes to the destination bucket (see writtenKeys)
+func checkNotInPlace(ctx context.Context, sources []sourceObject, destBucket, destKey string) error {
+	written := writtenKeys(ctx, sources, destKey)
+	for _, source := range sources {
+		if source.URL == "" && source.Bucket == destBucket && written(source.Key) {
+			return &InPlaceError{Source: source}
+		}
+	}
+	return nil
+}
+
+// writtenKeys returns a func reporting whether the run may write key: the output at destKey, or
+// the keys DEST_KEY_REGEX substitutes from the sources' keys, with the SPLIT_BY parts and ROLL_MAX_*
+// segments written in their place and their checksum sidecars, the files written next to destKey
+// (manifests and summaries), REJECT_KEY, the FILTER_PROFILES outputs, DEADLETTER_KEY and
+// STATUS_KEY. Parts and segments are matched by the shape of their keys, as their names are only
+// known once the records are written.
+func writtenKeys(ctx context.Context, sources []sourceObject, destKey string) func(key string) bool {
+	rewrite := func(key string) string { return outputKey(ctx, key) }
+	var outputs []*regexp.Regexp
+	seen := map[string]bool{}
+	addOutput := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			outputs = append(outputs, outputKeyPattern(key))
+		}
+	}
+	addOutput(destKey)
+	if destKeyRegexp != nil {
+		for _, source := range sources {
+			addOutput(destKeyFor(source.Key, destKey, rewrite))
+		}
+	}
+
+	keys := map[string]bool{
+		siblingKey(destKey, "invalid-records.jsonl"): true,
+	}
+	if outputManifest {
+		keys[siblingKey(destKey, "manifest.csv")] = true
+		keys[siblingKey(destKey, "manifest.checksum")] = true
+	}
+	if symlinkManifest {
+		keys[siblingKey(destKey, "_symlink.txt")] = true
+	}
+	if topN > 0 {
+		keys[siblingKey(destKey, "top-talkers.json")] = true
+	}
+	if fanoutAnalysis {
+		keys[siblingKey(destKey, "fanout.json")] = true
+	}
+	if rejectKey != "" {
+		keys[rewrite(rejectKey)] = true
+	}
+	for _, profile := range filterProfiles {
+		keys[rewrite(profile.DestKey)] = true
+	}
+	if deadletterKey != "" {
+		keys[expandKeyPlaceholders(ctx, deadletterKey)] = true
+	}
+	if statusKey != "" {
+		keys[statusKey] = true
+	}
+
+	return func(key string) bool {
+		if keys[key] {
+			return true
+		}
+		if checksumAlgo != "" {
+			key = strings.TrimSuffix(key, "."+checksumAlgo)
+		}
+		for _, output := range outputs {
+			if output.MatchString(key) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// outputKeyPattern matches the key of the output, or of the parts and segments written in its
+// place with SPLIT_BY (see splitKey) and ROLL_MAX_BYTES/ROLL_MAX_SECONDS (see segmentKey)
+func outputKeyPattern(key string) *regexp.Regexp {
+	name := key[strings.LastIndex(key, "/")+1:]
+	dir := key[:len(key)-len(name)]
+	base, ext := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		base, ext = name[:i], name[i:]
+	}
+
+	pattern := regexp.QuoteMeta(dir)
+	if splitBy == splitByAccount {
+		pattern += `(account=[^/]+/)?`
+	}
+	pattern += regexp.QuoteMeta(base)
+	if splitBy != "" && splitBy != splitByAccount {
+		pattern += `(-[^/]+)?`
+	}
+	if rollMaxBytes > 0 || rollMaxSeconds > 0 {
+		pattern += `(-\d{5}-\d{8}T\d{6}Z)?`
+	}
+	return regexp.MustCompile("^" + pattern + regexp.QuoteMeta(ext) + "$")
+}
+
+func parseDestKeyRegex(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Fatalf("DEST_KEY_REGEX %q is not a valid regular expression: %v", pattern, err)
+	}
+	return re
+}
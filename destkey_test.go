@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestDestKeyRegexSubstitution(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/unmatched.log")
+	setForTest(t, &destKeyRegexp, regexp.MustCompile(`^AWSLogs/(\d+)/flow/(.+)$`))
+	setForTest(t, &destKeyReplace, "filtered/$1/$2")
+
+	sources := map[string]string{
+		"AWSLogs/111111111111/flow/2024/03/05/a.log": flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		"AWSLogs/222222222222/flow/2024/03/05/b.log": flowLogLine("eni-2", "10.0.0.2", "8.8.8.8"),
+		"other/c.log": flowLogLine("eni-3", "10.0.0.3", "8.8.8.8"),
+	}
+	var objects []sourceObject
+	for _, key := range []string{"AWSLogs/111111111111/flow/2024/03/05/a.log", "AWSLogs/222222222222/flow/2024/03/05/b.log", "other/c.log"} {
+		fake.put("src", key, sources[key]+"\n")
+		objects = append(objects, sourceObject{Bucket: "src", Key: key})
+	}
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return objects, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{
+		"filtered/111111111111/2024/03/05/a.log": sources["AWSLogs/111111111111/flow/2024/03/05/a.log"],
+		"filtered/222222222222/2024/03/05/b.log": sources["AWSLogs/222222222222/flow/2024/03/05/b.log"],
+		"unmatched.log":                          sources["other/c.log"],
+	} {
+		if output, ok := fake.get("dest", key); !ok || output != want+"\n" {
+			t.Errorf("%s holds %q (written %v), want %q", key, output, ok, want)
+		}
+	}
+	if keys := fake.keys("dest"); len(keys) != 3 {
+		t.Errorf("wrote %s, want one output per destination", strings.Join(keys, ", "))
+	}
+}
+
+func TestDestKeyRegexWritesEmptyOutputs(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	rules, err := parseSourceRules("test", []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/unmatched.log")
+	setForTest(t, &destKeyRegexp, regexp.MustCompile(`^flow/(.+)$`))
+	setForTest(t, &destKeyReplace, "filtered/$1")
+	fake.put("src", "flow/a.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	fake.put("src", "flow/b.log", flowLogLine("eni-2", "10.0.0.2", "8.8.8.8")+"\n")
+
+	if _, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "flow/a.log"}, {Bucket: "src", Key: "flow/b.log"}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// As with a single output, a source without matches gets an empty object
+	if output, ok := fake.get("dest", "filtered/b.log"); !ok || output != "" {
+		t.Errorf("filtered/b.log holds %q (written %v), want an empty object", output, ok)
+	}
+	if output, _ := fake.get("dest", "filtered/a.log"); !strings.Contains(output, "eni-1") {
+		t.Errorf("filtered/a.log holds %q", output)
+	}
+}
+
+func TestInPlaceOutputRefused(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "logs/in.log")
+	setForTest(t, &destBucketName, "logs/in.log")
+	original := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8") + "\n" + flowLogLine("eni-2", "10.0.0.2", "8.8.8.8") + "\n"
+	fake.put("logs", "in.log", original)
+
+	_, err := HandleRequest(context.Background())
+	var inPlace *InPlaceError
+	if !errors.As(err, &inPlace) || inPlace.Source.Key != "in.log" {
+		t.Fatalf("run returned %v, want an InPlaceError for in.log", err)
+	}
+	if output, _ := fake.get("logs", "in.log"); output != original {
+		t.Errorf("source file overwritten with %q", output)
+	}
+
+	setForTest(t, &allowInPlace, true)
+	if _, err := HandleRequest(context.Background()); err != nil {
+		t.Fatalf("run with ALLOW_INPLACE returned %v", err)
+	}
+}
+
+func TestInPlaceSubstitutedKeyRefused(t *testing.T) {
+	setForTest(t, &destKeyRegexp, regexp.MustCompile(`^raw/(.+)$`))
+	setForTest(t, &destKeyReplace, "raw/$1")
+
+	err := checkNotInPlace(context.Background(), []sourceObject{{Bucket: "logs", Key: "raw/a.log"}}, "logs", "out.log")
+	var inPlace *InPlaceError
+	if !errors.As(err, &inPlace) {
+		t.Fatalf("substituting a source key onto itself returned %v, want an InPlaceError", err)
+	}
+	if err := checkNotInPlace(context.Background(), []sourceObject{{Bucket: "other", Key: "raw/a.log"}}, "logs", "out.log"); err != nil {
+		t.Errorf("same key in another bucket refused: %v", err)
+	}
+}
+
+func TestInPlaceRejectKeyRefused(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "logs/raw/in.log")
+	setForTest(t, &destBucketName, "logs/filtered/out.log")
+	setForTest(t, &rejectKey, "raw/in.log")
+	original := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8") + "\n"
+	fake.put("logs", "raw/in.log", original)
+
+	_, err := HandleRequest(context.Background())
+	var inPlace *InPlaceError
+	if !errors.As(err, &inPlace) || inPlace.Source.Key != "raw/in.log" {
+		t.Fatalf("run returned %v, want an InPlaceError for raw/in.log", err)
+	}
+	if output, _ := fake.get("logs", "raw/in.log"); output != original {
+		t.Errorf("source file overwritten with %q", output)
+	}
+}
+
+func TestInPlaceWrittenKeys(t *testing.T) {
+	setForTest(t, &splitBy, splitByProtocol)
+	setForTest(t, &rollMaxBytes, 1<<20)
+	setForTest(t, &outputManifest, true)
+	setForTest(t, &checksumAlgo, "sha256")
+	setForTest(t, &filterProfiles, parseFilterProfiles(`[{"name": "ssh", "filter": "dstport == 22", "destKey": "profiles/ssh.log"}]`))
+
+	for key, want := range map[string]bool{
+		"out/vpc.log":                                    true,
+		"out/vpc-tcp.log":                                true,
+		"out/vpc-tcp-00001-20240305T100000Z.log":         true,
+		"out/vpc-00002-20240305T100000Z.log.sha256":      true,
+		"out/manifest.csv":                               true,
+		"profiles/ssh.log":                               true,
+		"out/vpc.jsonl":                                  false,
+		"out/other.log":                                  false,
+		"out/archive/vpc-tcp-00001-20240305T100000Z.log": false,
+	} {
+		err := checkNotInPlace(context.Background(), []sourceObject{{Bucket: "logs", Key: key}}, "logs", "out/vpc.log")
+		var inPlace *InPlaceError
+		if got := errors.As(err, &inPlace); got != want {
+			t.Errorf("source %s: got %v, want refused %v", key, err, want)
+		}
+	}
+}
+
+func TestDestKeyRegexWithFlowDedup(t *testing.T) {
+	for _, mode := range []string{flowDedupFirst, flowDedupLast} {
+		t.Run(mode, func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			matchAllSources(t)
+			setForTest(t, &sourceBucketName, "src")
+			setForTest(t, &destBucketName, "dest/unmatched.log")
+			setForTest(t, &destKeyRegexp, regexp.MustCompile(`^raw/(.+)$`))
+			setForTest(t, &destKeyReplace, "filtered/$1")
+			setForTest(t, &flowDedup, mode)
+
+			// The same flow reported twice in each file, and a second flow in b.log
+			fake.put("src", "raw/a.log", recordLine("packets=1")+"\n"+recordLine("packets=2")+"\n")
+			fake.put("src", "raw/b.log", recordLine("packets=3")+"\n"+recordLine("srcport=2222", "packets=4")+"\n"+recordLine("packets=5")+"\n")
+
+			result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return []sourceObject{{Bucket: "src", Key: "raw/a.log"}, {Bucket: "src", Key: "raw/b.log"}}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{
+				"filtered/a.log": recordLine("packets=1") + "\n",
+				"filtered/b.log": recordLine("packets=3") + "\n" + recordLine("srcport=2222", "packets=4") + "\n",
+			}
+			if mode == flowDedupLast {
+				want = map[string]string{
+					"filtered/a.log": recordLine("packets=2") + "\n",
+					"filtered/b.log": recordLine("packets=5") + "\n" + recordLine("srcport=2222", "packets=4") + "\n",
+				}
+			}
+			if keys := strings.Join(fake.keys("dest"), ","); keys != "filtered/a.log,filtered/b.log" {
+				t.Fatalf("wrote %s, want one output per source", keys)
+			}
+			for key, records := range want {
+				if output, _ := fake.get("dest", key); output != records {
+					t.Errorf("%s holds %q, want %q", key, output, records)
+				}
+			}
+			if result.DuplicateFlows != 2 {
+				t.Errorf("duplicateFlows = %d, want 2", result.DuplicateFlows)
+			}
+		})
+	}
+}
+
+func TestDestKeyRegexWithFlowDeltas(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/unmatched.jsonl")
+	setForTest(t, &outputFormat, outputFormatJSON)
+	setForTest(t, &destKeyRegexp, regexp.MustCompile(`^raw/(.+)\.log$`))
+	setForTest(t, &destKeyReplace, "filtered/$1.jsonl")
+	setForTest(t, &flowDeltas, true)
+
+	// The same flow in both files: its deltas are computed within each destination
+	fake.put("src", "raw/a.log", recordLine("bytes=100", "start=1700000000")+"\n"+recordLine("bytes=300", "start=1700000060")+"\n")
+	fake.put("src", "raw/b.log", recordLine("bytes=1000", "start=1700000120")+"\n"+recordLine("bytes=1500", "start=1700000180")+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "raw/a.log"}, {Bucket: "src", Key: "raw/b.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := strings.Join(fake.keys("dest"), ","); keys != "filtered/a.jsonl,filtered/b.jsonl" {
+		t.Fatalf("wrote %s, want one output per source", keys)
+	}
+	for key, want := range map[string]string{
+		"filtered/a.jsonl": "100/- 300/200",
+		"filtered/b.jsonl": "1000/- 1500/500",
+	} {
+		output, _ := fake.get("dest", key)
+		var got []string
+		for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+			var record map[string]string
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+			got = append(got, record["bytes"]+"/"+record["bytesDelta"])
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("%s holds %v, want %s", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// DownloadError is returned when downloading a source file fails. Offset is how many bytes of the
+// file had been read when a download failed part way through (0 when it failed before any).
+type DownloadError struct {
+	Source sourceObject
+	Offset int64
+	Err    error
+}
+
+func (e *DownloadError) Error() string {
+	if e.Offset > 0 {
+		return fmt.Sprintf("Unable to download source file %s - partial read, failed after %d bytes: %v", e.Source, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("Unable to download source file %s: %v", e.Source, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// isDownloadFailure reports whether an error reading the source stream came from the download
+// itself rather than from decompressing or parsing what was downloaded
+func isDownloadFailure(err error) bool {
+	var notFound *SourceNotFoundError
+	var downloadErr *DownloadError
+	return errors.As(err, &notFound) || errors.As(err, &downloadErr)
+}
+
+// openSourceStream opens a reader over the source file's bytes, from S3 or over HTTP
+// (the download stops when ctx is cancelled)
+func openSourceStream(ctx context.Context, sourceS3Client s3iface.S3API, source sourceObject) io.ReadCloser {
+	if source.URL != "" {
+		return streamSourceURL(ctx, source)
+	}
+	return streamSourceObject(ctx, sourceS3Client, source)
+}
+
+// streamSourceURL streams a source file served over HTTP(S). Anything but a 200 response fails
+// with a DownloadError carrying the status.
+func streamSourceURL(ctx context.Context, source sourceObject) io.ReadCloser {
+	client := &http.Client{Timeout: time.Duration(sourceURLTimeout) * time.Second}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return errorStream(&DownloadError{Source: source, Err: err})
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return errorStream(&DownloadError{Source: source, Err: err})
+	}
+	if err := presignedURLError(source.URL, response); err != nil {
+		response.Body.Close()
+		return errorStream(&DownloadError{Source: source, Err: err})
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return errorStream(&DownloadError{Source: source, Err: fmt.Errorf("Unexpected HTTP status %s", response.Status)})
+	}
+	if maxSourceBytes > 0 && response.ContentLength > maxSourceBytes {
+		response.Body.Close()
+		return errorStream(&DownloadError{Source: source, Err: &SourceTooLargeError{Size: response.ContentLength}})
+	}
+
+	return &httpSourceStream{ReadCloser: response.Body, ctx: ctx, client: client, source: source}
+}
+
+// maxResumeAttempts is how many times a failed HTTP source read is resumed with a ranged GET
+const maxResumeAttempts = 3
+
+// httpSourceStream resumes the download from where it stopped when reading the response body fails
+// part way through (e.g. a connection reset), with a ranged GET for the rest of the file. Errors it
+// cannot recover from, including the client timeout, are returned as download failures with the
+// offset reached.
+type httpSourceStream struct {
+	io.ReadCloser
+	ctx     context.Context
+	client  *http.Client
+	source  sourceObject
+	offset  int64
+	resumed int
+}
+
+func (h *httpSourceStream) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	if h.ctx.Err() == nil && h.resumed < maxResumeAttempts && h.resume() {
+		if n > 0 {
+			return n, nil
+		}
+		return h.Read(p)
+	}
+	return n, &DownloadError{Source: h.source, Offset: h.offset, Err: err}
+}
+
+// resume replaces the response body with the rest of the file from the current offset, reporting
+// whether the server sent it
+func (h *httpSourceStream) resume() bool {
+	h.resumed++
+	h.ReadCloser.Close()
+
+	request, err := http.NewRequestWithContext(h.ctx, http.MethodGet, h.source.URL, nil)
+	if err != nil {
+		return false
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		h.ReadCloser = errorStream(err)
+		return false
+	}
+	if err := presignedURLError(h.source.URL, response); err != nil {
+		// The URL expired part way through the download
+		response.Body.Close()
+		h.ReadCloser = errorStream(err)
+		return false
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		// Without range support the server would send the file from the start again
+		response.Body.Close()
+		h.ReadCloser = errorStream(fmt.Errorf("Unexpected HTTP status %s resuming at byte %d", response.Status, h.offset))
+		return false
+	}
+
+	log.Printf("Resumed download of %s at byte %d\n", h.source, h.offset)
+	h.ReadCloser = response.Body
+	return true
+}
+
+// errorStream is a source stream that fails with err on the first read
+func errorStream(err error) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	pipeWriter.CloseWithError(err)
+	return pipeReader
+}
+
+// streamSourceObject downloads the source object (the given version, when it has one) with DOWNLOAD_CONCURRENCY ranged GETs of
+// DOWNLOAD_PART_SIZE bytes, and returns a reader over the object's bytes in order as they arrive,
+// so a large object is parsed while the rest of it is still downloading. Closing the reader stops
+// the download.
+func streamSourceObject(ctx context.Context, sourceS3Client s3iface.S3API, source sourceObject) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	ordered := newOrderedWriter(pipeWriter, int64(downloadConcurrency)*downloadPartSize)
+
+	downloader := s3manager.NewDownloaderWithClient(sourceS3Client, func(d *s3manager.Downloader) {
+		d.Concurrency = downloadConcurrency
+		d.PartSize = downloadPartSize
+	})
+
+	go func() {
+		if maxSourceBytes > 0 {
+			if err := checkSourceSize(ctx, sourceS3Client, source); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+
+		getObjectInput := &s3.GetObjectInput{
+			Bucket: aws.String(source.Bucket),
+			Key:    aws.String(source.Key),
+		}
+		if source.VersionID != "" {
+			getObjectInput.VersionId = aws.String(source.VersionID)
+		}
+		if source.End > 0 {
+			getObjectInput.Range = aws.String(fmt.Sprintf("bytes=%d-%d", source.Offset, source.End-1))
+		}
+
+		_, err := downloader.DownloadWithContext(ctx, ordered, getObjectInput)
+		if isNotFound(err) {
+			err = &SourceNotFoundError{Bucket: source.Bucket, Key: source.Key}
+		} else if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			err = &DownloadError{Source: source, Err: err}
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return &sourceStream{PipeReader: pipeReader, ordered: ordered}
+}
+
+// checkSourceSize HEADs the source object and refuses objects over MAX_SOURCE_BYTES before any of
+// their bytes are downloaded
+func checkSourceSize(ctx context.Context, sourceS3Client s3iface.S3API, source sourceObject) error {
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: aws.String(source.Bucket),
+		Key:    aws.String(source.Key),
+	}
+	if source.VersionID != "" {
+		headObjectInput.VersionId = aws.String(source.VersionID)
+	}
+
+	head, err := sourceS3Client.HeadObjectWithContext(ctx, headObjectInput)
+	if isNotFound(err) {
+		return &SourceNotFoundError{Bucket: source.Bucket, Key: source.Key}
+	}
+	if err != nil {
+		return &DownloadError{Source: source, Err: err}
+	}
+	if size := aws.Int64Value(head.ContentLength); size > maxSourceBytes {
+		return &DownloadError{Source: source, Err: &SourceTooLargeError{Size: size}}
+	}
+	return nil
+}
+
+// SourceTooLargeError is the reason a source file over MAX_SOURCE_BYTES is not downloaded
+type SourceTooLargeError struct {
+	Size int64
+}
+
+func (e *SourceTooLargeError) Error() string {
+	return fmt.Sprintf("Source file is %d bytes - over MAX_SOURCE_BYTES (%d), refusing to download it", e.Size, maxSourceBytes)
+}
+
+// sourceStream is the in-order stream of a downloading S3 object. A failure reaching the stream is
+// reported with the offset reached.
+type sourceStream struct {
+	*io.PipeReader
+	ordered *orderedWriter
+	offset  int64
+}
+
+func (s *sourceStream) Read(p []byte) (int, error) {
+	n, err := s.PipeReader.Read(p)
+	s.offset += int64(n)
+
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) && downloadErr.Offset == 0 {
+		downloadErr.Offset = s.offset
+	}
+	return n, err
+}
+
+// Close stops the download. The pipe is closed first: a part writer blocked writing to it holds the
+// orderedWriter's lock, and is only released by the pipe failing its write.
+func (s *sourceStream) Close() error {
+	err := s.PipeReader.Close()
+	s.ordered.abort(io.ErrClosedPipe)
+	return err
+}
+
+// orderedWriter turns the downloader's concurrent, out-of-order WriteAt calls into an in-order
+// stream. Parts that arrive ahead of the stream position are held until the gap before them has
+// been written, so lines that span a part boundary come out whole. Writers that get more than
+// window bytes ahead wait, bounding how much is held in memory.
+//
+// When reading a part's body fails, the downloader retries the part from its start, writing again
+// offsets that may already have been streamed or held. Bytes below the stream position are
+// dropped, and held writes are matched by the range they cover rather than their exact offset, so
+// a retry with different write boundaries neither duplicates bytes nor stalls the stream.
+type orderedWriter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	w       io.Writer
+	window  int64
+	next    int64
+	pending map[int64][]byte
+	err     error
+}
+
+func newOrderedWriter(w io.Writer, window int64) *orderedWriter {
+	o := &orderedWriter{w: w, window: window, pending: map[int64][]byte{}}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+func (o *orderedWriter) WriteAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for o.err == nil && off-o.next >= o.window {
+		o.cond.Wait()
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+
+	n := len(p)
+	if end := off + int64(n); end <= o.next {
+		// A retried part rewriting bytes already streamed
+		return n, nil
+	}
+	if off < o.next {
+		p, off = p[o.next-off:], o.next
+	}
+
+	if off > o.next {
+		// The downloader reuses its buffers, so held parts have to be copied
+		if held, ok := o.pending[off]; !ok || len(held) < len(p) {
+			o.pending[off] = append([]byte(nil), p...)
+		}
+		return n, nil
+	}
+
+	if err := o.write(p); err != nil {
+		return 0, err
+	}
+	if err := o.drain(); err != nil {
+		return 0, err
+	}
+
+	o.cond.Broadcast()
+	return n, nil
+}
+
+// drain writes the held parts that continue the stream, dropping those it has passed
+func (o *orderedWriter) drain() error {
+	for progressed := true; progressed; {
+		progressed = false
+		for off, chunk := range o.pending {
+			if off+int64(len(chunk)) <= o.next {
+				delete(o.pending, off)
+				continue
+			}
+			if off <= o.next {
+				delete(o.pending, off)
+				if err := o.write(chunk[o.next-off:]); err != nil {
+					return err
+				}
+				progressed = true
+			}
+		}
+	}
+	return nil
+}
+
+func (o *orderedWriter) write(p []byte) error {
+	if _, err := o.w.Write(p); err != nil {
+		o.err = err
+		o.cond.Broadcast()
+		return err
+	}
+	o.next += int64(len(p))
+	return nil
+}
+
+// abort fails all pending and future writes with err
+func (o *orderedWriter) abort(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.err = err
+	o.cond.Broadcast()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderedWriterReordersParts(t *testing.T) {
+	out := &bytes.Buffer{}
+	o := newOrderedWriter(out, 1<<20)
+
+	o.WriteAt([]byte("world\n"), 6)
+	o.WriteAt([]byte("hello "), 0)
+
+	if got := out.String(); got != "hello world\n" {
+		t.Fatalf("got %q, want %q", got, "hello world\n")
+	}
+}
+
+func TestOrderedWriterDropsRetriedBytes(t *testing.T) {
+	out := &bytes.Buffer{}
+	o := newOrderedWriter(out, 1<<20)
+	data := []byte("0123456789abcdefghij")
+
+	// The second part arrives first, fails part way and is retried with other write boundaries
+	o.WriteAt(data[10:13], 10)
+	o.WriteAt(data[13:15], 13)
+	o.WriteAt(data[0:10], 0)
+	o.WriteAt(data[10:12], 10)
+	o.WriteAt(data[12:20], 12)
+	// A retry of the first part, after it was streamed
+	o.WriteAt(data[0:4], 0)
+
+	if got := out.String(); got != string(data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+	if len(o.pending) != 0 {
+		t.Errorf("%d parts still held", len(o.pending))
+	}
+}
+
+func TestSourceStreamCloseWithBlockedWriter(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	ordered := newOrderedWriter(pipeWriter, 1<<20)
+	stream := &sourceStream{PipeReader: pipeReader, ordered: ordered}
+
+	// Nothing reads the pipe, so the write blocks holding the writer's lock
+	written := make(chan error, 1)
+	go func() {
+		_, err := ordered.WriteAt([]byte("line\n"), 0)
+		written <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		stream.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close deadlocked with a part write blocked on the pipe")
+	}
+	if err := <-written; err == nil {
+		t.Error("blocked write succeeded after Close")
+	}
+}
+
+func TestSourceVersionIDOnGet(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	var versions []string
+	fake.fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet {
+			versions = append(versions, r.URL.Query().Get("versionId"))
+		}
+		return 0
+	}
+	setForTest(t, &sourceVersionID, "v1")
+
+	sources, err := listSourceObjects(client, "src/in.log", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := streamSourceObject(context.Background(), client, sources[0])
+	defer stream.Close()
+	if _, err := io.ReadAll(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) == 0 || versions[0] != "v1" {
+		t.Fatalf("GET for versions %q, want v1", versions)
+	}
+}
+
+func TestReplayedEventVersionID(t *testing.T) {
+	sources, err := replaySources([]byte(`{"Records": [{"s3": {"bucket": {"name": "src"}, "object": {"key": "in.log", "versionId": "v2"}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].VersionID != "v2" {
+		t.Fatalf("event read as %+v, want version v2", sources)
+	}
+}
+
+func TestHandleRequestFiltersSourceURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs/in.log" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"))
+		fmt.Fprintln(w, flowLogLine("eni-1", "192.168.0.1", "8.8.8.8"))
+	}))
+	defer server.Close()
+
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	rules, err := parseSourceRules("test", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+	setForTest(t, &sourceURL, server.URL+"/logs/in.log")
+	setForTest(t, &destBucketName, "dest/out.log")
+
+	result, err := HandleRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LinesScanned != 2 || result.LinesMatched != 1 {
+		t.Errorf("matched %d of %d lines, want 1 of 2", result.LinesMatched, result.LinesScanned)
+	}
+	if output, _ := fake.get("dest", "out.log"); !strings.Contains(output, "10.0.0.1") {
+		t.Errorf("output %q", output)
+	}
+}
+
+func TestSourceURLErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	stream := streamSourceURL(context.Background(), sourceObject{URL: server.URL + "/in.log"})
+	defer stream.Close()
+	_, err := io.ReadAll(stream)
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("read returned %v, want a DownloadError with the 503 status", err)
+	}
+}
+
+func TestOversizedSourceRefused(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.put("src", "huge.log.gz", strings.Repeat("x", 2048))
+	setForTest(t, &maxSourceBytes, 1024)
+
+	stream := streamSourceObject(context.Background(), client, sourceObject{Bucket: "src", Key: "huge.log.gz"})
+	defer stream.Close()
+	_, err := io.ReadAll(stream)
+
+	var tooLarge *SourceTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 2048 {
+		t.Fatalf("read returned %v, want a SourceTooLargeError", err)
+	}
+	if gets := fake.count(http.MethodGet); gets != 0 {
+		t.Errorf("oversized object downloaded %d times after its HEAD", gets)
+	}
+	if heads := fake.count(http.MethodHead); heads != 1 {
+		t.Errorf("%d HEAD requests, want 1", heads)
+	}
+}
+
+// truncatingHandler serves body, cutting the connection after cutAt bytes of the first response.
+// Ranged requests get the rest of the body when ranges is set, or the whole body again otherwise.
+func truncatingHandler(t *testing.T, body string, cutAt int, ranges bool) http.HandlerFunc {
+	requests := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body[:cutAt])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err != nil || !ranges {
+			fmt.Fprint(w, body)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, body[start:])
+	}
+}
+
+func TestSourceURLResumesPartialRead(t *testing.T) {
+	body := strings.Repeat(flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n", 100)
+	server := httptest.NewServer(truncatingHandler(t, body, 1000, true))
+	defer server.Close()
+
+	stream := streamSourceURL(context.Background(), sourceObject{URL: server.URL + "/in.log"})
+	defer stream.Close()
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("read %d bytes, want the %d byte file whole", len(got), len(body))
+	}
+}
+
+func TestSourceURLPartialReadWithoutRanges(t *testing.T) {
+	body := strings.Repeat(flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n", 100)
+	server := httptest.NewServer(truncatingHandler(t, body, 1000, false))
+	defer server.Close()
+
+	stream := streamSourceURL(context.Background(), sourceObject{URL: server.URL + "/in.log"})
+	defer stream.Close()
+	got, err := io.ReadAll(stream)
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.Offset != 1000 {
+		t.Fatalf("read returned %v, want a DownloadError at offset 1000", err)
+	}
+	if len(got) != 1000 {
+		t.Errorf("read %d bytes before failing, want 1000", len(got))
+	}
+}
+
+func TestSourceStreamPartialReadOffset(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	stream := &sourceStream{PipeReader: pipeReader, ordered: newOrderedWriter(pipeWriter, 1024)}
+	defer stream.Close()
+
+	lines := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8") + "\n" + flowLogLine("eni-1", "10.0.0.2", "8.8.8.8") + "\n"
+	go func() {
+		io.WriteString(pipeWriter, lines)
+		pipeWriter.CloseWithError(&DownloadError{Source: sourceObject{Bucket: "src", Key: "in.log"}, Err: errors.New("connection reset")})
+	}()
+
+	matchAllSources(t)
+	writer := &recordingWriter{}
+	locate := func(line int) (sourceObject, int) { return sourceObject{Bucket: "src", Key: "in.log"}, line }
+	result, _, err := filterVPCLogs(context.Background(), stream, locate, writer, nil, nil, newSummaries())
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.Offset != int64(len(lines)) {
+		t.Fatalf("filtering returned %v, want a DownloadError at offset %d", err, len(lines))
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("partial read, failed after %d bytes", len(lines))) {
+		t.Errorf("error %q does not report the offset reached", err)
+	}
+	if result.LinesScanned != 2 {
+		t.Errorf("scanned %d lines before the failure, want 2", result.LinesScanned)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is an in-memory S3 serving the requests the function makes, for tests to run the real
+// SDK clients against. fail, when set, can fail a request with an HTTP status before it is served.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]map[int][]byte
+	// uploadMetadata is the metadata multipart uploads were created with
+	uploadMetadata map[string]map[string]string
+	requests       []string
+	nextID         int
+
+	fail func(r *http.Request) int
+}
+
+type fakeObject struct {
+	body         []byte
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+func (o *fakeObject) etag() string {
+	sum := md5.Sum(o.body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newFakeS3 starts a fake S3 and returns it with a client for it
+func newFakeS3(t *testing.T) (*fakeS3, *s3.S3) {
+	t.Helper()
+	fake := &fakeS3{objects: map[string]*fakeObject{}, uploads: map[string]map[int][]byte{}, uploadMetadata: map[string]map[string]string{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	awsSession := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:       aws.Int(0),
+	}))
+	return fake, s3.New(awsSession)
+}
+
+// useFakeS3 makes getS3Clients return client for the rest of the test
+func useFakeS3(t *testing.T, client *s3.S3) {
+	t.Helper()
+	s3ClientsOnce = sync.Once{}
+	s3ClientsOnce.Do(func() { cachedSourceS3Client, cachedDestS3Client = client, client })
+	t.Cleanup(func() { s3ClientsOnce = sync.Once{} })
+}
+
+// setForTest sets a config var for the rest of the test
+func setForTest[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	previous := *v
+	*v = value
+	t.Cleanup(func() { *v = previous })
+}
+
+func (f *fakeS3) put(bucket, key, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = &fakeObject{body: []byte(body), metadata: map[string]string{}, lastModified: time.Now().UTC()}
+}
+
+// get returns an object's body, and whether it exists
+func (f *fakeS3) get(bucket, key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return "", false
+	}
+	return string(object.body), true
+}
+
+func (f *fakeS3) metadata(bucket, key string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if object, ok := f.objects[bucket+"/"+key]; ok {
+		return object.metadata
+	}
+	return nil
+}
+
+// keys lists the keys in a bucket
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// count returns how many requests with the method were made
+func (f *fakeS3) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeS3) openUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.fail != nil {
+		if status := f.fail(r); status != 0 {
+			writeS3Error(w, status, "InternalError")
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, bucket, query.Get("prefix"), query.Get("start-after"), query.Get("delimiter"))
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		f.deleteObjects(w, bucket, body)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		f.uploadMetadata[id] = metadataOf(r)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			copied, ok := f.objects[copySourceName(source)]
+			if !ok {
+				writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			start, end := parseRange(r.Header.Get("X-Amz-Copy-Source-Range"), int64(len(copied.body)))
+			parts[number] = append([]byte(nil), copied.body[start:end+1]...)
+			sum := md5.Sum(parts[number])
+			fmt.Fprintf(w, `<CopyPartResult><ETag>"%s"</ETag></CopyPartResult>`, hex.EncodeToString(sum[:]))
+			return
+		}
+		parts[number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if _, exists := f.objects[bucket+"/"+key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		var numbers []int
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var joined []byte
+		for _, number := range numbers {
+			joined = append(joined, parts[number]...)
+		}
+		object := &fakeObject{body: joined, metadata: f.uploadMetadata[query.Get("uploadId")], lastModified: time.Now().UTC()}
+		f.objects[bucket+"/"+key] = object
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, bucket, key, object.etag())
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		copied, ok := f.objects[copySourceName(r.Header.Get("X-Amz-Copy-Source"))]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		object := &fakeObject{body: copied.body, metadata: copied.metadata, lastModified: time.Now().UTC()}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			object.metadata = metadataOf(r)
+		}
+		f.objects[bucket+"/"+key] = object
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, object.etag())
+	case r.Method == http.MethodPut:
+		if _, exists := f.objects[bucket+"/"+key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if digest := r.Header.Get("Content-Md5"); digest == "AAAAAAAAAAAAAAAAAAAAAA==" {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		object := &fakeObject{body: body, metadata: metadataOf(r), lastModified: time.Now().UTC()}
+		f.objects[bucket+"/"+key] = object
+		w.Header().Set("ETag", object.etag())
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" && match == object.etag() {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		for name, value := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("ETag", object.etag())
+		w.Header().Set("Last-Modified", object.lastModified.Format(http.TimeFormat))
+
+		content, status := object.body, http.StatusOK
+		if spec := r.Header.Get("Range"); spec != "" {
+			start, end := parseRange(spec, int64(len(object.body)))
+			if start >= int64(len(object.body)) {
+				writeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			content, status = object.body[start:end+1], http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object.body)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list lists the keys under prefix. Keys below a further delimiter are left out (the fake does not
+// return their common prefixes).
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix, startAfter, delimiter string) {
+	var keys []string
+	for name := range f.objects {
+		key := strings.TrimPrefix(name, bucket+"/")
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(key, prefix), delimiter) {
+			continue
+		}
+		if key != name && strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>`, bucket, prefix, len(keys))
+	for _, key := range keys {
+		object := f.objects[bucket+"/"+key]
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag><LastModified>%s</LastModified></Contents>`,
+			key, len(object.body), object.etag(), object.lastModified.Format(time.RFC3339))
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, bucket string, body []byte) {
+	var request struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	xml.Unmarshal(body, &request)
+	for _, object := range request.Objects {
+		delete(f.objects, bucket+"/"+object.Key)
+	}
+	fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+}
+
+// copySourceName returns the bucket/key name of an escaped copy source
+func copySourceName(source string) string {
+	name, _ := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	return name
+}
+
+func metadataOf(r *http.Request) map[string]string {
+	metadata := map[string]string{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-"))] = values[0]
+		}
+	}
+	return metadata
+}
+
+// parseRange parses a "bytes=start-end" or "bytes=start-" range header
+func parseRange(spec string, size int64) (int64, int64) {
+	bounds := strings.SplitN(strings.TrimPrefix(spec, "bytes="), "-", 2)
+	start, _ := strconv.ParseInt(bounds[0], 10, 64)
+	end := size - 1
+	if len(bounds) == 2 && bounds[1] != "" {
+		end, _ = strconv.ParseInt(bounds[1], 10, 64)
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// failPuts fails the uploads to a bucket
+func failPuts(bucket string) func(r *http.Request) int {
+	return func(r *http.Request) int {
+		if (r.Method == http.MethodPut || r.Method == http.MethodPost) && strings.HasPrefix(r.URL.Path, "/"+bucket+"/") {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FILTER_EXPR is a boolean expression over the fields of a record, e.g.
+//
+//	srcaddr in 10.0.0.0/8 and dstport == 443 and bytes > 1000
+//	not (action == REJECT or protocol in (1, 58))
+//
+// Comparisons are ==, !=, <, <=, > and >= between a field and a value - numerically when both are
+// numbers, otherwise as strings (only == and != then). "in" tests an address field against a CIDR
+// block or IP address, or any field against a parenthesized list of values. Comparisons combine
+// with and, or and not (in that order of decreasing precedence) and parentheses. Values are bare
+// words or double-quoted strings.
+
+// exprNode is a node of a parsed filter expression
+type exprNode interface {
+	eval(vpcLog *VPCFlowLog) bool
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n andNode) eval(vpcLog *VPCFlowLog) bool { return n.left.eval(vpcLog) && n.right.eval(vpcLog) }
+
+type orNode struct{ left, right exprNode }
+
+func (n orNode) eval(vpcLog *VPCFlowLog) bool { return n.left.eval(vpcLog) || n.right.eval(vpcLog) }
+
+type notNode struct{ operand exprNode }
+
+func (n notNode) eval(vpcLog *VPCFlowLog) bool { return !n.operand.eval(vpcLog) }
+
+// compareNode compares a field to a value. number is set when the value is numeric, so records
+// are compared numerically when their value is a number too.
+type compareNode struct {
+	field  string
+	op     string
+	value  string
+	number *float64
+}
+
+func (n compareNode) eval(vpcLog *VPCFlowLog) bool {
+	value := vpcLog.Get(n.field)
+	if n.number != nil {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			switch n.op {
+			case "==":
+				return number == *n.number
+			case "!=":
+				return number != *n.number
+			case "<":
+				return number < *n.number
+			case "<=":
+				return number <= *n.number
+			case ">":
+				return number > *n.number
+			case ">=":
+				return number >= *n.number
+			}
+		}
+	}
+
+	switch n.op {
+	case "==":
+		return value == n.value
+	case "!=":
+		return value != n.value
+	default:
+		// Ordering a value that is not a number (e.g. "-") never matches
+		return false
+	}
+}
+
+// inNetworkNode tests whether an address field is in a CIDR block
+type inNetworkNode struct {
+	field   string
+	network *net.IPNet
+}
+
+func (n inNetworkNode) eval(vpcLog *VPCFlowLog) bool {
+	ip := net.ParseIP(vpcLog.Get(n.field))
+	return ip != nil && n.network.Contains(ip)
+}
+
+// inValuesNode tests whether a field is one of a list of values
+type inValuesNode struct {
+	field  string
+	values map[string]bool
+}
+
+func (n inValuesNode) eval(vpcLog *VPCFlowLog) bool {
+	return n.values[vpcLog.Get(n.field)]
+}
+
+// filterExprFilter compiles a FILTER_EXPR into a record filter
+func filterExprFilter(expr string) (recordFilter, error) {
+	node, err := parseFilterExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	return node.eval, nil
+}
+
+// parseFilterExpr parses an expression into its tree, which is evaluated per record
+func parseFilterExpr(expr string) (exprNode, error) {
+	tokens, err := tokenizeFilterExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != tokenEnd {
+		return nil, p.errorf(token, "unexpected %s", token)
+	}
+	return node, nil
+}
+
+const (
+	tokenEnd = iota
+	tokenWord
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// tokenizeFilterExpr splits an expression into words (field names, keywords, numbers, addresses),
+// quoted strings, comparison operators, parentheses and commas
+func tokenizeFilterExpr(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, exprToken{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, exprToken{tokenRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, exprToken{tokenComma, ",", i})
+			i++
+		case c == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("FILTER_EXPR syntax error at position %d: unterminated string", i+1)
+			}
+			tokens = append(tokens, exprToken{tokenString, expr[i+1 : i+1+end], i})
+			i += end + 2
+		case strings.IndexByte("=!<>", c) >= 0:
+			op := string(c)
+			if i+1 < len(expr) && expr[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("FILTER_EXPR syntax error at position %d: unknown operator %q", i+1, op)
+			}
+			tokens = append(tokens, exprToken{tokenOperator, op, i})
+			i += len(op)
+		case isExprWordByte(c):
+			start := i
+			for i < len(expr) && isExprWordByte(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokenWord, expr[start:i], start})
+		default:
+			return nil, fmt.Errorf("FILTER_EXPR syntax error at position %d: unexpected character %q", i+1, c)
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEnd, pos: len(expr)}), nil
+}
+
+// isExprWordByte reports whether c can be part of a word - field names have dashes, addresses dots,
+// colons and slashes
+func isExprWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-_.:/", c) >= 0
+}
+
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) take() exprToken {
+	token := p.tokens[p.next]
+	if token.kind != tokenEnd {
+		p.next++
+	}
+	return token
+}
+
+func (p *exprParser) errorf(token exprToken, format string, args ...interface{}) error {
+	return fmt.Errorf("FILTER_EXPR syntax error at position %d: %s", token.pos+1, fmt.Sprintf(format, args...))
+}
+
+// isKeyword reports whether the next token is the given keyword (case-insensitive)
+func (p *exprParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token.kind == tokenWord && strings.EqualFold(token.text, keyword)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.take()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isKeyword("not") {
+		p.take()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.peek().kind == tokenLParen {
+		p.take()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if token := p.take(); token.kind != tokenRParen {
+			return nil, p.errorf(token, "expected \")\", got %s", token)
+		}
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	fieldToken := p.take()
+	if fieldToken.kind != tokenWord {
+		return nil, p.errorf(fieldToken, "expected a field name, got %s", fieldToken)
+	}
+	field := fieldToken.text
+	if !isKnownField(field) {
+		return nil, p.errorf(fieldToken, "%q is not a field of the log format", field)
+	}
+
+	if p.isKeyword("in") {
+		p.take()
+		return p.parseIn(field)
+	}
+
+	opToken := p.take()
+	if opToken.kind != tokenOperator {
+		return nil, p.errorf(opToken, "expected a comparison operator or \"in\" after %s, got %s", field, opToken)
+	}
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	node := compareNode{field: field, op: opToken.text, value: value}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		node.number = &number
+	} else if opToken.text != "==" && opToken.text != "!=" {
+		return nil, p.errorf(opToken, "%s needs a number, got %q", opToken.text, value)
+	}
+	return node, nil
+}
+
+// parseIn parses the right side of "field in": a CIDR block or IP address, or a list of values
+func (p *exprParser) parseIn(field string) (exprNode, error) {
+	if p.peek().kind == tokenLParen {
+		p.take()
+		values := map[string]bool{}
+		for {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values[value] = true
+
+			token := p.take()
+			if token.kind == tokenRParen {
+				return inValuesNode{field: field, values: values}, nil
+			}
+			if token.kind != tokenComma {
+				return nil, p.errorf(token, "expected \",\" or \")\", got %s", token)
+			}
+		}
+	}
+
+	token := p.take()
+	if token.kind != tokenWord {
+		return nil, p.errorf(token, "expected a CIDR block or value list after \"in\", got %s", token)
+	}
+	cidr := token.text
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, p.errorf(token, "%q is not a valid CIDR block or IP address", token.text)
+	}
+	return inNetworkNode{field: field, network: network}, nil
+}
+
+func (p *exprParser) parseValue() (string, error) {
+	token := p.take()
+	if token.kind != tokenWord && token.kind != tokenString {
+		return "", p.errorf(token, "expected a value, got %s", token)
+	}
+	return token.text, nil
+}
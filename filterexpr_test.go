@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterExpr(t *testing.T) {
+	web := parseTestRecord(t, recordLine("srcaddr=10.1.2.3", "dstport=443", "bytes=5000"))
+	small := parseTestRecord(t, recordLine("srcaddr=10.1.2.3", "dstport=443", "bytes=40"))
+	external := parseTestRecord(t, recordLine("srcaddr=192.168.1.1", "dstport=443", "bytes=5000"))
+	rejectedPing := parseTestRecord(t, recordLine("protocol=1", "action=REJECT", "dstport=0"))
+	noData := parseTestRecord(t, recordLine("packets=-", "bytes=-", "log-status=NODATA"))
+
+	for _, test := range []struct {
+		expr string
+		want map[*VPCFlowLog]bool
+	}{
+		{"srcaddr in 10.0.0.0/8 and dstport == 443 and bytes > 1000",
+			map[*VPCFlowLog]bool{web: true, small: false, external: false, rejectedPing: false}},
+		{"not (action == REJECT or protocol in (1, 58))",
+			map[*VPCFlowLog]bool{web: true, rejectedPing: false}},
+		// and binds tighter than or
+		{"dstport == 0 or srcaddr in 192.168.0.0/16 and bytes >= 5000",
+			map[*VPCFlowLog]bool{rejectedPing: true, external: true, web: false}},
+		{`action != "ACCEPT"`,
+			map[*VPCFlowLog]bool{rejectedPing: true, web: false}},
+		// Ordering "-" never matches, but != still does
+		{"bytes < 100", map[*VPCFlowLog]bool{small: true, noData: false}},
+		{"bytes != 100", map[*VPCFlowLog]bool{noData: true}},
+		{"srcaddr IN 10.1.2.3 AND NOT bytes <= 40", map[*VPCFlowLog]bool{web: true, small: false}},
+	} {
+		filter, err := filterExprFilter(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		for record, want := range test.want {
+			if got := filter(record); got != want {
+				t.Errorf("%s on %s = %v, want %v", test.expr, record.Raw, got, want)
+			}
+		}
+	}
+}
+
+func TestFilterExprSyntaxErrors(t *testing.T) {
+	for expr, want := range map[string]string{
+		"dstport == 443 and":           "position",
+		"(dstport == 443":              "position",
+		"dstport ~ 443":                "position",
+		"srcaddr in (10.0.0.1":         "position",
+		"dstport == 443 dstport == 80": "position",
+		"no-such-field == 1":           "not a field",
+		`action == "REJECT`:            "FILTER_EXPR",
+	} {
+		if _, err := filterExprFilter(expr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: compiled with error %v, want a syntax error", expr, err)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// recordFilter reports whether a record should be kept
+type recordFilter func(vpcLog *VPCFlowLog) bool
+
+// recordFilters are the optional filters configured on top of the source IP address match. A
+// record is only written when it passes all of them.
+var recordFilters = newRecordFilters()
+
+func newRecordFilters() []recordFilter {
+	var filters []recordFilter
+	if minPackets > 0 {
+		filters = append(filters, minCountFilter("packets", minPackets))
+	}
+	if bytesPerPacket != "" {
+		filter, err := bytesPerPacketFilter(bytesPerPacket)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	if srcPorts != "" {
+		filter, err := portFilter("srcport", srcPorts)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	if dstPorts != "" {
+		filter, err := portFilter("dstport", dstPorts)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	if tcpFlags != "" {
+		filter, err := tcpFlagsFilter(tcpFlags)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	if matchField != "" {
+		filter, err := fieldValuesFilter(matchField, matchValues)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	if filterExpr != "" {
+		filter, err := filterExprFilter(filterExpr)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	if matchThreatFeed {
+		if threatFeedURL == "" {
+			log.Fatalf("MATCH_THREAT_FEED requires THREAT_FEED_URL")
+		}
+		filters = append(filters, threatFeedFilter())
+	}
+	if lineRegex != "" {
+		filter, err := lineRegexFilter(lineRegex)
+		fatalIf(err)
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// fieldValuesFilter keeps records whose field is one of the comma-separated values, e.g. dstport
+// "443,8443" or action "REJECT", for filtering on any field of the log format
+func fieldValuesFilter(field, values string) (recordFilter, error) {
+	if !isKnownField(field) {
+		return nil, fmt.Errorf("MATCH_FIELD %q is not a field of the log format", field)
+	}
+	if values == "" {
+		return nil, fmt.Errorf("MATCH_FIELD requires MATCH_VALUES")
+	}
+
+	allowed := map[string]bool{}
+	for _, value := range strings.Split(values, ",") {
+		allowed[strings.TrimSpace(value)] = true
+	}
+	return func(vpcLog *VPCFlowLog) bool {
+		return allowed[vpcLog.Get(field)]
+	}, nil
+}
+
+// lineRegexFilter keeps records whose raw line matches the pattern. The regexp is compiled once,
+// when the filters are built at startup.
+func lineRegexFilter(pattern string) (recordFilter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("LINE_REGEX %q is not a valid regular expression: %v", pattern, err)
+	}
+
+	return func(vpcLog *VPCFlowLog) bool {
+		return re.MatchString(vpcLog.Raw)
+	}, nil
+}
+
+func passesFilters(vpcLog *VPCFlowLog) bool {
+	for _, filter := range recordFilters {
+		if !filter(vpcLog) {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceRule is one entry of SOURCE_IP_ADDRESSES - a single IP address or a CIDR block
+type sourceRule struct {
+	Name    string
+	network *net.IPNet
+}
+
+// configuredSourceRules are the parsed SOURCE_IP_ADDRESSES entries, in configured order, followed
+// by the entries of the embedded allowlist
+var configuredSourceRules = append(mustParseSourceRules(strings.Split(sourceIPAddresses, ",")), embeddedAllowlistRules...)
+
+// sourceRules are the rules logs are matched against: the configured rules, followed by the
+// entries of ALLOWLIST_PATH and WATCHLIST_TABLE when they are set (refreshed on every invocation)
+var sourceRules = configuredSourceRules
+
+// maskedRules indexes the source rules by network address when MATCH_MASK is set, so each log
+// costs one lookup of its masked srcaddr however many networks are listed
+var maskedRules = mustParseMaskedRules(sourceRules)
+
+func mustParseSourceRules(entries []string) []sourceRule {
+	rules, err := parseSourceRules("SOURCE_IP_ADDRESSES", entries)
+	fatalIf(err)
+	return rules
+}
+
+func mustParseMaskedRules(rules []sourceRule) map[string]string {
+	masked, err := parseMaskedRules(rules)
+	fatalIf(err)
+	return masked
+}
+
+// parseSourceRules parses IP address and CIDR block entries, skipping blank ones. source names
+// where the entries came from in errors.
+func parseSourceRules(source string, entries []string) ([]sourceRule, error) {
+	var rules []sourceRule
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rule := sourceRule{Name: entry}
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s entry %q is not a valid CIDR block", source, entry)
+			}
+			rule.network = network
+		} else if net.ParseIP(entry) == nil {
+			return nil, fmt.Errorf("%s entry %q is not a valid IP address", source, entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseMaskedRules(rules []sourceRule) (map[string]string, error) {
+	if matchMask == nil {
+		return nil, nil
+	}
+
+	masked := map[string]string{}
+	for _, rule := range rules {
+		ip := net.ParseIP(rule.Name).To4()
+		if rule.network != nil || ip == nil {
+			return nil, fmt.Errorf("Source IP address entry %q must be an IPv4 network address when MATCH_MASK is set", rule.Name)
+		}
+		if !ip.Mask(matchMask).Equal(ip) {
+			return nil, fmt.Errorf("Source IP address entry %q has host bits set for MATCH_MASK", rule.Name)
+		}
+		masked[ip.String()] = rule.Name
+	}
+	return masked, nil
+}
+
+// refreshSourceRules rebuilds the rules logs are matched against for an invocation: the
+// configured rules followed by the ALLOWLIST_PATH and WATCHLIST_TABLE entries
+func refreshSourceRules(sourceS3Client s3iface.S3API) error {
+	rules := append([]sourceRule{}, configuredSourceRules...)
+	if allowlistPath != "" {
+		allowlist, err := loadAllowlist(sourceS3Client)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, allowlist...)
+	}
+	if watchlistTable != "" {
+		dynamoDBClient, err := getDynamoDBClient()
+		if err != nil {
+			return err
+		}
+		watchlist, err := loadWatchlist(dynamoDBClient)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, watchlist...)
+	}
+	return setSourceRules(rules)
+}
+
+// setSourceRules replaces the rules logs are matched against
+func setSourceRules(rules []sourceRule) error {
+	masked, err := parseMaskedRules(rules)
+	if err != nil {
+		return err
+	}
+	sourceRules, maskedRules = rules, masked
+	return nil
+}
+
+// parseMatchMask parses MATCH_MASK, an IPv4 prefix length written as "/24"
+func parseMatchMask(value string) net.IPMask {
+	if value == "" {
+		return nil
+	}
+
+	bits, err := strconv.Atoi(strings.TrimPrefix(value, "/"))
+	if err != nil || bits < 0 || bits > 32 {
+		log.Fatalf("MATCH_MASK %q not in the correct format - expected a prefix length from /0 to /32", value)
+	}
+	return net.CIDRMask(bits, 32)
+}
+
+func (r sourceRule) matches(srcAddr string) bool {
+	if r.network == nil {
+		return srcAddr == r.Name
+	}
+
+	ip := net.ParseIP(srcAddr)
+	return ip != nil && r.network.Contains(ip)
+}
+
+const (
+	ruleAttributionFirst = "first"
+	ruleAttributionAll   = "all"
+)
+
+// matchSourceRules returns the source rules the srcaddr matches. Overlapping rules (e.g. an address
+// and a CIDR block containing it) are attributed per RULE_ATTRIBUTION: only the first matching rule
+// in configured order ("first", the default), or every matching rule ("all").
+func matchSourceRules(srcAddr string) []string {
+	if srcAddr == "" {
+		return nil
+	}
+	if matchMask != nil {
+		ip := net.ParseIP(srcAddr).To4()
+		if ip == nil {
+			return nil
+		}
+		if rule, ok := maskedRules[ip.Mask(matchMask).String()]; ok {
+			return []string{rule}
+		}
+		return nil
+	}
+
+	var matched []string
+	for _, rule := range sourceRules {
+		if rule.matches(srcAddr) {
+			matched = append(matched, rule.Name)
+			if ruleAttribution != ruleAttributionAll {
+				break
+			}
+		}
+	}
+	return matched
+}
+
+func parseRuleAttribution(value string) string {
+	switch value {
+	case "":
+		return ruleAttributionFirst
+	case ruleAttributionFirst, ruleAttributionAll:
+		return value
+	default:
+		log.Fatalf("RULE_ATTRIBUTION %s not supported - expected one of first, all", value)
+		return ""
+	}
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	from, to int
+}
+
+// namedPortSets are shortcuts for the IANA port ranges, usable in SRC_PORTS/DST_PORTS
+var namedPortSets = map[string]portRange{
+	"well-known": {0, 1023},
+	"registered": {1024, 49151},
+	"ephemeral":  {49152, 65535},
+}
+
+// servicePorts are the ports of well-known service names, usable in SRC_PORTS/DST_PORTS in place
+// of their numbers. The services of SERVICES_FILE, when set, are added at startup.
+var servicePorts = loadServicePorts(map[string]int{
+	"ftp-data": 20, "ftp": 21, "ssh": 22, "telnet": 23, "smtp": 25, "dns": 53, "domain": 53,
+	"dhcp": 67, "tftp": 69, "http": 80, "kerberos": 88, "pop3": 110, "ntp": 123, "imap": 143,
+	"snmp": 161, "ldap": 389, "https": 443, "smb": 445, "syslog": 514, "submission": 587,
+	"ldaps": 636, "imaps": 993, "pop3s": 995, "mssql": 1433, "oracle": 1521, "nfs": 2049,
+	"mysql": 3306, "rdp": 3389, "postgres": 5432, "postgresql": 5432, "vnc": 5900, "redis": 6379,
+	"http-alt": 8080, "https-alt": 8443, "mongodb": 27017,
+}, servicesFile)
+
+// loadServicePorts adds the services of an /etc/services style file ("name port/protocol
+// aliases... # comment") to the built-in ones, by name and alias
+func loadServicePorts(ports map[string]int, path string) map[string]int {
+	if path == "" {
+		return ports
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Unable to read SERVICES_FILE %s: %v", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		port, err := strconv.Atoi(strings.SplitN(fields[1], "/", 2)[0])
+		if err != nil || port < 0 || port > 65535 {
+			continue
+		}
+		for _, name := range append([]string{fields[0]}, fields[2:]...) {
+			name = strings.ToLower(name)
+			if _, ok := ports[name]; !ok {
+				ports[name] = port
+			}
+		}
+	}
+	return ports
+}
+
+// parsePortRanges parses a comma-separated list of ports ("443") or service names ("https"), ranges
+// ("8000-8999") and named port sets ("ephemeral")
+func parsePortRanges(spec string) ([]portRange, error) {
+	var ranges []portRange
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if named, ok := namedPortSets[entry]; ok {
+			ranges = append(ranges, named)
+			continue
+		}
+		if port, ok := servicePorts[entry]; ok {
+			ranges = append(ranges, portRange{port, port})
+			continue
+		}
+
+		from, to := entry, entry
+		if i := strings.Index(entry, "-"); i > 0 {
+			from, to = entry[:i], entry[i+1:]
+		}
+		fromPort, fromErr := strconv.Atoi(from)
+		toPort, toErr := strconv.Atoi(to)
+		if fromErr != nil || toErr != nil || fromPort < 0 || toPort > 65535 || fromPort > toPort {
+			return nil, fmt.Errorf("Port entry %q is not a port, a service name, a port range or one of well-known, registered, ephemeral", entry)
+		}
+		ranges = append(ranges, portRange{fromPort, toPort})
+	}
+	return ranges, nil
+}
+
+// portFilter keeps records whose port field is in one of the ranges. Records without ports (e.g.
+// ICMP, where the field is "-") never match.
+func portFilter(field, spec string) (recordFilter, error) {
+	ranges, err := parsePortRanges(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s filter: %v", field, err)
+	}
+
+	return func(vpcLog *VPCFlowLog) bool {
+		port, err := strconv.ParseUint(vpcLog.Get(field), 10, 16)
+		if err != nil {
+			return false
+		}
+		for _, r := range ranges {
+			if int(port) >= r.from && int(port) <= r.to {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// minCountFilter keeps records whose count field (packets, bytes) is at least min. Records with a
+// malformed count never match.
+func minCountFilter(field string, min int64) recordFilter {
+	return func(vpcLog *VPCFlowLog) bool {
+		count, err := parseCount(vpcLog.Get(field))
+		return err == nil && count >= min
+	}
+}
+
+// bytesPerPacketFilter keeps records whose average packet size - bytes divided by packets -
+// compares to the spec's value, e.g. ">1400" or "<=64" (a bare number means ">="). Records with no
+// packets, including NODATA/SKIPDATA records, have no average and never match.
+func bytesPerPacketFilter(spec string) (recordFilter, error) {
+	op, value := ">=", strings.TrimSpace(spec)
+	for _, prefix := range []string{">=", "<=", "==", ">", "<"} {
+		if strings.HasPrefix(value, prefix) {
+			op, value = prefix, strings.TrimSpace(strings.TrimPrefix(value, prefix))
+			break
+		}
+	}
+	limit, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("BYTES_PER_PACKET %q is not a comparison such as \">1400\"", spec)
+	}
+
+	return func(vpcLog *VPCFlowLog) bool {
+		packets, err := parseCount(vpcLog.Get("packets"))
+		if err != nil || packets == 0 {
+			return false
+		}
+		bytes, err := parseCount(vpcLog.Get("bytes"))
+		if err != nil {
+			return false
+		}
+
+		ratio := float64(bytes) / float64(packets)
+		switch op {
+		case ">":
+			return ratio > limit
+		case "<":
+			return ratio < limit
+		case "<=":
+			return ratio <= limit
+		case "==":
+			return ratio == limit
+		default:
+			return ratio >= limit
+		}
+	}, nil
+}
+
+// parseCount parses a numeric count field as an int64, so byte counts over 2GB don't overflow on
+// 32-bit builds. Records without data (NODATA/SKIPDATA) have "-" in place of their counts, which is
+// treated as zero; anything else that is not a non-negative integer is an error.
+func parseCount(value string) (int64, error) {
+	if value == "-" {
+		return 0, nil
+	}
+
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("Count %q is not a non-negative integer", value)
+	}
+	return count, nil
+}
+
+// tcpFlagBits are the bits of the tcp-flags field (version 3+ logs). Flags are OR-ed together
+// over the aggregation interval, so e.g. a completed handshake shows up as SYN-ACK (18).
+var tcpFlagBits = map[string]int64{
+	"fin": 1,
+	"syn": 2,
+	"rst": 4,
+	"psh": 8,
+	"ack": 16,
+	"urg": 32,
+}
+
+// tcpFlagsFilter keeps records whose tcp-flags have all the listed flags set and all the flags
+// listed with a "!" prefix unset, e.g. "syn,!ack" for SYN-only flows (potential scans). Records
+// without tcp-flags never match.
+func tcpFlagsFilter(expr string) (recordFilter, error) {
+	var set, unset int64
+	for _, name := range strings.Split(expr, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		negated := strings.HasPrefix(name, "!")
+
+		bit, ok := tcpFlagBits[strings.TrimPrefix(name, "!")]
+		if !ok {
+			return nil, fmt.Errorf("TCP_FLAGS contains unknown flag %q - expected fin, syn, rst, psh, ack or urg", name)
+		}
+		if negated {
+			unset |= bit
+		} else {
+			set |= bit
+		}
+	}
+
+	return func(vpcLog *VPCFlowLog) bool {
+		flags, err := strconv.ParseInt(vpcLog.Get("tcp-flags"), 10, 64)
+		if err != nil {
+			return false
+		}
+		return flags&set == set && flags&unset == 0
+	}, nil
+}
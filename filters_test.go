@@ -0,0 +1,308 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMinPacketsFilter(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &minPackets, 5)
+	setForTest(t, &dstPorts, "443")
+	setForTest(t, &recordFilters, newRecordFilters())
+
+	records, _, err := filterLines(t,
+		recordLine("packets=10"),
+		recordLine("packets=5", "srcaddr=10.0.0.2"),
+		recordLine("packets=4"),
+		// Above the threshold, but filtered out on its port
+		recordLine("packets=10", "dstport=80"),
+		// NODATA records have "-" in place of their counts
+		recordLine("packets=-", "bytes=-", "log-status=NODATA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("%d records kept, want the 2 at or above MIN_PACKETS on port 443", len(records))
+	}
+	if records[0].Get("packets") != "10" || records[1].Get("srcaddr") != "10.0.0.2" {
+		t.Errorf("kept %s and %s", records[0].Raw, records[1].Raw)
+	}
+}
+
+func TestBytesPerPacketFilter(t *testing.T) {
+	matchAllSources(t)
+	lines := []string{
+		recordLine("srcaddr=10.0.0.1", "packets=10", "bytes=15000"), // 1500
+		recordLine("srcaddr=10.0.0.2", "packets=10", "bytes=14000"), // 1400
+		recordLine("srcaddr=10.0.0.3", "packets=10", "bytes=400"),   // 40
+		recordLine("srcaddr=10.0.0.4", "packets=0", "bytes=0"),
+		recordLine("srcaddr=10.0.0.5", "packets=-", "bytes=-", "log-status=NODATA"),
+	}
+	for _, test := range []struct {
+		spec string
+		want []string
+	}{
+		{">1400", []string{"10.0.0.1"}},
+		{"1400", []string{"10.0.0.1", "10.0.0.2"}},
+		{">= 1400", []string{"10.0.0.1", "10.0.0.2"}},
+		{"<64", []string{"10.0.0.3"}},
+		{"<=1400", []string{"10.0.0.2", "10.0.0.3"}},
+		{"==40", []string{"10.0.0.3"}},
+		// Records with no packets have no average, so they match no limit
+		{"<1000000", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			setForTest(t, &bytesPerPacket, test.spec)
+			setForTest(t, &recordFilters, newRecordFilters())
+
+			records, _, err := filterLines(t, lines...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, record := range records {
+				kept = append(kept, record.Get("srcaddr"))
+			}
+			if strings.Join(kept, ",") != strings.Join(test.want, ",") {
+				t.Errorf("BYTES_PER_PACKET=%s kept %v, want %v", test.spec, kept, test.want)
+			}
+		})
+	}
+}
+
+func TestBytesPerPacketInvalidSpec(t *testing.T) {
+	for _, spec := range []string{"", ">", "big", "=>1400", "!=64"} {
+		if _, err := bytesPerPacketFilter(spec); err == nil {
+			t.Errorf("BYTES_PER_PACKET %q accepted", spec)
+		}
+	}
+}
+
+func TestTCPFlagsFilterMatchesSYNOnly(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &detectLogVersion, true)
+	setForTest(t, &tcpFlags, "syn,!ack")
+	setForTest(t, &recordFilters, newRecordFilters())
+
+	records, _, err := filterLines(t,
+		v5FlowLogLine("10.0.0.1", "2"),  // SYN
+		v5FlowLogLine("10.0.0.2", "18"), // SYN-ACK
+		v5FlowLogLine("10.0.0.3", "1"),  // FIN
+		v5FlowLogLine("10.0.0.4", "4"),  // RST
+		v5FlowLogLine("10.0.0.5", "-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Get("srcaddr") != "10.0.0.1" {
+		t.Fatalf("kept %d records, want only the SYN-only flow", len(records))
+	}
+}
+
+func TestNamedPortSets(t *testing.T) {
+	line := recordLine("dstport=50000")
+	for _, test := range []struct {
+		spec  string
+		match bool
+	}{
+		{"ephemeral", true},
+		{"well-known", false},
+		{"registered", false},
+		{"well-known,ephemeral", true},
+	} {
+		filter, err := portFilter("dstport", test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched := filter(parseTestRecord(t, line)); matched != test.match {
+			t.Errorf("port 50000 matched DST_PORTS=%s: %v, want %v", test.spec, matched, test.match)
+		}
+	}
+}
+
+func TestMatchMaskGroupsBySubnet(t *testing.T) {
+	setForTest(t, &matchMask, parseMatchMask("/24"))
+	rules, err := parseSourceRules("test", []string{"10.0.1.0", "10.0.2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, sourceRules)
+	setForTest(t, &maskedRules, maskedRules)
+	if err := setSourceRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _, err := filterLines(t,
+		flowLogLine("eni-1", "10.0.1.7", "8.8.8.8"),
+		flowLogLine("eni-1", "10.0.1.200", "8.8.8.8"),
+		flowLogLine("eni-1", "10.0.3.7", "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Get("srcaddr") != "10.0.1.7" || records[1].Get("srcaddr") != "10.0.1.200" {
+		t.Fatalf("kept %d records, want both addresses in 10.0.1.0/24", len(records))
+	}
+	if rule := matchSourceRules("10.0.1.200"); len(rule) != 1 || rule[0] != "10.0.1.0" {
+		t.Errorf("10.0.1.200 attributed to %v", rule)
+	}
+
+	// Entries with host bits set can't match any masked address
+	if _, err := parseMaskedRules([]sourceRule{{Name: "10.0.1.5"}}); err == nil {
+		t.Error("network entry with host bits accepted")
+	}
+}
+
+func TestParseCountLargeAndPlaceholder(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"9000000000000", 9000000000000, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"-", 0, true},
+		{"9223372036854775808", 0, false},
+		{"12kb", 0, false},
+		{"-5", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		count, err := parseCount(test.value)
+		if (err == nil) != test.ok || count != test.want {
+			t.Errorf("parseCount(%q) = %d, %v", test.value, count, err)
+		}
+	}
+}
+
+func TestBytesOverTwoGigabytesCounted(t *testing.T) {
+	large, placeholder := parseTestRecord(t, recordLine("bytes=9000000000000")), parseTestRecord(t, recordLine("bytes=-", "packets=-", "log-status=NODATA"))
+
+	filter := minCountFilter("bytes", 3<<30)
+	if !filter(large) || filter(placeholder) {
+		t.Errorf("a 3GB byte threshold kept the 9TB flow: %v, the NODATA record: %v", filter(large), filter(placeholder))
+	}
+
+	runSummaries := newSummaries()
+	runSummaries.add([]string{"10.0.0.0/8"}, large)
+	runSummaries.add([]string{"10.0.0.0/8"}, large)
+	runSummaries.add([]string{"10.0.0.0/8"}, placeholder)
+	if rule := runSummaries.rules["10.0.0.0/8"]; rule.Bytes != 18000000000000 || rule.Matches != 3 {
+		t.Errorf("rule summary %+v, want 18TB over 3 matches", rule)
+	}
+}
+
+func TestLineRegexFilter(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &lineRegex, `eni-0a1b|\sREJECT\s`)
+	setForTest(t, &recordFilters, newRecordFilters())
+
+	records, _, err := filterLines(t,
+		recordLine("interface-id=eni-0a1b2c3d"),
+		recordLine("interface-id=eni-9f8e7d6c"),
+		recordLine("interface-id=eni-2", "action=REJECT"),
+		// REJECT appears, but not as a whole field
+		recordLine("interface-id=eni-REJECTED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("%d records kept, want the 2 matching LINE_REGEX", len(records))
+	}
+	if records[0].Get("interface-id") != "eni-0a1b2c3d" || records[1].Get("action") != "REJECT" {
+		t.Errorf("kept %s and %s", records[0].Raw, records[1].Raw)
+	}
+}
+
+func TestLineRegexFilterInvalidPattern(t *testing.T) {
+	if _, err := lineRegexFilter("eni-(unclosed"); err == nil {
+		t.Error("invalid LINE_REGEX compiled")
+	}
+}
+
+func TestMatchFieldValues(t *testing.T) {
+	matchAllSources(t)
+	for _, test := range []struct {
+		field, values string
+		lines         []string
+		want          int
+	}{
+		{"dstport", "443, 8443", []string{recordLine("dstport=443"), recordLine("dstport=8443"), recordLine("dstport=80")}, 2},
+		{"action", "REJECT", []string{recordLine("action=ACCEPT"), recordLine("action=REJECT"), recordLine("action=ACCEPT")}, 1},
+	} {
+		t.Run(test.field, func(t *testing.T) {
+			setForTest(t, &matchField, test.field)
+			setForTest(t, &matchValues, test.values)
+			setForTest(t, &recordFilters, newRecordFilters())
+
+			records, _, err := filterLines(t, test.lines...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != test.want {
+				t.Fatalf("%d records kept, want %d with %s in %s", len(records), test.want, test.field, test.values)
+			}
+			for _, record := range records {
+				if !strings.Contains(test.values, record.Get(test.field)) {
+					t.Errorf("kept %s with %s %s", record.Raw, test.field, record.Get(test.field))
+				}
+			}
+		})
+	}
+}
+
+func TestMatchFieldValidation(t *testing.T) {
+	if _, err := fieldValuesFilter("no-such-field", "1"); err == nil {
+		t.Error("unknown MATCH_FIELD accepted")
+	}
+	if _, err := fieldValuesFilter("dstport", ""); err == nil {
+		t.Error("MATCH_FIELD without MATCH_VALUES accepted")
+	}
+}
+
+func TestServiceNamePorts(t *testing.T) {
+	ranges, err := parsePortRanges("https, SSH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0] != (portRange{443, 443}) || ranges[1] != (portRange{22, 22}) {
+		t.Fatalf("https, SSH expanded to %v, want 443 and 22", ranges)
+	}
+
+	filter, err := portFilter("dstport", "https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter(parseTestRecord(t, recordLine("dstport=443"))) || filter(parseTestRecord(t, recordLine("dstport=80"))) {
+		t.Error("DST_PORTS=https does not match port 443 only")
+	}
+
+	if _, err := parsePortRanges("no-such-service"); err == nil {
+		t.Error("unknown service name accepted")
+	}
+}
+
+func TestServicesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services")
+	services := "# Network services\n" +
+		"ssh             22/tcp\n" +
+		"gopher          70/tcp          # Internet Gopher\n" +
+		"ms-wbt-server   3389/tcp        rdp-alt\n" +
+		"broken          notaport/tcp\n"
+	if err := os.WriteFile(path, []byte(services), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := loadServicePorts(map[string]int{"ssh": 2222}, path)
+	for name, want := range map[string]int{"gopher": 70, "ms-wbt-server": 3389, "rdp-alt": 3389, "ssh": 2222} {
+		if ports[name] != want {
+			t.Errorf("%s is port %d, want %d", name, ports[name], want)
+		}
+	}
+	if _, ok := ports["broken"]; ok {
+		t.Error("service with an invalid port loaded")
+	}
+}
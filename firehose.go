@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+)
+
+// PutRecordBatch limits
+const (
+	firehoseMaxBatchRecords = 500
+	firehoseMaxBatchBytes   = 4 * 1024 * 1024
+	firehoseMaxRecordBytes  = 1000 * 1024
+	firehoseMaxAttempts     = 5
+)
+
+// firehoseWriter sends matched records to a Kinesis Data Firehose delivery stream. Records are
+// serialized in the configured output format (one record per line) and sent in PutRecordBatch
+// calls of up to 500 records / 4MB.
+type firehoseWriter struct {
+	client     firehoseiface.FirehoseAPI
+	streamName string
+
+	serialized *bytes.Buffer
+	serializer recordWriter
+
+	batch      []*firehose.Record
+	batchBytes int
+}
+
+func newFirehoseWriter(client firehoseiface.FirehoseAPI, streamName string) (*firehoseWriter, error) {
+	if streamName == "" {
+		return nil, fmt.Errorf("OUTPUT_SINK=firehose requires FIREHOSE_STREAM")
+	}
+
+	serialized := &bytes.Buffer{}
+	serializer, err := newRecordWriter(outputFormat, serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	return &firehoseWriter{client: client, streamName: streamName, serialized: serialized, serializer: serializer}, nil
+}
+
+func (f *firehoseWriter) Write(vpcLog *VPCFlowLog) error {
+	f.serialized.Reset()
+	if err := f.serializer.Write(vpcLog); err != nil {
+		return err
+	}
+	if err := f.serializer.Flush(); err != nil {
+		return err
+	}
+
+	data := append([]byte(nil), f.serialized.Bytes()...)
+	if len(data) > firehoseMaxRecordBytes {
+		return fmt.Errorf("Record of %d bytes exceeds the Firehose record size limit", len(data))
+	}
+
+	if len(f.batch) == firehoseMaxBatchRecords || f.batchBytes+len(data) > firehoseMaxBatchBytes {
+		if err := f.flush(); err != nil {
+			return err
+		}
+	}
+	f.batch = append(f.batch, &firehose.Record{Data: data})
+	f.batchBytes += len(data)
+	return nil
+}
+
+// flush sends the current batch. PutRecordBatch can partially fail (e.g. throttling), reporting
+// an error code per record, so the failed records are retried with backoff until they all succeed
+// or the attempts run out.
+func (f *firehoseWriter) flush() error {
+	records := f.batch
+	f.batch, f.batchBytes = nil, 0
+
+	for attempt := 1; len(records) > 0; attempt++ {
+		output, err := f.client.PutRecordBatch(&firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(f.streamName),
+			Records:            records,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to put records to Firehose stream %s: %v", f.streamName, err)
+		}
+		if aws.Int64Value(output.FailedPutCount) == 0 {
+			return nil
+		}
+
+		var failed []*firehose.Record
+		for i, response := range output.RequestResponses {
+			if response.ErrorCode != nil {
+				failed = append(failed, records[i])
+			}
+		}
+		if attempt == firehoseMaxAttempts {
+			return fmt.Errorf("%d records could not be put to Firehose stream %s after %d attempts", len(failed), f.streamName, attempt)
+		}
+
+		log.Printf("Retrying %d records that failed to put to Firehose stream %s\n", len(failed), f.streamName)
+		time.Sleep(time.Duration(1<<uint(attempt-1)) * 100 * time.Millisecond)
+		records = failed
+	}
+	return nil
+}
+
+func (f *firehoseWriter) Flush() error {
+	return f.flush()
+}
+
+func (f *firehoseWriter) Close() error {
+	return f.flush()
+}
+
+// Objects is empty - Firehose decides which objects the records end up in
+func (f *firehoseWriter) Objects() []outputObject {
+	return nil
+}
+
+// Abort drops the unsent batch. Records already sent cannot be recalled.
+func (f *firehoseWriter) Abort(err error) error {
+	f.batch, f.batchBytes = nil, 0
+	return err
+}
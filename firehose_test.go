@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+)
+
+// fakeFirehose records PutRecordBatch calls. failFirst, when set, is how many leading records of
+// the first call fail.
+type fakeFirehose struct {
+	firehoseiface.FirehoseAPI
+	batches   [][]string
+	failFirst int
+}
+
+func (f *fakeFirehose) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	var batch []string
+	output := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int64(0)}
+	for i, record := range input.Records {
+		batch = append(batch, string(record.Data))
+		response := &firehose.PutRecordBatchResponseEntry{RecordId: aws.String("id")}
+		if len(f.batches) == 0 && i < f.failFirst {
+			response = &firehose.PutRecordBatchResponseEntry{ErrorCode: aws.String("ServiceUnavailableException")}
+			*output.FailedPutCount++
+		}
+		output.RequestResponses = append(output.RequestResponses, response)
+	}
+	f.batches = append(f.batches, batch)
+	return output, nil
+}
+
+func TestFirehoseWriterBatchesRecords(t *testing.T) {
+	client := &fakeFirehose{}
+	writer, err := newFirehoseWriter(client, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1201; i++ {
+		if err := writer.Write(testFlowLog(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.batches) != 3 || len(client.batches[0]) != 500 || len(client.batches[1]) != 500 || len(client.batches[2]) != 201 {
+		t.Fatalf("sent batches of %v records, want 500, 500 and 201", batchSizes(client.batches))
+	}
+}
+
+func TestFirehoseWriterRetriesFailedRecords(t *testing.T) {
+	client := &fakeFirehose{failFirst: 2}
+	writer, err := newFirehoseWriter(client, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srcAddr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := writer.Write(parseTestRecord(t, flowLogLine("eni-1", srcAddr, "8.8.8.8"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.batches) != 2 || len(client.batches[1]) != 2 {
+		t.Fatalf("sent batches of %v records, want the 2 failed records retried", batchSizes(client.batches))
+	}
+	if client.batches[1][0] != client.batches[0][0] || client.batches[1][1] != client.batches[0][1] {
+		t.Errorf("retried %q, want the first two records", client.batches[1])
+	}
+}
+
+func batchSizes(batches [][]string) []int {
+	var sizes []int
+	for _, batch := range batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
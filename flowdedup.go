@@ -0,0 +1,71 @@
+package main
+
+import "log"
+
+const (
+	flowDedupNone  = "none"
+	flowDedupFirst = "first"
+	flowDedupLast  = "last"
+)
+
+// flowDedupWriter keeps a single record per flow (FLOW_DEDUP) - the first or the last one written
+// with the flow's 5-tuple (see flowID) - for flows reported once per aggregation window. The first
+// record of a flow is passed on as it comes; the last one can only be known at the end, so with
+// "last" the latest record of every flow is held in memory and the records are written by Close,
+// in the order their flows first appeared.
+type flowDedupWriter struct {
+	outputWriter
+	mode string
+
+	seen    map[string]bool
+	latest  map[string]*VPCFlowLog
+	flows   []string
+	dropped int
+}
+
+func newFlowDedupWriter(writer outputWriter, mode string) *flowDedupWriter {
+	return &flowDedupWriter{outputWriter: writer, mode: mode, seen: map[string]bool{}, latest: map[string]*VPCFlowLog{}}
+}
+
+func (f *flowDedupWriter) Write(vpcLog *VPCFlowLog) error {
+	flow := flowID(vpcLog)
+	if f.mode == flowDedupFirst {
+		if f.seen[flow] {
+			f.dropped++
+			return nil
+		}
+		f.seen[flow] = true
+		return f.outputWriter.Write(vpcLog)
+	}
+
+	if _, ok := f.latest[flow]; ok {
+		f.dropped++
+	} else {
+		f.flows = append(f.flows, flow)
+	}
+	f.latest[flow] = vpcLog
+	return nil
+}
+
+// Close writes the held records (with "last") before closing the output
+func (f *flowDedupWriter) Close() error {
+	for _, flow := range f.flows {
+		if err := f.outputWriter.Write(f.latest[flow]); err != nil {
+			return f.outputWriter.Abort(err)
+		}
+	}
+	f.flows, f.latest = nil, nil
+	return f.outputWriter.Close()
+}
+
+func parseFlowDedup(mode string) string {
+	switch mode {
+	case "", flowDedupNone:
+		return flowDedupNone
+	case flowDedupFirst, flowDedupLast:
+		return mode
+	default:
+		log.Fatalf("FLOW_DEDUP %s not supported - expected one of first, last, none", mode)
+		return ""
+	}
+}
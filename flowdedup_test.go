@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestFlowDedup(t *testing.T) {
+	// Two flows reported over three aggregation windows, and a flow differing only in srcport
+	lines := []string{
+		recordLine("srcport=1111", "packets=1", "start=1700000000"),
+		recordLine("srcport=2222", "packets=5", "start=1700000000"),
+		recordLine("srcport=1111", "packets=2", "start=1700000060"),
+		recordLine("srcport=3333", "packets=9", "start=1700000060"),
+		recordLine("srcport=1111", "packets=3", "start=1700000120"),
+		recordLine("srcport=2222", "packets=6", "start=1700000120"),
+	}
+
+	for mode, want := range map[string][]string{
+		flowDedupNone:  {"1111/1", "2222/5", "1111/2", "3333/9", "1111/3", "2222/6"},
+		flowDedupFirst: {"1111/1", "2222/5", "3333/9"},
+		// In the order the flows first appeared
+		flowDedupLast: {"1111/3", "2222/6", "3333/9"},
+	} {
+		t.Run(mode, func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			matchAllSources(t)
+			setForTest(t, &sourceBucketName, "src")
+			setForTest(t, &destBucketName, "dest/out.log")
+			setForTest(t, &flowDedup, mode)
+			fake.put("src", "in.log", strings.Join(lines, "\n")+"\n")
+
+			result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, _ := fake.get("dest", "out.log")
+			var got []string
+			for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+				record := parseTestRecord(t, line)
+				got = append(got, record.Get("srcport")+"/"+record.Get("packets"))
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("kept %v, want %v", got, want)
+			}
+			if result.DuplicateFlows != len(lines)-len(want) {
+				t.Errorf("duplicateFlows = %d, want %d", result.DuplicateFlows, len(lines)-len(want))
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// flowDeltaWriter adds the change in bytes and packets since the previous record of the same flow
+// (bytesDelta, packetsDelta) to every record (FLOW_DELTAS), for flows reported over several
+// aggregation windows, and drops the records whose deltas are under FLOW_DELTA_MIN_BYTES or
+// FLOW_DELTA_MIN_PACKETS - keeping the windows where a flow bursts. Only the thresholds that are
+// set are compared, so deltas that go down are kept without them. Deltas need every record of a
+// flow in time order, so all records are held in memory and written by Close: grouped by flow in
+// the order the flows first appeared, and sorted by start (then end) within each flow. The first
+// record of a flow has no previous one; its deltas are "-" and it is only kept without thresholds.
+type flowDeltaWriter struct {
+	outputWriter
+	minBytes, minPackets int64
+
+	records map[string][]*VPCFlowLog
+	flows   []string
+	dropped int
+}
+
+func newFlowDeltaWriter(writer outputWriter, minBytes, minPackets int64) *flowDeltaWriter {
+	return &flowDeltaWriter{outputWriter: writer, minBytes: minBytes, minPackets: minPackets, records: map[string][]*VPCFlowLog{}}
+}
+
+func (f *flowDeltaWriter) Write(vpcLog *VPCFlowLog) error {
+	flow := flowID(vpcLog)
+	if _, ok := f.records[flow]; !ok {
+		f.flows = append(f.flows, flow)
+	}
+	f.records[flow] = append(f.records[flow], vpcLog)
+	return nil
+}
+
+// Close computes the deltas and writes the records over the thresholds before closing the output
+func (f *flowDeltaWriter) Close() error {
+	for _, flow := range f.flows {
+		records := f.records[flow]
+		sort.SliceStable(records, func(i, j int) bool {
+			iStart, jStart := recordTime(records[i], "start"), recordTime(records[j], "start")
+			if iStart != jStart {
+				return iStart < jStart
+			}
+			return recordTime(records[i], "end") < recordTime(records[j], "end")
+		})
+
+		for i, vpcLog := range records {
+			if i == 0 {
+				vpcLog.Set("bytesDelta", "-")
+				vpcLog.Set("packetsDelta", "-")
+				if f.minBytes > 0 || f.minPackets > 0 {
+					f.dropped++
+					continue
+				}
+			} else {
+				bytesDelta := recordCount(vpcLog, "bytes") - recordCount(records[i-1], "bytes")
+				packetsDelta := recordCount(vpcLog, "packets") - recordCount(records[i-1], "packets")
+				vpcLog.Set("bytesDelta", strconv.FormatInt(bytesDelta, 10))
+				vpcLog.Set("packetsDelta", strconv.FormatInt(packetsDelta, 10))
+				if f.minBytes > 0 && bytesDelta < f.minBytes || f.minPackets > 0 && packetsDelta < f.minPackets {
+					f.dropped++
+					continue
+				}
+			}
+
+			if err := f.outputWriter.Write(vpcLog); err != nil {
+				return f.outputWriter.Abort(err)
+			}
+		}
+	}
+	f.flows, f.records = nil, nil
+	return f.outputWriter.Close()
+}
+
+// recordTime returns a record's start or end time, with records without one sorting first
+func recordTime(vpcLog *VPCFlowLog, field string) int64 {
+	value, err := strconv.ParseInt(vpcLog.Get(field), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// recordCount returns a record's bytes or packets, counting "-" and invalid values as zero
+func recordCount(vpcLog *VPCFlowLog, field string) int64 {
+	count, err := parseCount(vpcLog.Get(field))
+	if err != nil {
+		return 0
+	}
+	return count
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestFlowDeltasForTwoRecordFlow(t *testing.T) {
+	sink := &fakeSink{}
+	writer := newFlowDeltaWriter(sink, 0, 0)
+
+	// The later window of the flow arrives first, and another flow is interleaved
+	for _, line := range []string{
+		recordLine("srcport=1111", "packets=25", "bytes=30000", "start=1700000060", "end=1700000120"),
+		recordLine("srcport=2222", "packets=1", "bytes=40"),
+		recordLine("srcport=1111", "packets=10", "bytes=840", "start=1700000000", "end=1700000060"),
+	} {
+		if err := writer.Write(parseTestRecord(t, line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.records) != 0 {
+		t.Fatalf("%d records written before Close", len(sink.records))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, record := range sink.records {
+		got = append(got, strings.Join([]string{record.Get("srcport"), record.Get("start"), record.Get("bytesDelta"), record.Get("packetsDelta")}, "/"))
+	}
+	want := []string{"1111/1700000000/-/-", "1111/1700000060/29160/15", "2222/1700000000/-/-"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("wrote %v, want %v", got, want)
+	}
+	if !sink.closed {
+		t.Error("output not closed")
+	}
+}
+
+func TestFlowDeltaThresholds(t *testing.T) {
+	lines := []string{
+		recordLine("packets=10", "bytes=1000", "start=1700000000"),
+		recordLine("packets=12", "bytes=1200", "start=1700000060"),  // +200 bytes, +2 packets
+		recordLine("packets=40", "bytes=60000", "start=1700000120"), // burst
+		recordLine("packets=41", "bytes=60100", "start=1700000180"), // +100 bytes, +1 packet
+	}
+	for _, test := range []struct {
+		name                 string
+		minBytes, minPackets int64
+		want                 []string
+	}{
+		{"bytes", 10000, 0, []string{"1700000120"}},
+		{"packets", 0, 2, []string{"1700000060", "1700000120"}},
+		{"both", 150, 2, []string{"1700000060", "1700000120"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &fakeSink{}
+			writer := newFlowDeltaWriter(sink, test.minBytes, test.minPackets)
+			for _, line := range lines {
+				writer.Write(parseTestRecord(t, line))
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var kept []string
+			for _, record := range sink.records {
+				kept = append(kept, record.Get("start"))
+			}
+			if strings.Join(kept, " ") != strings.Join(test.want, " ") {
+				t.Errorf("kept %v, want %v", kept, test.want)
+			}
+			// The first record of the flow has no delta and is dropped with thresholds
+			if writer.dropped != len(lines)-len(test.want) {
+				t.Errorf("dropped %d, want %d", writer.dropped, len(lines)-len(test.want))
+			}
+		})
+	}
+}
+
+func TestFlowDeltasGoingDown(t *testing.T) {
+	lines := []string{
+		recordLine("packets=40", "bytes=60000", "start=1700000000"),
+		recordLine("packets=12", "bytes=1200", "start=1700000060"),
+		// More bytes in fewer packets
+		recordLine("packets=10", "bytes=15000", "start=1700000120"),
+	}
+	for _, test := range []struct {
+		name                 string
+		minBytes, minPackets int64
+		want                 []string
+	}{
+		{"no thresholds", 0, 0, []string{"1700000000/-/-", "1700000060/-58800/-28", "1700000120/13800/-2"}},
+		{"bytes only", 10000, 0, []string{"1700000120/13800/-2"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &fakeSink{}
+			writer := newFlowDeltaWriter(sink, test.minBytes, test.minPackets)
+			for _, line := range lines {
+				writer.Write(parseTestRecord(t, line))
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, record := range sink.records {
+				got = append(got, record.Get("start")+"/"+record.Get("bytesDelta")+"/"+record.Get("packetsDelta"))
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("wrote %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlowDeltasInOutput(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.jsonl")
+	setForTest(t, &outputFormat, outputFormatJSON)
+	setForTest(t, &flowDeltas, true)
+	setForTest(t, &flowDeltaMinBytes, int64(1000))
+	fake.put("src", "in.log", strings.Join([]string{
+		recordLine("packets=10", "bytes=840", "start=1700000000"),
+		recordLine("packets=30", "bytes=24840", "start=1700000060"),
+	}, "\n")+"\n")
+
+	result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, _ := fake.get("dest", "out.jsonl")
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(output)), &record); err != nil {
+		t.Fatalf("output %q: %v", output, err)
+	}
+	if record["bytesDelta"] != "24000" || record["packetsDelta"] != "20" {
+		t.Errorf("output record %v, want bytesDelta 24000 and packetsDelta 20", record)
+	}
+	if result.BelowFlowDelta != 1 {
+		t.Errorf("belowFlowDelta = %d, want the flow's first record", result.BelowFlowDelta)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultLogFields are the fields of the default (version 2) VPC flow log format, in the order
+// they appear on each log line.
+var defaultLogFields = []string{
+	"version", "account-id", "interface-id", "srcaddr", "dstaddr", "srcport", "dstport",
+	"protocol", "packets", "bytes", "start", "end", "action", "log-status",
+}
+
+// versionLogFields are the default layouts of each flow log version when every field available
+// in that version is included: each version appends its new fields to the previous layout.
+var versionLogFields = map[string][]string{
+	"2": defaultLogFields,
+	"3": logFieldsV3,
+	"4": logFieldsV4,
+	"5": logFieldsV5,
+}
+
+var (
+	logFieldsV3 = append(append([]string{}, defaultLogFields...),
+		"vpc-id", "subnet-id", "instance-id", "tcp-flags", "type", "pkt-srcaddr", "pkt-dstaddr")
+	logFieldsV4 = append(append([]string{}, logFieldsV3...),
+		"region", "az-id", "sublocation-type", "sublocation-id")
+	logFieldsV5 = append(append([]string{}, logFieldsV4...),
+		"pkt-src-aws-service", "pkt-dst-aws-service", "flow-direction", "traffic-path")
+)
+
+// lineLogFields returns the field layout of a text log line. When the layout is detected from
+// the version field, lines of another version than the ones known, like the header line, fall
+// back to the configured layout.
+func lineLogFields(line string) []string {
+	if !detectLogVersion {
+		return logFields
+	}
+
+	version := line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		version = line[:i]
+	}
+	if fields, ok := versionLogFields[version]; ok {
+		return fields
+	}
+	return logFields
+}
+
+// defaultTGWLogFields are the fields of the default Transit Gateway flow log format
+var defaultTGWLogFields = []string{
+	"version", "resource-type", "account-id", "tgw-id", "tgw-attachment-id", "tgw-src-vpc-account-id",
+	"tgw-dst-vpc-account-id", "tgw-src-vpc-id", "tgw-dst-vpc-id", "tgw-src-subnet-id", "tgw-dst-subnet-id",
+	"tgw-src-eni", "tgw-dst-eni", "tgw-src-az-id", "tgw-dst-az-id", "tgw-pair-attachment-id", "srcaddr",
+	"dstaddr", "srcport", "dstport", "protocol", "packets", "bytes", "start", "end", "log-status", "type",
+	"packets-lost-no-route", "packets-lost-blackhole", "packets-lost-mtu-exceeded", "packets-lost-ttl-expired",
+	"tcp-flags", "region", "flow-direction", "pkt-src-aws-service", "pkt-dst-aws-service",
+}
+
+const (
+	logTypeVPC = "vpc"
+	logTypeTGW = "tgw"
+)
+
+var logFormatFieldRegexp = regexp.MustCompile(`^\$\{([a-z0-9-]+)\}$`)
+
+// parseLogFields returns the field layout of the log lines: the fields of a custom format string
+// when one is given (the "${field} ${field} ..." format used when creating the flow log), otherwise
+// the default layout for the log type.
+func parseLogFields(logType, logFormat string) []string {
+	if logFormat != "" {
+		var fields []string
+		for _, token := range strings.Fields(logFormat) {
+			match := logFormatFieldRegexp.FindStringSubmatch(token)
+			if match == nil {
+				log.Fatalf("LOG_FORMAT token %q is not a ${field-name} reference", token)
+			}
+			fields = append(fields, match[1])
+		}
+		return fields
+	}
+
+	switch logType {
+	case "", logTypeVPC:
+		return defaultLogFields
+	case logTypeTGW:
+		return defaultTGWLogFields
+	default:
+		log.Fatalf("LOG_TYPE %s not supported - expected one of vpc, tgw", logType)
+		return nil
+	}
+}
+
+// computedFields are the fields that can be added to a record while it is processed, on top of
+// those parsed from the log line
+var computedFields = []string{"flowId", "protocolName", "srcCountry", "dstCountry", "srcAsn", "dstAsn", "interfaceName", "timestampAnomaly", "srcHost", "dstHost", "sourceKey", "lineNumber", "bytesDelta", "packetsDelta"}
+
+// Field is a single named value of a flow log record
+type Field struct {
+	Name  string
+	Value string
+}
+
+// VPCFlowLog is a parsed flow log line. Fields keeps the values in the order of the log format,
+// followed by any fields added while processing the record (e.g. flowId), so that serialized
+// output has a stable field order.
+type VPCFlowLog struct {
+	Raw    string
+	Fields []Field
+}
+
+// parseVPCFlowLog splits a space-separated log line into fields named by fieldNames. Lines with
+// fewer values than names only get the fields that are present.
+func parseVPCFlowLog(line string, fieldNames []string) *VPCFlowLog {
+	values := strings.Split(line, " ")
+
+	vpcLog := &VPCFlowLog{Raw: line, Fields: make([]Field, 0, len(fieldNames))}
+	for i, name := range fieldNames {
+		if i >= len(values) {
+			break
+		}
+		vpcLog.Fields = append(vpcLog.Fields, Field{Name: name, Value: values[i]})
+	}
+
+	return vpcLog
+}
+
+const (
+	inputFormatText = "text"
+	inputFormatJSON = "json"
+)
+
+// numericLogFields are the fields that hold numbers, or "-" when a record has no data for them
+var numericLogFields = map[string]bool{
+	"version": true, "srcport": true, "dstport": true, "protocol": true, "packets": true, "bytes": true,
+	"start": true, "end": true, "tcp-flags": true, "traffic-path": true, "packets-lost-no-route": true,
+	"packets-lost-blackhole": true, "packets-lost-mtu-exceeded": true, "packets-lost-ttl-expired": true,
+}
+
+// parseRecord parses a source line in the configured INPUT_FORMAT
+func parseRecord(line string) (*VPCFlowLog, error) {
+	if inputFormat == inputFormatJSON {
+		return parseJSONVPCFlowLog(line, logFields)
+	}
+	return parseVPCFlowLog(line, lineLogFields(line)), nil
+}
+
+// parseJSONVPCFlowLog parses a record written as a JSON object keyed by field name (the format of
+// JSON output). Unlike text lines, JSON records are validated: every field of the log format has
+// to be present, numeric fields must be numbers (or numeric strings, or "-") and every other field
+// a string.
+func parseJSONVPCFlowLog(line string, fieldNames []string) (*VPCFlowLog, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %v", err)
+	}
+
+	vpcLog := &VPCFlowLog{Raw: line, Fields: make([]Field, 0, len(fieldNames))}
+	for _, name := range fieldNames {
+		raw, ok := record[name]
+		if !ok {
+			return nil, fmt.Errorf("Missing field %s", name)
+		}
+
+		var value string
+		switch v := raw.(type) {
+		case json.Number:
+			if !numericLogFields[name] {
+				return nil, fmt.Errorf("Field %s must be a string, got %s", name, v)
+			}
+			value = v.String()
+		case string:
+			if numericLogFields[name] && v != "-" {
+				if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+					return nil, fmt.Errorf("Field %s must be a number, got %q", name, v)
+				}
+			}
+			value = v
+		default:
+			return nil, fmt.Errorf("Field %s has unexpected type %T", name, raw)
+		}
+		vpcLog.Fields = append(vpcLog.Fields, Field{Name: name, Value: value})
+	}
+
+	return vpcLog, nil
+}
+
+// Get returns the value of the named field, or "" if the record does not have it
+func (l *VPCFlowLog) Get(name string) string {
+	for _, field := range l.Fields {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Set updates the named field, appending it to the record if it does not exist yet
+func (l *VPCFlowLog) Set(name, value string) {
+	for i := range l.Fields {
+		if l.Fields[i].Name == name {
+			l.Fields[i].Value = value
+			return
+		}
+	}
+	l.Fields = append(l.Fields, Field{Name: name, Value: value})
+}
+
+// isKnownField reports whether name is a field of the log format (of any version, when it is
+// detected) or a computed field
+func isKnownField(name string) bool {
+	known := logFields
+	if detectLogVersion {
+		known = logFieldsV5
+	}
+	for _, fields := range [][]string{known, computedFields} {
+		for _, field := range fields {
+			if field == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isComputedField reports whether the field is added by the function rather than read from the log
+func isComputedField(name string) bool {
+	for _, field := range computedFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// flowID is a stable identifier for the flow's 5-tuple (srcaddr, dstaddr, srcport, dstport,
+// protocol) - the first 16 hex characters of its SHA-256 - so the same flow can be correlated
+// across tools and output files.
+func flowID(l *VPCFlowLog) string {
+	tuple := strings.Join([]string{
+		l.Get("srcaddr"), l.Get("dstaddr"), l.Get("srcport"), l.Get("dstport"), l.Get("protocol"),
+	}, "|")
+
+	sum := sha256.Sum256([]byte(tuple))
+	return hex.EncodeToString(sum[:8])
+}
+
+func parseInputFormat(format string) string {
+	switch format {
+	case "", inputFormatText:
+		return inputFormatText
+	case inputFormatJSON:
+		return inputFormatJSON
+	default:
+		log.Fatalf("INPUT_FORMAT %s not supported - expected one of text, json", format)
+		return ""
+	}
+}
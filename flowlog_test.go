@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFlowIDIdentifiesTheTuple(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &addFlowID, true)
+
+	records, _, err := filterLines(t,
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		// Same 5-tuple on another interface
+		flowLogLine("eni-2", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-1", "10.0.0.1", "8.8.4.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, same, other := records[0].Get("flowId"), records[1].Get("flowId"), records[2].Get("flowId")
+	if len(first) != 16 {
+		t.Fatalf("flowId %q is not 16 hex characters", first)
+	}
+	if first != same {
+		t.Errorf("identical tuples have flowIds %q and %q", first, same)
+	}
+	if first == other {
+		t.Errorf("different tuples share flowId %q", first)
+	}
+}
+
+// tgwFlowLogLine is a Transit Gateway record in the default TGW format
+func tgwFlowLogLine(srcAddr, dstAddr string) string {
+	return "6 TransitGateway 123456789012 tgw-1 tgw-attach-1 123456789012 210987654321 vpc-1 vpc-2 subnet-1 subnet-2 " +
+		"eni-1 eni-2 use1-az1 use1-az2 tgw-attach-2 " + srcAddr + " " + dstAddr + " 1234 443 6 10 840 1700000000 1700000060 OK IPv4 " +
+		"0 0 0 0 2 us-east-1 egress - -"
+}
+
+func TestTGWLogsFilterBySrcaddr(t *testing.T) {
+	rules, err := parseSourceRules("test", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+	setForTest(t, &logFields, parseLogFields(logTypeTGW, ""))
+	setForTest(t, &detectLogVersion, false)
+
+	records, result, err := filterLines(t,
+		tgwFlowLogLine("10.0.0.1", "8.8.8.8"),
+		tgwFlowLogLine("192.168.0.1", "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LinesScanned != 2 || len(records) != 1 {
+		t.Fatalf("%d of %d TGW lines matched, want 1 of 2", len(records), result.LinesScanned)
+	}
+	if got := records[0].Get("srcaddr"); got != "10.0.0.1" {
+		t.Errorf("matched srcaddr %s", got)
+	}
+	if got := records[0].Get("tgw-attachment-id"); got != "tgw-attach-1" {
+		t.Errorf("tgw-attachment-id %q", got)
+	}
+	if got := records[0].Get("packets-lost-no-route"); got != "0" {
+		t.Errorf("packets-lost-no-route %q", got)
+	}
+}
+
+func TestCustomTGWFormat(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &logFields, parseLogFields(logTypeTGW, "${tgw-id} ${srcaddr} ${dstaddr} ${packets-lost-blackhole}"))
+	setForTest(t, &detectLogVersion, false)
+
+	records, _, err := filterLines(t, "tgw-1 10.0.0.1 8.8.8.8 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Get("tgw-id") != "tgw-1" || records[0].Get("packets-lost-blackhole") != "3" {
+		t.Fatalf("custom TGW format parsed as %v", records)
+	}
+}
+
+// jsonRecordLine returns testFlowLogLine as a JSON record, with fields overridden by the given
+// values (nil removes a field)
+func jsonRecordLine(t *testing.T, overrides map[string]interface{}) string {
+	t.Helper()
+	record := map[string]interface{}{}
+	for name, value := range testRecordDefaults {
+		record[name] = value
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(record, name)
+			continue
+		}
+		record[name] = value
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line)
+}
+
+func TestJSONInputValidation(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &inputFormat, inputFormatJSON)
+	setForTest(t, &detectLogVersion, false)
+	setForTest(t, &quarantineInvalidRecords, true)
+
+	malformed := []string{
+		`{"version": "2", "srcaddr": `,
+		jsonRecordLine(t, map[string]interface{}{"srcaddr": nil}),
+		jsonRecordLine(t, map[string]interface{}{"bytes": "lots"}),
+		jsonRecordLine(t, map[string]interface{}{"action": 1}),
+	}
+	lines := append([]string{
+		jsonRecordLine(t, nil),
+		jsonRecordLine(t, map[string]interface{}{"bytes": 840, "srcaddr": "10.0.0.2"}),
+	}, malformed...)
+
+	writer := &recordingWriter{}
+	runSummaries := newSummaries()
+	locate := func(line int) (sourceObject, int) { return sourceObject{Bucket: "src", Key: "in.jsonl"}, line }
+	result, _, err := filterVPCLogs(context.Background(), strings.NewReader(strings.Join(lines, "\n")+"\n"), locate, writer, nil, nil, runSummaries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(writer.records) != 2 || result.InvalidRecords != len(malformed) {
+		t.Fatalf("%d valid and %d invalid records, want 2 and %d", len(writer.records), result.InvalidRecords, len(malformed))
+	}
+	if quarantined := runSummaries.invalid.String(); quarantined != strings.Join(malformed, "\n")+"\n" {
+		t.Errorf("quarantined %q", quarantined)
+	}
+}
+
+func TestMixedVersionLinesDetected(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &detectLogVersion, true)
+	setForTest(t, &logFields, defaultLogFields)
+
+	records, result, err := filterLines(t,
+		testFlowLogLine,
+		v5FlowLogLine("10.0.0.5", "2"),
+		flowLogLine("eni-2", "10.0.0.2", "8.8.4.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || result.InvalidRecords != 0 {
+		t.Fatalf("%d of 3 mixed-version lines parsed", len(records))
+	}
+
+	v2, v5 := records[0], records[1]
+	if len(v2.Fields) != len(defaultLogFields) || v2.Get("log-status") != "OK" {
+		t.Errorf("v2 line parsed as %v", v2.Fields)
+	}
+	if len(v5.Fields) != len(logFieldsV5) || v5.Get("srcaddr") != "10.0.0.5" || v5.Get("tcp-flags") != "2" || v5.Get("flow-direction") != "egress" {
+		t.Errorf("v5 line parsed as %v", v5.Fields)
+	}
+}
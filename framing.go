@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+const (
+	inputFramingNewline          = "newline"
+	inputFramingLengthPrefixed   = "length-prefixed"
+	inputFramingConcatenatedJSON = "concatenated-json"
+)
+
+// maxFramedRecordSize is the largest record Firehose accepts (1,000 KiB), so any length prefix
+// above it means the stream is not in the framing it was configured with
+const maxFramedRecordSize = 1000 * 1024
+
+// recordReader splits the decompressed source stream into records (log lines)
+type recordReader interface {
+	ReadRecord() ([]byte, error)
+}
+
+// newRecordReader returns a reader for the INPUT_FRAMING of the source files. Files written by S3
+// flow log delivery, and Firehose streams with a newline delimiter, are newline-delimited; Firehose
+// streams without one deliver records back to back, which are split by a 4-byte big-endian length
+// prefix ("length-prefixed", as written by producers that frame their own records) or, for JSON
+// records, at the end of each JSON value ("concatenated-json").
+func newRecordReader(r io.Reader) recordReader {
+	switch inputFraming {
+	case inputFramingLengthPrefixed:
+		return &lengthPrefixedReader{r: bufio.NewReader(r)}
+	case inputFramingConcatenatedJSON:
+		return &concatenatedJSONReader{decoder: json.NewDecoder(r)}
+	default:
+		return &lineReader{r: bufio.NewReader(r)}
+	}
+}
+
+type lineReader struct {
+	r *bufio.Reader
+}
+
+// ReadRecord returns the next line without its line ending. ReadLine only drops a "\r" directly
+// before the "\n", so carriage returns left over from files mixing endings (a last line ending in
+// a bare "\r", or "\r\r\n" from converting twice) are trimmed too, keeping them out of the last field.
+func (l *lineReader) ReadRecord() ([]byte, error) {
+	line, _, err := l.r.ReadLine()
+	return bytes.TrimRight(line, "\r"), err
+}
+
+type lengthPrefixedReader struct {
+	r *bufio.Reader
+}
+
+func (l *lengthPrefixedReader) ReadRecord() ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(l.r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > maxFramedRecordSize {
+		return nil, fmt.Errorf("Record length prefix %d is over the %d byte Firehose record limit", size, maxFramedRecordSize)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(l.r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	// Producers often end each record with a newline of its own
+	return bytes.TrimRight(record, "\r\n"), nil
+}
+
+type concatenatedJSONReader struct {
+	decoder *json.Decoder
+}
+
+func (c *concatenatedJSONReader) ReadRecord() ([]byte, error) {
+	var record json.RawMessage
+	if err := c.decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func parseInputFraming(framing string) string {
+	switch framing {
+	case "":
+		return inputFramingNewline
+	case inputFramingNewline, inputFramingLengthPrefixed, inputFramingConcatenatedJSON:
+		return framing
+	default:
+		log.Fatalf("INPUT_FRAMING %s not supported - expected one of newline, length-prefixed, concatenated-json", framing)
+		return ""
+	}
+}
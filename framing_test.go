@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readRecords reads every record from the stream in the given framing
+func readRecords(t *testing.T, framing string, stream []byte) []string {
+	t.Helper()
+	setForTest(t, &inputFraming, framing)
+
+	var records []string
+	reader := newRecordReader(bytes.NewReader(stream))
+	for {
+		record, err := reader.ReadRecord()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("ReadRecord: %v", err)
+		}
+		records = append(records, string(record))
+	}
+}
+
+func TestLengthPrefixedFraming(t *testing.T) {
+	want := []string{
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-2", "10.0.0.2", "8.8.4.4"),
+		flowLogLine("eni-3", "10.0.0.3", "1.1.1.1"),
+	}
+
+	// Firehose delivers the records back to back; the second ends with a newline of its own
+	var stream bytes.Buffer
+	for i, line := range want {
+		if i == 1 {
+			line += "\n"
+		}
+		binary.Write(&stream, binary.BigEndian, uint32(len(line)))
+		stream.WriteString(line)
+	}
+
+	got := readRecords(t, inputFramingLengthPrefixed, stream.Bytes())
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("records %q, want %q", got, want)
+	}
+}
+
+func TestLengthPrefixedFramingTruncated(t *testing.T) {
+	setForTest(t, &inputFraming, inputFramingLengthPrefixed)
+
+	var stream bytes.Buffer
+	binary.Write(&stream, binary.BigEndian, uint32(100))
+	stream.WriteString("short")
+
+	if _, err := newRecordReader(&stream).ReadRecord(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated record: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestLengthPrefixedFramingOversizedPrefix(t *testing.T) {
+	setForTest(t, &inputFraming, inputFramingLengthPrefixed)
+
+	var stream bytes.Buffer
+	binary.Write(&stream, binary.BigEndian, uint32(maxFramedRecordSize+1))
+
+	if _, err := newRecordReader(&stream).ReadRecord(); err == nil || err == io.ErrUnexpectedEOF {
+		t.Errorf("oversized length prefix: got %v, want a framing error", err)
+	}
+}
+
+func TestConcatenatedJSONFraming(t *testing.T) {
+	stream := `{"srcaddr":"10.0.0.1","dstport":443}{"srcaddr":"10.0.0.2",` + "\n" + `"dstport":53} {"srcaddr":"10.0.0.3"}`
+	want := []string{
+		`{"srcaddr":"10.0.0.1","dstport":443}`,
+		`{"srcaddr":"10.0.0.2",` + "\n" + `"dstport":53}`,
+		`{"srcaddr":"10.0.0.3"}`,
+	}
+
+	got := readRecords(t, inputFramingConcatenatedJSON, []byte(stream))
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("records %q, want %q", got, want)
+	}
+}
+
+func TestNewlineFramingTrimsCarriageReturns(t *testing.T) {
+	got := readRecords(t, inputFramingNewline, []byte("a\r\nb\r\r\nc\r"))
+	if want := []string{"a", "b", "c"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("records %q, want %q", got, want)
+	}
+}
+
+func TestMixedLineEndingsKeepFieldsClean(t *testing.T) {
+	matchAllSources(t)
+	// Objects concatenated from sources with different line endings
+	records, result, err := filterLines(t,
+		recordLine("srcaddr=10.0.0.1")+"\r",
+		recordLine("srcaddr=10.0.0.2"),
+		recordLine("srcaddr=10.0.0.3")+"\r\r",
+		recordLine("srcaddr=10.0.0.4"),
+		recordLine("srcaddr=10.0.0.5")+"\r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || result.InvalidRecords != 0 {
+		t.Fatalf("kept %d of 5 records, %d invalid", len(records), result.InvalidRecords)
+	}
+	for _, record := range records {
+		if status := record.Get("log-status"); status != "OK" {
+			t.Errorf("record from %s has log-status %q", record.Get("srcaddr"), status)
+		}
+	}
+}
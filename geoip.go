@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPTransformer adds the country (srcCountry, dstCountry) and autonomous system number
+// (srcAsn, dstAsn) of a record's addresses, looked up in MaxMind GeoLite2 databases. Private and
+// other non-public addresses, and addresses missing from the databases, get "-".
+type geoIPTransformer struct {
+	countryDB *maxminddb.Reader
+	asnDB     *maxminddb.Reader
+}
+
+var (
+	geoIPMu sync.Mutex
+	geoIP   *geoIPTransformer
+)
+
+// geoIPTransformerFromConfig loads GEOIP_DB_PATH and GEOIP_ASN_DB_PATH the first time it is called,
+// so the databases are read once per container rather than once per invocation. A load that fails
+// is not kept, so the next invocation tries again.
+func geoIPTransformerFromConfig() (*geoIPTransformer, error) {
+	geoIPMu.Lock()
+	defer geoIPMu.Unlock()
+	if geoIP != nil {
+		return geoIP, nil
+	}
+
+	transformer := &geoIPTransformer{}
+	var err error
+	if geoIPDBPath != "" {
+		if transformer.countryDB, err = openGeoIPDB(geoIPDBPath); err != nil {
+			return nil, err
+		}
+	}
+	if geoIPASNDBPath != "" {
+		if transformer.asnDB, err = openGeoIPDB(geoIPASNDBPath); err != nil {
+			if transformer.countryDB != nil {
+				transformer.countryDB.Close()
+			}
+			return nil, err
+		}
+	}
+	geoIP = transformer
+	return geoIP, nil
+}
+
+// openGeoIPDB reads an MMDB database from a local path (e.g. a Lambda layer under /opt) or an
+// "s3://bucket/key" URL
+func openGeoIPDB(path string) (*maxminddb.Reader, error) {
+	if !strings.HasPrefix(path, "s3://") {
+		return maxminddb.Open(path)
+	}
+
+	bucket, key, err := parseBucketAndKeyFromFilePath(strings.TrimPrefix(path, "s3://"))
+	if err != nil {
+		return nil, err
+	}
+	sourceS3Client, _, err := getS3Clients()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := sourceS3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download GeoIP database %s: %v", path, err)
+	}
+	defer object.Body.Close()
+
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download GeoIP database %s: %v", path, err)
+	}
+	return maxminddb.FromBytes(data)
+}
+
+// geoIPLazyTransformer defers loading the databases until a record needs them, so a bad
+// database path fails the run rather than the container's startup
+type geoIPLazyTransformer struct{}
+
+func (geoIPLazyTransformer) Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	transformer, err := geoIPTransformerFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return transformer.Transform(vpcLog)
+}
+
+func (g *geoIPTransformer) Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	for _, side := range []string{"src", "dst"} {
+		country, asn, err := g.lookup(vpcLog.Get(side + "addr"))
+		if err != nil {
+			return nil, err
+		}
+		vpcLog.Set(side+"Country", country)
+		vpcLog.Set(side+"Asn", asn)
+	}
+	return vpcLog, nil
+}
+
+func (g *geoIPTransformer) lookup(addr string) (string, string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || !isPublicIP(ip) {
+		return "-", "-", nil
+	}
+
+	country, asn := "-", "-"
+	if g.countryDB != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := g.countryDB.Lookup(ip, &record); err != nil {
+			return "", "", err
+		}
+		if record.Country.ISOCode != "" {
+			country = record.Country.ISOCode
+		}
+	}
+	if g.asnDB != nil {
+		var record struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		if err := g.asnDB.Lookup(ip, &record); err != nil {
+			return "", "", err
+		}
+		if record.ASN != 0 {
+			asn = strconv.FormatUint(uint64(record.ASN), 10)
+		}
+	}
+	return country, asn, nil
+}
+
+// isPublicIP reports whether ip can have geo data - private, loopback, link-local and other
+// special-purpose addresses cannot
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified())
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbEncode encodes a value in the MaxMind DB data format. Only the types the test databases use
+// are supported: strings, maps, arrays, uint16 and uint32 (as uint32) and uint64.
+func mmdbEncode(value interface{}) []byte {
+	var out bytes.Buffer
+	control := func(kind, size int) {
+		if kind <= 7 {
+			out.WriteByte(byte(kind<<5 | size))
+			return
+		}
+		out.WriteByte(byte(size))
+		out.WriteByte(byte(kind - 7))
+	}
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		out.WriteString(v)
+	case uint32:
+		control(6, 4)
+		binary.Write(&out, binary.BigEndian, v)
+	case uint64:
+		control(9, 8)
+		binary.Write(&out, binary.BigEndian, v)
+	case []interface{}:
+		control(11, len(v))
+		for _, item := range v {
+			out.Write(mmdbEncode(item))
+		}
+	case map[string]interface{}:
+		control(7, len(v))
+		for key, item := range v {
+			out.Write(mmdbEncode(key))
+			out.Write(mmdbEncode(item))
+		}
+	}
+	return out.Bytes()
+}
+
+// writeTestMMDB writes an IPv4 database with a one-node search tree: addresses in 0.0.0.0/1 have
+// the record, the others none
+func writeTestMMDB(t *testing.T, databaseType string, record map[string]interface{}) string {
+	t.Helper()
+	var db bytes.Buffer
+	// Left record points at the data section (node count + 16), right record is "not found"
+	db.Write([]byte{0, 0, 17, 0, 0, 1})
+	db.Write(make([]byte, 16))
+	db.Write(mmdbEncode(record))
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(mmdbEncode(map[string]interface{}{
+		"node_count":                  uint32(1),
+		"record_size":                 uint32(24),
+		"ip_version":                  uint32(4),
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"database_type":               databaseType,
+		"build_epoch":                 uint64(1700000000),
+		"languages":                   []interface{}{"en"},
+		"description":                 map[string]interface{}{"en": "test"},
+	}))
+
+	path := filepath.Join(t.TempDir(), databaseType+".mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func useGeoIPDBs(t *testing.T, countryPath, asnPath string) {
+	t.Helper()
+	setForTest(t, &geoIPDBPath, countryPath)
+	setForTest(t, &geoIPASNDBPath, asnPath)
+	setForTest(t, &geoIP, nil)
+}
+
+func TestGeoIPAddsCountryAndASN(t *testing.T) {
+	useGeoIPDBs(t,
+		writeTestMMDB(t, "GeoLite2-Country", map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}}),
+		writeTestMMDB(t, "GeoLite2-ASN", map[string]interface{}{"autonomous_system_number": uint32(15169)}))
+
+	vpcLog, err := parseRecord(flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (geoIPLazyTransformer{}).Transform(vpcLog); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"srcCountry": "-", "srcAsn": "-", "dstCountry": "US", "dstAsn": "15169"}
+	for field, value := range want {
+		if got := vpcLog.Get(field); got != value {
+			t.Errorf("%s = %q, want %q", field, got, value)
+		}
+	}
+}
+
+func TestGeoIPAddressesMissingFromTheDatabase(t *testing.T) {
+	useGeoIPDBs(t, writeTestMMDB(t, "GeoLite2-Country", map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}}), "")
+
+	vpcLog, err := parseRecord(flowLogLine("eni-1", "10.0.0.1", "200.1.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (geoIPLazyTransformer{}).Transform(vpcLog); err != nil {
+		t.Fatal(err)
+	}
+	if got := vpcLog.Get("dstCountry"); got != "-" {
+		t.Fatalf("dstCountry %q for an address missing from the database, want -", got)
+	}
+}
+
+func TestGeoIPRetriesFailedLoad(t *testing.T) {
+	fixture := writeTestMMDB(t, "GeoLite2-Country", map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}})
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	useGeoIPDBs(t, path, "")
+
+	if _, err := geoIPTransformerFromConfig(); err == nil {
+		t.Fatal("loaded a database that does not exist")
+	}
+
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geoIPTransformerFromConfig(); err != nil {
+		t.Fatalf("load after the database appeared failed: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlowLogLine is an outbound record in the default format
+const testFlowLogLine = "2 123456789012 eni-1 10.0.0.1 8.8.8.8 1234 443 6 10 840 1700000000 1700000060 ACCEPT OK"
+
+// testFlowLog returns testFlowLogLine parsed
+func testFlowLog(t *testing.T) *VPCFlowLog {
+	t.Helper()
+	vpcLog, err := parseRecord(testFlowLogLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vpcLog
+}
+
+// flowLogLine returns a default-format record from the interface and addresses
+func flowLogLine(interfaceID, srcAddr, dstAddr string) string {
+	return fmt.Sprintf("2 123456789012 %s %s %s 1234 443 6 10 840 1700000000 1700000060 ACCEPT OK", interfaceID, srcAddr, dstAddr)
+}
+
+// v5FlowLogLine is a version 5 record (every field, in the default order) with the given tcp-flags
+func v5FlowLogLine(srcAddr, tcpFlags string) string {
+	return "5 123456789012 eni-1 " + srcAddr + " 8.8.8.8 1234 443 6 1 40 1700000000 1700000060 ACCEPT OK " +
+		"vpc-1 subnet-1 i-1 " + tcpFlags + " IPv4 " + srcAddr + " 8.8.8.8 " +
+		"us-east-1 use1-az1 - - " +
+		"- - egress 1"
+}
+
+// gzipMembers compresses each part as its own gzip member, concatenated
+func gzipMembers(t *testing.T, parts ...string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	for _, part := range parts {
+		writer := gzip.NewWriter(&out)
+		if _, err := writer.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+// testRecordDefaults are the values of testFlowLogLine by field name
+var testRecordDefaults = map[string]string{
+	"version": "2", "account-id": "123456789012", "interface-id": "eni-1", "srcaddr": "10.0.0.1",
+	"dstaddr": "8.8.8.8", "srcport": "1234", "dstport": "443", "protocol": "6", "packets": "10",
+	"bytes": "840", "start": "1700000000", "end": "1700000060", "action": "ACCEPT", "log-status": "OK",
+}
+
+// recordLine returns a default-format line with the values of testFlowLogLine, overridden by name
+// with the given "field=value" pairs
+func recordLine(overrides ...string) string {
+	values := map[string]string{}
+	for name, value := range testRecordDefaults {
+		values[name] = value
+	}
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		values[parts[0]] = parts[1]
+	}
+
+	names := []string{"version", "account-id", "interface-id", "srcaddr", "dstaddr", "srcport", "dstport", "protocol", "packets", "bytes", "start", "end", "action", "log-status"}
+	line := make([]string, len(names))
+	for i, name := range names {
+		line[i] = values[name]
+	}
+	return strings.Join(line, " ")
+}
+
+// recordingWriter is a recordWriter keeping the records written to it
+type recordingWriter struct {
+	records []*VPCFlowLog
+	closed  bool
+}
+
+func (w *recordingWriter) Write(vpcLog *VPCFlowLog) error {
+	w.records = append(w.records, vpcLog)
+	return nil
+}
+
+func (w *recordingWriter) Flush() error {
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+// matchAllSources makes every source address match for the rest of the test
+func matchAllSources(t *testing.T) {
+	t.Helper()
+	rules, err := parseSourceRules("test", []string{"0.0.0.0/0", "::/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+}
+
+// filterLines runs the lines through filterVPCLogs, returning the records written to the output
+func filterLines(t *testing.T, lines ...string) ([]*VPCFlowLog, Result, error) {
+	t.Helper()
+	writer := &recordingWriter{}
+	result, err := filterLinesTo(t, writer, lines...)
+	return writer.records, result, err
+}
+
+// filterLinesTo runs the lines through filterVPCLogs into writer
+func filterLinesTo(t *testing.T, writer recordWriter, lines ...string) (Result, error) {
+	t.Helper()
+	locate := func(line int) (sourceObject, int) { return sourceObject{Bucket: "src", Key: "in.log"}, line }
+	result, _, err := filterVPCLogs(context.Background(), strings.NewReader(strings.Join(lines, "\n")+"\n"), locate, writer, nil, nil, newSummaries())
+	return result, err
+}
+
+// fakeClock is a Clock that only moves when the test advances it
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// parseTestRecord parses a record line built by the helpers above
+func parseTestRecord(t *testing.T, line string) *VPCFlowLog {
+	t.Helper()
+	vpcLog, err := parseRecord(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vpcLog
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const (
+	// maxDescribeInterfaceIDs is the most interface IDs resolved by one DescribeNetworkInterfaces call
+	maxDescribeInterfaceIDs = 200
+
+	// maxDescribeAttempts bounds the retries of a throttled DescribeNetworkInterfaces call
+	maxDescribeAttempts = 5
+)
+
+// interfaceNameTransformer adds an "interfaceName" field - the interface's ENI_NAME_TAG tag (default
+// "Name"), or its description when it has no such tag, or "-" - resolved with
+// DescribeNetworkInterfaces. The interfaces of each batch of records that are not cached yet are
+// described together, and names are cached for the life of the container, including for
+// interfaces that no longer exist, so each interface is described at most once.
+type interfaceNameTransformer struct {
+	names map[string]string
+}
+
+func newInterfaceNameTransformer() *interfaceNameTransformer {
+	return &interfaceNameTransformer{names: map[string]string{}}
+}
+
+func (t *interfaceNameTransformer) Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	id := vpcLog.Get("interface-id")
+	if id == "" || id == "-" {
+		vpcLog.Set("interfaceName", "-")
+		return vpcLog, nil
+	}
+
+	if _, ok := t.names[id]; !ok {
+		if err := t.resolve([]string{id}); err != nil {
+			return nil, err
+		}
+	}
+	vpcLog.Set("interfaceName", t.names[id])
+	return vpcLog, nil
+}
+
+func (t *interfaceNameTransformer) prefetch(vpcLogs []*VPCFlowLog) error {
+	var ids []string
+	queued := map[string]bool{}
+	for _, vpcLog := range vpcLogs {
+		id := vpcLog.Get("interface-id")
+		if _, ok := t.names[id]; ok || id == "" || id == "-" || queued[id] {
+			continue
+		}
+		queued[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return t.resolve(ids)
+}
+
+// resolve describes the interfaces in batches of up to maxDescribeInterfaceIDs and caches their
+// names. IDs are matched with a filter rather than NetworkInterfaceIds, so one deleted interface
+// doesn't fail the whole batch.
+func (t *interfaceNameTransformer) resolve(ids []string) error {
+	ec2Client, err := getEC2Client()
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(ids); start += maxDescribeInterfaceIDs {
+		end := start + maxDescribeInterfaceIDs
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+
+		interfaces, err := describeInterfaces(ec2Client, batch)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve interface names: %v", err)
+		}
+		for _, id := range batch {
+			t.names[id] = "-"
+		}
+		for _, networkInterface := range interfaces {
+			t.names[aws.StringValue(networkInterface.NetworkInterfaceId)] = interfaceName(networkInterface)
+		}
+	}
+	return nil
+}
+
+// describeInterfaces pages through DescribeNetworkInterfaces for the IDs, backing off and retrying
+// when EC2 throttles the call
+func describeInterfaces(ec2Client ec2iface.EC2API, ids []string) ([]*ec2.NetworkInterface, error) {
+	input := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("network-interface-id"), Values: aws.StringSlice(ids)}},
+	}
+
+	for attempt := 1; ; attempt++ {
+		var interfaces []*ec2.NetworkInterface
+		err := ec2Client.DescribeNetworkInterfacesPages(input, func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+			interfaces = append(interfaces, page.NetworkInterfaces...)
+			return true
+		})
+		if !isThrottled(err) || attempt == maxDescribeAttempts {
+			return interfaces, err
+		}
+
+		backoff := time.Duration(1<<uint(attempt-1)) * 100 * time.Millisecond
+		log.Printf("DescribeNetworkInterfaces throttled - retrying in %v\n", backoff)
+		time.Sleep(backoff)
+	}
+}
+
+func isThrottled(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "RequestLimitExceeded" || aerr.Code() == "Throttling")
+}
+
+func interfaceName(networkInterface *ec2.NetworkInterface) string {
+	for _, tag := range networkInterface.TagSet {
+		if aws.StringValue(tag.Key) == eniNameTag && aws.StringValue(tag.Value) != "" {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	if description := aws.StringValue(networkInterface.Description); description != "" {
+		return description
+	}
+	return "-"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 answers DescribeNetworkInterfaces from a set of named interfaces, failing the first
+// throttled calls with RequestLimitExceeded
+type fakeEC2 struct {
+	ec2iface.EC2API
+	names     map[string]string
+	calls     [][]string
+	throttled int
+}
+
+func (f *fakeEC2) DescribeNetworkInterfacesPages(input *ec2.DescribeNetworkInterfacesInput, fn func(*ec2.DescribeNetworkInterfacesOutput, bool) bool) error {
+	if f.throttled > 0 {
+		f.throttled--
+		return awserr.New("RequestLimitExceeded", "Request limit exceeded", nil)
+	}
+
+	ids := aws.StringValueSlice(input.Filters[0].Values)
+	f.calls = append(f.calls, ids)
+	output := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, id := range ids {
+		if name, ok := f.names[id]; ok {
+			output.NetworkInterfaces = append(output.NetworkInterfaces, &ec2.NetworkInterface{
+				NetworkInterfaceId: aws.String(id),
+				TagSet:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+			})
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func useFakeEC2(t *testing.T, fake *fakeEC2) {
+	t.Helper()
+	ec2ClientOnce = sync.Once{}
+	ec2ClientOnce.Do(func() { cachedEC2Client = fake })
+	t.Cleanup(func() { ec2ClientOnce = sync.Once{} })
+}
+
+func useInterfaceNames(t *testing.T) {
+	t.Helper()
+	setForTest(t, &transformers, []namedTransformer{{Transformer: newInterfaceNameTransformer(), name: "interface-name"}})
+}
+
+func TestInterfaceNamesDescribedInBatches(t *testing.T) {
+	fake := &fakeEC2{names: map[string]string{"eni-0": "web", "eni-249": "db"}}
+	useFakeEC2(t, fake)
+	useInterfaceNames(t)
+	matchAllSources(t)
+
+	var lines []string
+	for i := 0; i < 250; i++ {
+		lines = append(lines, flowLogLine(fmt.Sprintf("eni-%d", i), "10.0.0.1", "8.8.8.8"))
+	}
+	// Interfaces seen again are not described again
+	lines = append(lines, flowLogLine("eni-0", "10.0.0.1", "8.8.8.8"))
+
+	records, _, err := filterLines(t, lines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.calls) != 2 || len(fake.calls[0]) != maxDescribeInterfaceIDs || len(fake.calls[1]) != 50 {
+		t.Fatalf("described %d batches, want one of %d interfaces and one of 50", len(fake.calls), maxDescribeInterfaceIDs)
+	}
+
+	want := map[int]string{0: "web", 1: "-", 249: "db", 250: "web"}
+	for i, name := range want {
+		if got := records[i].Get("interfaceName"); got != name {
+			t.Errorf("record %d has interfaceName %q, want %q", i, got, name)
+		}
+	}
+}
+
+func TestInterfaceNamesRetryThrottledCalls(t *testing.T) {
+	fake := &fakeEC2{names: map[string]string{"eni-1": "web"}, throttled: 2}
+	useFakeEC2(t, fake)
+	useInterfaceNames(t)
+	matchAllSources(t)
+
+	records, _, err := filterLines(t, flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records[0].Get("interfaceName"); got != "web" {
+		t.Fatalf("interfaceName %q after throttling, want web", got)
+	}
+}
+
+func TestInterfaceNameFallsBackToDescription(t *testing.T) {
+	tests := []struct {
+		networkInterface *ec2.NetworkInterface
+		want             string
+	}{
+		{&ec2.NetworkInterface{TagSet: []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web")}}, Description: aws.String("ELB")}, "web"},
+		{&ec2.NetworkInterface{Description: aws.String("ELB app/web")}, "ELB app/web"},
+		{&ec2.NetworkInterface{}, "-"},
+	}
+	for _, test := range tests {
+		if got := interfaceName(test.networkInterface); got != test.want {
+			t.Errorf("interfaceName(%v) = %q, want %q", test.networkInterface, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// lease is a lock on LOCK_KEY held in the LOCK_TABLE DynamoDB table, so that only one invocation
+// processes the same source at a time. The table's partition key is the string attribute
+// "lockKey". Leases expire after LOCK_TTL_SECONDS, so an invocation that crashes without releasing
+// its lease only blocks the others until then; enabling DynamoDB TTL on the "expiresAt" attribute
+// also cleans up the expired items.
+type lease struct {
+	client dynamodbiface.DynamoDBAPI
+	key    string
+	owner  string
+}
+
+// acquireLease takes the lease on key for owner (the invocation's request ID). It returns a nil
+// lease, and no error, when another invocation holds an unexpired lease on the key.
+func acquireLease(client dynamodbiface.DynamoDBAPI, key, owner string) (*lease, error) {
+	now := clock.Now()
+	expiresAt := now.Add(time.Duration(lockTTLSeconds) * time.Second)
+
+	_, err := client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(lockTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"lockKey":   {S: aws.String(key)},
+			"owner":     {S: aws.String(owner)},
+			"expiresAt": {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(lockKey) OR expiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to acquire lock %s in %s: %v", key, lockTable, err)
+	}
+
+	return &lease{client: client, key: key, owner: owner}, nil
+}
+
+// release gives up the lease. The delete is conditional on still being the owner, so a lease that
+// expired and was taken over by another invocation is left alone.
+func (l *lease) release() {
+	_, err := l.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(lockTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"lockKey": {S: aws.String(l.key)},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(l.owner)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		log.Printf("Lock %s expired and was taken over before it was released\n", l.key)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to release lock %s - it expires in at most %d seconds: %v\n", l.key, lockTTLSeconds, err)
+	}
+}
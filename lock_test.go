@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeLockTable is a LOCK_TABLE evaluating the lease's conditional put and delete
+type fakeLockTable struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeLockTable() *fakeLockTable {
+	return &fakeLockTable{items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func (f *fakeLockTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	key := aws.StringValue(input.Item["lockKey"].S)
+	if held, ok := f.items[key]; ok {
+		expiresAt, _ := strconv.ParseInt(aws.StringValue(held["expiresAt"].N), 10, 64)
+		now, _ := strconv.ParseInt(aws.StringValue(input.ExpressionAttributeValues[":now"].N), 10, 64)
+		if expiresAt >= now {
+			return nil, conditionFailed()
+		}
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeLockTable) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	key := aws.StringValue(input.Key["lockKey"].S)
+	held, ok := f.items[key]
+	if !ok || aws.StringValue(held["owner"].S) != aws.StringValue(input.ExpressionAttributeValues[":owner"].S) {
+		return nil, conditionFailed()
+	}
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// useFakeDynamoDB makes getDynamoDBClient return client for the rest of the test
+func useFakeDynamoDB(t *testing.T, client dynamodbiface.DynamoDBAPI) {
+	t.Helper()
+	dynamoDBClientOnce = sync.Once{}
+	dynamoDBClientOnce.Do(func() { cachedDynamoDBClient = client })
+	t.Cleanup(func() { dynamoDBClientOnce = sync.Once{} })
+}
+
+func TestLeaseAcquireHeldRelease(t *testing.T) {
+	setForTest(t, &lockTable, "locks")
+	setForTest(t, &lockTTLSeconds, 60)
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)}
+	setForTest[Clock](t, &clock, now)
+	table := newFakeLockTable()
+
+	first, err := acquireLease(table, "src", "request-1")
+	if err != nil || first == nil {
+		t.Fatalf("acquiring a free lock returned %v, %v", first, err)
+	}
+	if held, err := acquireLease(table, "src", "request-2"); err != nil || held != nil {
+		t.Fatalf("acquiring a held lock returned %v, %v", held, err)
+	}
+
+	first.release()
+	second, err := acquireLease(table, "src", "request-2")
+	if err != nil || second == nil {
+		t.Fatalf("acquiring a released lock returned %v, %v", second, err)
+	}
+
+	// An expired lease is taken over, and its owner's release leaves the new lease alone
+	now.advance(2 * time.Minute)
+	third, err := acquireLease(table, "src", "request-3")
+	if err != nil || third == nil {
+		t.Fatalf("acquiring an expired lock returned %v, %v", third, err)
+	}
+	second.release()
+	if owner := aws.StringValue(table.items["src"]["owner"].S); owner != "request-3" {
+		t.Errorf("lock owned by %s after the expired owner released it", owner)
+	}
+}
+
+func TestRunSkipsWhenLockHeld(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	table := newFakeLockTable()
+	useFakeDynamoDB(t, table)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &lockTable, "locks")
+	setForTest(t, &lockKey, "src")
+	setForTest(t, &lockTTLSeconds, 60)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	if _, err := acquireLease(table, "src", "other-invocation"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		t.Error("sources listed while the lock is held")
+		return nil, nil
+	})
+	if err != nil || !result.Skipped {
+		t.Fatalf("run returned %+v, %v, want a skipped result", result, err)
+	}
+	if keys := fake.keys("dest"); len(keys) != 0 {
+		t.Errorf("skipped run wrote %v", keys)
+	}
+}
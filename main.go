@@ -1,123 +1,898 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// defaultRegion is the region the function runs in, falling back to us-east-1 when run outside of Lambda
+var defaultRegion = envOrDefault("AWS_REGION", "us-east-1")
+
 var (
 	accessKey       = os.Getenv("ACCESS_KEY")
 	secretAccessKey = os.Getenv("SECRET_ACCESS_KEY")
 
-	// Lambda Config Notes: Bucket name has format "[bucket-name]/path/to/file.ext" -- path (aka key) becomes "//path//to//file.ext"
+	// Lambda Config Notes: Bucket name has format "[bucket-name]/path/to/file.ext" -- path (aka key) becomes "path/to/file.ext" ("//path//to//file.ext" with PRESERVE_DOUBLE_SLASH)
 	sourceBucketName = os.Getenv("SOURCE_BUCKET_NAME")
 
-	// Lambda Config Notes: Source IP Addresses format should be comma-separated list of IP Addresses from which outbound traffic should be tracked
+	// Lambda Config Notes: Source IP Addresses format should be comma-separated list of IP Addresses (or CIDR blocks) from which outbound traffic should be tracked
 	sourceIPAddresses = os.Getenv("SOURCE_IP_ADDRESSES")
 
-	// Lambda Config Notes: Bucket name has format /path/to/file[[timestamp]].ext where "[[timestamp]]" is literally the string "[[timestamp]]"
+	// Lambda Config Notes: S3 object with more source IP addresses or CIDR blocks to match, one per line, in the format "[bucket-name]/path/to/allowlist.txt" - re-read on each invocation only when its ETag has changed - when unset, the allowlist.txt embedded in the binary at build time is matched instead
+	allowlistPath = os.Getenv("ALLOWLIST_PATH")
+
+	// Lambda Config Notes: DynamoDB table of source IP addresses or CIDR blocks to match - items with "status" set to "active", the entry in their WATCHLIST_IP_ATTRIBUTE (default "ip") - scanned at most every WATCHLIST_CACHE_SECONDS (default 60) by a warm container
+	watchlistTable        = os.Getenv("WATCHLIST_TABLE")
+	watchlistIPAttribute  = envOrDefault("WATCHLIST_IP_ATTRIBUTE", "ip")
+	watchlistCacheSeconds = envIntOrDefault("WATCHLIST_CACHE_SECONDS", 60)
+
+	// Lambda Config Notes: How matches of overlapping SOURCE_IP_ADDRESSES entries are counted in ruleHits - "first" (default) counts the first matching entry, "all" counts every matching entry
+	ruleAttribution = parseRuleAttribution(os.Getenv("RULE_ATTRIBUTION"))
+
+	// Lambda Config Notes: Set MATCH_MASK to a prefix length (e.g. "/24") to mask each log's IPv4 srcaddr and match it against SOURCE_IP_ADDRESSES as a list of network addresses (e.g. "10.0.1.0,10.0.2.0") - a single lookup per log instead of checking every CIDR block
+	matchMask = parseMatchMask(os.Getenv("MATCH_MASK"))
+
+	// Lambda Config Notes: When set, the source file is read from this http(s) URL instead of SOURCE_BUCKET_NAME, failing if the request takes longer than SOURCE_URL_TIMEOUT seconds (default 300)
+	// Lambda Config Notes: SOURCE_PRESIGNED_URL is the same for a presigned S3 GET URL handed over by another service - the object is read with the URL's signature rather than the function's credentials, its signature is kept out of the logs, and a 403 fails with a PresignedURLError saying whether it has expired
+	sourceURL        = envOrDefault("SOURCE_URL", os.Getenv("SOURCE_PRESIGNED_URL"))
+	sourceURLTimeout = envIntOrDefault("SOURCE_URL_TIMEOUT", 300)
+
+	// Lambda Config Notes: Version of the source file to process, for versioned source buckets - the latest version when unset
+	sourceVersionID = os.Getenv("SOURCE_VERSION_ID")
+
+	// Lambda Config Notes: Date range has format "yyyy-mm-dd/yyyy-mm-dd" - when set, SOURCE_BUCKET_NAME is the log delivery prefix and every file delivered on those days is processed
+	dateRangeStart, dateRangeEnd = parseDateRange(os.Getenv("DATE_RANGE"))
+
+	// Lambda Config Notes: Set WINDOW (e.g. "1h") to run on an EventBridge schedule instead - each invocation processes the log files under SOURCE_BUCKET_NAME (the log delivery prefix, as with DATE_RANGE) delivered in the WINDOW before the event's time, aligned to the 5-minute delivery interval
+	scheduleWindow = parseScheduleWindow(os.Getenv("WINDOW"))
+
+	// Lambda Config Notes: Set REPLAY to "true" for a function that replays S3 event notifications from a dead-letter queue (see HandleReplay) - invoke it with the failed event, or set REPLAY_EVENT to the event's JSON
+	replay      = envBool("REPLAY")
+	replayEvent = os.Getenv("REPLAY_EVENT")
+
+	// Lambda Config Notes: Number of times (up to 6) a DATE_RANGE listing that found no files is retried, with a doubling backoff starting at 1s
+	emptyListRetries = parseEmptyListRetries("EMPTY_LIST_RETRY")
+
+	// Lambda Config Notes: What to do with records whose start or end is more than TIMESTAMP_SANITY_WINDOW seconds (default 86400) from their file's delivery time - "off" (default), "flag" adds timestampAnomaly=true to them (and timestampAnomaly=false to every other record), "drop" drops them - counted as ClockSkewRecords either way
+	timestampSanity       = parseTimestampSanity(os.Getenv("TIMESTAMP_SANITY"))
+	timestampSanityWindow = envIntOrDefault("TIMESTAMP_SANITY_WINDOW", 86400)
+
+	// Lambda Config Notes: Set MERGE_SOURCES to "true" to read every source file as one stream, so that DEDUP_LINES applies across files rather than within each file
+	mergeSources = envBool("MERGE_SOURCES")
+
+	// Lambda Config Notes: Set FLOW_DEDUP to "first" or "last" to write only the first or last matched record of each flow (srcaddr/dstaddr/srcport/dstport/protocol 5-tuple) - "last" holds the latest record of every flow in memory until the end of the run - counting the others as DuplicateFlows ("none", the default, writes them all)
+	flowDedup = parseFlowDedup(os.Getenv("FLOW_DEDUP"))
+
+	// Lambda Config Notes: Set FLOW_DELTAS to "true" to add bytesDelta and packetsDelta - the change since the previous record of the same flow, in start time order - to every matched record, to spot flows bursting across aggregation windows. Set FLOW_DELTA_MIN_BYTES and/or FLOW_DELTA_MIN_PACKETS to only write records whose deltas reach them (the first record of each flow has no delta and is dropped then), counting the others as BelowFlowDelta. Every matched record is held in memory until the end of the run
+	flowDeltas          = envBool("FLOW_DELTAS")
+	flowDeltaMinBytes   = envInt64("FLOW_DELTA_MIN_BYTES")
+	flowDeltaMinPackets = envInt64("FLOW_DELTA_MIN_PACKETS")
+
+	// Lambda Config Notes: Set DEDUP_LINES to "true" to drop lines identical to one already scanned (e.g. records delivered twice), counted as DuplicateLines
+	dedupLines = envBool("DEDUP_LINES")
+
+	// Lambda Config Notes: Set to "true" to fail with a NoObjectsError when no source file is found (e.g. so a scheduled run alerts on a missing delivery) instead of writing an empty output
+	zeroObjectsIsError = envBool("ZERO_OBJECTS_IS_ERROR")
+
+	// Lambda Config Notes: Bucket name has format /path/to/file[[timestamp]].ext (the extension is replaced, see OUTPUT_EXTENSION) where "[[timestamp]]" is literally the string "[[timestamp]]"
+	// Lambda Config Notes: "[[request-id]]" is replaced by the invocation's request ID, e.g. /path/to/file[[timestamp]]-[[request-id]].ext, so repeated or concurrent runs on the same day write separate files
 	destBucketName = os.Getenv("DEST_BUCKET_NAME")
 
-	now              = time.Now()
-	year, month, day = now.Date()
-	timestamp        = fmt.Sprintf("%d-%d-%d", day, int(month), year)
+	// Lambda Config Notes: Set PRESERVE_SOURCE_LAST_MODIFIED to "true" to record the source file's LastModified (the latest one, for runs over several files) in the "source-last-modified" user metadata of the output objects, as RFC 3339
+	preserveSourceLastModified = envBool("PRESERVE_SOURCE_LAST_MODIFIED")
+
+	// Lambda Config Notes: Set CONTENT_HASH_SKIP to "true" to store a hash of the output records in the output's "content-hash" metadata, and skip writing the output when the object already at its key has the same hash - so a retry that matches the same records does not rewrite it (needs a single S3 output object at a key that is the same on retries, i.e. without "[[request-id]]"). The output is spooled to a temporary file (in /tmp) until the hash is known, so the function needs ephemeral storage for it
+	contentHashSkip = parseContentHashSkip("CONTENT_HASH_SKIP")
+
+	// Lambda Config Notes: Runs that would overwrite one of their source files with any object they write (the output and its parts or segments, REJECT_KEY, FILTER_PROFILES outputs, manifests and the other files written next to the output) fail with an InPlaceError unless ALLOW_INPLACE is "true"
+	allowInPlace = envBool("ALLOW_INPLACE")
+
+	// Lambda Config Notes: Set DEST_KEY_REGEX (e.g. "^AWSLogs/(.+)/flow/(.+)$") and DEST_KEY_REPLACE (e.g. "filtered/$1/$2") to write the records of each source file to the key substituted from its source key, in the bucket of DEST_BUCKET_NAME - files whose key does not match go to DEST_BUCKET_NAME. As with a single output, the object of a source file without matches is written empty
+	destKeyRegexp  = parseDestKeyRegex(os.Getenv("DEST_KEY_REGEX"))
+	destKeyReplace = os.Getenv("DEST_KEY_REPLACE")
+
+	// Lambda Config Notes: Set to "true" to build keys in the legacy "//path//to//file.ext" format (see formatKey)
+	preserveDoubleSlash = envBool("PRESERVE_DOUBLE_SLASH")
+
+	// Lambda Config Notes: Canned ACL set on objects written to the destination bucket, e.g. "bucket-owner-full-control" so the destination account owns objects written cross-account
+	destACL = parseDestACL(os.Getenv("DEST_ACL"))
+
+	// Lambda Config Notes: Tags set on objects written to the destination bucket, URL-encoded as "key1=val1&key2=val2"
+	destTags = parseDestTags(os.Getenv("DEST_TAGS"))
+
+	// Lambda Config Notes: Log type is "vpc" (default) or "tgw" (Transit Gateway flow logs) and selects the default field layout of the log lines
+	// Lambda Config Notes: Log format overrides the layout for logs created with a custom format, e.g. "${version} ${srcaddr} ${dstaddr} ${bytes}"
+	logFields = parseLogFields(os.Getenv("LOG_TYPE"), os.Getenv("LOG_FORMAT"))
+
+	// Lambda Config Notes: Without LOG_FORMAT, the layout of each VPC flow log line is picked from its version field (2, 3, 4 or 5 - with every field of that version, in the default order), so mixed-version files parse line by line
+	detectLogVersion = os.Getenv("LOG_FORMAT") == "" && os.Getenv("LOG_TYPE") != logTypeTGW
+
+	// Lambda Config Notes: Input format is "text" (default - space-separated flow log lines) or "json" (one JSON object per line keyed by field name, validated record by record)
+	// Lambda Config Notes: Input framing is "newline" (default), or for files delivered by Firehose without a record delimiter, "length-prefixed" (each record after a 4-byte big-endian length) or "concatenated-json" (JSON records back to back, with INPUT_FORMAT=json)
+	// Lambda Config Notes: Set QUARANTINE_INVALID_RECORDS to "true" to write JSON records that fail validation to "invalid-records.jsonl" next to the output file
+	inputFormat              = parseInputFormat(os.Getenv("INPUT_FORMAT"))
+	inputFraming             = parseInputFraming(os.Getenv("INPUT_FRAMING"))
+	quarantineInvalidRecords = envBool("QUARANTINE_INVALID_RECORDS")
+
+	// Lambda Config Notes: Output format is one of "raw" (default - matched lines are copied as-is), "json" (one JSON object per line) or "csv" (with a header row - the columns of every log version when versions are detected, "-" for the fields a line does not have)
+	// Lambda Config Notes: "json-seq" writes RFC 7464 JSON text sequences - each JSON object prefixed with the RS character (0x1e), for streaming JSON consumers
+	outputFormat = os.Getenv("OUTPUT_FORMAT")
+
+	// Lambda Config Notes: Terminator written after each raw/json record, with Go string escapes (e.g. "\r\n" or "\x1e") - defaults to a line feed
+	outputRecordSep = parseOutputRecordSep(os.Getenv("OUTPUT_RECORD_SEP"))
+
+	// Lambda Config Notes: Comma-separated list of the fields to include in JSON/CSV output, in output order (e.g. "srcaddr,dstaddr,bytes,action") - all fields when unset
+	outputFields = parseOutputFields(os.Getenv("OUTPUT_FIELDS"))
+
+	// Lambda Config Notes: Comma-separated list of fields to redact in the output (e.g. "account-id,interface-id") - filtering and matching still use the original values. Redacting raw output (REDACT_FIELDS or ANONYMIZE_MASK) needs text input - with INPUT_FORMAT=json set OUTPUT_FORMAT to json or csv
+	// Lambda Config Notes: REDACT_MODE is "mask" (default - values are replaced with "****") or "hash" (values are replaced with a hash salted with REDACT_SALT)
+	redactFields = parseRedactFields(os.Getenv("REDACT_FIELDS"))
+	redactMode   = parseRedactMode(os.Getenv("REDACT_MODE"))
+	redactSalt   = os.Getenv("REDACT_SALT")
+
+	// Lambda Config Notes: Set ANONYMIZE_MASK to truncate the addresses in the output to their network address - "/24" for IPv4, "/24,/48" for IPv4 and IPv6 - while filtering and matching use the full address
+	anonymizeMaskV4, anonymizeMaskV6 = parseAnonymizeMask(os.Getenv("ANONYMIZE_MASK"))
+
+	// Lambda Config Notes: Key in the destination bucket (with the same placeholders as DEST_BUCKET_NAME) to write every line that is not matched to, in the same pass - together the two outputs hold every source line exactly once
+	rejectKey = os.Getenv("REJECT_KEY")
+
+	// Lambda Config Notes: Key in the destination bucket (with the same placeholders as DEST_BUCKET_NAME) to write the raw lines of matched records that cannot be serialized in the output format to (e.g. values that are not valid UTF-8 in JSON/CSV output) - without it they fail the run
+	deadletterKey = os.Getenv("DEADLETTER_KEY")
+
+	// Lambda Config Notes: Output sink is "s3" (default - the output file is written to DEST_BUCKET_NAME) or "firehose" (matched records are sent to the FIREHOSE_STREAM delivery stream)
+	// Lambda Config Notes: OUTPUT_SINKS sends the output to several sinks at once, e.g. "s3,firehose"
+	outputSink     = os.Getenv("OUTPUT_SINK")
+	outputSinks    = parseOutputSinks(os.Getenv("OUTPUT_SINKS"))
+	firehoseStream = os.Getenv("FIREHOSE_STREAM")
+
+	// Lambda Config Notes: Set SINK_BUFFER_SIZE to send Firehose batches in the background, scanning on while up to that many records wait for the sink - the scan blocks when they are all waiting (0, the default, sends each batch inline)
+	sinkBufferSize = envInt("SINK_BUFFER_SIZE")
+
+	// Lambda Config Notes: Set to "gzip" to compress the output file as it is streamed to the destination bucket, or "bgzf" for blocked gzip, which parallel readers can split at its 64KB blocks (and plain gzip readers read as usual)
+	outputCompression = os.Getenv("OUTPUT_COMPRESSION")
+
+	// Lambda Config Notes: When either is set, the output is split into a sequence of files, starting a new one when the current file reaches ROLL_MAX_BYTES (uncompressed) or has been open for ROLL_MAX_SECONDS
+	rollMaxBytes   = envInt("ROLL_MAX_BYTES")
+	rollMaxSeconds = envInt("ROLL_MAX_SECONDS")
+
+	// Lambda Config Notes: Runs that would write more than MAX_OUTPUT_OBJECTS output objects (split parts, rolled files, DEST_KEY_REGEX keys and REJECT_KEY together) fail with a TooManyOutputObjectsError (0, the default, for no limit)
+	maxOutputObjects = envInt("MAX_OUTPUT_OBJECTS")
+
+	// Lambda Config Notes: Set SPLIT_BY to "protocol" to write TCP, UDP, ICMP and other records to separate files named after the output file, e.g. "out-tcp.jsonl", "out-udp.jsonl"
+	// Lambda Config Notes: SPLIT_BY=account writes each account-id's records under an "account=<id>/" directory next to the output file instead, e.g. "filtered/account=123456789012/out.jsonl"
+	splitBy = parseSplitBy(os.Getenv("SPLIT_BY"))
+
+	// Lambda Config Notes: Set IF_NONE_MATCH to "true" to only write the output if its key does not exist yet (a conditional put with "If-None-Match: *") - the run fails with an error instead of overwriting existing output
+	ifNoneMatch = envBool("IF_NONE_MATCH")
+
+	// Lambda Config Notes: Set COMPACT to "true" to merge small output files (under COMPACT_SMALL_BYTES, default 1MB) in the output file's directory into a single "compacted-<time>" file of at most COMPACT_MAX_BYTES (default 1GB) instead of processing logs
+	// Lambda Config Notes: Set COMPACT_DELETE to "true" to delete the merged files once the compacted file has been written
+	compactMode       = envBool("COMPACT")
+	compactSmallBytes = envIntOrDefault("COMPACT_SMALL_BYTES", 1<<20)
+	compactMaxBytes   = envIntOrDefault("COMPACT_MAX_BYTES", 1<<30)
+	compactDelete     = envBool("COMPACT_DELETE")
+
+	// Lambda Config Notes: Set CHECKSUM_ALGO to "sha256" or "crc32c" to write a sidecar with the checksum of each output object next to it, e.g. "out.log.sha256" - computed as the output is streamed
+	checksumAlgo = parseChecksumAlgo(os.Getenv("CHECKSUM_ALGO"))
+
+	// Lambda Config Notes: Set GLUE_DATABASE and GLUE_TABLE to register the partition of each run's output in the Glue catalog (for Athena) - values are read from "name=value" directories of the output key, e.g. "[bucket-name]/flows/date=[[timestamp]]/out.log"
+	glueDatabase = os.Getenv("GLUE_DATABASE")
+	glueTable    = os.Getenv("GLUE_TABLE")
+
+	// Lambda Config Notes: Set to "true" to list the output objects in "manifest.csv" (in the S3 Inventory CSV layout, with its MD5 in "manifest.checksum") next to the output file
+	outputManifest = envBool("OUTPUT_MANIFEST")
+
+	// Lambda Config Notes: Set to "true" to list the s3:// URLs of the output objects in "_symlink.txt" next to the output file, for Glue and Athena tables using SymlinkTextInputFormat
+	symlinkManifest = envBool("SYMLINK_MANIFEST")
+
+	// Lambda Config Notes: The extension of the output file is set from OUTPUT_FORMAT and OUTPUT_COMPRESSION (".log", ".jsonl" or ".csv", plus ".gz") - OUTPUT_EXTENSION sets it explicitly instead, e.g. "txt"
+	outputExtensionOverride = os.Getenv("OUTPUT_EXTENSION")
+
+	// Lambda Config Notes: Set to "true" to add a "flowId" field - a stable hash of the srcaddr/dstaddr/srcport/dstport/protocol 5-tuple - to JSON/CSV output
+	addFlowID = envBool("ADD_FLOW_ID")
+
+	// Lambda Config Notes: Set to "true" to add "sourceKey" and "lineNumber" fields - the key of the source file a log was read from and its line in that file - to JSON/CSV output
+	addSourceRef = envBool("ADD_SOURCE_REF")
+
+	// Lambda Config Notes: Comma-separated chain of transformers applied to matched logs before they are written, in order - "protocol-name" adds a "protocolName" field (e.g. "TCP") to JSON/CSV output
+	// Lambda Config Notes: "interface-name" adds an "interfaceName" field with the interface's ENI_NAME_TAG tag (default "Name") or description, looked up with ec2:DescribeNetworkInterfaces
+	// Lambda Config Notes: "reverse-dns" adds "srcHost"/"dstHost" fields with the PTR names of public addresses, resolved ahead of the output by PTR_CONCURRENCY (default 8) lookups in flight, each given PTR_TIMEOUT_MS (default 500). The names of the last PTR_CACHE_SIZE (default 10000) addresses are cached
+	transformers     = parseTransformers(os.Getenv("TRANSFORMERS"))
+	eniNameTag       = envOrDefault("ENI_NAME_TAG", "Name")
+	ptrConcurrency   = envIntOrDefault("PTR_CONCURRENCY", 8)
+	ptrTimeoutMillis = envIntOrDefault("PTR_TIMEOUT_MS", 500)
+	ptrCacheSize     = envIntOrDefault("PTR_CACHE_SIZE", 10000)
+
+	// Lambda Config Notes: Paths of MaxMind GeoLite2 Country and ASN databases - local (e.g. a layer under /opt) or "s3://bucket/key" - used to add srcCountry/dstCountry and srcAsn/dstAsn fields to JSON/CSV output ("-" for private addresses)
+	geoIPDBPath    = os.Getenv("GEOIP_DB_PATH")
+	geoIPASNDBPath = os.Getenv("GEOIP_ASN_DB_PATH")
+
+	// Lambda Config Notes: Only keep logs with at least this many packets ("-" counts as zero)
+	minPackets = envInt64("MIN_PACKETS")
+
+	// Lambda Config Notes: Only keep logs whose average packet size (bytes / packets) compares to BYTES_PER_PACKET, e.g. ">1400" for oversized packets or "<64" for tiny ones (a bare number means ">="). Records with no packets never match.
+	bytesPerPacket = os.Getenv("BYTES_PER_PACKET")
+
+	// Lambda Config Notes: Set FANOUT_ANALYSIS to "true" to write "fanout.json" next to the output file with the (approximate) number of distinct dstaddrs per matched srcaddr, flagging sources with more than FANOUT_THRESHOLD
+	fanoutAnalysis  = envBool("FANOUT_ANALYSIS")
+	fanoutThreshold = envInt("FANOUT_THRESHOLD")
+
+	// Lambda Config Notes: Only keep logs whose srcport/dstport is in the list - comma-separated ports ("443") or service names ("https", see servicePorts), ranges ("8000-8999") or port sets ("well-known" 0-1023, "registered" 1024-49151, "ephemeral" 49152-65535)
+	// Lambda Config Notes: Set SERVICES_FILE (e.g. "/etc/services") to add the service names of an /etc/services style file to the built-in ones
+	srcPorts     = os.Getenv("SRC_PORTS")
+	dstPorts     = os.Getenv("DST_PORTS")
+	servicesFile = os.Getenv("SERVICES_FILE")
+
+	// Lambda Config Notes: Only keep logs whose tcp-flags match, e.g. "syn,!ack" - flags are fin, syn, rst, psh, ack and urg, "!" requires the flag to be unset
+	tcpFlags = os.Getenv("TCP_FLAGS")
+
+	// Lambda Config Notes: Only keep logs whose MATCH_FIELD (any field of the log format, e.g. "dstport" or "action") is one of the comma-separated MATCH_VALUES, e.g. "443,8443"
+	matchField  = os.Getenv("MATCH_FIELD")
+	matchValues = os.Getenv("MATCH_VALUES")
+
+	// Lambda Config Notes: Only keep logs for which FILTER_EXPR holds, e.g. "srcaddr in 10.0.0.0/8 and dstport == 443 and bytes > 1000" (see filterexpr.go for the syntax) - the expression is compiled at startup, failing on syntax errors
+	filterExpr = os.Getenv("FILTER_EXPR")
+
+	// Lambda Config Notes: Set FILTER_PROFILES to a JSON array of extra filter profiles, each writing the records matching its filter (FILTER_EXPR syntax) to its own key in the destination bucket, in the same pass over the source, e.g. '[{"name": "ssh", "filter": "dstport == 22", "destKey": "profiles/ssh-[[timestamp]].jsonl"}]'. Profiles see every record - SOURCE_IP_ADDRESSES and the other filters only apply to the main output
+	filterProfiles = parseFilterProfiles(os.Getenv("FILTER_PROFILES"))
+
+	// Lambda Config Notes: Set THREAT_FEED_URL to an http(s) URL serving a newline-delimited feed of CIDR blocks and IP addresses (comments after "#" or ";" are ignored). The feed is downloaded on the first invocation and again once it is THREAT_FEED_REFRESH_SECONDS old (default 3600); when a download fails the last good copy is used
+	// Lambda Config Notes: Set MATCH_THREAT_FEED=true to only keep logs whose srcaddr or dstaddr is in the feed
+	threatFeedURL            = os.Getenv("THREAT_FEED_URL")
+	threatFeedRefreshSeconds = envIntOrDefault("THREAT_FEED_REFRESH_SECONDS", 3600)
+	matchThreatFeed          = envBool("MATCH_THREAT_FEED")
+
+	// Lambda Config Notes: Only keep logs whose raw line matches this regular expression (RE2 syntax), e.g. "eni-0a1b2c3d" or " REJECT "
+	lineRegex = os.Getenv("LINE_REGEX")
+
+	// Lambda Config Notes: When set, the top N source IPs by total bytes of the matched records are written to "top-talkers.json" next to the output file
+	topN = envInt("TOP_N")
+
+	// Lambda Config Notes: Cap on the distinct source IPs counted exactly for TOP_N (0, the default, for no cap) - past it the counts switch to the Space-Saving heavy-hitters algorithm, so memory stays bounded and each talker reports an overestimate
+	maxSummaryKeys = envInt("MAX_SUMMARY_KEYS")
+
+	// Lambda Config Notes: Fraction (0.0-1.0) of matched lines that are logged individually - 0 (default) logs none, 1.0 logs every match
+	matchLogSampleRate = parseSampleRate("MATCH_LOG_SAMPLE_RATE")
+
+	// Lambda Config Notes: CloudWatch namespace of the metrics emitted at the end of each run
+	metricsNamespace = envOrDefault("METRICS_NAMESPACE", "VPCLogFilter")
+	functionName     = envOrDefault("AWS_LAMBDA_FUNCTION_NAME", "vpc-log-filter")
+
+	// Lambda Config Notes: Set STATSD_ADDR to a host:port (e.g. "127.0.0.1:8125" for a sidecar agent) to also send the metrics as StatsD counters over UDP, named with STATSD_PREFIX (default "vpclogfilter.") in front. Set STATSD_DOGSTATSD=true to send the dimensions as DogStatsD tags
+	statsDAddr      = os.Getenv("STATSD_ADDR")
+	statsDPrefix    = envOrDefault("STATSD_PREFIX", "vpclogfilter.")
+	statsDDogStatsD = envBool("STATSD_DOGSTATSD")
+
+	// Lambda Config Notes: Set ENABLE_OTEL to "true" to export OpenTelemetry traces (run, download, filter and upload spans) over OTLP/HTTP, configured with the standard OTEL_EXPORTER_OTLP_ENDPOINT / OTEL_EXPORTER_OTLP_HEADERS / OTEL_SERVICE_NAME env vars
+	enableOTel = envBool("ENABLE_OTEL")
+
+	// Lambda Config Notes: What to do with source files that cannot be parsed at all - "skip" (default) logs and continues, "fail" fails the run, "quarantine" copies the file to QUARANTINE_PREFIX ("[bucket-name]/path/prefix") and continues
+	onParseFailure   = parseParseFailurePolicy(os.Getenv("ON_PARSE_FAILURE"))
+	quarantinePrefix = os.Getenv("QUARANTINE_PREFIX")
+
+	// Lambda Config Notes: SNS topic ARN to publish a summary of the matches to when a run matches more than ALERT_THRESHOLD (default 0) logs
+	alertSNSTopic  = os.Getenv("ALERT_SNS_TOPIC")
+	alertThreshold = envInt("ALERT_THRESHOLD")
+
+	// Lambda Config Notes: Source files are downloaded with DOWNLOAD_CONCURRENCY (default 5) parallel ranged GETs of DOWNLOAD_PART_SIZE bytes (default 5MB), and parsed as the parts arrive
+	downloadConcurrency = envIntOrDefault("DOWNLOAD_CONCURRENCY", s3manager.DefaultDownloadConcurrency)
+	downloadPartSize    = int64(envIntOrDefault("DOWNLOAD_PART_SIZE", int(s3manager.DefaultDownloadPartSize)))
+
+	// Lambda Config Notes: Output files are uploaded with UPLOAD_CONCURRENCY (default 5) parallel parts of UPLOAD_PART_SIZE bytes (default and minimum 5MB)
+	uploadConcurrency = envIntOrDefault("UPLOAD_CONCURRENCY", s3manager.DefaultUploadConcurrency)
+	uploadPartSize    = parseUploadPartSize("UPLOAD_PART_SIZE")
+
+	// Lambda Config Notes: Source files larger than MAX_SOURCE_BYTES (checked with a HEAD request before downloading - 0, the default, for no limit) fail the run instead of being downloaded
+	maxSourceBytes = envInt64("MAX_SOURCE_BYTES")
+
+	// Lambda Config Notes: Cap on the work running concurrently across all features - AWS requests (download and upload parts, Firehose batches, ...) and reverse DNS lookups share MAX_GOROUTINES slots (0, the default, for no cap). AWS requests hold a slot while they are sent, up to the response headers, not while their response body is read, so it caps requests in flight rather than the memory of download buffers, which DOWNLOAD_CONCURRENCY and DOWNLOAD_PART_SIZE bound
+	maxGoroutines = envInt("MAX_GOROUTINES")
+
+	// Lambda Config Notes: Timeouts in seconds of the AWS clients' HTTP requests for connecting (HTTP_DIAL_TIMEOUT, default 5), the TLS handshake (HTTP_TLS_HANDSHAKE_TIMEOUT, default 5) and the response headers (HTTP_RESPONSE_HEADER_TIMEOUT, default 30), and how many idle connections are kept per host (HTTP_MAX_IDLE_CONNS, default 25)
+	httpDialTimeout           = envIntOrDefault("HTTP_DIAL_TIMEOUT", 5)
+	httpTLSHandshakeTimeout   = envIntOrDefault("HTTP_TLS_HANDSHAKE_TIMEOUT", 5)
+	httpResponseHeaderTimeout = envIntOrDefault("HTTP_RESPONSE_HEADER_TIMEOUT", 30)
+	httpMaxIdleConns          = envIntOrDefault("HTTP_MAX_IDLE_CONNS", 25)
+
+	// Lambda Config Notes: Gzipped source files that decompress to more than MAX_DECOMPRESSED_BYTES (0, the default, for no limit) fail to parse (see ON_PARSE_FAILURE) rather than being read to the end
+	maxDecompressedBytes = envInt64("MAX_DECOMPRESSED_BYTES")
+
+	// Lambda Config Notes: When fewer than this many seconds of the invocation remain, scanning stops and the output so far is flushed, returning a truncated result with the resume point (0 disables)
+	flushMarginSeconds = envInt("FLUSH_MARGIN_SECONDS")
+
+	// Lambda Config Notes: Regions of the source and destination buckets, for cross-region log aggregation - both default to the function's own region (AWS_REGION)
+	sourceRegion = envOrDefault("SOURCE_REGION", defaultRegion)
+	destRegion   = envOrDefault("DEST_REGION", defaultRegion)
+
+	// Lambda Config Notes: Set LOCK_TABLE to a DynamoDB table (partition key "lockKey") to stop concurrent invocations processing the same source - an invocation that finds LOCK_KEY (default SOURCE_BUCKET_NAME, or SOURCE_URL) locked returns a skipped result
+	// Lambda Config Notes: Locks expire after LOCK_TTL_SECONDS (default 900, the longest a Lambda invocation can run) so a crashed invocation cannot hold one forever
+	lockTable      = os.Getenv("LOCK_TABLE")
+	lockKey        = envOrDefault("LOCK_KEY", envOrDefault("SOURCE_URL", sourceBucketName))
+	lockTTLSeconds = envIntOrDefault("LOCK_TTL_SECONDS", 900)
+
+	// Lambda Config Notes: Set CHECKPOINT_TABLE to a DynamoDB table (partition key "checkpointKey") to record the last source file processed under CHECKPOINT_KEY (default SOURCE_BUCKET_NAME) - the next run's DATE_RANGE or WINDOW listing starts after it
+	checkpointTable = os.Getenv("CHECKPOINT_TABLE")
+	checkpointKey   = envOrDefault("CHECKPOINT_KEY", sourceBucketName)
+
+	// Lambda Config Notes: Set TAIL_MODE=true for append-only source objects: the size, ETag, version and a hash of the bytes of every object processed are saved in CHECKPOINT_TABLE, and the next run only processes the bytes appended since (reading the old bytes again to check they still hash the same). Objects that are unchanged are skipped, and objects that shrank or were overwritten are processed again from the start. Appends must be whole lines (or whole gzip members). The CHECKPOINT_KEY last-key checkpoint is not used in this mode
+	tailMode = parseTailMode("TAIL_MODE")
+
+	// Lambda Config Notes: Set PIPELINE_RETRIES to run the whole download, filter and upload sequence again that many times when it fails with an error that may be transient (e.g. a failed download or upload), waiting PIPELINE_RETRY_BACKOFF_MS (default 1000) before the first retry and twice as long before each next one. Output objects committed by the failed attempt are deleted before it is retried
+	pipelineRetries            = envInt("PIPELINE_RETRIES")
+	pipelineRetryBackoffMillis = envIntOrDefault("PIPELINE_RETRY_BACKOFF_MS", 1000)
+
+	// Lambda Config Notes: Set AUDIT_LOG=true to end every invocation with one JSON line summarizing the run for CloudWatch Logs Insights - "event": "vpclogfilter.run", a hash of the configuration, the source and destination, the outcome (success, failure, truncated or skipped), error, duration and counts
+	auditLog = envBool("AUDIT_LOG")
+
+	// Lambda Config Notes: Set STATUS_KEY to a key in the destination bucket to overwrite it after every invocation with a JSON status - its time, request ID, success or error, duration in milliseconds and the result counts - for dashboards to poll
+	statusKey = os.Getenv("STATUS_KEY")
+
+	// Lambda Config Notes: Set PERMISSION_PROBE=true to check on a container's first invocation that the source can be read and the output written, failing with a PermissionError before any work is done. Warm invocations skip the probe once it has passed.
+	permissionProbe = envBool("PERMISSION_PROBE")
+
+	// Lambda Config Notes: Invocations with a payload of {"warmup": true} return straight away with a "warmup" result, without reading or writing anything - for scheduled warmers. Set WARMUP_SOURCE to also treat payloads whose "source" field has that value as warmup pings, e.g. "serverless-plugin-warmup"
+	warmupSource = os.Getenv("WARMUP_SOURCE")
 
 	timestampRegexp = regexp.MustCompile("\\[\\[timestamp\\]\\]")
+	requestIDRegexp = regexp.MustCompile("\\[\\[request-id\\]\\]")
 )
 
-func HandleRequest(ctx context.Context) (string, error) {
-	log.Println("Attempting to parse VPC logs from %s", sourceBucketName)
+func HandleRequest(ctx context.Context) (Result, error) {
+	return run(ctx, func(sourceS3Client s3iface.S3API, startAfter string) ([]sourceObject, error) {
+		return listSourceObjects(sourceS3Client, sourceBucketName, startAfter)
+	})
+}
+
+// sourceLister resolves the source objects an invocation processes. Listings skip the keys up to
+// startAfter when it is set.
+type sourceLister func(sourceS3Client s3iface.S3API, startAfter string) ([]sourceObject, error)
 
-	config := &aws.Config{
-		Region:                         aws.String("us-east-1"),
-		Credentials:                    credentials.NewStaticCredentials(accessKey, secretAccessKey, ""),
-		DisableRestProtocolURICleaning: aws.Bool(true), // May not be needed, but just to be safe
+// sourceBatches groups the source objects into the units processed in one pass: each object on its
+// own, or all of them as one merged stream with MERGE_SOURCES
+func sourceBatches(sourceObjects []sourceObject) [][]sourceObject {
+	if mergeSources {
+		if len(sourceObjects) == 0 {
+			return nil
+		}
+		return [][]sourceObject{sourceObjects}
 	}
 
-	awsSession, err := session.NewSession(config)
-	fatalIf(err)
+	batches := make([][]sourceObject, 0, len(sourceObjects))
+	for _, source := range sourceObjects {
+		batches = append(batches, []sourceObject{source})
+	}
+	return batches
+}
+
+// run processes the source objects returned by listSources into the output, retrying with
+// PIPELINE_RETRIES, then writes the STATUS_KEY object and the AUDIT_LOG event when they are set
+func run(ctx context.Context, listSources sourceLister) (Result, error) {
+	started := clock.Now()
+	result, err := runPipeline(ctx, listSources)
+	if statusKey != "" {
+		writeStatus(ctx, started, result, err)
+	}
+	if auditLog {
+		emitAuditEvent(ctx, started, result, err)
+	}
+	return result, err
+}
 
-	s3Client := s3.New(awsSession)
+func processSources(ctx context.Context, listSources sourceLister) (Result, error) {
+	ctx, finish := trackInvocation(ctx)
+	defer finish()
+	defer flushTraces(ctx)
 
-	sourceS3Bucket, sourceS3Key, err := parseBucketAndKeyFromFilePath(sourceBucketName)
-	fatalIf(err)
+	ctx, span := tracer.Start(ctx, "run")
+	defer span.End()
 
-	getObjectInput := &s3.GetObjectInput{
-		Bucket: aws.String(sourceS3Bucket),
-		Key:    aws.String(sourceS3Key),
+	if sourceURL != "" {
+		log.Printf("Attempting to parse VPC logs from %s\n", redactURL(sourceURL))
+	} else {
+		log.Printf("Attempting to parse VPC logs from %s\n", sourceBucketName)
 	}
 
-	buf := aws.NewWriteAtBuffer([]byte{})
-	downloader := s3manager.NewDownloaderWithClient(s3Client)
-	_, err = downloader.Download(buf, getObjectInput)
-	fatalIf(err)
+	sourceS3Client, destS3Client, err := getS3Clients()
+	if err != nil {
+		return Result{}, err
+	}
 
-	reader := bufio.NewReader(bytes.NewReader(buf.Bytes()))
-	outboundVPCLogs := []byte{}
-	for {
-		//VPC Log has format <version> <account-id> <interface-id> <srcaddr> <dstaddr> <srcport> <dstport> <protocol> <packets> <bytes> <start> <end> <action> <log-status>
-		//Outbound traffic is filtered by checking that the `srcaddr` is equal to our IP Address
-		vpcLog, _, err := reader.ReadLine()
-		if err != nil && err == io.EOF {
-			break
+	if permissionProbe {
+		if err := verifyPermissions(sourceS3Client, destS3Client); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if lockTable != "" {
+		dynamoDBClient, err := getDynamoDBClient()
+		if err != nil {
+			return Result{}, err
+		}
+
+		held, err := acquireLease(dynamoDBClient, lockKey, invocationRequestID(ctx))
+		if err != nil {
+			return Result{}, err
+		}
+		if held == nil {
+			log.Printf("Lock %s is held by another invocation - skipping\n", lockKey)
+			return Result{Skipped: true}, nil
+		}
+		defer held.release()
+	}
+
+	if compactMode {
+		return compactOutputs(destS3Client)
+	}
+
+	if threatFeedURL != "" {
+		if err := refreshThreatFeed(ctx); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if allowlistPath != "" || watchlistTable != "" {
+		if err := refreshSourceRules(sourceS3Client); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var checkpoint *checkpointStore
+	startAfter := ""
+	if checkpointTable != "" && !tailMode {
+		dynamoDBClient, err := getDynamoDBClient()
+		if err != nil {
+			return Result{}, err
+		}
+
+		checkpoint = &checkpointStore{client: dynamoDBClient, key: checkpointKey}
+		startAfter, err = checkpoint.load()
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	sourceObjects, err := listSources(sourceS3Client, startAfter)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(sourceObjects) == 0 && zeroObjectsIsError {
+		return Result{}, &NoObjectsError{Path: sourceBucketName, StartAfter: startAfter}
+	}
+
+	var tails *tailStore
+	var tailStates map[string]tailState
+	if tailMode {
+		dynamoDBClient, err := getDynamoDBClient()
+		if err != nil {
+			return Result{}, err
+		}
+
+		tails = &tailStore{client: dynamoDBClient}
+		sourceObjects, tailStates, err = tailSources(ctx, sourceS3Client, tails, sourceObjects)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	destS3Bucket, destS3Key, err := parseBucketAndKeyFromFilePath(destBucketName)
+	if err != nil {
+		return Result{}, err
+	}
+
+	destS3Key = outputKey(ctx, destS3Key)
+
+	outputMetadata, outputObjectsOpened = nil, 0
+	if preserveSourceLastModified {
+		lastModified, err := sourceLastModified(ctx, sourceS3Client, sourceObjects)
+		if err != nil {
+			return Result{}, err
+		}
+		setSourceLastModified(lastModified)
+	}
+
+	if !allowInPlace {
+		if err := checkNotInPlace(ctx, sourceObjects, destS3Bucket, destS3Key); err != nil {
+			return Result{}, err
+		}
+	}
+
+	// Flows are deduplicated, and their deltas computed, per destination: with DEST_KEY_REGEX every
+	// routed key gets its own flowDedupWriter and flowDeltaWriter, as the records they hold are only
+	// written when they are closed. Deltas are computed over every record of a flow, before
+	// FLOW_DEDUP keeps one of them.
+	var deduped []*flowDedupWriter
+	var deltas []*flowDeltaWriter
+	withFlowWriters := func(writer outputWriter) outputWriter {
+		if flowDedup != flowDedupNone {
+			dedup := newFlowDedupWriter(writer, flowDedup)
+			deduped = append(deduped, dedup)
+			writer = dedup
+		}
+		if flowDeltas {
+			delta := newFlowDeltaWriter(writer, flowDeltaMinBytes, flowDeltaMinPackets)
+			deltas = append(deltas, delta)
+			writer = delta
+		}
+		return writer
+	}
+
+	var writer outputWriter
+	var routed *sourceKeyWriter
+	var hashed *contentHashWriter
+	if destKeyRegexp != nil {
+		routed = newSourceKeyWriter(destS3Key, func(key string) string { return outputKey(ctx, key) }, func(key string) (outputWriter, error) {
+			writer, err := newOutputWriter(ctx, destS3Client, destS3Bucket, key)
+			if err != nil {
+				return nil, err
+			}
+			return withFlowWriters(writer), nil
+		})
+		writer = routed
+	} else if contentHashSkip {
+		hashed, err = newContentHashWriter(destS3Client, destS3Bucket, destS3Key)
+		if err != nil {
+			return Result{}, err
+		}
+		writer = withFlowWriters(hashed)
+	} else {
+		writer, err = newOutputWriter(ctx, destS3Client, destS3Bucket, destS3Key)
+		if err != nil {
+			return Result{}, err
+		}
+		writer = withFlowWriters(writer)
+	}
+
+	var rejects outputWriter
+	if rejectKey != "" {
+		rejects, err = openObjectWriter(newUploader(destS3Client), destS3Bucket, outputKey(ctx, rejectKey))
+		if err != nil {
+			return Result{}, writer.Abort(err)
 		}
-		fatalIf(err)
+	}
 
-		vpcLogParts := strings.Split(string(vpcLog), " ")
-		if len(vpcLogParts) > 3 {
-			for _, sourceIPAddress := range strings.Split(sourceIPAddresses, ",") {
-				if vpcLogParts[3] == sourceIPAddress {
-					log.Printf("Found outbound log from %s: %s\n", sourceIPAddress, string(vpcLog))
+	profiles, err := openProfileOutputs(ctx, destS3Client, destS3Bucket)
+	if err != nil {
+		if rejects != nil {
+			rejects.Abort(err)
+		}
+		return Result{}, writer.Abort(err)
+	}
 
-					outboundVPCLogs = append(outboundVPCLogs, []byte(fmt.Sprintf("%s\n", string(vpcLog)))...)
+	runSummaries := newSummaries()
+	result := newResult()
+	lastProcessed := ""
+	var tailed []sourceObject
+	for _, batch := range sourceBatches(sourceObjects) {
+		if routed != nil {
+			// A merged batch goes to the destination of its first file
+			if err := routed.setSource(batch[0]); err != nil {
+				if rejects != nil {
+					rejects.Abort(err)
 				}
+				abortProfileOutputs(profiles, err)
+				return result, writer.Abort(err)
 			}
 		}
+
+		var objectResult Result
+		if mergeSources {
+			objectResult, err = processMergedSources(ctx, sourceS3Client, batch, writer, rejects, profiles, runSummaries)
+		} else {
+			objectResult, err = processSourceObject(ctx, sourceS3Client, batch[0], writer, rejects, profiles, runSummaries)
+		}
+		result.add(objectResult)
+		if result.Truncated {
+			log.Printf("Stopping early to flush before the invocation ends - resume from line %d of s3://%s/%s\n", result.ResumeFrom.Line, result.ResumeFrom.Bucket, result.ResumeFrom.Key)
+			break
+		}
+
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			result.ParseFailures++
+			err = handleParseFailure(sourceS3Client, parseErr)
+		}
+		if err != nil {
+			if rejects != nil {
+				rejects.Abort(err)
+			}
+			abortProfileOutputs(profiles, err)
+			return result, writer.Abort(err)
+		}
+		lastProcessed = batch[len(batch)-1].Key
+		if parseErr != nil {
+			// A merged batch stops at the file that could not be parsed
+			lastProcessed = parseErr.Source.Key
+		}
+		if tails != nil {
+			for _, source := range batch {
+				tailed = append(tailed, source)
+				if parseErr != nil && source.Key == parseErr.Source.Key {
+					break
+				}
+			}
+		}
+	}
+	if rejects != nil {
+		if err := rejects.Close(); err != nil {
+			abortProfileOutputs(profiles, err)
+			return result, writer.Abort(err)
+		}
 	}
+	if err := closeProfileOutputs(profiles); err != nil {
+		return result, writer.Abort(err)
+	}
+	_, uploadSpan := tracer.Start(ctx, "upload", trace.WithAttributes(attribute.String("s3.bucket", destS3Bucket), attribute.String("s3.key", destS3Key)))
+	err = writer.Close()
+	result.OutputUnchanged = err == nil && hashed != nil && hashed.unchanged
+	endSpan(uploadSpan, err)
+	if err != nil {
+		return result, err
+	}
+	for _, dedup := range deduped {
+		result.DuplicateFlows += dedup.dropped
+	}
+	for _, delta := range deltas {
+		result.BelowFlowDelta += delta.dropped
+	}
+	if checkpoint != nil && lastProcessed != "" {
+		// Only checkpointed once the output is committed, so a failed run reprocesses its objects
+		if err := checkpoint.save(lastProcessed); err != nil {
+			return result, err
+		}
+	}
+	if tails != nil {
+		for i, source := range tailed {
+			// As with the checkpoint, tail positions only move on once the output is committed
+			if err := tails.save(source, tailStates[source.Key]); err != nil {
+				return result, &TailSaveError{Saved: i, Unsaved: len(tailed) - i, Err: err}
+			}
+		}
+	}
+	log.Printf("Found %d outbound logs in %d lines\n", result.LinesMatched, result.LinesScanned)
+	if result.InvalidRecords > 0 {
+		log.Printf("Skipped %d records that failed validation\n", result.InvalidRecords)
+	}
+	if result.ClockSkewRecords > 0 {
+		log.Printf("Found %d records with timestamps outside TIMESTAMP_SANITY_WINDOW\n", result.ClockSkewRecords)
+	}
+	if result.DuplicateFlows > 0 {
+		log.Printf("Dropped %d records of flows already written (FLOW_DEDUP=%s)\n", result.DuplicateFlows, flowDedup)
+	}
+	if result.BelowFlowDelta > 0 {
+		log.Printf("Dropped %d records under the FLOW_DELTA_MIN_BYTES/FLOW_DELTA_MIN_PACKETS deltas\n", result.BelowFlowDelta)
+	}
+	if result.DuplicateLines > 0 {
+		log.Printf("Dropped %d duplicate lines\n", result.DuplicateLines)
+	}
+	for _, profile := range filterProfiles {
+		log.Printf("Wrote %d records for filter profile %s\n", result.ProfileMatches[profile.Name], profile.Name)
+	}
+	emitMetrics(result, outputBytes(writer.Objects()))
 
-	destS3Bucket, destS3Key, err := parseBucketAndKeyFromFilePath(destBucketName)
+	if topN > 0 {
+		topTalkers, err := json.Marshal(runSummaries.talkers.Top(topN))
+		if err != nil {
+			return result, err
+		}
+
+		_, err = destS3Client.PutObject(newDestPutObjectInput(destS3Bucket, siblingKey(destS3Key, "top-talkers.json"), topTalkers))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if checksumAlgo != "" {
+		if err := writeChecksumSidecars(destS3Client, writer.Objects()); err != nil {
+			return result, err
+		}
+	}
+
+	if glueDatabase != "" && glueTable != "" {
+		glueClient, err := getGlueClient()
+		if err != nil {
+			log.Printf("Unable to register partition: %v\n", err)
+		} else {
+			registerPartition(glueClient, destS3Bucket, destS3Key)
+		}
+	}
+
+	if outputManifest && !result.OutputUnchanged {
+		if err := writeManifest(destS3Client, destS3Bucket, destS3Key, writer.Objects()); err != nil {
+			return result, err
+		}
+	}
+
+	if symlinkManifest && !result.OutputUnchanged {
+		if err := writeSymlinkManifest(destS3Client, destS3Bucket, destS3Key, writer.Objects()); err != nil {
+			return result, err
+		}
+	}
+
+	if runSummaries.deadletter.Len() > 0 {
+		log.Printf("Wrote %d records that could not be serialized to the deadletter file\n", result.SerializationFailures)
+		_, err := destS3Client.PutObject(newDestPutObjectInput(destS3Bucket, expandKeyPlaceholders(ctx, deadletterKey), runSummaries.deadletter.Bytes()))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if runSummaries.invalid.Len() > 0 {
+		_, err := destS3Client.PutObject(newDestPutObjectInput(destS3Bucket, siblingKey(destS3Key, "invalid-records.jsonl"), runSummaries.invalid.Bytes()))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if fanoutAnalysis {
+		fanout, err := json.Marshal(runSummaries.Fanout())
+		if err != nil {
+			return result, err
+		}
+
+		_, err = destS3Client.PutObject(newDestPutObjectInput(destS3Bucket, siblingKey(destS3Key, "fanout.json"), fanout))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if alertSNSTopic != "" {
+		if err := publishAlert(sourceBucketName, result, runSummaries); err != nil {
+			log.Printf("Unable to publish alert: %v\n", err)
+		}
+	}
+
+	return result, nil
+}
+
+// Clock tells the time. Everything that depends on the current time goes through clock, so it is
+// read once per invocation rather than frozen when the container started, and can be replaced.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = realClock{}
 
+// timestamp is the value of the "[[timestamp]]" placeholder in output keys, e.g. "5-3-2024"
+func timestamp(now time.Time) string {
+	year, month, day := now.Date()
+	return fmt.Sprintf("%d-%d-%d", day, int(month), year)
+}
+
+// outputKey fills in the placeholders of an output key and sets its extension from the output format
+func outputKey(ctx context.Context, key string) string {
+	return withOutputExtension(expandKeyPlaceholders(ctx, key))
+}
+
+// expandKeyPlaceholders fills in the [[timestamp]] and [[request-id]] placeholders of a key
+func expandKeyPlaceholders(ctx context.Context, key string) string {
+	key = timestampRegexp.ReplaceAllString(key, timestamp(clock.Now()))   //Add timestamp to the name of the file
+	key = requestIDRegexp.ReplaceAllString(key, invocationRequestID(ctx)) //Keep runs on the same day from overwriting each other
+	return key
+}
+
+// invocationRequestID returns the Lambda request ID of the invocation, or "local" when the handler
+// is not running in Lambda
+func invocationRequestID(ctx context.Context) string {
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok && lambdaContext.AwsRequestID != "" {
+		return lambdaContext.AwsRequestID
+	}
+	return "local"
+}
+
+// newDestPutObjectInput builds the input for writing an object to the destination bucket, with the
+// object settings (ACL, tags) configured for the destination applied
+func newDestPutObjectInput(bucket, key string, body []byte) *s3.PutObjectInput {
 	putObjectInput := &s3.PutObjectInput{
-		Bucket: aws.String(destS3Bucket),
-		Key:    aws.String(timestampRegexp.ReplaceAllString(destS3Key, timestamp)), //Add timestamp to the name of the filex
-		Body:   bytes.NewReader(outboundVPCLogs),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}
+	if destACL != "" {
+		putObjectInput.ACL = aws.String(destACL)
+	}
+	if destTags != "" {
+		putObjectInput.Tagging = aws.String(destTags)
+	}
+	if outputMetadata != nil {
+		putObjectInput.Metadata = outputMetadata
 	}
 
-	_, err = s3Client.PutObject(putObjectInput)
-	fatalIf(err)
+	return putObjectInput
+}
+
+// parseDestACL validates DEST_ACL against S3's canned ACLs
+func parseDestACL(acl string) string {
+	if acl == "" {
+		return ""
+	}
 
-	return fmt.Sprintf("Done."), nil
+	for _, cannedACL := range s3.ObjectCannedACL_Values() {
+		if acl == cannedACL {
+			return acl
+		}
+	}
+	log.Fatalf("DEST_ACL %q is not a canned ACL - expected one of %s", acl, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+	return ""
+}
+
+// tagCharsRegexp matches the characters S3 allows in tag keys and values
+var tagCharsRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// parseDestTags validates DEST_TAGS ("key1=val1&key2=val2", URL-encoded) against S3's tagging
+// limits and returns it in the canonical encoding used for PutObjectInput.Tagging
+func parseDestTags(tags string) string {
+	if tags == "" {
+		return ""
+	}
+
+	values, err := url.ParseQuery(tags)
+	if err != nil {
+		log.Fatalf("DEST_TAGS %q is not a URL-encoded key=value list: %v", tags, err)
+	}
+	if len(values) > 10 {
+		log.Fatalf("DEST_TAGS has %d tags - S3 allows at most 10 per object", len(values))
+	}
+
+	for key, vals := range values {
+		if len(vals) > 1 {
+			log.Fatalf("DEST_TAGS tag %q is set more than once", key)
+		}
+		if key == "" || utf8.RuneCountInString(key) > 128 || strings.HasPrefix(key, "aws:") || !tagCharsRegexp.MatchString(key) {
+			log.Fatalf("DEST_TAGS tag key %q is invalid - keys must be 1-128 letters, numbers, spaces or _.:/=+-@ and must not start with \"aws:\"", key)
+		}
+		if utf8.RuneCountInString(vals[0]) > 256 || !tagCharsRegexp.MatchString(vals[0]) {
+			log.Fatalf("DEST_TAGS tag value %q is invalid - values must be up to 256 letters, numbers, spaces or _.:/=+-@", vals[0])
+		}
+	}
+
+	return values.Encode()
+}
+
+// siblingKey returns the key of an object named name in the same "directory" as key
+func siblingKey(key, name string) string {
+	return key[:strings.LastIndex(key, "/")+1] + name
 }
 
 func parseBucketAndKeyFromFilePath(filePath string) (string, string, error) {
 	var (
 		bucketName, key string
-		parts           = strings.Split(bucketName, "/")
+		parts           = strings.Split(strings.TrimPrefix(filePath, "/"), "/")
 	)
 
-	if len(parts) > 0 {
+	if len(parts) > 0 && parts[0] != "" {
 		bucketName = parts[0]
 	} else {
 		return bucketName, key, fmt.Errorf("File path string %s not in the correct format - expected [bucket-name]/path/to/file.csv", filePath)
 	}
 
-	if len(parts) > 1 {
-		key = fmt.Sprintf("//%s", strings.Join(parts[1:], "//"))
+	if len(parts) > 1 && strings.Join(parts[1:], "") != "" {
+		key = formatKey(parts[1:])
 	} else {
 		return bucketName, key, fmt.Errorf("File path string %s not in the correct format - expected [bucket-name]/path/to/file.csv", filePath)
 	}
@@ -125,6 +900,105 @@ func parseBucketAndKeyFromFilePath(filePath string) (string, string, error) {
 	return bucketName, key, nil
 }
 
+// formatKey joins the path segments of a file path into an S3 key. Keys used to always be built
+// as "//path//to//file.ext" - the objects this function was first written against had been
+// uploaded by a tool that wrote doubled slashes into the key, and those keys can only be
+// addressed with DisableRestProtocolURICleaning set (the SDK otherwise collapses "//" to "/"
+// before signing). PRESERVE_DOUBLE_SLASH keeps that behavior for such buckets.
+func formatKey(segments []string) string {
+	if preserveDoubleSlash {
+		return fmt.Sprintf("//%s", strings.Join(segments, "//"))
+	}
+	return strings.Join(segments, "/")
+}
+
+// envOrDefault returns the value of the env var, or fallback when it is unset
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envBool parses a boolean env var, treating an unset var as false
+func envBool(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Env var %s must be a boolean, got %q", name, value)
+	}
+	return b
+}
+
+// envInt parses an integer env var, treating an unset var as 0
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Env var %s must be an integer, got %q", name, value)
+	}
+	return i
+}
+
+// envInt64 parses a 64-bit integer env var, for counts that can exceed an int on 32-bit builds,
+// treating an unset var as 0
+func envInt64(name string) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Env var %s must be an integer, got %q", name, value)
+	}
+	return i
+}
+
+// envIntOrDefault parses a positive integer env var, returning fallback when it is unset
+func envIntOrDefault(name string, fallback int) int {
+	if os.Getenv(name) == "" {
+		return fallback
+	}
+
+	i := envInt(name)
+	if i <= 0 {
+		log.Fatalf("Env var %s must be greater than 0, got %d", name, i)
+	}
+	return i
+}
+
+// envFloat parses a floating point env var, treating an unset var as 0
+func envFloat(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Env var %s must be a number, got %q", name, value)
+	}
+	return f
+}
+
+// parseSampleRate parses a sampling rate env var, which must be between 0 and 1
+func parseSampleRate(name string) float64 {
+	rate := envFloat(name)
+	if rate < 0 || rate > 1 {
+		log.Fatalf("Env var %s must be between 0.0 and 1.0, got %v", name, rate)
+	}
+	return rate
+}
+
 func fatalIf(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -132,5 +1006,17 @@ func fatalIf(err error) {
 }
 
 func main() {
-	lambda.Start(HandleRequest)
+	handleSIGTERM()
+	if enableOTel {
+		initTracing()
+	}
+	if replay {
+		lambda.StartHandler(warmupHandler{lambda.NewHandler(HandleReplay)})
+		return
+	}
+	if scheduleWindow > 0 {
+		lambda.StartHandler(warmupHandler{lambda.NewHandler(HandleScheduled)})
+		return
+	}
+	lambda.StartHandler(warmupHandler{lambda.NewHandler(HandleRequest)})
 }
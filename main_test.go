@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestParseBucketAndKeyKeyStyles(t *testing.T) {
+	tests := []struct {
+		preserveDoubleSlash bool
+		want                string
+	}{
+		{false, "path/to/file.csv"},
+		{true, "//path//to//file.csv"},
+	}
+	for _, test := range tests {
+		setForTest(t, &preserveDoubleSlash, test.preserveDoubleSlash)
+		bucket, key, err := parseBucketAndKeyFromFilePath("bucket/path/to/file.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket != "bucket" || key != test.want {
+			t.Errorf("with PRESERVE_DOUBLE_SLASH=%v got %s %s, want bucket %s", test.preserveDoubleSlash, bucket, key, test.want)
+		}
+	}
+
+	for _, path := range []string{"", "bucket", "bucket/"} {
+		if _, _, err := parseBucketAndKeyFromFilePath(path); err == nil {
+			t.Errorf("%q parsed without a key", path)
+		}
+	}
+}
+
+func TestDestACLOnPutInput(t *testing.T) {
+	if acl := parseDestACL("bucket-owner-full-control"); acl != "bucket-owner-full-control" {
+		t.Fatalf("parsed ACL %q", acl)
+	}
+
+	putObjectInput := newDestPutObjectInput("dest", "out.log", nil)
+	if putObjectInput.ACL != nil {
+		t.Errorf("ACL %s set without DEST_ACL", aws.StringValue(putObjectInput.ACL))
+	}
+
+	setForTest(t, &destACL, "bucket-owner-full-control")
+	putObjectInput = newDestPutObjectInput("dest", "out.log", nil)
+	if acl := aws.StringValue(putObjectInput.ACL); acl != "bucket-owner-full-control" {
+		t.Errorf("put input ACL %q", acl)
+	}
+	if acl := aws.StringValue(newDestUploadInput("dest", "out.log").ACL); acl != "bucket-owner-full-control" {
+		t.Errorf("upload input ACL %q", acl)
+	}
+}
+
+func TestDestTagsOnPutInput(t *testing.T) {
+	tags := parseDestTags("team=net%20ops&cost-center=1234")
+	if tags != "cost-center=1234&team=net+ops" {
+		t.Fatalf("parsed tags %q", tags)
+	}
+	if tags := parseDestTags(""); tags != "" {
+		t.Errorf("empty DEST_TAGS parsed as %q", tags)
+	}
+
+	setForTest(t, &destTags, tags)
+	if tagging := aws.StringValue(newDestPutObjectInput("dest", "out.log", nil).Tagging); tagging != tags {
+		t.Errorf("put input tagging %q", tagging)
+	}
+	if tagging := aws.StringValue(newDestUploadInput("dest", "out.log").Tagging); tagging != tags {
+		t.Errorf("upload input tagging %q", tagging)
+	}
+}
+
+func TestOutputKeyRequestID(t *testing.T) {
+	invocation := func(requestID string) context.Context {
+		return lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: requestID})
+	}
+
+	first := expandKeyPlaceholders(invocation("request-1"), "out/[[timestamp]]-[[request-id]].log")
+	second := expandKeyPlaceholders(invocation("request-2"), "out/[[timestamp]]-[[request-id]].log")
+	if first == second {
+		t.Fatalf("invocations with different request IDs both wrote %s", first)
+	}
+	if !strings.HasSuffix(first, "-request-1.log") {
+		t.Errorf("key %s does not end with the request ID", first)
+	}
+	if key := expandKeyPlaceholders(context.Background(), "out/[[request-id]].log"); key != "out/local.log" {
+		t.Errorf("key outside Lambda %s", key)
+	}
+}
+
+func TestOutputKeyTimestampFromClock(t *testing.T) {
+	now := &fakeClock{now: time.Date(2024, 3, 5, 23, 59, 0, 0, time.UTC)}
+	setForTest[Clock](t, &clock, now)
+
+	if key := expandKeyPlaceholders(context.Background(), "out/[[timestamp]].log"); key != "out/5-3-2024.log" {
+		t.Fatalf("key %s, want the fake clock's day", key)
+	}
+	// The timestamp is taken per invocation, so a warm container moves on to the next day
+	now.advance(time.Minute)
+	if key := expandKeyPlaceholders(context.Background(), "out/[[timestamp]].log"); key != "out/6-3-2024.log" {
+		t.Errorf("key %s after midnight, want out/6-3-2024.log", key)
+	}
+}
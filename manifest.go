@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// inventoryTimeLayout is the layout of the LastModifiedDate column of S3 Inventory CSV files, in
+// UTC with milliseconds
+const inventoryTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// writeManifest lists the output objects of the run in manifest.csv next to the output file, in
+// the layout of an S3 Inventory CSV data file: one row per object with the quoted, URL-encoded
+// Bucket, Key, Size and LastModifiedDate columns and no header row. As with S3 Inventory,
+// manifest.checksum holds the MD5 of the manifest so consumers can check it is complete.
+func writeManifest(destS3Client s3iface.S3API, bucket, destKey string, objects []outputObject) error {
+	manifest := &bytes.Buffer{}
+	for _, object := range objects {
+		fmt.Fprintf(manifest, "\"%s\",\"%s\",\"%d\",\"%s\"\n",
+			url.QueryEscape(object.Bucket), url.QueryEscape(object.Key), object.Size,
+			object.LastModified.UTC().Format(inventoryTimeLayout))
+	}
+
+	_, err := destS3Client.PutObject(newDestPutObjectInput(bucket, siblingKey(destKey, "manifest.csv"), manifest.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(manifest.Bytes())
+	_, err = destS3Client.PutObject(newDestPutObjectInput(bucket, siblingKey(destKey, "manifest.checksum"), []byte(hex.EncodeToString(sum[:]))))
+	return err
+}
+
+// writeSymlinkManifest lists the s3:// URLs of the output objects of the run, one per line, in
+// _symlink.txt next to the output file - the manifest read by Glue and Athena tables using
+// SymlinkTextInputFormat, which then read the listed objects with the table's own SerDe
+func writeSymlinkManifest(destS3Client s3iface.S3API, bucket, destKey string, objects []outputObject) error {
+	manifest := &bytes.Buffer{}
+	for _, object := range objects {
+		fmt.Fprintf(manifest, "s3://%s/%s\n", object.Bucket, object.Key)
+	}
+
+	_, err := destS3Client.PutObject(newDestPutObjectInput(bucket, siblingKey(destKey, "_symlink.txt"), manifest.Bytes()))
+	return err
+}
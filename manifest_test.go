@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestWriteManifestInventoryLayout(t *testing.T) {
+	fake, client := newFakeS3(t)
+	objects := []outputObject{
+		{Bucket: "dest", Key: "out/part one.log", Size: 120, LastModified: time.Date(2024, 3, 5, 10, 15, 0, 250e6, time.FixedZone("CET", 3600))},
+		{Bucket: "dest", Key: "out/part-2.log", Size: 7, LastModified: time.Date(2024, 3, 5, 10, 16, 0, 0, time.UTC)},
+	}
+	if err := writeManifest(client, "dest", "out/log.jsonl", objects); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, ok := fake.get("dest", "out/manifest.csv")
+	if !ok {
+		t.Fatal("no manifest written")
+	}
+	rows, err := csv.NewReader(strings.NewReader(manifest)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"dest", "out%2Fpart+one.log", "120", "2024-03-05T09:15:00.250Z"},
+		{"dest", "out%2Fpart-2.log", "7", "2024-03-05T10:16:00.000Z"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("manifest has %d rows, want %d: %q", len(rows), len(want), manifest)
+	}
+	for i := range want {
+		if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("row %d is %q, want %q", i, rows[i], want[i])
+		}
+	}
+	if !strings.HasPrefix(manifest, `"dest","out%2Fpart+one.log"`) {
+		t.Errorf("manifest columns are not quoted: %q", manifest)
+	}
+
+	checksum, _ := fake.get("dest", "out/manifest.checksum")
+	sum := md5.Sum([]byte(manifest))
+	if checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("manifest.checksum %q is not the MD5 of the manifest", checksum)
+	}
+}
+
+func TestWriteSymlinkManifest(t *testing.T) {
+	fake, client := newFakeS3(t)
+	objects := []outputObject{{Bucket: "dest", Key: "out/a.log"}, {Bucket: "dest", Key: "out/b.log"}}
+	if err := writeSymlinkManifest(client, "dest", "out/log.jsonl", objects); err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest, _ := fake.get("dest", "out/_symlink.txt"); manifest != "s3://dest/out/a.log\ns3://dest/out/b.log\n" {
+		t.Fatalf("symlink manifest %q", manifest)
+	}
+}
+
+func TestSymlinkManifestListsPartitionedOutput(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/filtered/out.jsonl")
+	setForTest(t, &outputFormat, outputFormatJSON)
+	setForTest(t, &splitBy, splitByAccount)
+	setForTest(t, &symlinkManifest, true)
+	fake.put("src", "in.log", recordLine("account-id=111111111111")+"\n"+recordLine("account-id=222222222222")+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, ok := fake.get("dest", "filtered/_symlink.txt")
+	if !ok {
+		t.Fatalf("no _symlink.txt next to the output, dest has %v", fake.keys("dest"))
+	}
+	want := "s3://dest/filtered/account=111111111111/out.jsonl\ns3://dest/filtered/account=222222222222/out.jsonl\n"
+	if manifest != want {
+		t.Errorf("symlink manifest %q, want %q", manifest, want)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// mergedReader reads the decompressed source files one after the other as a single stream, in the
+// manner of io.MultiReader, opening each file only once the previous one is exhausted so that
+// one download is in flight at a time
+type mergedReader struct {
+	ctx            context.Context
+	sourceS3Client s3iface.S3API
+	sources        []sourceObject
+
+	// current is the index in sources of the file being read, and stream its download
+	current int
+	stream  io.ReadCloser
+	reader  io.Reader
+
+	// lastByte is the last byte read from the current file, to end newline-delimited files that do
+	// not end with a newline before the next one starts
+	lastByte byte
+
+	// newlines counts the newlines read so far, and lineStarts how many had been read when each
+	// opened file started, to map the lines of the stream back to their files
+	newlines   int
+	lineStarts []int
+}
+
+func newMergedReader(ctx context.Context, sourceS3Client s3iface.S3API, sources []sourceObject) *mergedReader {
+	return &mergedReader{ctx: ctx, sourceS3Client: sourceS3Client, sources: sources, current: -1}
+}
+
+func (m *mergedReader) Read(p []byte) (int, error) {
+	for {
+		if m.reader == nil {
+			if m.current+1 >= len(m.sources) {
+				return 0, io.EOF
+			}
+			if err := m.open(m.current + 1); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := m.reader.Read(p)
+		if n > 0 {
+			m.lastByte = p[n-1]
+			m.newlines += bytes.Count(p[:n], []byte{'\n'})
+			return n, nil
+		}
+		if err != io.EOF {
+			return 0, err
+		}
+
+		m.closeCurrent()
+		if inputFraming == inputFramingNewline && m.lastByte != '\n' && m.lastByte != 0 && len(p) > 0 {
+			p[0], m.lastByte = '\n', '\n'
+			m.newlines++
+			return 1, nil
+		}
+	}
+}
+
+// open starts reading the file at index i. Files that cannot be decompressed fail with a ParseError.
+func (m *mergedReader) open(i int) error {
+	m.current, m.lastByte = i, 0
+	m.lineStarts = append(m.lineStarts, m.newlines)
+	m.stream = openSourceStream(m.ctx, m.sourceS3Client, m.sources[i])
+
+	reader, err := newSourceReader(m.stream)
+	if err != nil {
+		m.closeCurrent()
+		if isDownloadFailure(err) {
+			return err
+		}
+		return &ParseError{Source: m.sources[i], Err: err}
+	}
+	m.reader = reader
+	return nil
+}
+
+func (m *mergedReader) closeCurrent() {
+	if m.stream != nil {
+		m.stream.Close()
+	}
+	m.stream, m.reader = nil, nil
+}
+
+// Source returns the file being read, or the last one once the stream is exhausted
+func (m *mergedReader) Source() sourceObject {
+	if m.current < 0 {
+		return m.sources[0]
+	}
+	return m.sources[m.current]
+}
+
+// locate maps the number of a line of the stream to its file and its number in that file. Lines are
+// only known by their newlines, so files with another INPUT_FRAMING are located by the file being
+// read, and numbered across the stream.
+func (m *mergedReader) locate(line int) (sourceObject, int) {
+	if inputFraming != inputFramingNewline || len(m.lineStarts) == 0 {
+		return m.Source(), line
+	}
+
+	// The last file that started before the line
+	i := sort.Search(len(m.lineStarts), func(i int) bool { return m.lineStarts[i] >= line }) - 1
+	if i < 0 {
+		i = 0
+	}
+	return m.sources[i], line - m.lineStarts[i]
+}
+
+func (m *mergedReader) Close() error {
+	m.closeCurrent()
+	return nil
+}
+
+// processMergedSources filters the source files as one stream (MERGE_SOURCES), so that processing
+// spanning records, like DEDUP_LINES, applies across files. A run stopped early resumes from the
+// start of the file it was reading.
+func processMergedSources(ctx context.Context, sourceS3Client s3iface.S3API, sources []sourceObject, writer, rejects recordWriter, profiles []*profileOutput, runSummaries *summaries) (Result, error) {
+	if len(sources) == 0 {
+		return Result{}, nil
+	}
+
+	merged := newMergedReader(ctx, sourceS3Client, sources)
+	defer merged.Close()
+
+	result, validLines, err := filterVPCLogs(ctx, merged, merged.locate, writer, rejects, profiles, runSummaries)
+	result.ObjectsProcessed = merged.current + 1
+	if result.Truncated {
+		source := merged.Source()
+		result.ResumeFrom = &ResumePoint{Bucket: source.Bucket, Key: source.Key}
+	}
+
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) && parseErr.Source == (sourceObject{}) {
+		parseErr.Source = merged.Source()
+	}
+	if err == nil && result.LinesScanned > 0 && validLines == 0 {
+		err = &ParseError{Source: merged.Source(), Err: errNoValidLines()}
+	}
+	return result, err
+}
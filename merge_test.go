@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// runMergeSources filters three source files sharing duplicated lines with DEDUP_LINES, returning
+// the result and the output
+func runMergeSources(t *testing.T, merge bool) (Result, string) {
+	t.Helper()
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &dedupLines, true)
+	setForTest(t, &mergeSources, merge)
+
+	first := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")
+	second := flowLogLine("eni-2", "10.0.0.2", "8.8.8.8")
+	third := flowLogLine("eni-3", "10.0.0.3", "8.8.8.8")
+	fake.put("src", "a.log", first+"\n"+second+"\n")
+	// Delivered again in the next file, which does not end with a newline
+	fake.put("src", "b.log", second+"\n"+third)
+	fake.put("src", "c.log", first+"\n")
+
+	result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "a.log"}, {Bucket: "src", Key: "b.log"}, {Bucket: "src", Key: "c.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, _ := fake.get("dest", "out.log")
+	return result, output
+}
+
+func TestMergeSourcesDedupsAcrossFiles(t *testing.T) {
+	result, output := runMergeSources(t, true)
+
+	if result.DuplicateLines != 2 || result.ObjectsProcessed != 3 {
+		t.Errorf("dropped %d duplicate lines from %d files, want 2 from 3", result.DuplicateLines, result.ObjectsProcessed)
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("output %q, want each of the 3 distinct lines once", output)
+	}
+	for i, line := range lines {
+		if want := "10.0.0." + strconv.Itoa(i+1); !strings.Contains(line, want) {
+			t.Errorf("output line %d is %q, want the record from %s", i, line, want)
+		}
+	}
+}
+
+func TestDedupWithoutMergeSourcesIsPerFile(t *testing.T) {
+	result, output := runMergeSources(t, false)
+
+	if result.DuplicateLines != 0 || strings.Count(output, "\n") != 5 {
+		t.Errorf("dropped %d duplicate lines and wrote %q, want every line of each file", result.DuplicateLines, output)
+	}
+}
+
+func TestMergedReaderLocatesLines(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.put("src", "a.log", "1\n2\n")
+	fake.put("src", "b.log", "3\n4\n5\n")
+
+	merged := newMergedReader(context.Background(), client, []sourceObject{{Bucket: "src", Key: "a.log"}, {Bucket: "src", Key: "b.log"}})
+	defer merged.Close()
+	reader := newRecordReader(merged)
+	for i := 0; i < 5; i++ {
+		if _, err := reader.ReadRecord(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for line, want := range map[int]string{1: "a.log:1", 2: "a.log:2", 3: "b.log:1", 5: "b.log:3"} {
+		source, number := merged.locate(line)
+		if got := source.Key + ":" + strconv.Itoa(number); got != want {
+			t.Errorf("line %d located at %s, want %s", line, got, want)
+		}
+	}
+}
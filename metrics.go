@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// emitMetrics writes the run's counts (and the bytes of output written to S3) to stdout in
+// CloudWatch Embedded Metric Format, which
+// CloudWatch Logs turns into metrics without any API calls. Every metric is emitted on every run -
+// including LinesMatched when it is zero - so alarms see a datapoint instead of missing data, and
+// ZeroMatchRuns is 1 on runs that matched nothing so an alarm can fire on sustained zero-match
+// invocations (a misconfigured filter or a source that stopped receiving traffic). RuleHits is
+// emitted per rule, with the rule as a dimension.
+func emitMetrics(result Result, bytesWritten int64) {
+	zeroMatchRuns := 0
+	if result.LinesMatched == 0 {
+		zeroMatchRuns = 1
+	}
+
+	emitMetric(map[string]string{"FunctionName": functionName}, []metricValue{
+		{"LinesScanned", result.LinesScanned},
+		{"LinesMatched", result.LinesMatched},
+		{"ZeroMatchRuns", zeroMatchRuns},
+		{"BytesWritten", int(bytesWritten)},
+	})
+
+	for rule, hits := range result.RuleHits {
+		emitMetric(map[string]string{"FunctionName": functionName, "Rule": rule}, []metricValue{{"RuleHits", hits}})
+	}
+}
+
+// emitMetric emits the counts as EMF, and to StatsD when STATSD_ADDR is set
+func emitMetric(dimensions map[string]string, values []metricValue) {
+	emitEMF(dimensions, values)
+	emitStatsD(dimensions, values)
+}
+
+type metricValue struct {
+	Name  string
+	Value int
+}
+
+// emitEMF prints a single EMF event with the given dimensions and count metrics
+func emitEMF(dimensions map[string]string, values []metricValue) {
+	dimensionNames := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+	}
+	sort.Strings(dimensionNames)
+
+	metrics := make([]map[string]string, 0, len(values))
+	for _, value := range values {
+		metrics = append(metrics, map[string]string{"Name": value.Name, "Unit": "Count"})
+	}
+
+	event := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": clock.Now().UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  metricsNamespace,
+				"Dimensions": [][]string{dimensionNames},
+				"Metrics":    metrics,
+			}},
+		},
+	}
+	for name, value := range dimensions {
+		event[name] = value
+	}
+	for _, value := range values {
+		event[value.Name] = value.Value
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// Printed rather than logged - EMF events must be bare JSON lines, without the log package's prefix
+	fmt.Println(string(line))
+}
+
+// outputBytes sums the sizes of the committed output objects
+func outputBytes(objects []outputObject) int64 {
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+	return total
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestZeroMatchRunEmitsMetrics(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	rules, err := parseSourceRules("test", []string{"192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+
+	var runErr error
+	output := captureStdout(t, func() {
+		_, runErr = run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+			return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+		})
+	})
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+
+	var metrics map[string]interface{}
+	for _, line := range strings.Split(output, "\n") {
+		var event map[string]interface{}
+		if json.Unmarshal([]byte(line), &event) == nil && event["LinesScanned"] != nil {
+			metrics = event
+		}
+	}
+	if metrics == nil {
+		t.Fatalf("no run metrics emitted:\n%s", output)
+	}
+	if matched, ok := metrics["LinesMatched"]; !ok || matched != 0.0 {
+		t.Errorf("LinesMatched %v, want 0", matched)
+	}
+	if zeroMatchRuns := metrics["ZeroMatchRuns"]; zeroMatchRuns != 1.0 {
+		t.Errorf("ZeroMatchRuns %v, want 1", zeroMatchRuns)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	outputFormatRaw     = "raw"
+	outputFormatJSON    = "json"
+	outputFormatJSONSeq = "json-seq"
+	outputFormatCSV     = "csv"
+)
+
+// recordWriter serializes matched flow log records to the output object. Flush writes out any
+// records the writer is buffering; Close flushes and finishes the output.
+type recordWriter interface {
+	Write(vpcLog *VPCFlowLog) error
+	Flush() error
+	Close() error
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	var writer recordWriter
+	switch format {
+	case "", outputFormatRaw:
+		return withRedaction(&rawRecordWriter{w: w, terminator: outputRecordSep}), nil
+	case outputFormatJSON:
+		writer = &jsonRecordWriter{w: w, terminator: outputRecordSep}
+	case outputFormatJSONSeq:
+		// RFC 7464 JSON text sequence: each record starts with a record separator and ends with a
+		// line feed, so a consumer can recover from a truncated record at the next RS
+		writer = &jsonRecordWriter{w: w, prefix: "\x1e", terminator: "\n"}
+	case outputFormatCSV:
+		csvWriter := &csvRecordWriter{w: csv.NewWriter(w)}
+		if len(outputFields) == 0 {
+			csvWriter.layout = csvLayoutFields()
+		}
+		writer = csvWriter
+	default:
+		return nil, fmt.Errorf("Output format %s not supported - expected one of raw, json, json-seq, csv", format)
+	}
+
+	if len(outputFields) > 0 {
+		writer = &projectingRecordWriter{recordWriter: writer, fields: outputFields}
+	}
+	return withRedaction(writer), nil
+}
+
+// outputExtension is the file extension for the output format and compression, e.g. ".jsonl.gz".
+// OUTPUT_EXTENSION overrides it.
+func outputExtension() string {
+	if outputExtensionOverride != "" {
+		return "." + strings.TrimPrefix(outputExtensionOverride, ".")
+	}
+
+	ext := ".log"
+	switch outputFormat {
+	case outputFormatJSON:
+		ext = ".jsonl"
+	case outputFormatJSONSeq:
+		ext = ".json-seq"
+	case outputFormatCSV:
+		ext = ".csv"
+	}
+	if outputCompression == outputCompressionGzip || outputCompression == outputCompressionBGZF {
+		// BGZF is gzip to readers that don't know it
+		ext += ".gz"
+	}
+	return ext
+}
+
+// withOutputExtension replaces the extension of the key's file name (everything from its first
+// ".") with the output extension, so e.g. JSON output doesn't end up in a .csv object
+func withOutputExtension(key string) string {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return key[:strings.LastIndex(key, "/")+1] + name + outputExtension()
+}
+
+// parseOutputRecordSep parses OUTPUT_RECORD_SEP, written with Go string escapes (e.g. "\r\n" or
+// "\x1e"), defaulting to a line feed
+func parseOutputRecordSep(value string) string {
+	if value == "" {
+		return "\n"
+	}
+
+	sep, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		log.Fatalf("OUTPUT_RECORD_SEP %q is not a valid escaped string, e.g. \\n or \\x1e", value)
+	}
+	return sep
+}
+
+// parseOutputFields parses the comma-separated OUTPUT_FIELDS list, failing on unknown field names
+func parseOutputFields(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	fields := strings.Split(value, ",")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+		if !isKnownField(fields[i]) {
+			log.Fatalf("OUTPUT_FIELDS contains unknown field %q", fields[i])
+		}
+	}
+	return fields
+}
+
+// projectingRecordWriter reduces each record to the configured fields, in the configured order,
+// before it is serialized. Fields a record does not have are written as empty values.
+type projectingRecordWriter struct {
+	recordWriter
+	fields []string
+}
+
+func (p *projectingRecordWriter) Write(vpcLog *VPCFlowLog) error {
+	projected := &VPCFlowLog{Raw: vpcLog.Raw, Fields: make([]Field, len(p.fields))}
+	for i, name := range p.fields {
+		projected.Fields[i] = Field{Name: name, Value: vpcLog.Get(name)}
+	}
+	return p.recordWriter.Write(projected)
+}
+
+const (
+	redactModeMask = "mask"
+	redactModeHash = "hash"
+
+	redactedValue = "****"
+)
+
+// anonymizedFields are the address fields ANONYMIZE_MASK truncates
+var anonymizedFields = map[string]bool{"srcaddr": true, "dstaddr": true, "pkt-srcaddr": true, "pkt-dstaddr": true}
+
+// redactingRecordWriter masks the REDACT_FIELDS of each record, and truncates its addresses to
+// ANONYMIZE_MASK, before it is serialized. Records are only redacted on their way out, so filtering
+// and rule matching always see the original values.
+type redactingRecordWriter struct {
+	recordWriter
+	fields map[string]bool
+}
+
+func withRedaction(writer recordWriter) recordWriter {
+	if len(redactFields) == 0 && anonymizeMaskV4 == nil && anonymizeMaskV6 == nil {
+		return writer
+	}
+	return &redactingRecordWriter{recordWriter: writer, fields: redactFields}
+}
+
+func (r *redactingRecordWriter) Write(vpcLog *VPCFlowLog) error {
+	redacted := &VPCFlowLog{Fields: make([]Field, len(vpcLog.Fields))}
+	for i, field := range vpcLog.Fields {
+		if r.fields[field.Name] {
+			field.Value = redactValue(field.Value)
+		} else if anonymizedFields[field.Name] {
+			field.Value = anonymizeAddr(field.Value)
+		}
+		redacted.Fields[i] = field
+	}
+	redacted.Raw = redactLine(vpcLog.Raw, redacted.Fields)
+	return r.recordWriter.Write(redacted)
+}
+
+// redactLine puts the redacted values of a text line's layout fields in place in the line, for raw
+// output, which copies the line. Values past the end of the layout are kept as they are, and lines
+// that were not parsed into fields (rejected invalid lines) are left unchanged.
+func redactLine(line string, fields []Field) string {
+	if inputFormat == inputFormatJSON {
+		// Only raw output copies the line, and it refuses to redact JSON input (checkRawRedaction)
+		return line
+	}
+	values := strings.Split(line, " ")
+	layout := len(lineLogFields(line))
+	for i := 0; i < layout && i < len(values) && i < len(fields); i++ {
+		values[i] = fields[i].Value
+	}
+	return strings.Join(values, " ")
+}
+
+// checkRawRedaction refuses redacting raw output of INPUT_FORMAT=json records: raw output copies
+// the source lines, and the values of a JSON line cannot be redacted in place
+func checkRawRedaction(name string) {
+	if inputFormat == inputFormatJSON && (outputFormat == "" || outputFormat == outputFormatRaw) {
+		log.Fatalf("%s cannot be used with INPUT_FORMAT=json and raw output - set OUTPUT_FORMAT to json or csv", name)
+	}
+}
+
+// redactValue replaces a value with "****", or with a salted hash under REDACT_MODE=hash so
+// redacted values can still be grouped and joined on without revealing them
+func redactValue(value string) string {
+	if redactMode != redactModeHash {
+		return redactedValue
+	}
+	sum := sha256.Sum256([]byte(redactSalt + value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// anonymizeAddr zeroes the host bits of an address past the ANONYMIZE_MASK prefix of its IP
+// version. Values that are not addresses ("-") and versions without a mask are left as they are.
+func anonymizeAddr(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return value
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if anonymizeMaskV4 == nil {
+			return value
+		}
+		return ip4.Mask(anonymizeMaskV4).String()
+	}
+	if anonymizeMaskV6 == nil {
+		return value
+	}
+	return ip.Mask(anonymizeMaskV6).String()
+}
+
+// parseAnonymizeMask parses ANONYMIZE_MASK - an IPv4 prefix length, an IPv6 one, or both
+// comma-separated, e.g. "/24,/48". A single prefix over /32 is taken as the IPv6 mask.
+func parseAnonymizeMask(value string) (net.IPMask, net.IPMask) {
+	if value == "" {
+		return nil, nil
+	}
+	checkRawRedaction("ANONYMIZE_MASK")
+
+	var v4, v6 net.IPMask
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		bits, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(part), "/"))
+		if err != nil || bits < 0 || bits > 128 || len(parts) > 2 {
+			log.Fatalf("ANONYMIZE_MASK %q not in the correct format - expected an IPv4 and/or IPv6 prefix length, e.g. /24,/48", value)
+		}
+		if (len(parts) == 1 && bits <= 32) || (len(parts) == 2 && i == 0) {
+			if bits > 32 {
+				log.Fatalf("ANONYMIZE_MASK %q has an IPv4 prefix over /32", value)
+			}
+			v4 = net.CIDRMask(bits, 32)
+		} else {
+			v6 = net.CIDRMask(bits, 128)
+		}
+	}
+	return v4, v6
+}
+
+// parseRedactFields parses the comma-separated REDACT_FIELDS list, failing on unknown field names
+func parseRedactFields(value string) map[string]bool {
+	if value == "" {
+		return nil
+	}
+
+	checkRawRedaction("REDACT_FIELDS")
+	fields := map[string]bool{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !isKnownField(field) {
+			log.Fatalf("REDACT_FIELDS contains unknown field %q", field)
+		}
+		fields[field] = true
+	}
+	return fields
+}
+
+func parseRedactMode(mode string) string {
+	switch mode {
+	case "":
+		return redactModeMask
+	case redactModeMask, redactModeHash:
+		return mode
+	default:
+		log.Fatalf("REDACT_MODE %s not supported - expected one of mask, hash", mode)
+		return ""
+	}
+}
+
+// rawRecordWriter copies the original log lines as-is, each followed by the terminator
+type rawRecordWriter struct {
+	w          io.Writer
+	terminator string
+}
+
+func (r *rawRecordWriter) Write(vpcLog *VPCFlowLog) error {
+	_, err := io.WriteString(r.w, vpcLog.Raw+r.terminator)
+	return err
+}
+
+func (r *rawRecordWriter) Flush() error {
+	return nil
+}
+
+func (r *rawRecordWriter) Close() error {
+	return nil
+}
+
+// jsonRecordWriter writes one JSON object per record, between prefix and terminator - one per line
+// (JSONL) by default. Objects are built by hand rather than marshalling a map so the keys keep the
+// order of the log format.
+type jsonRecordWriter struct {
+	w          io.Writer
+	prefix     string
+	terminator string
+}
+
+func (j *jsonRecordWriter) Write(vpcLog *VPCFlowLog) error {
+	if err := checkSerializable(vpcLog); err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(j.prefix)
+	buf.WriteByte('{')
+	for i, field := range vpcLog.Fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.Name)
+		value, _ := json.Marshal(field.Value)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	buf.WriteString(j.terminator)
+
+	_, err := j.w.Write(buf.Bytes())
+	return err
+}
+
+func (j *jsonRecordWriter) Flush() error {
+	return nil
+}
+
+func (j *jsonRecordWriter) Close() error {
+	return nil
+}
+
+// SerializationError is returned for a record that cannot be written in the output format as it
+// is. Nothing of the record has been written when it is returned.
+type SerializationError struct {
+	Field string
+	Err   error
+}
+
+func (e *SerializationError) Error() string {
+	return fmt.Sprintf("Unable to serialize field %s: %v", e.Field, e.Err)
+}
+
+func (e *SerializationError) Unwrap() error {
+	return e.Err
+}
+
+// checkSerializable rejects records with values that are not valid UTF-8. JSON and CSV output
+// would silently replace the invalid bytes, so the record would no longer be what was logged.
+func checkSerializable(vpcLog *VPCFlowLog) error {
+	for _, field := range vpcLog.Fields {
+		if !utf8.ValidString(field.Value) {
+			return &SerializationError{Field: field.Name, Err: fmt.Errorf("Value %q is not valid UTF-8", field.Value)}
+		}
+	}
+	return nil
+}
+
+// csvRecordWriter writes a header row followed by one row per record, all with the header's
+// columns: every field of the log lines (layout), followed by the other fields of the first record
+// (e.g. flowId) - or just the fields of the first record, when the records are projected to
+// OUTPUT_FIELDS. Fields a record does not have are written as "-". A record with a field that is
+// not a column fails with a SerializationError rather than making its row longer than the header.
+type csvRecordWriter struct {
+	w       *csv.Writer
+	layout  []string
+	columns map[string]int
+}
+
+// csvLayoutFields are the fields CSV output has a column for whatever the lines of a file are: the
+// fields of every version layout when the version is detected per line (each version extends the
+// previous one, so that is the v5 layout), otherwise those of the log format
+func csvLayoutFields() []string {
+	if detectLogVersion && inputFormat != inputFormatJSON {
+		return logFieldsV5
+	}
+	return logFields
+}
+
+func (c *csvRecordWriter) Write(vpcLog *VPCFlowLog) error {
+	if err := checkSerializable(vpcLog); err != nil {
+		return err
+	}
+
+	if c.columns == nil {
+		header := append([]string{}, c.layout...)
+		c.columns = map[string]int{}
+		for i, name := range header {
+			c.columns[name] = i
+		}
+		for _, field := range vpcLog.Fields {
+			if _, ok := c.columns[field.Name]; !ok {
+				c.columns[field.Name] = len(header)
+				header = append(header, field.Name)
+			}
+		}
+		if err := c.w.Write(header); err != nil {
+			return err
+		}
+	}
+
+	row := make([]string, len(c.columns))
+	for i := range row {
+		row[i] = "-"
+	}
+	for _, field := range vpcLog.Fields {
+		i, ok := c.columns[field.Name]
+		if !ok {
+			return &SerializationError{Field: field.Name, Err: fmt.Errorf("Field is not one of the CSV columns, which are fixed by the header")}
+		}
+		row[i] = field.Value
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvRecordWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvRecordWriter) Close() error {
+	return c.Flush()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serialize writes the lines' records in the format
+func serialize(t *testing.T, format string, lines ...string) string {
+	t.Helper()
+	var output bytes.Buffer
+	writer, err := newRecordWriter(format, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		vpcLog, err := parseRecord(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Write(vpcLog); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+// redactedOutput filters the lines into the format with the fields redacted, matching srcaddr 10.0.0.1
+func redactedOutput(t *testing.T, format string, fields map[string]bool, lines ...string) string {
+	t.Helper()
+	rules, err := parseSourceRules("test", []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+	setForTest(t, &redactFields, fields)
+
+	var output bytes.Buffer
+	writer, err := newRecordWriter(format, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := filterLinesTo(t, writer, lines...); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+func TestOutputFieldsProjection(t *testing.T) {
+	setForTest(t, &outputFields, parseOutputFields("dstaddr, srcaddr,bytes"))
+
+	if got, want := serialize(t, outputFormatJSON, testFlowLogLine), `{"dstaddr":"8.8.8.8","srcaddr":"10.0.0.1","bytes":"840"}`+"\n"; got != want {
+		t.Errorf("JSON output %q, want %q", got, want)
+	}
+	if got, want := serialize(t, outputFormatCSV, testFlowLogLine), "dstaddr,srcaddr,bytes\n8.8.8.8,10.0.0.1,840\n"; got != want {
+		t.Errorf("CSV output %q, want %q", got, want)
+	}
+	// Raw output copies the line whatever the projection
+	if got := serialize(t, outputFormatRaw, testFlowLogLine); got != testFlowLogLine+"\n" {
+		t.Errorf("raw output %q", got)
+	}
+}
+
+func TestCSVMixedLogVersions(t *testing.T) {
+	v2 := testFlowLogLine
+	v5 := v5FlowLogLine("10.0.0.5", "2")
+
+	rows, err := csv.NewReader(strings.NewReader(serialize(t, outputFormatCSV, v2, v5, v2))).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV with version 2 and 5 lines: %v", err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(logFieldsV5, ",") {
+		t.Fatalf("header %v, want the version 5 layout", rows[0])
+	}
+	for i, want := range []string{"-", "2", "-"} {
+		if tcpFlags := rows[i+1][indexOf(logFieldsV5, "tcp-flags")]; tcpFlags != want {
+			t.Errorf("row %d tcp-flags %q, want %q", i+1, tcpFlags, want)
+		}
+	}
+	if rows[1][indexOf(logFieldsV5, "srcaddr")] != "10.0.0.1" {
+		t.Errorf("version 2 row %v not mapped to the header's columns", rows[1])
+	}
+}
+
+func indexOf(fields []string, name string) int {
+	for i, field := range fields {
+		if field == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestOutputKeyExtension(t *testing.T) {
+	tests := []struct {
+		format, compression, override string
+		want                          string
+	}{
+		{"", "", "", "out/vpc-logs.log"},
+		{outputFormatRaw, "", "", "out/vpc-logs.log"},
+		{outputFormatJSON, "", "", "out/vpc-logs.jsonl"},
+		{outputFormatJSONSeq, "", "", "out/vpc-logs.json-seq"},
+		{outputFormatCSV, "", "", "out/vpc-logs.csv"},
+		{"", outputCompressionGzip, "", "out/vpc-logs.log.gz"},
+		{outputFormatJSON, outputCompressionGzip, "", "out/vpc-logs.jsonl.gz"},
+		{outputFormatCSV, outputCompressionBGZF, "", "out/vpc-logs.csv.gz"},
+		{outputFormatJSON, outputCompressionGzip, "txt", "out/vpc-logs.txt"},
+	}
+	for _, test := range tests {
+		setForTest(t, &outputFormat, test.format)
+		setForTest(t, &outputCompression, test.compression)
+		setForTest(t, &outputExtensionOverride, test.override)
+		if key := withOutputExtension("out/vpc-logs.csv"); key != test.want {
+			t.Errorf("format %q, compression %q, extension %q: key %s, want %s", test.format, test.compression, test.override, key, test.want)
+		}
+	}
+}
+
+func TestRedactFieldsMasksOutputNotMatching(t *testing.T) {
+	output := redactedOutput(t, outputFormatRaw, map[string]bool{"account-id": true, "srcaddr": true},
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-2", "10.0.0.2", "8.8.8.8"))
+
+	want := "2 **** eni-1 **** 8.8.8.8 1234 443 6 10 840 1700000000 1700000060 ACCEPT OK\n"
+	if output != want {
+		t.Fatalf("raw output %q, want %q", output, want)
+	}
+}
+
+func TestRedactFieldsKeepsTrailingValues(t *testing.T) {
+	output := redactedOutput(t, outputFormatRaw, map[string]bool{"account-id": true},
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+" extra")
+
+	if !strings.HasPrefix(output, "2 **** eni-1 ") || !strings.HasSuffix(output, " OK extra\n") {
+		t.Fatalf("raw output %q lost the values past the layout", output)
+	}
+}
+
+func TestRedactFieldsJSONOutput(t *testing.T) {
+	output := redactedOutput(t, outputFormatJSON, map[string]bool{"account-id": true}, flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"))
+
+	if !strings.Contains(output, `"account-id":"****"`) || strings.Contains(output, "123456789012") {
+		t.Fatalf("JSON output %q does not mask account-id", output)
+	}
+}
+
+func TestRedactValueHashMode(t *testing.T) {
+	setForTest(t, &redactMode, redactModeHash)
+	setForTest(t, &redactSalt, "salt")
+
+	hashed := redactValue("123456789012")
+	if hashed == "123456789012" || hashed == redactedValue || len(hashed) != 16 {
+		t.Fatalf("hash mode redacted to %q", hashed)
+	}
+	if redactValue("123456789012") != hashed {
+		t.Fatal("hash mode is not deterministic")
+	}
+	setForTest(t, &redactSalt, "other")
+	if redactValue("123456789012") == hashed {
+		t.Fatal("hash does not depend on REDACT_SALT")
+	}
+}
+
+func TestAnonymizeMaskTruncatesOutputNotMatching(t *testing.T) {
+	setForTest(t, &anonymizeMaskV4, net.CIDRMask(24, 32))
+	output := redactedOutput(t, outputFormatRaw, nil,
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-2", "10.0.0.2", "8.8.8.8"))
+
+	// Matching saw 10.0.0.1; the output only has its /24 network
+	want := "2 123456789012 eni-1 10.0.0.0 8.8.8.0 1234 443 6 10 840 1700000000 1700000060 ACCEPT OK\n"
+	if output != want {
+		t.Fatalf("raw output %q, want %q", output, want)
+	}
+}
+
+func TestAnonymizeAddr(t *testing.T) {
+	v4, v6 := parseAnonymizeMask("/16,/48")
+	setForTest(t, &anonymizeMaskV4, v4)
+	setForTest(t, &anonymizeMaskV6, v6)
+
+	for value, want := range map[string]string{
+		"10.1.2.3":              "10.1.0.0",
+		"2001:db8:1234:5678::1": "2001:db8:1234::",
+		"-":                     "-",
+	} {
+		if got := anonymizeAddr(value); got != want {
+			t.Errorf("anonymizeAddr(%q) = %q, want %q", value, got, want)
+		}
+	}
+
+	setForTest(t, &anonymizeMaskV6, nil)
+	if got := anonymizeAddr("2001:db8::1"); got != "2001:db8::1" {
+		t.Errorf("IPv6 address without an IPv6 mask anonymized to %q", got)
+	}
+}
+
+func TestParseAnonymizeMaskSinglePrefix(t *testing.T) {
+	if v4, v6 := parseAnonymizeMask("/24"); v6 != nil || v4.String() != net.CIDRMask(24, 32).String() {
+		t.Errorf("/24 parsed as %v, %v, want an IPv4 mask", v4, v6)
+	}
+	if v4, v6 := parseAnonymizeMask("/48"); v4 != nil || v6.String() != net.CIDRMask(48, 128).String() {
+		t.Errorf("/48 parsed as %v, %v, want an IPv6 mask", v4, v6)
+	}
+}
+
+func TestSerializationErrorWritesNothing(t *testing.T) {
+	for _, format := range []string{outputFormatJSON, outputFormatCSV} {
+		var output bytes.Buffer
+		writer, err := newRecordWriter(format, &output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = writer.Write(parseTestRecord(t, recordLine("interface-id=eni-\xff")))
+		var serializationErr *SerializationError
+		if !errors.As(err, &serializationErr) || serializationErr.Field != "interface-id" {
+			t.Errorf("%s: write returned %v, want a SerializationError for interface-id", format, err)
+		}
+		if output.Len() != 0 {
+			t.Errorf("%s: wrote %q for a record that failed to serialize", format, output.String())
+		}
+	}
+}
+
+func TestJSONSeqPrefixesEachRecord(t *testing.T) {
+	output := serialize(t, outputFormatJSONSeq,
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-2", "10.0.0.2", "8.8.8.8"))
+
+	records := strings.Split(output, "\x1e")
+	if len(records) != 3 || records[0] != "" {
+		t.Fatalf("json-seq output %q, want RS before each of the 2 records", output)
+	}
+	for _, record := range records[1:] {
+		if !strings.HasPrefix(record, "{") || !strings.HasSuffix(record, "}\n") {
+			t.Errorf("json-seq record %q, want a JSON object followed by a line feed", record)
+		}
+	}
+}
+
+func TestOutputRecordSep(t *testing.T) {
+	setForTest(t, &outputRecordSep, parseOutputRecordSep(`\r\n`))
+	line := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")
+
+	if output := serialize(t, outputFormatRaw, line, line); output != line+"\r\n"+line+"\r\n" {
+		t.Errorf("raw output %q, want each line terminated by CRLF", output)
+	}
+	if output := serialize(t, outputFormatJSON, line); !strings.HasSuffix(output, "}\r\n") {
+		t.Errorf("JSON output %q, want the record terminated by CRLF", output)
+	}
+
+	if sep := parseOutputRecordSep(`\x1e`); sep != "\x1e" {
+		t.Errorf(`parsed \x1e as %q`, sep)
+	}
+	if sep := parseOutputRecordSep(""); sep != "\n" {
+		t.Errorf("default separator %q, want a line feed", sep)
+	}
+}
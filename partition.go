@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+)
+
+// registerPartition adds the partition the output was written to to GLUE_TABLE, so it can be
+// queried from Athena without running a crawler or ALTER TABLE ADD PARTITION. Partition values are
+// read from the Hive-style "name=value" directories of the output key, e.g.
+// "flows/date=2024-03-05/out.log". Registration is best-effort: failures are logged and the run
+// still succeeds.
+func registerPartition(glueClient glueiface.GlueAPI, bucket, key string) {
+	if err := createPartition(glueClient, bucket, key); err != nil {
+		log.Printf("Unable to register partition of s3://%s/%s in %s.%s: %v\n", bucket, key, glueDatabase, glueTable, err)
+	}
+}
+
+func createPartition(glueClient glueiface.GlueAPI, bucket, key string) error {
+	table, err := glueClient.GetTable(&glue.GetTableInput{
+		DatabaseName: aws.String(glueDatabase),
+		Name:         aws.String(glueTable),
+	})
+	if err != nil {
+		return err
+	}
+	if len(table.Table.PartitionKeys) == 0 {
+		return fmt.Errorf("Table is not partitioned")
+	}
+
+	values, location, err := partitionOf(table.Table.PartitionKeys, key)
+	if err != nil {
+		return err
+	}
+
+	descriptor := &glue.StorageDescriptor{}
+	if table.Table.StorageDescriptor != nil {
+		copied := *table.Table.StorageDescriptor
+		descriptor = &copied
+	}
+	descriptor.Location = aws.String(fmt.Sprintf("s3://%s/%s", bucket, location))
+
+	_, err = glueClient.CreatePartition(&glue.CreatePartitionInput{
+		DatabaseName: aws.String(glueDatabase),
+		TableName:    aws.String(glueTable),
+		PartitionInput: &glue.PartitionInput{
+			Values:            aws.StringSlice(values),
+			StorageDescriptor: descriptor,
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == glue.ErrCodeAlreadyExistsException {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Registered partition %s of %s.%s\n", strings.Join(values, "/"), glueDatabase, glueTable)
+	return nil
+}
+
+// partitionOf returns the values of the table's partition keys, in key order, from the
+// "name=value" directories of the output key, along with the partition's location - the key's
+// directory up to and including the last partition directory
+func partitionOf(partitionKeys []*glue.Column, key string) ([]string, string, error) {
+	dirs := strings.Split(key, "/")
+	dirs = dirs[:len(dirs)-1]
+
+	found := map[string]string{}
+	last := -1
+	for i, dir := range dirs {
+		if name, value, ok := strings.Cut(dir, "="); ok {
+			found[name] = value
+			last = i
+		}
+	}
+
+	values := make([]string, len(partitionKeys))
+	for i, column := range partitionKeys {
+		value, ok := found[aws.StringValue(column.Name)]
+		if !ok {
+			return nil, "", fmt.Errorf("Output key has no %s=... directory for partition key %s", aws.StringValue(column.Name), aws.StringValue(column.Name))
+		}
+		values[i] = value
+	}
+	return values, strings.Join(dirs[:last+1], "/") + "/", nil
+}
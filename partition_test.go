@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+)
+
+// fakeGlue serves a table partitioned by date and region, recording the partitions created.
+// createErr, when set, fails CreatePartition.
+type fakeGlue struct {
+	glueiface.GlueAPI
+	created   []*glue.CreatePartitionInput
+	createErr error
+}
+
+func (f *fakeGlue) GetTable(input *glue.GetTableInput) (*glue.GetTableOutput, error) {
+	return &glue.GetTableOutput{Table: &glue.TableData{
+		Name: input.Name,
+		PartitionKeys: []*glue.Column{
+			{Name: aws.String("date")},
+			{Name: aws.String("region")},
+		},
+		StorageDescriptor: &glue.StorageDescriptor{Location: aws.String("s3://dest/flows/")},
+	}}, nil
+}
+
+func (f *fakeGlue) CreatePartition(input *glue.CreatePartitionInput) (*glue.CreatePartitionOutput, error) {
+	f.created = append(f.created, input)
+	return &glue.CreatePartitionOutput{}, f.createErr
+}
+
+func TestRegisterPartition(t *testing.T) {
+	setForTest(t, &glueDatabase, "logs")
+	setForTest(t, &glueTable, "flows")
+	client := &fakeGlue{}
+
+	registerPartition(client, "dest", "flows/region=us-east-1/date=2024-03-05/out.log")
+
+	if len(client.created) != 1 {
+		t.Fatalf("%d partitions created, want 1", len(client.created))
+	}
+	input := client.created[0]
+	if aws.StringValue(input.DatabaseName) != "logs" || aws.StringValue(input.TableName) != "flows" {
+		t.Errorf("partition created in %s.%s", aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName))
+	}
+	// Values follow the table's partition key order, not the key's directory order
+	values := aws.StringValueSlice(input.PartitionInput.Values)
+	if len(values) != 2 || values[0] != "2024-03-05" || values[1] != "us-east-1" {
+		t.Errorf("partition values %v", values)
+	}
+	if location := aws.StringValue(input.PartitionInput.StorageDescriptor.Location); location != "s3://dest/flows/region=us-east-1/date=2024-03-05/" {
+		t.Errorf("partition location %s", location)
+	}
+}
+
+func TestRegisterPartitionIsBestEffort(t *testing.T) {
+	setForTest(t, &glueDatabase, "logs")
+	setForTest(t, &glueTable, "flows")
+
+	// An existing partition is not an error, and other failures are only logged
+	exists := &fakeGlue{createErr: awserr.New(glue.ErrCodeAlreadyExistsException, "exists", nil)}
+	if err := createPartition(exists, "dest", "flows/region=us-east-1/date=2024-03-05/out.log"); err != nil {
+		t.Errorf("existing partition returned %v", err)
+	}
+	failing := &fakeGlue{createErr: errors.New("access denied")}
+	registerPartition(failing, "dest", "flows/region=us-east-1/date=2024-03-05/out.log")
+
+	noPartition := &fakeGlue{}
+	if err := createPartition(noPartition, "dest", "flows/out.log"); err == nil || len(noPartition.created) != 0 {
+		t.Errorf("key without partition directories returned %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+var (
+	permissionsMu       sync.Mutex
+	permissionsVerified bool
+)
+
+// PermissionError is returned by the PERMISSION_PROBE when the function cannot read its source or
+// write its output
+type PermissionError struct {
+	Action string
+	Path   string
+	Err    error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Permission probe failed: cannot %s s3://%s: %v", e.Action, e.Path, e.Err)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// verifyPermissions checks, once per container, that the source can be read and the output
+// written, so a missing permission fails the first invocation up front rather than part way
+// through a run. Only a successful probe is cached - after a failure the next invocation probes
+// again, in case the role has been fixed.
+func verifyPermissions(sourceS3Client, destS3Client s3iface.S3API) error {
+	permissionsMu.Lock()
+	defer permissionsMu.Unlock()
+	if permissionsVerified {
+		return nil
+	}
+
+	if err := probeSource(sourceS3Client); err != nil {
+		return err
+	}
+	if err := probeDest(destS3Client); err != nil {
+		return err
+	}
+	log.Printf("Permission probe passed\n")
+	permissionsVerified = true
+	return nil
+}
+
+// probeSource reads the source object, or lists the first key under the DATE_RANGE prefix. SOURCE_URL
+// sources, and replayed events that name their own objects, are not probed.
+func probeSource(sourceS3Client s3iface.S3API) error {
+	if sourceURL != "" || sourceBucketName == "" {
+		return nil
+	}
+	bucket, key, err := parseBucketAndKeyFromFilePath(sourceBucketName)
+	if err != nil {
+		return err
+	}
+
+	if dateRangeStart.IsZero() {
+		_, err = sourceS3Client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil && !isNotFound(err) {
+			return &PermissionError{Action: "read", Path: bucket + "/" + key, Err: err}
+		}
+		return nil
+	}
+	_, err = sourceS3Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(key), MaxKeys: aws.Int64(1)})
+	if err != nil {
+		return &PermissionError{Action: "list", Path: bucket + "/" + key, Err: err}
+	}
+	return nil
+}
+
+// probeDest checks that objects can be put next to the output without writing one: the probe's
+// Content-MD5 does not match its body, and S3 authorizes a request before checking its digest, so
+// a role that may write gets BadDigest and nothing is stored, while one that may not gets
+// AccessDenied.
+func probeDest(destS3Client s3iface.S3API) error {
+	bucket, key, err := parseBucketAndKeyFromFilePath(destBucketName)
+	if err != nil {
+		return err
+	}
+	probeKey := siblingKey(key, ".permission-probe")
+
+	_, err = destS3Client.PutObject(&s3.PutObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(probeKey),
+		Body:       bytes.NewReader([]byte("probe")),
+		ContentMD5: aws.String("AAAAAAAAAAAAAAAAAAAAAA=="),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "BadDigest" {
+		return nil
+	}
+	if err != nil {
+		return &PermissionError{Action: "write", Path: bucket + "/" + probeKey, Err: err}
+	}
+	// S3-compatible stores that do not check the digest store the probe object
+	log.Printf("Permission probe wrote s3://%s/%s\n", bucket, probeKey)
+	return nil
+}
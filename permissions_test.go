@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// probeRequests counts the requests made for the dest permission probe
+func probeRequests(fake *fakeS3) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	n := 0
+	for _, request := range fake.requests {
+		if request == http.MethodPut+" /dest/.permission-probe" {
+			n++
+		}
+	}
+	return n
+}
+
+func usePermissionProbe(t *testing.T) *fakeS3 {
+	t.Helper()
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src/in.log")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &permissionProbe, true)
+	setForTest(t, &permissionsVerified, false)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	return fake
+}
+
+func TestPermissionProbeRunsOncePerContainer(t *testing.T) {
+	fake := usePermissionProbe(t)
+
+	for i := 0; i < 3; i++ {
+		if _, err := HandleRequest(context.Background()); err != nil {
+			t.Fatalf("invocation %d: %v", i+1, err)
+		}
+	}
+	if probes := probeRequests(fake); probes != 1 {
+		t.Errorf("probed the dest %d times over 3 invocations, want once", probes)
+	}
+	// The probe's bad digest keeps anything from being stored
+	for _, key := range fake.keys("dest") {
+		if strings.Contains(key, "permission-probe") {
+			t.Errorf("probe object %s was stored", key)
+		}
+	}
+}
+
+func TestPermissionProbeFailureIsNotCached(t *testing.T) {
+	fake := usePermissionProbe(t)
+	denied := true
+	fake.fail = func(r *http.Request) int {
+		if denied && strings.HasSuffix(r.URL.Path, ".permission-probe") {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+
+	_, err := HandleRequest(context.Background())
+	var permissionErr *PermissionError
+	if !errors.As(err, &permissionErr) || permissionErr.Action != "write" || permissionErr.Path != "dest/.permission-probe" {
+		t.Fatalf("got %v, want a write PermissionError for dest/.permission-probe", err)
+	}
+	if keys := fake.keys("dest"); len(keys) != 0 {
+		t.Errorf("failed probe still wrote %v", keys)
+	}
+
+	// Once the role is fixed the next invocation probes again and goes ahead
+	denied = false
+	if _, err := HandleRequest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if probes := probeRequests(fake); probes != 2 {
+		t.Errorf("probed the dest %d times, want again after the failure", probes)
+	}
+	if _, ok := fake.get("dest", "out.log"); !ok {
+		t.Error("no output after the probe passed")
+	}
+}
+
+func TestPermissionProbeReportsUnreadableSource(t *testing.T) {
+	fake := usePermissionProbe(t)
+	fake.fail = func(r *http.Request) int {
+		if r.Method == http.MethodHead && r.URL.Path == "/src/in.log" {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+
+	_, err := HandleRequest(context.Background())
+	var permissionErr *PermissionError
+	if !errors.As(err, &permissionErr) || permissionErr.Action != "read" || permissionErr.Path != "src/in.log" {
+		t.Fatalf("got %v, want a read PermissionError for src/in.log", err)
+	}
+	if probes := probeRequests(fake); probes != 0 {
+		t.Errorf("probed the dest %d times after the source probe failed", probes)
+	}
+}
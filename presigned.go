@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PresignedURLError is returned when S3 refuses a presigned source URL (403), usually because it
+// has expired - Expires is when it did, when the URL says
+type PresignedURLError struct {
+	Expires time.Time
+}
+
+func (e *PresignedURLError) Error() string {
+	if e.Expires.IsZero() {
+		return "Presigned URL was refused (403 Forbidden) - it may have expired, or been signed by credentials that cannot read the object"
+	}
+	if !e.Expires.After(clock.Now()) {
+		return fmt.Sprintf("Presigned URL expired at %s - request a new one", e.Expires.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("Presigned URL was refused (403 Forbidden) before it expires at %s - it was signed by credentials that cannot read the object, or they have been revoked", e.Expires.UTC().Format(time.RFC3339))
+}
+
+// isPresignedURL reports whether rawURL carries an S3 query string signature (SigV4 or SigV2)
+func isPresignedURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	query := parsed.Query()
+	return query.Get("X-Amz-Signature") != "" || query.Get("Signature") != ""
+}
+
+// presignedURLExpiry returns when a presigned URL expires: X-Amz-Date plus X-Amz-Expires seconds for
+// SigV4, or the Expires timestamp for SigV2. It is zero when the URL does not say.
+func presignedURLExpiry(rawURL string) time.Time {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}
+	}
+	query := parsed.Query()
+
+	if signed, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date")); err == nil {
+		if seconds, err := strconv.Atoi(query.Get("X-Amz-Expires")); err == nil {
+			return signed.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	if expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64); err == nil {
+		return time.Unix(expires, 0)
+	}
+	return time.Time{}
+}
+
+// presignedURLError turns a 403 response for a presigned URL into a PresignedURLError, returning
+// nil for any other response
+func presignedURLError(rawURL string, response *http.Response) error {
+	if response.StatusCode != http.StatusForbidden || !isPresignedURL(rawURL) {
+		return nil
+	}
+	return &PresignedURLError{Expires: presignedURLExpiry(rawURL)}
+}
+
+// redactURL drops the query string of a presigned URL, whose signature must not end up in the logs
+func redactURL(rawURL string) string {
+	if !isPresignedURL(rawURL) {
+		return rawURL
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	parsed.RawQuery = ""
+	return parsed.String() + "?<signature redacted>"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presignedServer mimics S3 serving a presigned GET: the request is authorized by the SigV4 query
+// string alone, and refused with 403 once X-Amz-Expires seconds have passed since X-Amz-Date
+func presignedServer(t *testing.T, now Clock, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("Authorization") != "" || query.Get("X-Amz-Signature") == "" {
+			http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+			return
+		}
+		if expires := presignedURLExpiry(r.URL.String()); !expires.After(now.Now()) {
+			http.Error(w, "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func presignedURL(server *httptest.Server, signed time.Time, expires time.Duration) string {
+	return fmt.Sprintf("%s/src/in.log?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIAEXAMPLE%%2F20240305%%2Fus-east-1%%2Fs3%%2Faws4_request&X-Amz-Date=%s&X-Amz-Expires=%d&X-Amz-SignedHeaders=host&X-Amz-Signature=0123456789abcdef",
+		server.URL, signed.UTC().Format("20060102T150405Z"), int(expires.Seconds()))
+}
+
+func TestPresignedURLSource(t *testing.T) {
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)}
+	setForTest[Clock](t, &clock, now)
+	server := presignedServer(t, now, testFlowLogLine+"\n")
+
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceURL, presignedURL(server, now.now.Add(-time.Minute), 15*time.Minute))
+	setForTest(t, &destBucketName, "dest/out.log")
+	logged := captureLog(t)
+
+	result, err := HandleRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LinesMatched != 1 {
+		t.Errorf("matched %d lines, want the presigned object's line", result.LinesMatched)
+	}
+	for _, request := range fake.requests {
+		if !strings.HasPrefix(request, "PUT /dest/") && !strings.HasPrefix(request, "POST /dest/") {
+			t.Errorf("source read through S3 credentials as well: %s", request)
+		}
+	}
+	if strings.Contains(logged.String(), "0123456789abcdef") {
+		t.Errorf("presigned URL signature logged:\n%s", logged)
+	}
+}
+
+func TestExpiredPresignedURL(t *testing.T) {
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)}
+	setForTest[Clock](t, &clock, now)
+	server := presignedServer(t, now, testFlowLogLine+"\n")
+
+	_, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceURL, presignedURL(server, now.now.Add(-time.Hour), 15*time.Minute))
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &pipelineRetries, 2)
+	captureLog(t)
+
+	_, err := HandleRequest(context.Background())
+	var presigned *PresignedURLError
+	if !errors.As(err, &presigned) {
+		t.Fatalf("got %v, want a PresignedURLError", err)
+	}
+	if !presigned.Expires.Equal(time.Date(2024, 3, 5, 9, 15, 0, 0, time.UTC)) || !strings.Contains(err.Error(), "expired at 2024-03-05T09:15:00Z") {
+		t.Errorf("error %q, want it to say the URL expired at 09:15", err)
+	}
+	if isRetryablePipelineError(err) {
+		t.Error("expired presigned URL is retried")
+	}
+}
+
+func TestPresignedURLExpiryAndRedaction(t *testing.T) {
+	for rawURL, want := range map[string]time.Time{
+		"https://b.s3.amazonaws.com/k?X-Amz-Date=20240305T100000Z&X-Amz-Expires=3600&X-Amz-Signature=abc": time.Date(2024, 3, 5, 11, 0, 0, 0, time.UTC),
+		"https://b.s3.amazonaws.com/k?AWSAccessKeyId=AKIA&Expires=1709636400&Signature=abc":               time.Unix(1709636400, 0),
+		"https://example.com/k?X-Amz-Signature=abc":                                                       {},
+	} {
+		if got := presignedURLExpiry(rawURL); !got.Equal(want) {
+			t.Errorf("%s expires %v, want %v", rawURL, got, want)
+		}
+		if redacted := redactURL(rawURL); strings.Contains(redacted, "abc") || !strings.HasSuffix(redacted, "/k?<signature redacted>") {
+			t.Errorf("%s redacted to %s", rawURL, redacted)
+		}
+	}
+	if plain := "https://example.com/logs/in.log?page=2"; redactURL(plain) != plain {
+		t.Errorf("unsigned URL redacted to %s", redactURL(plain))
+	}
+}
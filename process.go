@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// processSourceObject downloads a source object and filters its logs into writer. Objects that
+// cannot be decompressed, or that have no line in the configured log format, fail with a ParseError.
+func processSourceObject(ctx context.Context, sourceS3Client s3iface.S3API, source sourceObject, writer, rejects recordWriter, profiles []*profileOutput, runSummaries *summaries) (Result, error) {
+	if stopEarly(ctx) {
+		return Result{Truncated: true, ResumeFrom: &ResumePoint{Bucket: source.Bucket, Key: source.Key}}, nil
+	}
+
+	_, downloadSpan := tracer.Start(ctx, "download", trace.WithAttributes(attribute.String("source", source.String())))
+	sourceStream := openSourceStream(ctx, sourceS3Client, source)
+	defer sourceStream.Close()
+
+	sourceReader, err := newSourceReader(sourceStream)
+	endSpan(downloadSpan, err)
+	if isDownloadFailure(err) {
+		return Result{}, err
+	}
+	if err != nil {
+		return Result{}, &ParseError{Source: source, Err: err}
+	}
+
+	filterCtx, filterSpan := tracer.Start(ctx, "filter", trace.WithAttributes(attribute.String("source", source.String())))
+	result, validLines, err := filterVPCLogs(filterCtx, sourceReader, func(line int) (sourceObject, int) { return source, line }, writer, rejects, profiles, runSummaries)
+	filterSpan.SetAttributes(attribute.Int("lines.scanned", result.LinesScanned), attribute.Int("lines.matched", result.LinesMatched))
+	endSpan(filterSpan, err)
+	result.ObjectsProcessed = 1
+	if result.Truncated {
+		result.ResumeFrom = &ResumePoint{Bucket: source.Bucket, Key: source.Key, Line: result.LinesScanned}
+	}
+
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		parseErr.Source = source
+	}
+	if err == nil && result.LinesScanned > 0 && validLines == 0 {
+		err = &ParseError{Source: source, Err: errNoValidLines()}
+	}
+	return result, err
+}
+
+func errNoValidLines() error {
+	return fmt.Errorf("No line has the %d fields of the log format", len(logFields))
+}
+
+// filterVPCLogs scans the source logs and writes the outbound ones to writer, and every other line
+// to rejects when it is not nil, also returning how many lines had every field of the log format.
+// Every parsed record is also written to the outputs of the FILTER_PROFILES it matches.
+// locate maps the number of a line of sourceReader to the file it was read from and its number in
+// that file. Scanning stops early, with a truncated result, when the invocation deadline is near or
+// the invocation is cancelled by SIGTERM.
+func filterVPCLogs(ctx context.Context, sourceReader io.Reader, locate func(line int) (sourceObject, int), writer, rejects recordWriter, profiles []*profileOutput, runSummaries *summaries) (Result, int, error) {
+	reader := newRecordReader(sourceReader)
+	stats := Result{}
+	validLines := 0
+	seen := map[uint64]bool{}
+	batch := batchSize()
+	var matched []matchedRecord
+
+	for {
+		if stats.LinesScanned%deadlineCheckInterval == 0 && stopEarly(ctx) {
+			stats.Truncated = true
+			break
+		}
+
+		//VPC Log has default format <version> <account-id> <interface-id> <srcaddr> <dstaddr> <srcport> <dstport> <protocol> <packets> <bytes> <start> <end> <action> <log-status>
+		//(see logFields for TGW logs and custom formats)
+		//Outbound traffic is filtered by checking that the `srcaddr` is equal to our IP Address
+		line, err := reader.ReadRecord()
+		if err != nil && err == io.EOF {
+			break
+		}
+		if err != nil && ctx.Err() != nil {
+			// The download was cancelled along with the invocation - keep what was scanned
+			stats.Truncated = true
+			break
+		}
+		if isDownloadFailure(err) {
+			return stats, validLines, err
+		}
+		if err != nil {
+			// The records matched before the line that could not be read are still written
+			if writeErr := writeMatched(matched, writer, &stats, runSummaries); writeErr != nil {
+				return stats, validLines, writeErr
+			}
+			return stats, validLines, &ParseError{Err: err}
+		}
+		stats.LinesScanned++
+		if dedupLines {
+			// Lines are compared by their 64-bit hash, so memory grows by a few bytes per line
+			hash := hash64(string(line))
+			if seen[hash] {
+				stats.DuplicateLines++
+				continue
+			}
+			seen[hash] = true
+		}
+
+		vpcLog, err := parseRecord(string(line))
+		if err != nil {
+			stats.InvalidRecords++
+			runSummaries.addInvalid(string(line))
+			if err := reject(rejects, &VPCFlowLog{Raw: string(line)}); err != nil {
+				return stats, validLines, err
+			}
+			continue
+		}
+		// Layouts detected from the version field all extend the default one
+		if len(vpcLog.Fields) >= len(logFields) {
+			validLines++
+		}
+		source, lineNumber := locate(stats.LinesScanned)
+		if timestampSanity != timestampSanityOff {
+			sane := hasSaneTimestamps(vpcLog, deliveryTime(source))
+			if !sane {
+				stats.ClockSkewRecords++
+				if timestampSanity == timestampSanityDrop {
+					if err := reject(rejects, vpcLog); err != nil {
+						return stats, validLines, err
+					}
+					continue
+				}
+			}
+			// Flagging sets the field on every record, so CSV rows all have the header's columns
+			vpcLog.Set("timestampAnomaly", strconv.FormatBool(!sane))
+		}
+		if err := writeProfiles(profiles, vpcLog, &stats); err != nil {
+			return stats, validLines, err
+		}
+		rules := matchSourceRules(vpcLog.Get("srcaddr"))
+		if len(rules) == 0 || !passesFilters(vpcLog) {
+			if err := reject(rejects, vpcLog); err != nil {
+				return stats, validLines, err
+			}
+			continue
+		}
+
+		stats.LinesMatched++
+		if matchLogSampleRate > 0 && rand.Float64() < matchLogSampleRate {
+			log.Printf("Found outbound log from %s: %s\n", rules[0], vpcLog.Raw)
+		}
+
+		if addFlowID {
+			vpcLog.Set("flowId", flowID(vpcLog))
+		}
+		if addSourceRef {
+			vpcLog.Set("sourceKey", source.Key)
+			vpcLog.Set("lineNumber", strconv.Itoa(lineNumber))
+		}
+		matched = append(matched, matchedRecord{vpcLog: vpcLog, rules: rules})
+		if len(matched) >= batch {
+			if err := writeMatched(matched, writer, &stats, runSummaries); err != nil {
+				return stats, validLines, err
+			}
+			matched = matched[:0]
+		}
+	}
+
+	if err := writeMatched(matched, writer, &stats, runSummaries); err != nil {
+		return stats, validLines, err
+	}
+	return stats, validLines, nil
+}
+
+// matchedRecord is a matched record waiting to be transformed and written, with the rules it matched
+type matchedRecord struct {
+	vpcLog *VPCFlowLog
+	rules  []string
+}
+
+// writeMatched runs a batch of matched records through the TRANSFORMERS chain and writes them.
+// Records that cannot be serialized go to the deadletter file when DEADLETTER_KEY is set.
+func writeMatched(matched []matchedRecord, writer recordWriter, stats *Result, runSummaries *summaries) error {
+	if len(matched) == 0 {
+		return nil
+	}
+	vpcLogs := make([]*VPCFlowLog, len(matched))
+	for i, record := range matched {
+		vpcLogs[i] = record.vpcLog
+	}
+	if err := prefetch(vpcLogs); err != nil {
+		return err
+	}
+
+	for _, record := range matched {
+		vpcLog, err := transform(record.vpcLog)
+		if err != nil {
+			return err
+		}
+		var serializationErr *SerializationError
+		if err := writer.Write(vpcLog); errors.As(err, &serializationErr) && deadletterKey != "" {
+			stats.SerializationFailures++
+			runSummaries.addDeadletter(vpcLog.Raw)
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, rule := range record.rules {
+			stats.hitRule(rule)
+		}
+		runSummaries.add(record.rules, vpcLog)
+	}
+	return nil
+}
+
+// reject writes a line that was not matched to the REJECT_KEY output, if there is one
+func reject(rejects recordWriter, vpcLog *VPCFlowLog) error {
+	if rejects == nil {
+		return nil
+	}
+	return rejects.Write(vpcLog)
+}
+
+// deadlineCheckInterval is how many lines are scanned between checks of the invocation deadline
+const deadlineCheckInterval = 1000
+
+// stopEarly reports whether scanning should stop so the output can be flushed
+func stopEarly(ctx context.Context) bool {
+	return ctx.Err() != nil || deadlineNear(ctx)
+}
+
+// deadlineNear reports whether less than FLUSH_MARGIN_SECONDS remain before the invocation's
+// deadline, leaving just enough time to flush the output before Lambda kills the invocation
+func deadlineNear(ctx context.Context) bool {
+	if flushMarginSeconds <= 0 {
+		return false
+	}
+
+	deadline, ok := ctx.Deadline()
+	return ok && deadline.Sub(clock.Now()) < time.Duration(flushMarginSeconds)*time.Second
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// captureLog collects what the standard logger writes for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buffer
+}
+
+func TestMatchLogSampleRate(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &matchLogSampleRate, 0.1)
+	logged := captureLog(t)
+
+	const n = 5000
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = testFlowLogLine
+	}
+	_, result, err := filterLines(t, lines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LinesMatched != n {
+		t.Errorf("%d lines matched, want every one of %d counted", result.LinesMatched, n)
+	}
+	// 500 expected, with a standard deviation of about 21
+	if sampled := strings.Count(logged.String(), "Found outbound log"); sampled < 400 || sampled > 600 {
+		t.Errorf("%d matches logged at a rate of 0.1, want about 500", sampled)
+	}
+}
+
+func TestMatchLogSampleRateZeroLogsNothing(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &matchLogSampleRate, 0)
+	logged := captureLog(t)
+
+	if _, _, err := filterLines(t, testFlowLogLine, testFlowLogLine); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logged.String(), "Found outbound log") {
+		t.Errorf("matches logged with sampling off:\n%s", logged)
+	}
+}
+
+// advancingWriter moves the clock on by step after every record written
+type advancingWriter struct {
+	recordingWriter
+	clock *fakeClock
+	step  time.Duration
+}
+
+func (w *advancingWriter) Write(vpcLog *VPCFlowLog) error {
+	w.clock.advance(w.step)
+	return w.recordingWriter.Write(vpcLog)
+}
+
+func TestFilterStopsBeforeDeadline(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &flushMarginSeconds, 30)
+	// The context's own deadline is on the real clock, so the fake one starts from the real time
+	now := &fakeClock{now: time.Now()}
+	setForTest[Clock](t, &clock, now)
+	ctx, cancel := context.WithDeadline(context.Background(), now.now.Add(time.Minute))
+	defer cancel()
+
+	// The margin is reached after 1500 records, so scanning stops at the next deadline check
+	writer := &advancingWriter{clock: now, step: 20 * time.Millisecond}
+	lines := make([]string, 2500)
+	for i := range lines {
+		lines[i] = testFlowLogLine
+	}
+	locate := func(line int) (sourceObject, int) { return sourceObject{Bucket: "src", Key: "in.log"}, line }
+	result, _, err := filterVPCLogs(ctx, strings.NewReader(strings.Join(lines, "\n")+"\n"), locate, writer, nil, nil, newSummaries())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Truncated || result.LinesScanned != 2*deadlineCheckInterval || len(writer.records) != result.LinesScanned {
+		t.Fatalf("scanned %d lines and wrote %d (truncated %v), want a stop at line %d", result.LinesScanned, len(writer.records), result.Truncated, 2*deadlineCheckInterval)
+	}
+}
+
+func TestRunFlushesNearDeadline(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &flushMarginSeconds, 30)
+	now := &fakeClock{now: time.Now()}
+	setForTest[Clock](t, &clock, now)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.now.Add(10*time.Second))
+	defer cancel()
+	result, err := run(ctx, func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("run near the deadline failed: %v", err)
+	}
+	if !result.Truncated || result.ResumeFrom == nil || result.ResumeFrom.Key != "in.log" {
+		t.Fatalf("result %+v, want a truncated run resuming from in.log", result)
+	}
+	if _, ok := fake.get("dest", "out.log"); !ok {
+		t.Error("truncated run did not commit its output")
+	}
+	if uploads := fake.openUploads(); uploads != 0 {
+		t.Errorf("%d uploads left open", uploads)
+	}
+}
+
+func TestRejectKeyPartitionsLines(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	rules, err := parseSourceRules("test", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sourceRules, rules)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/matched.log")
+	setForTest(t, &rejectKey, "rejected.log")
+
+	lines := []string{
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-1", "192.168.0.1", "8.8.8.8"),
+		"not a flow log",
+		flowLogLine("eni-2", "10.9.0.1", "8.8.4.4"),
+		flowLogLine("eni-2", "172.16.0.1", "8.8.4.4"),
+	}
+	fake.put("src", "in.log", strings.Join(lines, "\n")+"\n")
+
+	_, err = run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched, _ := fake.get("dest", "matched.log")
+	rejected, _ := fake.get("dest", "rejected.log")
+	if want := lines[0] + "\n" + lines[3] + "\n"; matched != want {
+		t.Errorf("matched output %q, want %q", matched, want)
+	}
+	if want := lines[1] + "\n" + lines[2] + "\n" + lines[4] + "\n"; rejected != want {
+		t.Errorf("rejected output %q, want %q", rejected, want)
+	}
+}
+
+func TestDeadletterUnserializableRecords(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.jsonl")
+	setForTest(t, &outputFormat, outputFormatJSON)
+	setForTest(t, &deadletterKey, "deadletter.log")
+
+	unserializable := recordLine("interface-id=eni-\xff\xfe", "srcaddr=10.0.0.2")
+	fake.put("src", "in.log", recordLine()+"\n"+unserializable+"\n"+recordLine("srcaddr=10.0.0.3")+"\n")
+
+	result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.SerializationFailures != 1 {
+		t.Errorf("serializationFailures = %d, want 1", result.SerializationFailures)
+	}
+	if deadletter, _ := fake.get("dest", "deadletter.log"); deadletter != unserializable+"\n" {
+		t.Errorf("deadletter output %q, want the raw unserializable line", deadletter)
+	}
+	output, _ := fake.get("dest", "out.jsonl")
+	if strings.Count(output, "\n") != 2 || !strings.Contains(output, `"10.0.0.1"`) || !strings.Contains(output, `"10.0.0.3"`) {
+		t.Errorf("JSON output %q, want the two serializable records", output)
+	}
+}
+
+func TestAddSourceRefLineNumbers(t *testing.T) {
+	for _, merge := range []bool{false, true} {
+		t.Run("merge="+strconv.FormatBool(merge), func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			rules, err := parseSourceRules("test", []string{"10.0.0.0/8"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			setForTest(t, &sourceRules, rules)
+			setForTest(t, &sourceBucketName, "src")
+			setForTest(t, &destBucketName, "dest/out.jsonl")
+			setForTest(t, &outputFormat, outputFormatJSON)
+			setForTest(t, &addSourceRef, true)
+			setForTest(t, &mergeSources, merge)
+
+			fake.put("src", "a.log", strings.Join([]string{
+				flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+				flowLogLine("eni-1", "192.168.0.1", "8.8.8.8"),
+				flowLogLine("eni-1", "10.0.0.3", "8.8.8.8"),
+				flowLogLine("eni-1", "10.0.0.4", "8.8.8.8"),
+			}, "\n")+"\n")
+			fake.put("src", "b.log", strings.Join([]string{
+				flowLogLine("eni-2", "192.168.0.2", "8.8.8.8"),
+				flowLogLine("eni-2", "10.0.0.6", "8.8.8.8"),
+			}, "\n")+"\n")
+
+			_, err = run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return []sourceObject{{Bucket: "src", Key: "a.log"}, {Bucket: "src", Key: "b.log"}}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, _ := fake.get("dest", "out.jsonl")
+			var refs []string
+			for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+				var record map[string]string
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("output line %q: %v", line, err)
+				}
+				refs = append(refs, record["srcaddr"]+"@"+record["sourceKey"]+":"+record["lineNumber"])
+			}
+			if got, want := strings.Join(refs, " "), "10.0.0.1@a.log:1 10.0.0.3@a.log:3 10.0.0.4@a.log:4 10.0.0.6@b.log:2"; got != want {
+				t.Errorf("source refs %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// filterProfile is a FILTER_PROFILES entry: records matching its filter (in the FILTER_EXPR
+// syntax) are written to its destKey in the destination bucket. Profiles are matched against every
+// record of the scan, independently of SOURCE_IP_ADDRESSES and the other filters, so several
+// filter configs reading the same source share one pass over it.
+type filterProfile struct {
+	Name    string `json:"name"`
+	Filter  string `json:"filter"`
+	DestKey string `json:"destKey"`
+
+	matcher exprNode
+}
+
+// profileOutput is a profile's output for an invocation
+type profileOutput struct {
+	*filterProfile
+	writer outputWriter
+}
+
+// parseFilterProfiles parses FILTER_PROFILES, a JSON array of profiles, e.g.
+// [{"name": "ssh", "filter": "dstport == 22", "destKey": "profiles/ssh.jsonl"}]
+func parseFilterProfiles(value string) []*filterProfile {
+	if value == "" {
+		return nil
+	}
+
+	var profiles []*filterProfile
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		log.Fatalf("FILTER_PROFILES %s not in the correct format - expected a JSON array of {\"name\", \"filter\", \"destKey\"} objects: %v", value, err)
+	}
+	names := map[string]bool{}
+	for _, profile := range profiles {
+		if profile.Name == "" || profile.Filter == "" || profile.DestKey == "" {
+			log.Fatalf("FILTER_PROFILES entries need a name, filter and destKey")
+		}
+		if names[profile.Name] {
+			log.Fatalf("FILTER_PROFILES has more than one profile named %s", profile.Name)
+		}
+		names[profile.Name] = true
+
+		matcher, err := parseFilterExpr(profile.Filter)
+		if err != nil {
+			log.Fatalf("FILTER_PROFILES profile %s: %v", profile.Name, err)
+		}
+		profile.matcher = matcher
+	}
+	return profiles
+}
+
+// openProfileOutputs opens the output of every profile in the destination bucket
+func openProfileOutputs(ctx context.Context, destS3Client s3iface.S3API, bucket string) ([]*profileOutput, error) {
+	var outputs []*profileOutput
+	for _, profile := range filterProfiles {
+		writer, err := openObjectWriter(newUploader(destS3Client), bucket, outputKey(ctx, profile.DestKey))
+		if err != nil {
+			abortProfileOutputs(outputs, err)
+			return nil, err
+		}
+		outputs = append(outputs, &profileOutput{filterProfile: profile, writer: writer})
+	}
+	return outputs, nil
+}
+
+// writeProfiles writes the record to the output of every profile it matches, counting the matches
+// in stats.ProfileMatches
+func writeProfiles(outputs []*profileOutput, vpcLog *VPCFlowLog, stats *Result) error {
+	for _, output := range outputs {
+		if !output.matcher.eval(vpcLog) {
+			continue
+		}
+		if err := output.writer.Write(vpcLog); err != nil {
+			return err
+		}
+		if stats.ProfileMatches == nil {
+			stats.ProfileMatches = map[string]int{}
+		}
+		stats.ProfileMatches[output.Name]++
+	}
+	return nil
+}
+
+func closeProfileOutputs(outputs []*profileOutput) error {
+	for i, output := range outputs {
+		if err := output.writer.Close(); err != nil {
+			abortProfileOutputs(outputs[i+1:], err)
+			return err
+		}
+	}
+	return nil
+}
+
+func abortProfileOutputs(outputs []*profileOutput, err error) {
+	for _, output := range outputs {
+		output.writer.Abort(err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestFilterProfilesShareOneScan(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &dstPorts, "443")
+	setForTest(t, &recordFilters, newRecordFilters())
+	setForTest(t, &filterProfiles, parseFilterProfiles(`[
+		{"name": "ssh", "filter": "dstport == 22", "destKey": "profiles/ssh.log"},
+		{"name": "rejected", "filter": "action == REJECT", "destKey": "profiles/rejected.log"}
+	]`))
+
+	https := recordLine("dstport=443")
+	ssh := recordLine("dstport=22", "srcaddr=10.0.0.2")
+	rejectedSSH := recordLine("dstport=22", "srcaddr=10.0.0.3", "action=REJECT")
+	rejectedDNS := recordLine("dstport=53", "srcaddr=10.0.0.4", "action=REJECT")
+	fake.put("src", "in.log", strings.Join([]string{https, ssh, rejectedSSH, rejectedDNS}, "\n")+"\n")
+
+	result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gets := fake.count(http.MethodGet); gets != 1 {
+		t.Errorf("source read %d times, want one scan for the output and both profiles", gets)
+	}
+	// Profiles see the records the main output's DST_PORTS filter drops
+	for key, want := range map[string][]string{
+		"out.log":               {https},
+		"profiles/ssh.log":      {ssh, rejectedSSH},
+		"profiles/rejected.log": {rejectedSSH, rejectedDNS},
+	} {
+		if output, _ := fake.get("dest", key); output != strings.Join(want, "\n")+"\n" {
+			t.Errorf("%s is %q, want %q", key, output, want)
+		}
+	}
+	if result.ProfileMatches["ssh"] != 2 || result.ProfileMatches["rejected"] != 2 {
+		t.Errorf("profile matches %v, want 2 for each profile", result.ProfileMatches)
+	}
+}
+
+func TestFilterProfilesAbortedWithTheRun(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &filterProfiles, parseFilterProfiles(`[{"name": "ssh", "filter": "dstport == 22", "destKey": "profiles/ssh.log"}]`))
+	fake.put("src", "in.log", recordLine("dstport=22")+"\n")
+	fake.fail = failPuts("dest")
+
+	if _, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	}); err == nil {
+		t.Fatal("run with failing uploads succeeded")
+	}
+	if keys := fake.keys("dest"); len(keys) != 0 {
+		t.Errorf("failed run left %v", keys)
+	}
+	if uploads := fake.openUploads(); uploads != 0 {
+		t.Errorf("%d multipart uploads left open", uploads)
+	}
+}
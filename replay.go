@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// HandleReplay reprocesses an S3 event notification that failed and was sent to a dead-letter queue
+// (used when REPLAY is set). The event is the invocation payload, or REPLAY_EVENT when the function
+// is invoked without one, and is either the S3 event itself (a Lambda DLQ message body) or an SQS
+// event whose messages carry S3 events, as received from an SQS dead-letter queue. Every object of
+// the event is processed in one run, the same way as SOURCE_BUCKET_NAME objects.
+func HandleReplay(ctx context.Context, payload json.RawMessage) (Result, error) {
+	if len(payload) == 0 || string(payload) == "null" || string(payload) == "{}" {
+		payload = json.RawMessage(replayEvent)
+	}
+
+	sources, err := replaySources(payload)
+	if err != nil {
+		return Result{}, err
+	}
+	log.Printf("Replaying %d source files\n", len(sources))
+
+	result, err := run(ctx, func(sourceS3Client s3iface.S3API, startAfter string) ([]sourceObject, error) {
+		return sources, nil
+	})
+	if err != nil {
+		log.Printf("Replay failed: %v\n", err)
+		return result, err
+	}
+	log.Printf("Replayed %d source files\n", result.ObjectsProcessed)
+	return result, nil
+}
+
+// replaySources returns the objects of the S3 event in payload, unwrapping SQS messages
+func replaySources(payload []byte) ([]sourceObject, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("No event to replay - invoke with the failed event or set REPLAY_EVENT")
+	}
+
+	var sqsEvent events.SQSEvent
+	if err := json.Unmarshal(payload, &sqsEvent); err == nil && len(sqsEvent.Records) > 0 && sqsEvent.Records[0].EventSource == "aws:sqs" {
+		var sources []sourceObject
+		for _, message := range sqsEvent.Records {
+			messageSources, err := replaySources([]byte(message.Body))
+			if err != nil {
+				return nil, fmt.Errorf("Unable to replay SQS message %s: %v", message.MessageId, err)
+			}
+			sources = append(sources, messageSources...)
+		}
+		return sources, nil
+	}
+
+	var s3Event events.S3Event
+	if err := json.Unmarshal(payload, &s3Event); err != nil {
+		return nil, fmt.Errorf("Event to replay is not an S3 event: %v", err)
+	}
+	if len(s3Event.Records) == 0 {
+		return nil, fmt.Errorf("Event to replay has no S3 records")
+	}
+
+	var sources []sourceObject
+	for _, record := range s3Event.Records {
+		// Keys are URL-encoded in event notifications, with spaces as "+"
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Event key %q is not URL-encoded: %v", record.S3.Object.Key, err)
+		}
+		sources = append(sources, sourceObject{Bucket: record.S3.Bucket.Name, Key: key, VersionID: record.S3.Object.VersionID})
+	}
+	return sources, nil
+}
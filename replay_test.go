@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// s3EventPayload is an S3 event notification for the keys of a bucket, URL-encoded as S3 sends them
+func s3EventPayload(bucket string, keys ...string) string {
+	var records []string
+	for _, key := range keys {
+		records = append(records, fmt.Sprintf(`{"eventSource": "aws:s3", "s3": {"bucket": {"name": %q}, "object": {"key": %q}}}`, bucket, key))
+	}
+	return `{"Records": [` + strings.Join(records, ",") + `]}`
+}
+
+func TestReplayPreviouslyFailedEvent(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &destBucketName, "dest/out.log")
+	fake.put("src", "AWSLogs/2024/03/05/flow log.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	fake.put("src", "AWSLogs/2024/03/05/b.log", flowLogLine("eni-2", "10.0.0.2", "8.8.8.8")+"\n")
+	event := json.RawMessage(s3EventPayload("src", "AWSLogs/2024/03/05/flow+log.log", "AWSLogs/2024/03/05/b.log"))
+
+	// The first attempt failed writing its output, sending the event to the dead-letter queue
+	fake.fail = failPuts("dest")
+	if _, err := HandleReplay(context.Background(), event); err == nil {
+		t.Fatal("run succeeded with the output upload failing")
+	}
+
+	fake.fail = nil
+	result, err := HandleReplay(context.Background(), event)
+	if err != nil {
+		t.Fatalf("replay returned %v", err)
+	}
+	if result.ObjectsProcessed != 2 || result.LinesMatched != 2 {
+		t.Errorf("replayed %d files matching %d lines, want 2 and 2", result.ObjectsProcessed, result.LinesMatched)
+	}
+	if output, _ := fake.get("dest", "out.log"); !strings.Contains(output, "10.0.0.1") || !strings.Contains(output, "10.0.0.2") {
+		t.Errorf("replay output %q, want the records of both files", output)
+	}
+}
+
+func TestReplaySQSDeadLetterFromEnv(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &destBucketName, "dest/out.log")
+	fake.put("src", "a.log", flowLogLine("eni-1", "10.0.0.1", "8.8.8.8")+"\n")
+	fake.put("src", "b.log", flowLogLine("eni-2", "10.0.0.2", "8.8.8.8")+"\n")
+
+	message := func(id, body string) string {
+		quoted, _ := json.Marshal(body)
+		return fmt.Sprintf(`{"messageId": %q, "eventSource": "aws:sqs", "body": %s}`, id, quoted)
+	}
+	setForTest(t, &replayEvent, `{"Records": [`+message("1", s3EventPayload("src", "a.log"))+`,`+message("2", s3EventPayload("src", "b.log"))+`]}`)
+
+	// Invoked by hand without a payload, the event comes from REPLAY_EVENT
+	result, err := HandleReplay(context.Background(), json.RawMessage("{}"))
+	if err != nil {
+		t.Fatalf("replay returned %v", err)
+	}
+	if result.ObjectsProcessed != 2 {
+		t.Errorf("replayed %d files, want the 2 of the SQS messages", result.ObjectsProcessed)
+	}
+}
+
+func TestReplayInvalidEvents(t *testing.T) {
+	setForTest(t, &replayEvent, "")
+	for name, payload := range map[string]string{
+		"no event":   "",
+		"not S3":     `{"detail-type": "Scheduled Event"}`,
+		"not JSON":   `Records`,
+		"bad escape": s3EventPayload("src", "in%zz.log"),
+	} {
+		if _, err := HandleReplay(context.Background(), json.RawMessage(payload)); err == nil {
+			t.Errorf("%s: replay succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// Result summarizes an invocation and is returned as the handler's response. The same type holds
+// the counts of a single source file while it is processed.
+type Result struct {
+	ObjectsProcessed int `json:"objectsProcessed"`
+	LinesScanned     int `json:"linesScanned"`
+	LinesMatched     int `json:"linesMatched"`
+	ParseFailures    int `json:"parseFailures"`
+	InvalidRecords   int `json:"invalidRecords"`
+
+	// ClockSkewRecords counts the records with a start or end too far from their file's delivery
+	// time for TIMESTAMP_SANITY
+	ClockSkewRecords int `json:"clockSkewRecords,omitempty"`
+
+	// DuplicateLines counts the lines dropped by DEDUP_LINES
+	DuplicateLines int `json:"duplicateLines,omitempty"`
+
+	// DuplicateFlows counts the matched records not written because FLOW_DEDUP kept another record
+	// of their flow
+	DuplicateFlows int `json:"duplicateFlows,omitempty"`
+
+	// BelowFlowDelta counts the matched records not written because their FLOW_DELTAS deltas were
+	// under the thresholds
+	BelowFlowDelta int `json:"belowFlowDelta,omitempty"`
+
+	// SerializationFailures counts the matched records written to DEADLETTER_KEY because they could
+	// not be serialized in the output format
+	SerializationFailures int `json:"serializationFailures"`
+
+	// RuleHits counts the matches per SOURCE_IP_ADDRESSES entry. Every configured entry is listed,
+	// so rules that never match stand out with a count of 0.
+	RuleHits map[string]int `json:"ruleHits"`
+
+	// ProfileMatches counts the records written to each FILTER_PROFILES profile's output
+	ProfileMatches map[string]int `json:"profileMatches,omitempty"`
+
+	// Truncated is set when the run stopped early to flush before the invocation deadline. The
+	// next run should pick up from ResumeFrom.
+	Truncated  bool         `json:"truncated"`
+	ResumeFrom *ResumePoint `json:"resumeFrom,omitempty"`
+
+	// OutputUnchanged is set when the output was not written because the object at its key already
+	// has the same content (CONTENT_HASH_SKIP)
+	OutputUnchanged bool `json:"outputUnchanged,omitempty"`
+
+	// Skipped is set when the run did nothing because another invocation holds the LOCK_TABLE lock
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Warmup is set when the invocation was a warmup ping and did nothing
+	Warmup bool `json:"warmup,omitempty"`
+}
+
+// ResumePoint is where a truncated run stopped: the source file, and how many of its lines had been
+// processed (0 when the file was not started)
+type ResumePoint struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Line   int    `json:"line"`
+}
+
+// newResult returns an empty result with a zero hit count for every source rule
+func newResult() Result {
+	result := Result{RuleHits: map[string]int{}}
+	for _, rule := range sourceRules {
+		result.RuleHits[rule.Name] = 0
+	}
+	return result
+}
+
+func (r *Result) hitRule(rule string) {
+	if r.RuleHits == nil {
+		r.RuleHits = map[string]int{}
+	}
+	r.RuleHits[rule]++
+}
+
+func (r *Result) add(other Result) {
+	r.ObjectsProcessed += other.ObjectsProcessed
+	r.LinesScanned += other.LinesScanned
+	r.LinesMatched += other.LinesMatched
+	r.ParseFailures += other.ParseFailures
+	r.InvalidRecords += other.InvalidRecords
+	r.DuplicateLines += other.DuplicateLines
+	r.ClockSkewRecords += other.ClockSkewRecords
+	r.SerializationFailures += other.SerializationFailures
+	for rule, hits := range other.RuleHits {
+		if r.RuleHits == nil {
+			r.RuleHits = map[string]int{}
+		}
+		r.RuleHits[rule] += hits
+	}
+	for profile, matches := range other.ProfileMatches {
+		if r.ProfileMatches == nil {
+			r.ProfileMatches = map[string]int{}
+		}
+		r.ProfileMatches[profile] += matches
+	}
+	if other.Truncated {
+		r.Truncated, r.ResumeFrom = true, other.ResumeFrom
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestRuleHitsPerAttribution(t *testing.T) {
+	tests := []struct {
+		attribution string
+		want        map[string]int
+	}{
+		{ruleAttributionFirst, map[string]int{"10.0.0.0/8": 2, "10.0.0.1": 0, "172.16.0.0/12": 0}},
+		{ruleAttributionAll, map[string]int{"10.0.0.0/8": 2, "10.0.0.1": 1, "172.16.0.0/12": 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.attribution, func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			setForTest(t, &sourceBucketName, "src")
+			setForTest(t, &destBucketName, "dest/out.log")
+			setForTest(t, &ruleAttribution, test.attribution)
+			rules, err := parseSourceRules("test", []string{"10.0.0.0/8", "10.0.0.1", "172.16.0.0/12"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			setForTest(t, &sourceRules, rules)
+			fake.put("src", "in.log", strings.Join([]string{
+				flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+				flowLogLine("eni-1", "10.0.0.2", "8.8.8.8"),
+				flowLogLine("eni-1", "192.168.0.1", "8.8.8.8"),
+			}, "\n")+"\n")
+
+			result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.RuleHits, test.want) {
+				t.Errorf("rule hits %v, want %v", result.RuleHits, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// committedOutputs are the output objects committed by the current attempt of the pipeline, which
+// are deleted before the pipeline is retried
+var committedOutputs []outputObject
+
+// runPipeline runs processSources, running the whole download, filter and upload sequence again,
+// up to PIPELINE_RETRIES times with exponential backoff from PIPELINE_RETRY_BACKOFF_MS, when it
+// fails with an error that may be transient. Output objects a failed attempt already committed
+// (rolled segments, split parts, REJECT_KEY, profile outputs) are deleted first, so a retry starts
+// from the same state as the first attempt; uploads still in flight are aborted by the failed
+// attempt itself.
+func runPipeline(ctx context.Context, listSources sourceLister) (Result, error) {
+	for attempt := 0; ; attempt++ {
+		committedOutputs = nil
+		result, err := processSources(ctx, listSources)
+		if err == nil || attempt >= pipelineRetries || !isRetryablePipelineError(err) || stopEarly(ctx) {
+			return result, err
+		}
+
+		if cleanupErr := deleteCommittedOutputs(); cleanupErr != nil {
+			log.Printf("Unable to delete the output of the failed run, not retrying: %v\n", cleanupErr)
+			return result, err
+		}
+
+		backoff := time.Duration(pipelineRetryBackoffMillis<<uint(attempt)) * time.Millisecond
+		log.Printf("Run failed (attempt %d of %d): %v - retrying in %v\n", attempt+1, pipelineRetries+1, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return result, err
+		}
+	}
+}
+
+// isRetryablePipelineError reports whether a run failing with err might succeed if run again.
+// Failures due to the configuration or the data itself would fail again the same way, and a run
+// that fails to save its tail positions has already committed output that a retry would delete.
+func isRetryablePipelineError(err error) bool {
+	var noObjects *NoObjectsError
+	var inPlace *InPlaceError
+	var outputExists *OutputExistsError
+	var permission *PermissionError
+	var tooManyObjects *TooManyOutputObjectsError
+	var parseErr *ParseError
+	var notFound *SourceNotFoundError
+	var presigned *PresignedURLError
+	var tailSave *TailSaveError
+	return !errors.As(err, &noObjects) && !errors.As(err, &inPlace) && !errors.As(err, &outputExists) &&
+		!errors.As(err, &permission) && !errors.As(err, &tooManyObjects) && !errors.As(err, &parseErr) &&
+		!errors.As(err, &notFound) && !errors.As(err, &presigned) && !errors.As(err, &tailSave) && !errors.Is(err, context.Canceled)
+}
+
+// deleteCommittedOutputs deletes the output objects committed by the failed attempt
+func deleteCommittedOutputs() error {
+	if len(committedOutputs) == 0 {
+		return nil
+	}
+	_, destS3Client, err := getS3Clients()
+	if err != nil {
+		return err
+	}
+
+	keys := map[string][]string{}
+	for _, object := range committedOutputs {
+		keys[object.Bucket] = append(keys[object.Bucket], object.Key)
+	}
+	for bucket, bucketKeys := range keys {
+		if err := deleteObjects(destS3Client, bucket, bucketKeys); err != nil {
+			return err
+		}
+		log.Printf("Deleted %d output files of the failed run from %s\n", len(bucketKeys), bucket)
+	}
+	committedOutputs = nil
+	return nil
+}
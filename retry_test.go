@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestRunPipelineRetriesFailedListing(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &pipelineRetries, 1)
+	setForTest(t, &pipelineRetryBackoffMillis, 0)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+
+	listings := 0
+	_, err := runPipeline(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		listings++
+		if listings == 1 {
+			return nil, errors.New("listing failed")
+		}
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("retried run failed: %v", err)
+	}
+	if listings != 2 {
+		t.Fatalf("listed %d times, want 2", listings)
+	}
+	if _, ok := fake.get("dest", "out.log"); !ok {
+		t.Fatal("retried run wrote no output")
+	}
+}
+
+func TestRunPipelineReturnsCommitFailure(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	fake.fail = failPuts("dest")
+
+	_, err := runPipeline(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err == nil {
+		t.Fatal("run succeeded with the output upload failing")
+	}
+}
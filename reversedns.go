@@ -0,0 +1,141 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reverseDNSTransformer adds the host names of a record's addresses (srcHost, dstHost), from their
+// PTR records. Only public addresses are looked up; private (RFC 1918) and other special-purpose
+// addresses, addresses without a PTR record and lookups that fail or time out (PTR_TIMEOUT_MS) get
+// "-". The addresses of each batch of records are queued before the batch is transformed, to be
+// resolved by PTR_CONCURRENCY workers (each lookup also taking one of the MAX_GOROUTINES worker
+// slots) while the records ahead of them are written. Results, including failures, are cached for
+// the last PTR_CACHE_SIZE addresses.
+type reverseDNSTransformer struct {
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	timeout    time.Duration
+	workers    int
+
+	// queue feeds the lookups to the workers, which are started on the first lookup
+	queue        chan *ptrLookup
+	startWorkers sync.Once
+
+	mu    sync.Mutex
+	hosts *ptrCache
+}
+
+// ptrLookup is a cached lookup - done is closed once host is set, so concurrent records needing
+// the same address wait for a single lookup
+type ptrLookup struct {
+	addr string
+	done chan struct{}
+	host string
+}
+
+func newReverseDNSTransformer() *reverseDNSTransformer {
+	return &reverseDNSTransformer{
+		lookupAddr: net.DefaultResolver.LookupAddr,
+		timeout:    time.Duration(ptrTimeoutMillis) * time.Millisecond,
+		workers:    ptrConcurrency,
+		queue:      make(chan *ptrLookup, 2*transformBatchSize),
+		hosts:      newPTRCache(ptrCacheSize),
+	}
+}
+
+func (t *reverseDNSTransformer) prefetch(vpcLogs []*VPCFlowLog) error {
+	for _, vpcLog := range vpcLogs {
+		t.start(vpcLog.Get("srcaddr"))
+		t.start(vpcLog.Get("dstaddr"))
+	}
+	return nil
+}
+
+func (t *reverseDNSTransformer) Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	// Both sides are looked up at once
+	src, dst := t.start(vpcLog.Get("srcaddr")), t.start(vpcLog.Get("dstaddr"))
+	vpcLog.Set("srcHost", src.wait())
+	vpcLog.Set("dstHost", dst.wait())
+	return vpcLog, nil
+}
+
+// start returns the lookup of addr, queueing it when it is not cached
+func (t *reverseDNSTransformer) start(addr string) *ptrLookup {
+	t.mu.Lock()
+	if lookup, ok := t.hosts.get(addr); ok {
+		t.mu.Unlock()
+		return lookup
+	}
+	lookup := &ptrLookup{addr: addr, done: make(chan struct{}), host: "-"}
+	t.hosts.add(lookup)
+	t.mu.Unlock()
+
+	ip := net.ParseIP(addr)
+	if ip == nil || !isPublicIP(ip) {
+		close(lookup.done)
+		return lookup
+	}
+
+	t.startWorkers.Do(func() {
+		for i := 0; i < t.workers; i++ {
+			go t.work()
+		}
+	})
+	t.queue <- lookup
+	return lookup
+}
+
+// work resolves queued lookups, for the life of the container
+func (t *reverseDNSTransformer) work() {
+	for lookup := range t.queue {
+		acquireWorker()
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		names, err := t.lookupAddr(ctx, lookup.addr)
+		cancel()
+		releaseWorker()
+
+		if err == nil && len(names) > 0 {
+			lookup.host = strings.TrimSuffix(names[0], ".")
+		}
+		close(lookup.done)
+	}
+}
+
+func (l *ptrLookup) wait() string {
+	<-l.done
+	return l.host
+}
+
+// ptrCache keeps the most recently used lookups, evicting the least recently used one when it is
+// full. Records still waiting on an evicted lookup get its result all the same.
+type ptrCache struct {
+	size    int
+	order   *list.List
+	lookups map[string]*list.Element
+}
+
+func newPTRCache(size int) *ptrCache {
+	return &ptrCache{size: size, order: list.New(), lookups: map[string]*list.Element{}}
+}
+
+func (c *ptrCache) get(addr string) (*ptrLookup, bool) {
+	element, ok := c.lookups[addr]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*ptrLookup), true
+}
+
+func (c *ptrCache) add(lookup *ptrLookup) {
+	c.lookups[lookup.addr] = c.order.PushFront(lookup)
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.lookups, oldest.Value.(*ptrLookup).addr)
+	}
+}
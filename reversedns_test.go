@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers PTR lookups from names, counting the lookups of each address. Addresses
+// without a name block until the lookup times out.
+type stubResolver struct {
+	mu       sync.Mutex
+	names    map[string]string
+	lookups  map[string]int
+	delay    time.Duration
+	inFlight int
+	peak     int
+}
+
+func (s *stubResolver) lookupAddr(ctx context.Context, addr string) ([]string, error) {
+	s.mu.Lock()
+	s.lookups[addr]++
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	name, ok := s.names[addr]
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	if !ok {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(s.delay)
+	return []string{name + "."}, nil
+}
+
+func newStubbedReverseDNS(t *testing.T, resolver *stubResolver) *reverseDNSTransformer {
+	t.Helper()
+	if resolver.lookups == nil {
+		resolver.lookups = map[string]int{}
+	}
+	transformer := newReverseDNSTransformer()
+	transformer.lookupAddr = resolver.lookupAddr
+	transformer.timeout = 50 * time.Millisecond
+	setForTest(t, &transformers, []namedTransformer{{Transformer: transformer, name: "reverse-dns"}})
+	return transformer
+}
+
+func TestReverseDNSResolvesPublicAddresses(t *testing.T) {
+	resolver := &stubResolver{names: map[string]string{"8.8.8.8": "dns.google"}}
+	newStubbedReverseDNS(t, resolver)
+	matchAllSources(t)
+
+	records, _, err := filterLines(t,
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-1", "192.168.1.1", "172.16.0.1"),
+		flowLogLine("eni-1", "8.8.8.8", "10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][2]string{{"-", "dns.google"}, {"-", "-"}, {"dns.google", "-"}}
+	for i, hosts := range want {
+		if got := [2]string{records[i].Get("srcHost"), records[i].Get("dstHost")}; got != hosts {
+			t.Errorf("record %d has hosts %v, want %v", i, got, hosts)
+		}
+	}
+	if len(resolver.lookups) != 1 || resolver.lookups["8.8.8.8"] != 1 {
+		t.Fatalf("looked up %v, want 8.8.8.8 once and no private address", resolver.lookups)
+	}
+}
+
+func TestReverseDNSTimesOut(t *testing.T) {
+	resolver := &stubResolver{names: map[string]string{}}
+	newStubbedReverseDNS(t, resolver)
+	matchAllSources(t)
+
+	records, _, err := filterLines(t, flowLogLine("eni-1", "10.0.0.1", "1.2.3.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records[0].Get("dstHost"); got != "-" {
+		t.Fatalf("dstHost %q for a lookup that timed out, want -", got)
+	}
+}
+
+func TestReverseDNSResolvesAheadWithBoundedConcurrency(t *testing.T) {
+	setForTest(t, &ptrConcurrency, 4)
+	resolver := &stubResolver{names: map[string]string{}, delay: 20 * time.Millisecond}
+	var lines []string
+	for i := 1; i <= 40; i++ {
+		addr := fmt.Sprintf("1.1.1.%d", i)
+		resolver.names[addr] = fmt.Sprintf("host%d", i)
+		lines = append(lines, flowLogLine("eni-1", "10.0.0.1", addr))
+	}
+	newStubbedReverseDNS(t, resolver)
+	matchAllSources(t)
+
+	records, _, err := filterLines(t, lines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records[39].Get("dstHost"); got != "host40" {
+		t.Fatalf("dstHost %q, want host40", got)
+	}
+	if resolver.peak != 4 {
+		t.Fatalf("%d lookups in flight at most, want PTR_CONCURRENCY (4)", resolver.peak)
+	}
+}
+
+func TestPTRCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newPTRCache(2)
+	for _, addr := range []string{"1.1.1.1", "2.2.2.2"} {
+		cache.add(&ptrLookup{addr: addr})
+	}
+	cache.get("1.1.1.1")
+	cache.add(&ptrLookup{addr: "3.3.3.3"})
+
+	if _, ok := cache.get("2.2.2.2"); ok {
+		t.Error("least recently used address still cached")
+	}
+	for _, addr := range []string{"1.1.1.1", "3.3.3.3"} {
+		if _, ok := cache.get(addr); !ok {
+			t.Errorf("%s evicted", addr)
+		}
+	}
+}
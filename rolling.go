@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// rollingWriter splits the output into a sequence of objects, starting a new one when the current
+// object reaches ROLL_MAX_BYTES or has been open for ROLL_MAX_SECONDS, so near-real-time consumers
+// can pick up completed objects while the run is still going. Objects are named after the output
+// key with a sequence number and the time they were started, e.g. out-00002-20240305T101500Z.json.
+// Rollover only happens between records, so no record is split across objects.
+type rollingWriter struct {
+	uploader *s3manager.Uploader
+	bucket   string
+	key      string
+	clock    Clock
+
+	sequence  int
+	current   *objectWriter
+	committed []outputObject
+	written   *countingWriter
+	started   time.Time
+}
+
+func newRollingWriter(uploader *s3manager.Uploader, bucket, key string, clock Clock) (*rollingWriter, error) {
+	r := &rollingWriter{uploader: uploader, bucket: bucket, key: key, clock: clock}
+	if err := r.roll(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rollingWriter) Write(vpcLog *VPCFlowLog) error {
+	if r.current == nil {
+		return errRollingWriterFailed
+	}
+	if r.written.n > 0 && r.due() {
+		if err := r.roll(); err != nil {
+			return err
+		}
+	}
+	return r.current.Write(vpcLog)
+}
+
+// due reports whether the current object has hit either threshold. Size is measured before
+// compression, so compressed objects roll over below ROLL_MAX_BYTES.
+func (r *rollingWriter) due() bool {
+	if rollMaxBytes > 0 && r.written.n >= int64(rollMaxBytes) {
+		return true
+	}
+	return rollMaxSeconds > 0 && r.clock.Now().Sub(r.started) >= time.Duration(rollMaxSeconds)*time.Second
+}
+
+// roll commits the current object, if any, and starts the next object of the sequence. The next
+// object is counted against MAX_OUTPUT_OBJECTS first, so hitting the limit leaves the current object
+// open for Abort to discard. After any later failure the current object is closed or was never
+// started, and is dropped so that Abort does not wait on it again.
+func (r *rollingWriter) roll() error {
+	r.sequence++
+	r.started = r.clock.Now()
+
+	if err := reserveOutputObject(r.segmentKey()); err != nil {
+		return err
+	}
+	if r.current != nil {
+		err := r.closeCurrent()
+		r.current = nil
+		if err != nil {
+			return err
+		}
+	}
+	upload, err := startStreamingUpload(r.uploader, newDestUploadInput(r.bucket, r.segmentKey()), outputCompression)
+	if err != nil {
+		return err
+	}
+
+	r.written = &countingWriter{w: upload}
+	writer, err := newRecordWriter(outputFormat, r.written)
+	if err != nil {
+		return upload.Abort(err)
+	}
+
+	r.current = &objectWriter{recordWriter: writer, upload: upload}
+	return nil
+}
+
+// segmentKey inserts the sequence number and start time before the output key's extension
+func (r *rollingWriter) segmentKey() string {
+	name := r.key[strings.LastIndex(r.key, "/")+1:]
+	dir := r.key[:len(r.key)-len(name)]
+
+	base, ext := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		base, ext = name[:i], name[i:]
+	}
+	return fmt.Sprintf("%s%s-%05d-%s%s", dir, base, r.sequence, r.started.UTC().Format("20060102T150405Z"), ext)
+}
+
+func (r *rollingWriter) Flush() error {
+	if r.current == nil {
+		return errRollingWriterFailed
+	}
+	return r.current.Flush()
+}
+
+func (r *rollingWriter) Close() error {
+	if r.current == nil {
+		return errRollingWriterFailed
+	}
+	return r.closeCurrent()
+}
+
+// closeCurrent commits the current object of the sequence
+func (r *rollingWriter) closeCurrent() error {
+	if err := r.current.Close(); err != nil {
+		return err
+	}
+	r.committed = append(r.committed, r.current.Objects()...)
+	return nil
+}
+
+func (r *rollingWriter) Objects() []outputObject {
+	return r.committed
+}
+
+func (r *rollingWriter) Abort(err error) error {
+	if r.current == nil {
+		return err
+	}
+	return r.current.Abort(err)
+}
+
+// errRollingWriterFailed is returned by a rolling writer used after rolling over failed
+var errRollingWriterFailed = fmt.Errorf("Output failed to roll over to its next object")
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollingWriterAbortAfterFailedRoll(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &rollMaxBytes, 1)
+
+	writer, err := newRollingWriter(newUploader(client), "dest", "out/log.jsonl", realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(testFlowLog(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Committing the first object fails, so rolling over fails
+	fake.fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	if err := writer.Write(testFlowLog(t)); err == nil {
+		t.Fatal("roll over succeeded with the upload failing")
+	}
+
+	aborted := make(chan error, 1)
+	go func() { aborted <- writer.Abort(errRollingWriterFailed) }()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Abort hung after a failed roll over")
+	}
+}
+
+func TestRollingWriterLimitLeavesCurrentAbortable(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &rollMaxBytes, 1)
+	setForTest(t, &maxOutputObjects, 1)
+	setForTest(t, &outputObjectsOpened, 0)
+
+	writer, err := newRollingWriter(newUploader(client), "dest", "out/log.jsonl", realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(testFlowLog(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var tooMany *TooManyOutputObjectsError
+	if err := writer.Write(testFlowLog(t)); !errors.As(err, &tooMany) {
+		t.Fatalf("rolling over the limit returned %v, want a TooManyOutputObjectsError", err)
+	}
+
+	aborted := make(chan error, 1)
+	go func() { aborted <- writer.Abort(tooMany) }()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Abort hung after hitting MAX_OUTPUT_OBJECTS")
+	}
+	if keys := fake.keys("dest"); len(keys) != 0 {
+		t.Fatalf("aborted run left objects %v", keys)
+	}
+}
+
+func TestRollingWriterRollsOverBySize(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &rollMaxBytes, 1)
+	setForTest(t, &rollMaxSeconds, 0)
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 15, 0, 0, time.UTC)}
+
+	writer, err := newRollingWriter(newUploader(client), "dest", "out/log.jsonl", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := writer.Write(testFlowLog(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "out/log-00001-20240305T101500Z.jsonl out/log-00002-20240305T101500Z.jsonl out/log-00003-20240305T101500Z.jsonl"
+	if keys := strings.Join(fake.keys("dest"), " "); keys != want {
+		t.Fatalf("wrote %s, want one object per record", keys)
+	}
+	if objects := writer.Objects(); len(objects) != 3 {
+		t.Errorf("%d objects committed", len(objects))
+	}
+}
+
+func TestRollingWriterRollsOverByTime(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &rollMaxBytes, 0)
+	setForTest(t, &rollMaxSeconds, 60)
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 15, 0, 0, time.UTC)}
+
+	writer, err := newRollingWriter(newUploader(client), "dest", "out/log.jsonl", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, 30 * time.Second, 10 * time.Second} {
+		now.advance(elapsed)
+		if err := writer.Write(testFlowLog(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third record is written 60s after the first object was started
+	want := "out/log-00001-20240305T101500Z.jsonl out/log-00002-20240305T101600Z.jsonl"
+	if keys := strings.Join(fake.keys("dest"), " "); keys != want {
+		t.Fatalf("wrote %s, want %s", keys, want)
+	}
+	first, _ := fake.get("dest", "out/log-00001-20240305T101500Z.jsonl")
+	second, _ := fake.get("dest", "out/log-00002-20240305T101600Z.jsonl")
+	if strings.Count(first, "\n") != 2 || strings.Count(second, "\n") != 2 {
+		t.Errorf("records split as %q and %q", first, second)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// deliveryInterval is how often flow log files are published to S3. Scheduled windows are aligned
+// to it so consecutive runs cover adjacent, non-overlapping sets of files.
+const deliveryInterval = 5 * time.Minute
+
+// logFileTimeRegexp matches the time a flow log file was written, in its name, e.g.
+// 123456789012_vpcflowlogs_us-east-1_fl-1234abcd_20240305T1005Z_a1b2c3d4.log.gz
+var logFileTimeRegexp = regexp.MustCompile(`_(\d{8}T\d{4}Z)_`)
+
+// HandleScheduled is the handler for EventBridge scheduled invocations (used when WINDOW is set).
+// It processes the log files written in the WINDOW ending at the event's time.
+func HandleScheduled(ctx context.Context, event events.CloudWatchEvent) error {
+	start, end := scheduledWindow(event.Time)
+	log.Printf("Processing log files written from %s to %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	result, err := run(ctx, func(sourceS3Client s3iface.S3API, startAfter string) ([]sourceObject, error) {
+		return listWindowObjects(sourceS3Client, sourceBucketName, start, end, startAfter)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Processed %d source files\n", result.ObjectsProcessed)
+	return nil
+}
+
+// scheduledWindow returns the window of WINDOW length ending at the event time, rounded down to
+// the delivery interval so a schedule firing a few seconds late still covers the same files
+func scheduledWindow(eventTime time.Time) (time.Time, time.Time) {
+	if eventTime.IsZero() {
+		eventTime = clock.Now()
+	}
+	end := eventTime.UTC().Truncate(deliveryInterval)
+	return end.Add(-scheduleWindow), end
+}
+
+// listWindowObjects lists the log files written in [start, end) under the log delivery prefix.
+// Every day the window touches is listed, then files are kept by the time in their name; files
+// without one are skipped.
+func listWindowObjects(sourceS3Client s3iface.S3API, sourcePath string, start, end time.Time, startAfter string) ([]sourceObject, error) {
+	firstDay := start.Truncate(24 * time.Hour)
+	objects, err := listDateRangeObjects(sourceS3Client, sourcePath, firstDay, end.Add(-time.Nanosecond), startAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	var inWindow []sourceObject
+	for _, object := range objects {
+		match := logFileTimeRegexp.FindStringSubmatch(path.Base(object.Key))
+		if match == nil {
+			continue
+		}
+		written, err := time.Parse("20060102T1504Z", match[1])
+		if err != nil || written.Before(start) || !written.Before(end) {
+			continue
+		}
+		inWindow = append(inWindow, object)
+	}
+	return inWindow, nil
+}
+
+// parseScheduleWindow parses WINDOW, a duration of at least the delivery interval
+func parseScheduleWindow(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window < deliveryInterval {
+		log.Fatalf("WINDOW %q not supported - expected a duration of at least %v, e.g. 1h", value, deliveryInterval)
+	}
+	return window
+}
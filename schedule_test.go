@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduledWindowAcrossMidnight(t *testing.T) {
+	setForTest(t, &scheduleWindow, time.Hour)
+
+	// Fired a little late - the window still ends on the delivery interval
+	start, end := scheduledWindow(time.Date(2024, 3, 5, 0, 32, 17, 0, time.UTC))
+	if want := time.Date(2024, 3, 4, 23, 30, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("window starts at %v, want %v", start, want)
+	}
+	if want := time.Date(2024, 3, 5, 0, 30, 0, 0, time.UTC); !end.Equal(want) {
+		t.Errorf("window ends at %v, want %v", end, want)
+	}
+	if prefixes := datePrefixes(start.Truncate(24*time.Hour), end.Add(-time.Nanosecond)); strings.Join(prefixes, " ") != "2024/03/04/ 2024/03/05/" {
+		t.Errorf("window lists prefixes %v", prefixes)
+	}
+}
+
+func TestListWindowObjects(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &scheduleWindow, time.Hour)
+	const logs = "AWSLogs/123456789012/vpcflowlogs/us-east-1/"
+	for _, key := range []string{
+		"2024/03/04/123456789012_vpcflowlogs_us-east-1_fl-1_20240304T2325Z_a.log.gz",
+		"2024/03/04/123456789012_vpcflowlogs_us-east-1_fl-1_20240304T2330Z_b.log.gz",
+		"2024/03/05/123456789012_vpcflowlogs_us-east-1_fl-1_20240305T0025Z_c.log.gz",
+		"2024/03/05/123456789012_vpcflowlogs_us-east-1_fl-1_20240305T0030Z_d.log.gz",
+		"2024/03/05/no-time-in-name.log.gz",
+	} {
+		fake.put("src", logs+key, "")
+	}
+
+	start, end := scheduledWindow(time.Date(2024, 3, 5, 0, 32, 17, 0, time.UTC))
+	objects, err := listWindowObjects(client, "src/"+logs, start, end, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Key[strings.LastIndex(object.Key, "_")+1:])
+	}
+	if strings.Join(names, " ") != "b.log.gz c.log.gz" {
+		t.Errorf("window listed %v, want the files written from 23:30 to before 00:30", names)
+	}
+}
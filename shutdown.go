@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownGrace is how long the SIGTERM handler waits for an in-flight invocation to flush its
+// output. Lambda allows about 500ms between SIGTERM and killing the execution environment.
+const shutdownGrace = 450 * time.Millisecond
+
+// inFlight is the invocation currently being handled, if any
+var inFlight struct {
+	sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// trackInvocation derives the context an invocation runs under, which the SIGTERM handler cancels.
+// The returned func must be called when the invocation has finished.
+func trackInvocation(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	inFlight.Lock()
+	inFlight.cancel, inFlight.done = cancel, done
+	inFlight.Unlock()
+
+	return ctx, func() {
+		inFlight.Lock()
+		inFlight.cancel, inFlight.done = nil, nil
+		inFlight.Unlock()
+
+		cancel()
+		close(done)
+	}
+}
+
+// handleSIGTERM installs a handler for the SIGTERM Lambda sends before shutting down the execution
+// environment. An in-flight invocation is cancelled, which stops scanning and flushes the output
+// written so far the same way as stopping at the deadline (see FLUSH_MARGIN_SECONDS); if the flush
+// fails, the multipart upload is aborted rather than left incomplete.
+func handleSIGTERM() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+
+		inFlight.Lock()
+		cancel, done := inFlight.cancel, inFlight.done
+		inFlight.Unlock()
+
+		if cancel != nil {
+			log.Println("Received SIGTERM - flushing the in-flight invocation")
+			cancel()
+
+			select {
+			case <-done:
+			case <-time.After(shutdownGrace):
+				log.Println("In-flight invocation did not finish flushing before shutdown")
+			}
+		}
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCancelledInvocationFlushesPartialOutput(t *testing.T) {
+	sent, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"))
+		fmt.Fprintln(w, flowLogLine("eni-1", "10.0.0.2", "8.8.8.8"))
+		w.(http.Flusher).Flush()
+		close(sent)
+		// The rest of the file never arrives
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceURL, server.URL+"/in.log")
+	setForTest(t, &destBucketName, "dest/out.log")
+
+	go func() {
+		<-sent
+		// Give the filter time to scan what was sent, then do what the SIGTERM handler does
+		time.Sleep(100 * time.Millisecond)
+		inFlight.Lock()
+		cancel := inFlight.cancel
+		inFlight.Unlock()
+		cancel()
+	}()
+
+	result, err := HandleRequest(context.Background())
+	if err != nil {
+		t.Fatalf("cancelled invocation failed: %v", err)
+	}
+	if !result.Truncated || result.LinesMatched != 2 {
+		t.Fatalf("result %+v, want the 2 lines sent before the cancellation, truncated", result)
+	}
+	output, ok := fake.get("dest", "out.log")
+	if !ok || strings.Count(output, "\n") != 2 {
+		t.Errorf("flushed output %q, want the 2 matched lines", output)
+	}
+	if uploads := fake.openUploads(); uploads != 0 {
+		t.Errorf("%d uploads left open", uploads)
+	}
+}
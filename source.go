@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Flow logs delivered to S3 are stored under date prefixes: AWSLogs/<account>/vpcflowlogs/<region>/yyyy/mm/dd/
+const dateRangeLayout = "2006-01-02"
+
+// sourceObject is a source file to process - an S3 object (VersionID is empty for the latest
+// version), or a file served over HTTP when URL is set
+type sourceObject struct {
+	Bucket    string
+	Key       string
+	VersionID string
+	URL       string
+
+	// LastModified is the object's last-modified time when it is known from the listing
+	LastModified time.Time
+
+	// Offset and End limit the download to that byte range of the object when End is set
+	// (TAIL_MODE)
+	Offset, End int64
+}
+
+func (s sourceObject) String() string {
+	if s.URL != "" {
+		return redactURL(s.URL)
+	}
+	return fmt.Sprintf("s3://%s/%s", s.Bucket, s.Key)
+}
+
+// listSourceObjects resolves SOURCE_BUCKET_NAME (or SOURCE_URL) to the source objects to process. Without
+// DATE_RANGE it names a single object (SOURCE_VERSION_ID pins the version to read); with
+// DATE_RANGE the path is the log delivery prefix (e.g.
+// "[bucket-name]/AWSLogs/123456789012/vpcflowlogs/us-east-1") and every object under each day's
+// prefix in the range is processed, skipping those up to startAfter (a checkpointed key) when set.
+func listSourceObjects(sourceS3Client s3iface.S3API, sourcePath, startAfter string) ([]sourceObject, error) {
+	if sourceURL != "" {
+		return []sourceObject{{URL: sourceURL}}, nil
+	}
+	if dateRangeStart.IsZero() {
+		bucket, key, err := parseBucketAndKeyFromFilePath(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		return []sourceObject{{Bucket: bucket, Key: key, VersionID: sourceVersionID}}, nil
+	}
+
+	objects, err := listDateRangeObjects(sourceS3Client, sourcePath, dateRangeStart, dateRangeEnd, startAfter)
+	// Listings can briefly miss objects S3 has only just delivered, so an empty listing is retried
+	// before concluding there is nothing to process
+	for retry := 1; err == nil && len(objects) == 0 && retry <= emptyListRetries; retry++ {
+		backoff := time.Duration(1<<uint(retry-1)) * time.Second
+		log.Printf("No source files found - listing again in %v (retry %d of %d)\n", backoff, retry, emptyListRetries)
+		time.Sleep(backoff)
+
+		objects, err = listDateRangeObjects(sourceS3Client, sourcePath, dateRangeStart, dateRangeEnd, startAfter)
+	}
+	if err != nil {
+		return objects, err
+	}
+
+	log.Printf("Found %d source files between %s and %s\n", len(objects), dateRangeStart.Format(dateRangeLayout), dateRangeEnd.Format(dateRangeLayout))
+	return objects, nil
+}
+
+// listDateRangeObjects lists every object under each day's prefix from start to end inclusive.
+// Keys sort by day, so with startAfter set, whole days before it list nothing and listing resumes
+// in the day it is in.
+func listDateRangeObjects(sourceS3Client s3iface.S3API, sourcePath string, start, end time.Time, startAfter string) ([]sourceObject, error) {
+	var objects []sourceObject
+	for _, datePrefix := range datePrefixes(start, end) {
+		bucket, prefix, err := parseBucketAndKeyFromFilePath(strings.TrimSuffix(sourcePath, "/") + "/" + datePrefix)
+		if err != nil {
+			return objects, err
+		}
+
+		listInput := &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		}
+		if startAfter != "" {
+			listInput.StartAfter = aws.String(startAfter)
+		}
+		err = sourceS3Client.ListObjectsV2Pages(listInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				objects = append(objects, sourceObject{Bucket: bucket, Key: aws.StringValue(object.Key), LastModified: aws.TimeValue(object.LastModified)})
+			}
+			return true
+		})
+		if err != nil {
+			return objects, err
+		}
+	}
+	return objects, nil
+}
+
+// maxEmptyListRetries caps EMPTY_LIST_RETRY - with the doubling backoff, 6 retries already wait
+// over a minute in total
+const maxEmptyListRetries = 6
+
+func parseEmptyListRetries(name string) int {
+	retries := envInt(name)
+	if retries < 0 || retries > maxEmptyListRetries {
+		log.Fatalf("Env var %s must be between 0 and %d, got %d", name, maxEmptyListRetries, retries)
+	}
+	return retries
+}
+
+// parseDateRange parses DATE_RANGE, an inclusive range of days written as "2024-03-01/2024-03-05"
+func parseDateRange(value string) (time.Time, time.Time) {
+	if value == "" {
+		return time.Time{}, time.Time{}
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		log.Fatalf("DATE_RANGE %q not in the correct format - expected yyyy-mm-dd/yyyy-mm-dd", value)
+	}
+
+	start, err := time.Parse(dateRangeLayout, parts[0])
+	fatalIf(err)
+	end, err := time.Parse(dateRangeLayout, parts[1])
+	fatalIf(err)
+
+	if end.Before(start) {
+		log.Fatalf("DATE_RANGE %q ends before it starts", value)
+	}
+	return start, end
+}
+
+// datePrefixes returns the zero-padded "yyyy/mm/dd/" prefix of every day from start to end inclusive
+func datePrefixes(start, end time.Time) []string {
+	var prefixes []string
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		prefixes = append(prefixes, day.Format("2006/01/02")+"/")
+	}
+	return prefixes
+}
+
+// SourceNotFoundError is returned when the source object does not exist, which usually means
+// SOURCE_BUCKET_NAME is misconfigured or the logs have not been delivered yet
+type SourceNotFoundError struct {
+	Bucket string
+	Key    string
+}
+
+func (e *SourceNotFoundError) Error() string {
+	return fmt.Sprintf("Source file s3://%s/%s does not exist", e.Bucket, e.Key)
+}
+
+// NoObjectsError is returned, with ZERO_OBJECTS_IS_ERROR, when the listing found no source file
+type NoObjectsError struct {
+	Path       string
+	StartAfter string
+}
+
+func (e *NoObjectsError) Error() string {
+	if e.StartAfter != "" {
+		return fmt.Sprintf("No source files found under %s after %s", e.Path, e.StartAfter)
+	}
+	return fmt.Sprintf("No source files found under %s", e.Path)
+}
+
+// isNotFound reports whether err is S3's response for a missing object - NoSuchKey for GETs, or a
+// bare 404 for requests without a response body (e.g. HEAD)
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.StatusCode() == http.StatusNotFound
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
+// ParseError is returned for a source object that cannot be parsed at all, e.g. a file that is not
+// a flow log or does not match LOG_FORMAT
+type ParseError struct {
+	Source sourceObject
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Unable to parse source file %s: %v", e.Source, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	parseFailureSkip       = "skip"
+	parseFailureFail       = "fail"
+	parseFailureQuarantine = "quarantine"
+)
+
+func parseParseFailurePolicy(policy string) string {
+	switch policy {
+	case "":
+		return parseFailureSkip
+	case parseFailureSkip, parseFailureFail:
+		return policy
+	case parseFailureQuarantine:
+		if quarantinePrefix == "" {
+			log.Fatalf("ON_PARSE_FAILURE=quarantine requires QUARANTINE_PREFIX")
+		}
+		return policy
+	default:
+		log.Fatalf("ON_PARSE_FAILURE %s not supported - expected one of skip, fail, quarantine", policy)
+		return ""
+	}
+}
+
+// handleParseFailure applies the ON_PARSE_FAILURE policy to an unparseable source object,
+// returning an error only when the run should fail
+func handleParseFailure(sourceS3Client s3iface.S3API, parseErr *ParseError) error {
+	switch onParseFailure {
+	case parseFailureFail:
+		return parseErr
+	case parseFailureQuarantine:
+		source := parseErr.Source
+		if source.URL != "" {
+			log.Printf("%v - skipping, HTTP sources cannot be quarantined\n", parseErr)
+			return nil
+		}
+
+		bucket, prefix, err := parseBucketAndKeyFromFilePath(quarantinePrefix)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(source.Key, "/")
+
+		copySource := url.PathEscape(source.Bucket + "/" + source.Key)
+		if source.VersionID != "" {
+			copySource += "?versionId=" + url.QueryEscape(source.VersionID)
+		}
+
+		_, err = sourceS3Client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(copySource),
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to quarantine source file %s: %v", source, err)
+		}
+		log.Printf("%v - quarantined to s3://%s/%s\n", parseErr, bucket, key)
+	default:
+		log.Printf("%v - skipping\n", parseErr)
+	}
+	return nil
+}
+
+// newSourceReader returns a reader over the decompressed contents of the source object.
+// VPC logs delivered to S3 are gzipped, and objects that have been appended to are made up of
+// several concatenated gzip members, so multistream mode is set explicitly to make sure every
+// member is read through to EOF rather than stopping after the first one.
+func newSourceReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !isGzip(magic) {
+		return buffered, nil
+	}
+
+	gzipReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read gzip header of source file: %w", err)
+	}
+	gzipReader.Multistream(true)
+
+	if maxDecompressedBytes > 0 {
+		return &decompressedLimitReader{r: gzipReader, remaining: maxDecompressedBytes}, nil
+	}
+	return gzipReader, nil
+}
+
+// decompressedLimitReader fails once more than MAX_DECOMPRESSED_BYTES have been decompressed, so a
+// small, highly compressed file (a "zip bomb") cannot exhaust memory or run out the invocation
+type decompressedLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *decompressedLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &DecompressedTooLargeError{}
+	}
+	// Read one byte past the limit, to tell a file of exactly the limit from a larger one
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), &DecompressedTooLargeError{}
+	}
+	return n, err
+}
+
+// DecompressedTooLargeError is returned when a source file decompresses to more than
+// MAX_DECOMPRESSED_BYTES
+type DecompressedTooLargeError struct{}
+
+func (e *DecompressedTooLargeError) Error() string {
+	return fmt.Sprintf("Source file decompresses to more than MAX_DECOMPRESSED_BYTES (%d) - stopped reading it", maxDecompressedBytes)
+}
+
+// isGzip checks for the gzip magic number (RFC 1952) at the start of the data
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// outputMetadata is the user metadata of the objects written by the current invocation, nil when
+// there is none
+var outputMetadata map[string]*string
+
+// setSourceLastModified records the sources' last-modified time in the output metadata, for lineage
+func setSourceLastModified(lastModified time.Time) {
+	if lastModified.IsZero() {
+		return
+	}
+	outputMetadata = map[string]*string{"source-last-modified": aws.String(lastModified.UTC().Format(time.RFC3339))}
+}
+
+// sourceLastModified returns the latest LastModified of the source objects. Objects listed without
+// one (a single SOURCE_BUCKET_NAME object) are HEADed; files served over HTTP have none.
+func sourceLastModified(ctx context.Context, sourceS3Client s3iface.S3API, sources []sourceObject) (time.Time, error) {
+	var latest time.Time
+	for _, source := range sources {
+		lastModified := source.LastModified
+		if lastModified.IsZero() && source.URL == "" {
+			headObjectInput := &s3.HeadObjectInput{Bucket: aws.String(source.Bucket), Key: aws.String(source.Key)}
+			if source.VersionID != "" {
+				headObjectInput.VersionId = aws.String(source.VersionID)
+			}
+			head, err := sourceS3Client.HeadObjectWithContext(ctx, headObjectInput)
+			if isNotFound(err) {
+				return time.Time{}, &SourceNotFoundError{Bucket: source.Bucket, Key: source.Key}
+			}
+			if err != nil {
+				return time.Time{}, fmt.Errorf("Unable to read the last-modified time of source file %s: %v", source, err)
+			}
+			lastModified = aws.TimeValue(head.LastModified)
+		}
+		if lastModified.After(latest) {
+			latest = lastModified
+		}
+	}
+	return latest, nil
+}
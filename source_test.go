@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestSourceReaderReadsEveryGzipMember(t *testing.T) {
+	first := flowLogLine("eni-1", "10.0.0.1", "8.8.8.8") + "\n"
+	second := flowLogLine("eni-2", "10.0.0.2", "8.8.4.4") + "\n"
+
+	reader, err := newSourceReader(bytes.NewReader(gzipMembers(t, first, second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != first+second {
+		t.Fatalf("read %q, want both members", content)
+	}
+}
+
+func TestSourceReaderPassesPlainText(t *testing.T) {
+	reader, err := newSourceReader(bytes.NewReader([]byte(testFlowLogLine + "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := io.ReadAll(reader); string(content) != testFlowLogLine+"\n" {
+		t.Fatalf("read %q", content)
+	}
+}
+
+func TestMissingSourceObject(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &pipelineRetries, 2)
+	setForTest(t, &pipelineRetryBackoffMillis, 0)
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "missing.log"}}, nil
+	})
+	var notFound *SourceNotFoundError
+	if !errors.As(err, &notFound) || notFound.Key != "missing.log" {
+		t.Fatalf("run returned %v, want a SourceNotFoundError for missing.log", err)
+	}
+	// A missing object is not retried, and nothing is written
+	if gets := fake.count(http.MethodGet); gets != 1 {
+		t.Errorf("source fetched %d times, want once", gets)
+	}
+	if keys := fake.keys("dest"); len(keys) != 0 {
+		t.Errorf("failed run wrote %v", keys)
+	}
+}
+
+func TestDatePrefixesAcrossBoundaries(t *testing.T) {
+	tests := []struct {
+		dateRange string
+		want      []string
+	}{
+		{"2024-02-27/2024-03-02", []string{"2024/02/27/", "2024/02/28/", "2024/02/29/", "2024/03/01/", "2024/03/02/"}},
+		{"2023-12-31/2024-01-01", []string{"2023/12/31/", "2024/01/01/"}},
+		{"2024-03-05/2024-03-05", []string{"2024/03/05/"}},
+	}
+	for _, test := range tests {
+		got := datePrefixes(parseDateRange(test.dateRange))
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("DATE_RANGE %s gave prefixes %v, want %v", test.dateRange, got, test.want)
+		}
+	}
+}
+
+func TestListDateRangeObjects(t *testing.T) {
+	fake, client := newFakeS3(t)
+	const logs = "AWSLogs/123456789012/vpcflowlogs/us-east-1/"
+	fake.put("src", logs+"2024/02/29/a.log.gz", "")
+	fake.put("src", logs+"2024/03/01/b.log.gz", "")
+	fake.put("src", logs+"2024/03/02/c.log.gz", "")
+	fake.put("src", logs+"2024/03/10/d.log.gz", "")
+
+	start, end := parseDateRange("2024-02-28/2024-03-01")
+	objects, err := listDateRangeObjects(client, "src/"+logs, start, end, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if want := logs + "2024/02/29/a.log.gz " + logs + "2024/03/01/b.log.gz"; strings.Join(keys, " ") != want {
+		t.Errorf("listed %v", keys)
+	}
+}
+
+func TestParseFailurePolicies(t *testing.T) {
+	for _, policy := range []string{parseFailureSkip, parseFailureFail, parseFailureQuarantine} {
+		t.Run(policy, func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			matchAllSources(t)
+			setForTest(t, &sourceBucketName, "src")
+			setForTest(t, &destBucketName, "dest/out.log")
+			setForTest(t, &onParseFailure, policy)
+			setForTest(t, &quarantinePrefix, "quarantine/bad-files")
+			fake.put("src", "bad.log", "<html>not a flow log</html>\n")
+			fake.put("src", "good.log", testFlowLogLine+"\n")
+
+			result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return []sourceObject{{Bucket: "src", Key: "bad.log"}, {Bucket: "src", Key: "good.log"}}, nil
+			})
+			if result.ParseFailures != 1 {
+				t.Errorf("%d parse failures counted, want 1", result.ParseFailures)
+			}
+
+			var parseErr *ParseError
+			if policy == parseFailureFail {
+				if !errors.As(err, &parseErr) || parseErr.Source.Key != "bad.log" {
+					t.Fatalf("run returned %v, want a ParseError for bad.log", err)
+				}
+				if keys := fake.keys("dest"); len(keys) != 0 {
+					t.Errorf("failed run wrote %v", keys)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if result.LinesMatched != 1 {
+				t.Errorf("%d lines matched, want the good file processed", result.LinesMatched)
+			}
+			_, quarantined := fake.get("quarantine", "bad-files/bad.log")
+			if quarantined != (policy == parseFailureQuarantine) {
+				t.Errorf("bad.log quarantined: %v", quarantined)
+			}
+		})
+	}
+}
+
+func TestEmptyListingRetried(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &emptyListRetries, 2)
+	start, end := parseDateRange("2024-03-05/2024-03-05")
+	setForTest(t, &dateRangeStart, start)
+	setForTest(t, &dateRangeEnd, end)
+
+	listings := 0
+	fake.fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet && r.URL.Query().Has("list-type") {
+			listings++
+			if listings == 2 {
+				// Delivered between the two listings (the fake's lock is held while fail runs)
+				fake.objects["src/logs/2024/03/05/in.log.gz"] = &fakeObject{metadata: map[string]string{}, lastModified: time.Now().UTC()}
+			}
+		}
+		return 0
+	}
+
+	objects, err := listSourceObjects(client, "src/logs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listings != 2 || len(objects) != 1 || objects[0].Key != "logs/2024/03/05/in.log.gz" {
+		t.Fatalf("listed %d times and found %v, want the object delivered before the retry", listings, objects)
+	}
+}
+
+func TestZeroObjects(t *testing.T) {
+	for _, isError := range []bool{false, true} {
+		t.Run(strconv.FormatBool(isError), func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			useFakeS3(t, client)
+			matchAllSources(t)
+			setForTest(t, &sourceBucketName, "src/AWSLogs/")
+			setForTest(t, &destBucketName, "dest/out.log")
+			setForTest(t, &zeroObjectsIsError, isError)
+
+			result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+				return nil, nil
+			})
+
+			var noObjects *NoObjectsError
+			if isError {
+				if !errors.As(err, &noObjects) || noObjects.Path != "src/AWSLogs/" {
+					t.Fatalf("run returned %v, want a NoObjectsError", err)
+				}
+				if keys := fake.keys("dest"); len(keys) != 0 {
+					t.Errorf("wrote %v for a run that found no source files", keys)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output, ok := fake.get("dest", "out.log"); !ok || output != "" || result.LinesScanned != 0 {
+				t.Errorf("output %q (written %v) after scanning %d lines, want an empty output", output, ok, result.LinesScanned)
+			}
+		})
+	}
+}
+
+func TestDecompressedSizeGuard(t *testing.T) {
+	setForTest(t, &maxDecompressedBytes, 1<<20)
+
+	// 64MB of newlines compress to about 128KB
+	bomb := gzipMembers(t, strings.Repeat("\n", 64<<20))
+	if len(bomb) > 256<<10 {
+		t.Fatalf("fixture compressed to %d bytes", len(bomb))
+	}
+	reader, err := newSourceReader(bytes.NewReader(bomb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, reader)
+	var tooLarge *DecompressedTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("reading the gzip bomb returned %v after %d bytes, want a DecompressedTooLargeError", err, n)
+	}
+	if n != 1<<20 {
+		t.Errorf("read %d bytes before stopping, want MAX_DECOMPRESSED_BYTES", n)
+	}
+
+	// A file of exactly the limit is read whole
+	reader, err = newSourceReader(bytes.NewReader(gzipMembers(t, strings.Repeat("\n", 1<<20))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(io.Discard, reader); err != nil || n != 1<<20 {
+		t.Errorf("reading a file of exactly the limit returned %d bytes, %v", n, err)
+	}
+}
+
+// setLastModified sets the LastModified the fake store reports for an object
+func setLastModified(fake *fakeS3, bucket, key string, lastModified time.Time) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.objects[bucket+"/"+key].lastModified = lastModified
+}
+
+func TestPreserveSourceLastModified(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src/in.log")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &preserveSourceLastModified, true)
+	t.Cleanup(func() { outputMetadata = nil })
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	setLastModified(fake, "src", "in.log", time.Date(2024, 3, 5, 10, 15, 30, 0, time.UTC))
+
+	if _, err := HandleRequest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.metadata("dest", "out.log")["source-last-modified"]; got != "2024-03-05T10:15:30Z" {
+		t.Errorf("source-last-modified metadata %q, want the source's LastModified", got)
+	}
+	if heads := fake.count(http.MethodHead); heads != 1 {
+		t.Errorf("%d HEAD requests, want 1 for the source not listed", heads)
+	}
+}
+
+func TestPreserveSourceLastModifiedLatestListed(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	const logs = "AWSLogs/123456789012/vpcflowlogs/us-east-1/"
+	start, end := parseDateRange("2024-03-05/2024-03-05")
+	setForTest(t, &dateRangeStart, start)
+	setForTest(t, &dateRangeEnd, end)
+	setForTest(t, &sourceBucketName, "src/"+logs)
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &preserveSourceLastModified, true)
+	t.Cleanup(func() { outputMetadata = nil })
+
+	for key, lastModified := range map[string]time.Time{
+		"a.log": time.Date(2024, 3, 5, 10, 5, 0, 0, time.UTC),
+		"b.log": time.Date(2024, 3, 5, 10, 20, 0, 0, time.UTC),
+		"c.log": time.Date(2024, 3, 5, 10, 10, 0, 0, time.UTC),
+	} {
+		fake.put("src", logs+"2024/03/05/"+key, testFlowLogLine+"\n")
+		setLastModified(fake, "src", logs+"2024/03/05/"+key, lastModified)
+	}
+
+	if _, err := HandleRequest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.metadata("dest", "out.log")["source-last-modified"]; got != "2024-03-05T10:20:00Z" {
+		t.Errorf("source-last-modified metadata %q, want the latest of the listed sources", got)
+	}
+	if heads := fake.count(http.MethodHead); heads != 0 {
+		t.Errorf("%d HEAD requests for sources listed with their LastModified", heads)
+	}
+}
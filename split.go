@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	splitByProtocol = "protocol"
+	splitByAccount  = "account"
+)
+
+// splitWriter writes each record to the output object of its part (its protocol or account), opening
+// the part's object the first time one of its records is written. Every part streams to its own
+// key, derived from the output key.
+type splitWriter struct {
+	open    func(key string) (outputWriter, error)
+	key     string
+	writers map[string]outputWriter
+	parts   []string
+}
+
+func newSplitWriter(key string, open func(key string) (outputWriter, error)) *splitWriter {
+	return &splitWriter{open: open, key: key, writers: map[string]outputWriter{}}
+}
+
+func (s *splitWriter) Write(vpcLog *VPCFlowLog) error {
+	part := splitPart(vpcLog)
+	writer, ok := s.writers[part]
+	if !ok {
+		var err error
+		writer, err = s.open(splitKey(s.key, part))
+		if err != nil {
+			return err
+		}
+		s.writers[part] = writer
+		s.parts = append(s.parts, part)
+	}
+	return writer.Write(vpcLog)
+}
+
+func (s *splitWriter) Flush() error {
+	for _, part := range s.parts {
+		if err := s.writers[part].Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close commits every part. If one fails, the parts not committed yet are aborted.
+func (s *splitWriter) Close() error {
+	for i, part := range s.parts {
+		if err := s.writers[part].Close(); err != nil {
+			for _, rest := range s.parts[i+1:] {
+				s.writers[rest].Abort(err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *splitWriter) Abort(err error) error {
+	for _, part := range s.parts {
+		s.writers[part].Abort(err)
+	}
+	return err
+}
+
+func (s *splitWriter) Objects() []outputObject {
+	var objects []outputObject
+	for _, part := range s.parts {
+		objects = append(objects, s.writers[part].Objects()...)
+	}
+	return objects
+}
+
+// splitPart is the part of the output a record belongs to under SPLIT_BY
+func splitPart(vpcLog *VPCFlowLog) string {
+	if splitBy == splitByAccount {
+		account := vpcLog.Get("account-id")
+		if account == "" || account == "-" {
+			return "unknown"
+		}
+		return account
+	}
+
+	switch vpcLog.Get("protocol") {
+	case "6":
+		return "tcp"
+	case "17":
+		return "udp"
+	case "1", "58":
+		return "icmp"
+	default:
+		return "other"
+	}
+}
+
+// splitKey inserts the part before the extension of the output key's file name, e.g.
+// "out.jsonl" becomes "out-tcp.jsonl", or for accounts, as a Hive-style "account=<id>" directory
+// before the file name, e.g. "filtered/account=123456789012/out.jsonl"
+func splitKey(key, part string) string {
+	name := key[strings.LastIndex(key, "/")+1:]
+	dir := key[:len(key)-len(name)]
+	if splitBy == splitByAccount {
+		return dir + "account=" + part + "/" + name
+	}
+
+	base, ext := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		base, ext = name[:i], name[i:]
+	}
+	return dir + base + "-" + part + ext
+}
+
+func parseSplitBy(value string) string {
+	switch value {
+	case "", splitByProtocol, splitByAccount:
+		return value
+	default:
+		log.Fatalf("SPLIT_BY %s not supported - expected one of protocol, account", value)
+		return ""
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestSplitByProtocol(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/filtered/out.log")
+	setForTest(t, &splitBy, splitByProtocol)
+
+	tcp := []string{recordLine("protocol=6", "srcport=1"), recordLine("protocol=6", "srcport=2")}
+	udp := []string{recordLine("protocol=17", "dstport=53")}
+	icmp := []string{recordLine("protocol=1", "srcport=0"), recordLine("protocol=58", "srcport=0")}
+	source := []string{tcp[0], udp[0], icmp[0], tcp[1], icmp[1]}
+	fake.put("src", "in.log", strings.Join(source, "\n")+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := strings.Join(fake.keys("dest"), ","); keys != "filtered/out-icmp.log,filtered/out-tcp.log,filtered/out-udp.log" {
+		t.Fatalf("output keys %s, want one per protocol", keys)
+	}
+	for key, want := range map[string][]string{
+		"filtered/out-tcp.log":  tcp,
+		"filtered/out-udp.log":  udp,
+		"filtered/out-icmp.log": icmp,
+	} {
+		if output, _ := fake.get("dest", key); output != strings.Join(want, "\n")+"\n" {
+			t.Errorf("%s holds %q, want %q", key, output, want)
+		}
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	setForTest(t, &splitBy, splitByProtocol)
+	for key, want := range map[string]string{
+		"out.jsonl":           "out-udp.jsonl",
+		"filtered/out.log":    "filtered/out-udp.log",
+		"filtered/out.log.gz": "filtered/out-udp.log.gz",
+		"filtered/out":        "filtered/out-udp",
+	} {
+		if got := splitKey(key, "udp"); got != want {
+			t.Errorf("splitKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestSplitByAccount(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/filtered/out.jsonl")
+	setForTest(t, &outputFormat, outputFormatJSON)
+	setForTest(t, &splitBy, splitByAccount)
+
+	fake.put("src", "in.log", strings.Join([]string{
+		recordLine("account-id=111111111111", "srcaddr=10.0.0.1"),
+		recordLine("account-id=222222222222", "srcaddr=10.0.0.2"),
+		recordLine("account-id=111111111111", "srcaddr=10.0.0.3"),
+	}, "\n")+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := strings.Join(fake.keys("dest"), ","); keys != "filtered/account=111111111111/out.jsonl,filtered/account=222222222222/out.jsonl" {
+		t.Fatalf("output keys %s, want one per account", keys)
+	}
+	for key, want := range map[string][]string{
+		"filtered/account=111111111111/out.jsonl": {"10.0.0.1", "10.0.0.3"},
+		"filtered/account=222222222222/out.jsonl": {"10.0.0.2"},
+	} {
+		output, _ := fake.get("dest", key)
+		records := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+		if len(records) != len(want) {
+			t.Fatalf("%s holds %d records, want %d", key, len(records), len(want))
+		}
+		for i, srcAddr := range want {
+			if !strings.Contains(records[i], `"srcaddr":"`+srcAddr+`"`) {
+				t.Errorf("%s record %d is %s, want the record from %s", key, i, records[i], srcAddr)
+			}
+		}
+	}
+}
+
+func TestSplitPartUnknownAccount(t *testing.T) {
+	setForTest(t, &splitBy, splitByAccount)
+	if part := splitPart(parseTestRecord(t, recordLine("account-id=-"))); part != "unknown" {
+		t.Errorf("record without an account split to %q, want unknown", part)
+	}
+	if key := splitKey("out.jsonl", "unknown"); key != "account=unknown/out.jsonl" {
+		t.Errorf("splitKey = %q", key)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// maxStatsDPacket keeps datagrams under the common 1500 byte MTU, so they are not fragmented
+const maxStatsDPacket = 1432
+
+var (
+	statsDOnce sync.Once
+	statsDConn net.Conn
+	statsDErr  error
+)
+
+// statsDNameRegexp matches the characters that are not safe in a StatsD metric name segment
+var statsDNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// emitStatsD sends the counts to STATSD_ADDR over UDP as StatsD counters named after the EMF
+// metrics, with STATSD_PREFIX in front. With STATSD_DOGSTATSD the dimensions are sent as DogStatsD
+// tags; plain StatsD has no tags, so dimensions other than the function name are appended to the
+// metric name instead (e.g. "vpclogfilter.RuleHits.10_0_0_0_8"). Sending is best effort - UDP gives no
+// delivery guarantee, and a failure is only logged.
+func emitStatsD(dimensions map[string]string, values []metricValue) {
+	if statsDAddr == "" {
+		return
+	}
+	statsDOnce.Do(func() {
+		statsDConn, statsDErr = net.Dial("udp", statsDAddr)
+	})
+	if statsDErr != nil {
+		log.Printf("Unable to send metrics to StatsD %s: %v\n", statsDAddr, statsDErr)
+		return
+	}
+
+	dimensionNames := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+	}
+	sort.Strings(dimensionNames)
+
+	suffix, tags := "", ""
+	for _, name := range dimensionNames {
+		if statsDDogStatsD {
+			if tags == "" {
+				tags = "|#"
+			} else {
+				tags += ","
+			}
+			tags += statsDNameRegexp.ReplaceAllString(name, "_") + ":" + dimensions[name]
+		} else if name != "FunctionName" {
+			suffix += "." + statsDNameRegexp.ReplaceAllString(dimensions[name], "_")
+		}
+	}
+
+	packet := &bytes.Buffer{}
+	for _, value := range values {
+		line := fmt.Sprintf("%s%s%s:%d|c%s", statsDPrefix, value.Name, suffix, value.Value, tags)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacket {
+			sendStatsD(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	sendStatsD(packet.Bytes())
+}
+
+func sendStatsD(packet []byte) {
+	if _, err := statsDConn.Write(packet); err != nil {
+		log.Printf("Unable to send metrics to StatsD %s: %v\n", statsDAddr, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenStatsD points STATSD_ADDR at a local UDP listener, returning a func that reads the metric
+// lines received so far, sorted
+func listenStatsD(t *testing.T) func() []string {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	setForTest(t, &statsDAddr, listener.LocalAddr().String())
+	setForTest(t, &statsDPrefix, "vpclogfilter.")
+	setForTest(t, &functionName, "vpc-log-filter")
+	statsDOnce, statsDConn, statsDErr = sync.Once{}, nil, nil
+	t.Cleanup(func() {
+		if statsDConn != nil {
+			statsDConn.Close()
+		}
+		statsDOnce, statsDConn, statsDErr = sync.Once{}, nil, nil
+	})
+
+	return func() []string {
+		var lines []string
+		buffer := make([]byte, 65536)
+		for {
+			listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := listener.ReadFrom(buffer)
+			if err != nil {
+				break
+			}
+			lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+}
+
+func TestStatsDCounters(t *testing.T) {
+	received := listenStatsD(t)
+
+	captureStdout(t, func() {
+		emitMetrics(Result{LinesScanned: 10, LinesMatched: 3, RuleHits: map[string]int{"10.0.0.0/8": 3}}, 840)
+	})
+
+	want := []string{
+		"vpclogfilter.BytesWritten:840|c",
+		"vpclogfilter.LinesMatched:3|c",
+		"vpclogfilter.LinesScanned:10|c",
+		"vpclogfilter.RuleHits.10_0_0_0_8:3|c",
+		"vpclogfilter.ZeroMatchRuns:0|c",
+	}
+	if got := received(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestDogStatsDTags(t *testing.T) {
+	received := listenStatsD(t)
+	setForTest(t, &statsDDogStatsD, true)
+
+	captureStdout(t, func() {
+		emitMetrics(Result{LinesScanned: 10, LinesMatched: 3, RuleHits: map[string]int{"10.0.0.0/8": 3}}, 840)
+	})
+
+	got := received()
+	for _, line := range []string{
+		"vpclogfilter.LinesScanned:10|c|#FunctionName:vpc-log-filter",
+		"vpclogfilter.RuleHits:3|c|#FunctionName:vpc-log-filter,Rule:10.0.0.0/8",
+	} {
+		found := false
+		for _, metric := range got {
+			found = found || metric == line
+		}
+		if !found {
+			t.Errorf("%s not among %q", line, got)
+		}
+	}
+}
+
+func TestStatsDLargeBatchSplitIntoDatagrams(t *testing.T) {
+	received := listenStatsD(t)
+
+	values := make([]metricValue, 200)
+	for i := range values {
+		values[i] = metricValue{Name: "Metric" + strings.Repeat("x", 20), Value: i}
+	}
+	emitStatsD(map[string]string{"FunctionName": functionName}, values)
+
+	if got := received(); len(got) != len(values) {
+		t.Errorf("received %d metrics, want all %d across several datagrams", len(got), len(values))
+	}
+}
+
+func TestStatsDNoOpWhenUnset(t *testing.T) {
+	setForTest(t, &statsDAddr, "")
+	statsDOnce, statsDConn, statsDErr = sync.Once{}, nil, nil
+
+	captureStdout(t, func() { emitMetrics(Result{LinesScanned: 1}, 0) })
+	if statsDConn != nil {
+		t.Error("StatsD connection opened without STATSD_ADDR")
+	}
+}
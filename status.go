@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// runStatus is the object written to STATUS_KEY after each invocation, for dashboards to poll
+type runStatus struct {
+	Timestamp  time.Time `json:"timestamp"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"durationMs"`
+	Result     Result    `json:"result"`
+}
+
+// writeStatus overwrites the STATUS_KEY object in the destination bucket with the outcome of the
+// invocation. A status that cannot be written is logged, and does not fail the invocation.
+func writeStatus(ctx context.Context, started time.Time, result Result, runErr error) {
+	finished := clock.Now()
+	status := runStatus{
+		Timestamp:  finished.UTC(),
+		RequestID:  invocationRequestID(ctx),
+		Success:    runErr == nil,
+		DurationMS: finished.Sub(started).Milliseconds(),
+		Result:     result,
+	}
+	if runErr != nil {
+		status.Error = runErr.Error()
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Unable to write the status: %v\n", err)
+		return
+	}
+	_, destS3Client, err := getS3Clients()
+	if err != nil {
+		log.Printf("Unable to write the status: %v\n", err)
+		return
+	}
+	destS3Bucket, _, err := parseBucketAndKeyFromFilePath(destBucketName)
+	if err != nil {
+		log.Printf("Unable to write the status: %v\n", err)
+		return
+	}
+	if _, err := destS3Client.PutObject(newDestPutObjectInput(destS3Bucket, statusKey, body)); err != nil {
+		log.Printf("Unable to write the status to s3://%s/%s: %v\n", destS3Bucket, statusKey, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestRunWritesFailureStatus(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &statusKey, "status.json")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return nil, errors.New("listing failed")
+	})
+	if err == nil {
+		t.Fatal("run succeeded with the listing failing")
+	}
+
+	body, ok := fake.get("dest", "status.json")
+	if !ok {
+		t.Fatal("no status written for the failed run")
+	}
+	var status runStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Success || status.Error != "listing failed" {
+		t.Fatalf("status %+v, want the listing failure", status)
+	}
+}
+
+func TestRunWritesSuccessStatus(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &statusKey, "status.json")
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := fake.get("dest", "status.json")
+	var status runStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Success || status.Result.LinesScanned != 1 {
+		t.Fatalf("status %+v, want a success with one line scanned", status)
+	}
+}
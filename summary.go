@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+// summaries are the aggregates collected over the matched records of a run, across all of its
+// source files
+type summaries struct {
+	talkers talkerCounts
+	rules   map[string]*ruleSummary
+	fanout  map[string]*hyperLogLog
+
+	// invalid holds the raw invalid records (INPUT_FORMAT=json) when they are quarantined
+	invalid *bytes.Buffer
+
+	// deadletter holds the raw lines of matched records that could not be serialized
+	deadletter *bytes.Buffer
+}
+
+// ruleSummary is the traffic matched by one configured source IP address
+type ruleSummary struct {
+	Matches int   `json:"matches"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func newSummaries() *summaries {
+	return &summaries{talkers: newTalkerCounts(), rules: map[string]*ruleSummary{}, fanout: map[string]*hyperLogLog{}, invalid: &bytes.Buffer{}, deadletter: &bytes.Buffer{}}
+}
+
+// add records a matched record, attributed to the given rules (source IP addresses or CIDR blocks)
+func (s *summaries) add(rules []string, vpcLog *VPCFlowLog) {
+	// Malformed byte counts add nothing to the totals
+	bytes, _ := parseCount(vpcLog.Get("bytes"))
+	for _, rule := range rules {
+		summary, ok := s.rules[rule]
+		if !ok {
+			summary = &ruleSummary{}
+			s.rules[rule] = summary
+		}
+		summary.Matches++
+		summary.Bytes += bytes
+	}
+
+	if topN > 0 {
+		s.talkers.Add(vpcLog)
+	}
+
+	if fanoutAnalysis {
+		srcAddr := vpcLog.Get("srcaddr")
+		sketch, ok := s.fanout[srcAddr]
+		if !ok {
+			sketch = &hyperLogLog{}
+			s.fanout[srcAddr] = sketch
+		}
+		sketch.Add(vpcLog.Get("dstaddr"))
+	}
+}
+
+// addInvalid records a source line that failed validation
+func (s *summaries) addInvalid(line string) {
+	if quarantineInvalidRecords {
+		s.invalid.WriteString(line)
+		s.invalid.WriteByte('\n')
+	}
+}
+
+// addDeadletter records the raw line of a matched record that failed to serialize
+func (s *summaries) addDeadletter(line string) {
+	s.deadletter.WriteString(line)
+	s.deadletter.WriteByte('\n')
+}
+
+// FanoutSummary is the number of distinct destinations a source IP talked to, as written to
+// fanout.json. The count is a HyperLogLog estimate (about 3% error) so memory stays fixed per
+// source however many destinations it has.
+type FanoutSummary struct {
+	SrcAddr          string `json:"srcaddr"`
+	DistinctDstAddrs uint64 `json:"distinctDstAddrs"`
+	ExceedsThreshold bool   `json:"exceedsThreshold"`
+}
+
+// Fanout returns the distinct destination counts per source, highest first. Sources with more than
+// FANOUT_THRESHOLD distinct destinations (when set) are flagged.
+func (s *summaries) Fanout() []FanoutSummary {
+	fanout := make([]FanoutSummary, 0, len(s.fanout))
+	for srcAddr, sketch := range s.fanout {
+		distinct := sketch.Estimate()
+		fanout = append(fanout, FanoutSummary{
+			SrcAddr:          srcAddr,
+			DistinctDstAddrs: distinct,
+			ExceedsThreshold: fanoutThreshold > 0 && distinct > uint64(fanoutThreshold),
+		})
+	}
+
+	sort.Slice(fanout, func(i, j int) bool {
+		if fanout[i].DistinctDstAddrs != fanout[j].DistinctDstAddrs {
+			return fanout[i].DistinctDstAddrs > fanout[j].DistinctDstAddrs
+		}
+		return fanout[i].SrcAddr < fanout[j].SrcAddr
+	})
+	return fanout
+}
+
+// TopTalker is a source IP's share of the matched traffic, as written to top-talkers.json
+type TopTalker struct {
+	Rank       int    `json:"rank"`
+	SrcAddr    string `json:"srcaddr"`
+	TotalBytes int64  `json:"totalBytes"`
+	FlowCount  int64  `json:"flowCount"`
+
+	// Overestimate bounds how much of TotalBytes may belong to other source IPs, once more than
+	// MAX_SUMMARY_KEYS were seen (see talkerCounts)
+	Overestimate int64 `json:"overestimate,omitempty"`
+
+	// index is the talker's position in talkerCounts.smallest
+	index int
+}
+
+// talkerCounts accumulates bytes and flow counts per source IP across the matched records. Counts
+// are exact for up to MAX_SUMMARY_KEYS distinct IPs (unbounded when 0); past that, the Space-Saving
+// algorithm keeps memory fixed: a new IP replaces the one with the fewest bytes and inherits its
+// byte count as an overestimate, so heavy hitters are still found and never undercounted.
+type talkerCounts struct {
+	byAddr map[string]*TopTalker
+
+	// smallest is a min-heap of the talkers by bytes, kept only when the keys are capped
+	smallest *spaceSavingHeap
+}
+
+func newTalkerCounts() talkerCounts {
+	return talkerCounts{byAddr: map[string]*TopTalker{}, smallest: &spaceSavingHeap{}}
+}
+
+func (t talkerCounts) Add(vpcLog *VPCFlowLog) {
+	srcAddr := vpcLog.Get("srcaddr")
+	bytes, _ := parseCount(vpcLog.Get("bytes"))
+
+	talker, ok := t.byAddr[srcAddr]
+	switch {
+	case ok:
+	case maxSummaryKeys > 0 && len(t.byAddr) >= maxSummaryKeys:
+		// Evict the smallest talker, reusing its entry for the new IP
+		talker = t.smallest.items[0]
+		delete(t.byAddr, talker.SrcAddr)
+		talker.SrcAddr, talker.FlowCount, talker.Overestimate = srcAddr, 0, talker.TotalBytes
+		t.byAddr[srcAddr] = talker
+	default:
+		talker = &TopTalker{SrcAddr: srcAddr}
+		t.byAddr[srcAddr] = talker
+		if maxSummaryKeys > 0 {
+			heap.Push(t.smallest, talker)
+		}
+	}
+
+	talker.TotalBytes += bytes
+	talker.FlowCount++
+	if maxSummaryKeys > 0 {
+		heap.Fix(t.smallest, talker.index)
+	}
+}
+
+// Top selects the n source IPs with the most bytes, largest first. Selection goes through a
+// min-heap bounded at n entries so it stays O(n) in memory however many distinct IPs there are.
+func (t talkerCounts) Top(n int) []TopTalker {
+	h := &talkerHeap{}
+	for _, talker := range t.byAddr {
+		if h.Len() < n {
+			heap.Push(h, talker)
+		} else if h.Len() > 0 && h.less(h.items[0], talker) {
+			h.items[0] = talker
+			heap.Fix(h, 0)
+		}
+	}
+
+	top := make([]TopTalker, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = *heap.Pop(h).(*TopTalker)
+		top[i].Rank = i + 1
+	}
+	return top
+}
+
+// talkerHeap is a min-heap ordered by total bytes, with ties broken by address so the ranking
+// is deterministic
+type talkerHeap struct {
+	items []*TopTalker
+}
+
+func (h *talkerHeap) less(a, b *TopTalker) bool {
+	if a.TotalBytes != b.TotalBytes {
+		return a.TotalBytes < b.TotalBytes
+	}
+	return a.SrcAddr > b.SrcAddr
+}
+
+func (h *talkerHeap) Len() int           { return len(h.items) }
+func (h *talkerHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+func (h *talkerHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *talkerHeap) Push(x interface{}) { h.items = append(h.items, x.(*TopTalker)) }
+
+func (h *talkerHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// spaceSavingHeap is a min-heap of talkers by total bytes that tracks each talker's position, so a
+// talker's entry can be fixed up in place as its count grows
+type spaceSavingHeap struct {
+	items []*TopTalker
+}
+
+func (h *spaceSavingHeap) Len() int           { return len(h.items) }
+func (h *spaceSavingHeap) Less(i, j int) bool { return h.items[i].TotalBytes < h.items[j].TotalBytes }
+
+func (h *spaceSavingHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index, h.items[j].index = i, j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	talker := x.(*TopTalker)
+	talker.index = len(h.items)
+	h.items = append(h.items, talker)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestTopTalkersRanking(t *testing.T) {
+	talkers := newTalkerCounts()
+	for _, line := range []string{
+		recordLine("srcaddr=10.0.0.1", "bytes=100"),
+		recordLine("srcaddr=10.0.0.2", "bytes=500"),
+		recordLine("srcaddr=10.0.0.3", "bytes=300"),
+		recordLine("srcaddr=10.0.0.4", "bytes=50"),
+		recordLine("srcaddr=10.0.0.1", "bytes=250"),
+		recordLine("srcaddr=10.0.0.4", "bytes=-"),
+	} {
+		vpcLog, err := parseRecord(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		talkers.Add(vpcLog)
+	}
+
+	want := []TopTalker{
+		{Rank: 1, SrcAddr: "10.0.0.2", TotalBytes: 500, FlowCount: 1},
+		{Rank: 2, SrcAddr: "10.0.0.1", TotalBytes: 350, FlowCount: 2},
+		{Rank: 3, SrcAddr: "10.0.0.3", TotalBytes: 300, FlowCount: 1},
+	}
+	top := talkers.Top(3)
+	if len(top) != len(want) {
+		t.Fatalf("got %d talkers, want %d", len(top), len(want))
+	}
+	for i := range want {
+		if top[i] != want[i] {
+			t.Errorf("rank %d is %+v, want %+v", i+1, top[i], want[i])
+		}
+	}
+}
+
+func TestFanoutExactOnSmallFixture(t *testing.T) {
+	setForTest(t, &fanoutAnalysis, true)
+	setForTest(t, &fanoutThreshold, 2)
+
+	runSummaries := newSummaries()
+	for _, line := range []string{
+		recordLine("srcaddr=10.0.0.1", "dstaddr=8.8.8.8"),
+		recordLine("srcaddr=10.0.0.1", "dstaddr=8.8.4.4"),
+		recordLine("srcaddr=10.0.0.1", "dstaddr=1.1.1.1"),
+		recordLine("srcaddr=10.0.0.1", "dstaddr=8.8.8.8"),
+		recordLine("srcaddr=10.0.0.2", "dstaddr=8.8.8.8"),
+	} {
+		runSummaries.add([]string{"10.0.0.0/8"}, parseTestRecord(t, line))
+	}
+
+	want := []FanoutSummary{
+		{SrcAddr: "10.0.0.1", DistinctDstAddrs: 3, ExceedsThreshold: true},
+		{SrcAddr: "10.0.0.2", DistinctDstAddrs: 1},
+	}
+	fanout := runSummaries.Fanout()
+	if len(fanout) != len(want) {
+		t.Fatalf("got %d sources, want %d", len(fanout), len(want))
+	}
+	for i := range want {
+		if fanout[i] != want[i] {
+			t.Errorf("fanout %d is %+v, want %+v", i, fanout[i], want[i])
+		}
+	}
+}
+
+func TestHyperLogLogEstimateWithinTolerance(t *testing.T) {
+	for _, distinct := range []int{1000, 50000} {
+		var sketch hyperLogLog
+		for i := 0; i < distinct; i++ {
+			address := fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+			sketch.Add(address)
+			// Repeats don't count
+			sketch.Add(address)
+		}
+
+		// 3 standard errors
+		estimate := float64(sketch.Estimate())
+		if errorRate := math.Abs(estimate-float64(distinct)) / float64(distinct); errorRate > 0.1 {
+			t.Errorf("estimated %.0f of %d distinct values", estimate, distinct)
+		}
+	}
+}
+
+func TestTopTalkersBoundedByMaxSummaryKeys(t *testing.T) {
+	setForTest(t, &maxSummaryKeys, 100)
+	talkers := newTalkerCounts()
+
+	// 10 heavy hitters among 20,000 one-off source IPs
+	exact := map[string]int64{}
+	for i := 0; i < 20000; i++ {
+		addr := fmt.Sprintf("172.16.%d.%d", i/256, i%256)
+		bytes := int64(10 + i%7)
+		if i%20 == 0 {
+			addr = fmt.Sprintf("10.0.0.%d", i/20%10+1)
+			bytes = int64(1000 * (i/20%10 + 1))
+		}
+		exact[addr] += bytes
+		talkers.Add(parseTestRecord(t, recordLine("srcaddr="+addr, fmt.Sprintf("bytes=%d", bytes))))
+
+		if len(talkers.byAddr) > 100 || talkers.smallest.Len() > 100 {
+			t.Fatalf("%d talkers held after %d records, want at most MAX_SUMMARY_KEYS", len(talkers.byAddr), i+1)
+		}
+	}
+
+	top := talkers.Top(10)
+	if len(top) != 10 {
+		t.Fatalf("got %d talkers, want 10", len(top))
+	}
+	for i, talker := range top {
+		if want := fmt.Sprintf("10.0.0.%d", 10-i); talker.SrcAddr != want {
+			t.Errorf("rank %d is %s, want the heavy hitter %s", i+1, talker.SrcAddr, want)
+		}
+		// Space-Saving never undercounts, and overestimates by at most Overestimate
+		if talker.TotalBytes < exact[talker.SrcAddr] || talker.TotalBytes-talker.Overestimate > exact[talker.SrcAddr] {
+			t.Errorf("%s counted %d bytes (overestimate %d), exactly %d", talker.SrcAddr, talker.TotalBytes, talker.Overestimate, exact[talker.SrcAddr])
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// tailState is how much of a source object has been processed (TAIL_MODE): its size, ETag and
+// version at the time, and the hash of those Size bytes
+type tailState struct {
+	Size      int64
+	ETag      string
+	VersionID string
+	Hash      string
+}
+
+// tailStore keeps the tailState of every source object in the CHECKPOINT_TABLE, under the
+// checkpointKey "tail/<bucket>/<key>"
+type tailStore struct {
+	client dynamodbiface.DynamoDBAPI
+}
+
+func tailCheckpointKey(source sourceObject) string {
+	return "tail/" + source.Bucket + "/" + source.Key
+}
+
+// load returns the source's state, or nil when it has not been processed yet
+func (t *tailStore) load(source sourceObject) (*tailState, error) {
+	output, err := t.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(checkpointTable),
+		Key:            map[string]*dynamodb.AttributeValue{"checkpointKey": {S: aws.String(tailCheckpointKey(source))}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the tail position of %s from %s: %v", source, checkpointTable, err)
+	}
+	if _, ok := output.Item["size"]; !ok {
+		return nil, nil
+	}
+
+	size, err := strconv.ParseInt(aws.StringValue(output.Item["size"].N), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Tail position of %s in %s has an invalid size: %v", source, checkpointTable, err)
+	}
+	state := &tailState{Size: size}
+	if etag, ok := output.Item["etag"]; ok {
+		state.ETag = aws.StringValue(etag.S)
+	}
+	if versionID, ok := output.Item["versionId"]; ok {
+		state.VersionID = aws.StringValue(versionID.S)
+	}
+	if hash, ok := output.Item["hash"]; ok {
+		state.Hash = aws.StringValue(hash.S)
+	}
+	return state, nil
+}
+
+func (t *tailStore) save(source sourceObject, state tailState) error {
+	_, err := t.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(checkpointTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"checkpointKey": {S: aws.String(tailCheckpointKey(source))},
+			"size":          {N: aws.String(strconv.FormatInt(state.Size, 10))},
+			"etag":          {S: aws.String(state.ETag)},
+			"versionId":     {S: aws.String(state.VersionID)},
+			"hash":          {S: aws.String(state.Hash)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to save the tail position of %s to %s: %v", source, checkpointTable, err)
+	}
+	return nil
+}
+
+// TailSaveError is returned when the tail positions cannot all be saved after the output is
+// committed. It is not retried: the retry would delete the committed output while the positions
+// already saved have moved past the bytes it holds. The objects whose positions were not saved
+// are read again from their old positions by the next run.
+type TailSaveError struct {
+	Saved, Unsaved int
+	Err            error
+}
+
+func (e *TailSaveError) Error() string {
+	return fmt.Sprintf("%v - the output is kept, and the %d of %d sources whose tail positions were not saved will be processed again from their old positions", e.Err, e.Unsaved, e.Saved+e.Unsaved)
+}
+
+func (e *TailSaveError) Unwrap() error {
+	return e.Err
+}
+
+// tailSources narrows every source object to the bytes appended since it was last processed,
+// dropping the objects that are unchanged, and returns the state to save for each object once the
+// run's output is committed. An object whose ETag or version changed is only continued from its
+// old end when its bytes up to there still hash the same: one that is smaller than before, or was
+// overwritten, is processed again from the start.
+//
+// Appends are expected to be whole lines (or whole gzip members for gzipped objects), as written
+// by log shippers: the new bytes are read from the old end to the size found when the run starts,
+// of the version found then.
+func tailSources(ctx context.Context, sourceS3Client s3iface.S3API, store *tailStore, sources []sourceObject) ([]sourceObject, map[string]tailState, error) {
+	var tailed []sourceObject
+	states := map[string]tailState{}
+	for _, source := range sources {
+		headObjectInput := &s3.HeadObjectInput{Bucket: aws.String(source.Bucket), Key: aws.String(source.Key)}
+		if source.VersionID != "" {
+			headObjectInput.VersionId = aws.String(source.VersionID)
+		}
+		head, err := sourceS3Client.HeadObjectWithContext(ctx, headObjectInput)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read the size of %s: %v", source, err)
+		}
+		current := tailState{Size: aws.Int64Value(head.ContentLength), ETag: aws.StringValue(head.ETag), VersionID: aws.StringValue(head.VersionId)}
+
+		previous, err := store.load(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		if previous != nil && previous.ETag == current.ETag && previous.VersionID == current.VersionID && previous.Size == current.Size {
+			log.Printf("%s is unchanged since it was last processed - skipping\n", source)
+			continue
+		}
+
+		// The bytes are read from the version the sizes and hashes are for
+		if current.VersionID != "" {
+			source.VersionID = current.VersionID
+		}
+		var previousSize int64
+		if previous != nil && previous.Size < current.Size {
+			previousSize = previous.Size
+		}
+		prefixHash, hash, err := hashObject(ctx, sourceS3Client, source, previousSize, current.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		current.Hash = hash
+
+		source.Offset, source.End = 0, current.Size
+		if previousSize > 0 && prefixHash == previous.Hash {
+			source.Offset = previousSize
+		}
+		if previous != nil && source.Offset == 0 {
+			log.Printf("%s was truncated or overwritten since it was last processed - processing it from the start\n", source)
+		} else if source.Offset > 0 {
+			log.Printf("Processing %d bytes appended to %s\n", source.End-source.Offset, source)
+		}
+
+		tailed = append(tailed, source)
+		states[source.Key] = current
+	}
+	return tailed, states, nil
+}
+
+// hashObject hashes the first size bytes of the object, returning the hash of its first prefix
+// bytes as well
+func hashObject(ctx context.Context, sourceS3Client s3iface.S3API, source sourceObject, prefix, size int64) (string, string, error) {
+	hash := sha256.New()
+	if size == 0 {
+		sum := hex.EncodeToString(hash.Sum(nil))
+		return sum, sum, nil
+	}
+
+	getObjectInput := &s3.GetObjectInput{
+		Bucket: aws.String(source.Bucket),
+		Key:    aws.String(source.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", size-1)),
+	}
+	if source.VersionID != "" {
+		getObjectInput.VersionId = aws.String(source.VersionID)
+	}
+	object, err := sourceS3Client.GetObjectWithContext(ctx, getObjectInput)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to read %s to check it was only appended to: %v", source, err)
+	}
+	defer object.Body.Close()
+
+	if _, err := io.CopyN(hash, object.Body, prefix); err != nil {
+		return "", "", fmt.Errorf("Unable to read %s to check it was only appended to: %v", source, err)
+	}
+	prefixHash := hex.EncodeToString(hash.Sum(nil))
+	if _, err := io.CopyN(hash, object.Body, size-prefix); err != nil {
+		return "", "", fmt.Errorf("Unable to read %s to check it was only appended to: %v", source, err)
+	}
+	return prefixHash, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// parseTailMode parses TAIL_MODE, which needs CHECKPOINT_TABLE to keep its positions in and S3
+// sources to range over
+func parseTailMode(name string) bool {
+	if !envBool(name) {
+		return false
+	}
+	if checkpointTable == "" {
+		log.Fatalf("%s requires CHECKPOINT_TABLE", name)
+	}
+	if sourceURL != "" {
+		log.Fatalf("%s cannot be combined with SOURCE_URL", name)
+	}
+	return true
+}
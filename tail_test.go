@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeTailTable is a CHECKPOINT_TABLE keeping whole items by checkpointKey
+type fakeTailTable struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+	// failPut fails the put of the given number, counting from 1
+	failPut, puts int
+}
+
+func (f *fakeTailTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[aws.StringValue(input.Key["checkpointKey"].S)]}, nil
+}
+
+func (f *fakeTailTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if f.puts++; f.puts == f.failPut {
+		return nil, errors.New("ProvisionedThroughputExceededException")
+	}
+	f.items[aws.StringValue(input.Item["checkpointKey"].S)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestTailModeProcessesAppendedBytes(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	table := &fakeTailTable{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	useFakeDynamoDB(t, table)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &checkpointTable, "checkpoints")
+	setForTest(t, &tailMode, true)
+
+	first := []string{recordLine("srcaddr=10.0.0.1"), recordLine("srcaddr=10.0.0.2")}
+	appended := []string{recordLine("srcaddr=10.0.0.3")}
+	runTail := func(lines []string) (Result, string) {
+		t.Helper()
+		fake.put("src", "in.log", strings.Join(lines, "\n")+"\n")
+		result, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+			return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, _ := fake.get("dest", "out.log")
+		return result, output
+	}
+
+	if result, output := runTail(first); result.LinesScanned != 2 || output != strings.Join(first, "\n")+"\n" {
+		t.Fatalf("first run scanned %d lines into %q", result.LinesScanned, output)
+	}
+	if _, ok := table.items["tail/src/in.log"]; !ok {
+		t.Fatal("no tail position saved after the first run")
+	}
+
+	// The second run only reads what was appended
+	if result, output := runTail(append(append([]string{}, first...), appended...)); result.LinesScanned != 1 || output != appended[0]+"\n" {
+		t.Fatalf("second run scanned %d lines into %q, want only the appended line", result.LinesScanned, output)
+	}
+
+	// An unchanged object is skipped
+	if result, _ := runTail(append(append([]string{}, first...), appended...)); result.LinesScanned != 0 {
+		t.Errorf("unchanged object scanned %d lines", result.LinesScanned)
+	}
+
+	// A truncated (rotated) object is processed from the start
+	rotated := []string{recordLine("srcaddr=10.0.0.9")}
+	if result, output := runTail(rotated); result.LinesScanned != 1 || output != rotated[0]+"\n" {
+		t.Errorf("truncated object scanned %d lines into %q, want it from the start", result.LinesScanned, output)
+	}
+
+	// So is one replaced by a larger object that does not continue it
+	replaced := []string{recordLine("srcaddr=10.0.1.1"), recordLine("srcaddr=10.0.1.2"), recordLine("srcaddr=10.0.1.3")}
+	if result, output := runTail(replaced); result.LinesScanned != 3 || output != strings.Join(replaced, "\n")+"\n" {
+		t.Errorf("replaced object scanned %d lines into %q, want it from the start", result.LinesScanned, output)
+	}
+
+	// And one overwritten with the same bytes just before the old end, but not before them
+	overwritten := []string{recordLine("srcaddr=10.0.2.1"), replaced[1], replaced[2], recordLine("srcaddr=10.0.2.4")}
+	if result, output := runTail(overwritten); result.LinesScanned != 4 || output != strings.Join(overwritten, "\n")+"\n" {
+		t.Errorf("overwritten object scanned %d lines into %q, want it from the start", result.LinesScanned, output)
+	}
+}
+
+func TestTailSaveFailureKeepsOutput(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	table := &fakeTailTable{items: map[string]map[string]*dynamodb.AttributeValue{}, failPut: 2}
+	useFakeDynamoDB(t, table)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &checkpointTable, "checkpoints")
+	setForTest(t, &tailMode, true)
+	setForTest(t, &pipelineRetries, 2)
+	captureLog(t)
+
+	lines := map[string]string{"a.log": recordLine("srcaddr=10.0.0.1"), "b.log": recordLine("srcaddr=10.0.0.2")}
+	for key, line := range lines {
+		fake.put("src", key, line+"\n")
+	}
+	listSources := func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "a.log"}, {Bucket: "src", Key: "b.log"}}, nil
+	}
+
+	_, err := run(context.Background(), listSources)
+	var tailSave *TailSaveError
+	if !errors.As(err, &tailSave) || tailSave.Saved != 1 || tailSave.Unsaved != 1 {
+		t.Fatalf("got %v, want a TailSaveError after saving the first position", err)
+	}
+	if table.puts != 2 {
+		t.Errorf("%d tail saves, want the run not retried after the second failed", table.puts)
+	}
+	// The output holding a.log's records is kept, as its position has moved past them
+	if output, _ := fake.get("dest", "out.log"); output != lines["a.log"]+"\n"+lines["b.log"]+"\n" {
+		t.Errorf("output %q, want both sources' records kept", output)
+	}
+
+	// The next run only reads the source whose position was not saved
+	result, err := run(context.Background(), listSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, _ := fake.get("dest", "out.log"); result.LinesScanned != 1 || output != lines["b.log"]+"\n" {
+		t.Errorf("next run scanned %d lines into %q, want only b.log again", result.LinesScanned, output)
+	}
+}
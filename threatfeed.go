@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// threatFeed is the last good copy of THREAT_FEED_URL, kept for the life of the container and
+// fetched again once it is THREAT_FEED_REFRESH_SECONDS old
+var threatFeed struct {
+	networks *networkSet
+	etag     string
+	fetched  time.Time
+}
+
+// refreshThreatFeed downloads THREAT_FEED_URL when the cached copy is missing or due a refresh. A
+// failed download keeps the last good copy, so a feed outage does not stop processing; it is only
+// an error when there is no copy to fall back to.
+func refreshThreatFeed(ctx context.Context) error {
+	if threatFeed.networks != nil && clock.Now().Sub(threatFeed.fetched) < time.Duration(threatFeedRefreshSeconds)*time.Second {
+		return nil
+	}
+
+	err := fetchThreatFeed(ctx)
+	if err == nil {
+		return nil
+	}
+	if threatFeed.networks == nil {
+		return err
+	}
+	log.Printf("%v - using the %d entries fetched at %s\n", err, threatFeed.networks.size, threatFeed.fetched.Format(time.RFC3339))
+	return nil
+}
+
+func fetchThreatFeed(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, threatFeedURL, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to read threat feed %s: %v", threatFeedURL, err)
+	}
+	if threatFeed.etag != "" {
+		request.Header.Set("If-None-Match", threatFeed.etag)
+	}
+
+	client := &http.Client{Timeout: time.Duration(sourceURLTimeout) * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("Unable to read threat feed %s: %v", threatFeedURL, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified && threatFeed.networks != nil {
+		log.Printf("Threat feed %s is unchanged - using the cached %d entries\n", threatFeedURL, threatFeed.networks.size)
+		threatFeed.fetched = clock.Now()
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to read threat feed %s: unexpected HTTP status %s", threatFeedURL, response.Status)
+	}
+
+	networks, skipped, err := parseThreatFeed(response.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to read threat feed %s: %v", threatFeedURL, err)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d threat feed lines that are not an IP address or CIDR block\n", skipped)
+	}
+
+	threatFeed.networks, threatFeed.etag, threatFeed.fetched = networks, response.Header.Get("ETag"), clock.Now()
+	log.Printf("Loaded %d entries from threat feed %s\n", networks.size, threatFeedURL)
+	return nil
+}
+
+// parseThreatFeed reads a newline-delimited feed of CIDR blocks and IP addresses. Blank lines,
+// comments ("#" or ";") and anything after the first field of a line (e.g. the SBL reference of a
+// Spamhaus DROP entry) are ignored; lines that are not an address or block are counted in skipped.
+func parseThreatFeed(feed io.Reader) (*networkSet, int, error) {
+	networks := newNetworkSet()
+	skipped := 0
+
+	scanner := bufio.NewScanner(feed)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		entry := fields[0]
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			skipped++
+			continue
+		}
+		networks.add(network)
+	}
+	return networks, skipped, scanner.Err()
+}
+
+// threatFeedFilter keeps records whose srcaddr or dstaddr is in the threat feed (MATCH_THREAT_FEED)
+func threatFeedFilter() recordFilter {
+	return func(vpcLog *VPCFlowLog) bool {
+		if threatFeed.networks == nil {
+			return false
+		}
+		return threatFeed.networks.contains(vpcLog.Get("srcaddr")) || threatFeed.networks.contains(vpcLog.Get("dstaddr"))
+	}
+}
+
+// networkSet holds CIDR blocks by prefix length, so an address is looked up once per distinct
+// prefix length rather than compared against every block - feeds run to tens of thousands of
+// entries
+type networkSet struct {
+	byPrefix map[int]map[string]bool
+	prefixes []int
+	size     int
+}
+
+func newNetworkSet() *networkSet {
+	return &networkSet{byPrefix: map[int]map[string]bool{}}
+}
+
+func (s *networkSet) add(network *net.IPNet) {
+	ones, bits := network.Mask.Size()
+	prefix := ones
+	if bits == 128 {
+		// IPv6 prefixes are kept apart from IPv4 ones of the same length
+		prefix += 1000
+	}
+
+	networks, ok := s.byPrefix[prefix]
+	if !ok {
+		networks = map[string]bool{}
+		s.byPrefix[prefix] = networks
+		s.prefixes = append(s.prefixes, prefix)
+		sort.Ints(s.prefixes)
+	}
+	if !networks[network.IP.String()] {
+		networks[network.IP.String()] = true
+		s.size++
+	}
+}
+
+func (s *networkSet) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	bits, offset := 128, 1000
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, offset = ip4, 32, 0
+	}
+
+	for _, prefix := range s.prefixes {
+		ones := prefix - offset
+		if ones < 0 || ones > bits {
+			continue
+		}
+		if s.byPrefix[prefix][ip.Mask(net.CIDRMask(ones, bits)).String()] {
+			return true
+		}
+	}
+	return false
+}
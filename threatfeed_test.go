@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// feedServer serves feed as THREAT_FEED_URL, with its ETag, and fails with the status in fail when
+// it is set
+type feedServer struct {
+	feed     string
+	fail     int
+	requests int
+}
+
+func (f *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	if f.fail != 0 {
+		w.WriteHeader(f.fail)
+		return
+	}
+	etag := fmt.Sprintf(`"%d"`, len(f.feed))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, f.feed)
+}
+
+func useThreatFeed(t *testing.T, feed string) (*feedServer, *fakeClock) {
+	t.Helper()
+	server := &feedServer{feed: feed}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)}
+	setForTest[Clock](t, &clock, now)
+	setForTest(t, &threatFeedURL, httpServer.URL+"/drop.txt")
+	setForTest(t, &threatFeedRefreshSeconds, 3600)
+	setForTest(t, &matchThreatFeed, true)
+	setForTest(t, &threatFeed, threatFeed)
+	threatFeed.networks, threatFeed.etag = nil, ""
+	setForTest(t, &recordFilters, newRecordFilters())
+	return server, now
+}
+
+func TestThreatFeedFilter(t *testing.T) {
+	matchAllSources(t)
+	useThreatFeed(t, "; Spamhaus DROP List\n"+
+		"198.51.100.0/24 ; SBL123\n"+
+		"203.0.113.7\n"+
+		"2001:db8::/32\n"+
+		"\n"+
+		"not-a-network\n")
+	if err := refreshThreatFeed(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if threatFeed.networks.size != 3 {
+		t.Fatalf("loaded %d feed entries, want 3", threatFeed.networks.size)
+	}
+
+	records, _, err := filterLines(t,
+		recordLine("srcaddr=198.51.100.20"),
+		recordLine("dstaddr=203.0.113.7"),
+		recordLine("dstaddr=203.0.113.8"),
+		recordLine("srcaddr=2001:db8::1", "dstaddr=2001:db9::1"),
+		recordLine("srcaddr=10.0.0.9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, record := range records {
+		kept = append(kept, record.Get("srcaddr")+">"+record.Get("dstaddr"))
+	}
+	want := "198.51.100.20>8.8.8.8,10.0.0.1>203.0.113.7,2001:db8::1>2001:db9::1"
+	if strings.Join(kept, ",") != want {
+		t.Errorf("kept %v, want %s", kept, want)
+	}
+}
+
+func TestThreatFeedCachedAndRefreshed(t *testing.T) {
+	server, now := useThreatFeed(t, "198.51.100.0/24\n")
+	ctx := context.Background()
+
+	if err := refreshThreatFeed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now.advance(30 * time.Minute)
+	if err := refreshThreatFeed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests != 1 {
+		t.Fatalf("fetched the feed %d times within the refresh interval", server.requests)
+	}
+
+	// Past the interval an unchanged feed is revalidated, then a changed one is loaded
+	now.advance(time.Hour)
+	if err := refreshThreatFeed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests != 2 || !threatFeed.networks.contains("198.51.100.1") {
+		t.Fatalf("after %d requests the feed no longer has its entry", server.requests)
+	}
+	server.feed = "192.0.2.0/24\n"
+	now.advance(time.Hour)
+	if err := refreshThreatFeed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !threatFeed.networks.contains("192.0.2.1") || threatFeed.networks.contains("198.51.100.1") {
+		t.Error("changed feed was not loaded on refresh")
+	}
+}
+
+func TestThreatFeedFailureFallsBackToLastGoodCopy(t *testing.T) {
+	server, now := useThreatFeed(t, "198.51.100.0/24\n")
+	ctx := context.Background()
+
+	server.fail = http.StatusServiceUnavailable
+	if err := refreshThreatFeed(ctx); err == nil {
+		t.Fatal("failed first download without a copy to fall back to was not an error")
+	}
+
+	server.fail = 0
+	if err := refreshThreatFeed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.fail = http.StatusInternalServerError
+	now.advance(2 * time.Hour)
+	if err := refreshThreatFeed(ctx); err != nil {
+		t.Fatalf("failed refresh with a cached copy: %v", err)
+	}
+	if !threatFeed.networks.contains("198.51.100.1") {
+		t.Error("last good copy dropped after a failed refresh")
+	}
+}
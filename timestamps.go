@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	timestampSanityOff  = "off"
+	timestampSanityFlag = "flag"
+	timestampSanityDrop = "drop"
+)
+
+// deliveryTime is when the source file was delivered, from the time in its name (see
+// logFileTimeRegexp), or the current time for files whose name has none (e.g. SOURCE_URL)
+func deliveryTime(source sourceObject) time.Time {
+	if match := logFileTimeRegexp.FindStringSubmatch(path.Base(source.Key)); match != nil {
+		if delivered, err := time.Parse("20060102T1504Z", match[1]); err == nil {
+			return delivered
+		}
+	}
+	return clock.Now()
+}
+
+// hasSaneTimestamps reports whether the record's start and end are within TIMESTAMP_SANITY_WINDOW
+// of its file's delivery time. Flow logs are delivered minutes after the capture window ends, so
+// timestamps far from it (e.g. in 2099, or 0) come from a bug at the source. Records without a
+// start or end ("-", for NODATA and SKIPDATA records) are not checked.
+func hasSaneTimestamps(vpcLog *VPCFlowLog, delivered time.Time) bool {
+	window := time.Duration(timestampSanityWindow) * time.Second
+	for _, field := range []string{"start", "end"} {
+		epoch, err := strconv.ParseInt(vpcLog.Get(field), 10, 64)
+		if err != nil {
+			continue
+		}
+		timestamp := time.Unix(epoch, 0)
+		if timestamp.Before(delivered.Add(-window)) || timestamp.After(delivered.Add(window)) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTimestampSanity(policy string) string {
+	switch policy {
+	case "":
+		return timestampSanityOff
+	case timestampSanityOff, timestampSanityFlag, timestampSanityDrop:
+		return policy
+	default:
+		log.Fatalf("TIMESTAMP_SANITY %s not supported - expected one of off, flag, drop", policy)
+		return ""
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+// year2099 is a start time far past the delivery of any file
+const year2099 = "4070908800"
+
+func TestTimestampSanityPolicies(t *testing.T) {
+	for _, policy := range []string{timestampSanityFlag, timestampSanityDrop} {
+		t.Run(policy, func(t *testing.T) {
+			matchAllSources(t)
+			setForTest(t, &timestampSanity, policy)
+			setForTest(t, &timestampSanityWindow, 86400)
+			// in.log has no delivery time in its name, so the current time is used
+			setForTest[Clock](t, &clock, &fakeClock{now: time.Unix(1700000300, 0)})
+
+			records, result, err := filterLines(t,
+				recordLine(),
+				recordLine("srcaddr=10.0.0.2", "start="+year2099, "end="+year2099),
+				recordLine("packets=-", "bytes=-", "start=-", "end=-", "log-status=NODATA"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.ClockSkewRecords != 1 {
+				t.Errorf("counted %d clock skew records, want the 2099 record", result.ClockSkewRecords)
+			}
+			if policy == timestampSanityDrop {
+				if len(records) != 2 || records[1].Get("srcaddr") == "10.0.0.2" {
+					t.Errorf("kept %d records, want the 2099 record dropped", len(records))
+				}
+				return
+			}
+			if len(records) != 3 {
+				t.Fatalf("kept %d records, want all 3 when flagging", len(records))
+			}
+			for i, want := range []string{"false", "true", "false"} {
+				if got := records[i].Get("timestampAnomaly"); got != want {
+					t.Errorf("record %d has timestampAnomaly %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliveryTimeFromFileName(t *testing.T) {
+	setForTest[Clock](t, &clock, &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)})
+
+	named := sourceObject{Bucket: "src", Key: "AWSLogs/123456789012/vpcflowlogs/us-east-1/2024/03/05/123456789012_vpcflowlogs_us-east-1_fl-1_20240305T1015Z_abcd.log.gz"}
+	if got := deliveryTime(named); !got.Equal(time.Date(2024, 3, 5, 10, 15, 0, 0, time.UTC)) {
+		t.Errorf("delivery time %v, want the time in the file name", got)
+	}
+	if got := deliveryTime(sourceObject{URL: "https://example.com/in.log"}); !got.Equal(clock.Now()) {
+		t.Errorf("delivery time %v for a file without one in its name, want the current time", got)
+	}
+
+	delivered := time.Date(2024, 3, 5, 10, 15, 0, 0, time.UTC)
+	for _, line := range []string{recordLine("start=0"), recordLine("end=" + year2099)} {
+		if hasSaneTimestamps(parseTestRecord(t, line), delivered) {
+			t.Errorf("%s accepted as sane for a file delivered %v", line, delivered)
+		}
+	}
+}
+
+func TestTimestampSanityFlagCSVColumns(t *testing.T) {
+	matchAllSources(t)
+	setForTest(t, &timestampSanity, timestampSanityFlag)
+	setForTest(t, &timestampSanityWindow, 86400)
+	setForTest(t, &outputFormat, outputFormatCSV)
+	setForTest[Clock](t, &clock, &fakeClock{now: time.Unix(1700000300, 0)})
+
+	var output bytes.Buffer
+	writer, err := newRecordWriter(outputFormatCSV, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := filterLinesTo(t, writer, recordLine(), recordLine("start="+year2099, "end="+year2099), recordLine()); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV output does not parse: %v\n%s", err, output.String())
+	}
+	if len(rows) != 4 || rows[0][len(rows[0])-1] != "timestampAnomaly" {
+		t.Fatalf("CSV output %q, want a header ending in timestampAnomaly and 3 rows", rows)
+	}
+	for i, want := range []string{"false", "true", "false"} {
+		if got := rows[i+1][len(rows[0])-1]; got != want {
+			t.Errorf("row %d has timestampAnomaly %q, want %q", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of an invocation (run, and download/filter per source file and upload).
+// Until initTracing installs a provider it is OpenTelemetry's no-op tracer, so spans cost next to
+// nothing when ENABLE_OTEL is not set.
+var tracer = otel.Tracer("vpc-log-filter")
+
+// tracerProvider is the provider installed by initTracing, nil when tracing is disabled
+var tracerProvider *sdktrace.TracerProvider
+
+// initTracing installs a tracer provider exporting spans over OTLP/HTTP. The exporter is configured
+// by the standard OTEL_EXPORTER_OTLP_* env vars (OTEL_EXPORTER_OTLP_ENDPOINT, ..._HEADERS, ...) and
+// the service by OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES.
+func initTracing() {
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to create the OTLP trace exporter: %v", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// flushTraces exports the spans of the invocation before it returns - Lambda freezes the execution
+// environment between invocations, so spans left in the batch could be delayed or lost
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		log.Printf("Unable to export traces: %v\n", err)
+	}
+}
+
+// endSpan ends span, recording err on it when there is one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans traces the rest of the test to an in-memory exporter
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	setForTest[trace.Tracer](t, &tracer, provider.Tracer("vpc-log-filter"))
+	return exporter
+}
+
+func TestRunSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	fake.put("src", "a.log", testFlowLogLine+"\n")
+	fake.put("src", "b.log", testFlowLogLine+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "a.log"}, {Bucket: "src", Key: "b.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	var names []string
+	var root trace.SpanContext
+	for _, span := range spans {
+		names = append(names, span.Name)
+		if span.Name == "run" {
+			root = span.SpanContext
+		}
+	}
+	if got := strings.Join(names, ","); got != "download,filter,download,filter,upload,run" {
+		t.Fatalf("spans %s, want download and filter per source file, then upload, within run", got)
+	}
+	for _, span := range spans {
+		if span.Name != "run" && span.Parent.SpanID() != root.SpanID() {
+			t.Errorf("%s span is not a child of the run span", span.Name)
+		}
+	}
+}
+
+func TestRunSpanRecordsError(t *testing.T) {
+	exporter := recordSpans(t)
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &ifNoneMatch, true)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	fake.put("dest", "out.log", "existing output\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	var exists *OutputExistsError
+	if !errors.As(err, &exists) {
+		t.Fatalf("run returned %v, want an OutputExistsError", err)
+	}
+
+	failed := map[string]bool{}
+	for _, span := range exporter.GetSpans() {
+		failed[span.Name] = span.Status.Code == codes.Error
+	}
+	if !failed["upload"] || failed["download"] || failed["filter"] {
+		t.Errorf("error status on spans %v, want only the upload span failed", failed)
+	}
+}
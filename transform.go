@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Transformer rewrites or enriches a matched record before it is serialized, returning the record
+// to write (which can be the record it was given, modified in place). An error fails the run.
+type Transformer interface {
+	Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error)
+}
+
+// batchTransformer is a Transformer that resolves what its records need a batch at a time.
+// prefetch is given each batch of records before any of them is transformed (so before the
+// transformers ahead of it in the chain have run on them).
+type batchTransformer interface {
+	Transformer
+	prefetch(vpcLogs []*VPCFlowLog) error
+}
+
+// transformBatchSize is how many matched records are held back to be transformed together when a
+// batch transformer is configured, the most interface IDs one DescribeNetworkInterfaces call takes
+const transformBatchSize = maxDescribeInterfaceIDs
+
+// builtinTransformers are the transformers that can be named in TRANSFORMERS
+var builtinTransformers = map[string]Transformer{
+	"protocol-name":  protocolNameTransformer{},
+	"interface-name": newInterfaceNameTransformer(),
+	"reverse-dns":    newReverseDNSTransformer(),
+}
+
+// namedTransformer keeps the configured name of a transformer for error messages
+type namedTransformer struct {
+	Transformer
+	name string
+}
+
+// transform runs the record through the TRANSFORMERS chain in order. With no transformers
+// configured the record is returned unchanged.
+func transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	for _, transformer := range transformers {
+		var err error
+		vpcLog, err = transformer.Transform(vpcLog)
+		if err != nil {
+			return nil, fmt.Errorf("Transformer %s failed: %w", transformer.name, err)
+		}
+	}
+	return vpcLog, nil
+}
+
+// prefetch runs the batch transformers of the TRANSFORMERS chain over a batch of records
+func prefetch(vpcLogs []*VPCFlowLog) error {
+	for _, transformer := range transformers {
+		if batch, ok := transformer.Transformer.(batchTransformer); ok {
+			if err := batch.prefetch(vpcLogs); err != nil {
+				return fmt.Errorf("Transformer %s failed: %w", transformer.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// batchSize is how many matched records are transformed together: transformBatchSize when the
+// chain has a batch transformer, otherwise each record is transformed and written on its own
+func batchSize() int {
+	for _, transformer := range transformers {
+		if _, ok := transformer.Transformer.(batchTransformer); ok {
+			return transformBatchSize
+		}
+	}
+	return 1
+}
+
+// parseTransformers parses the comma-separated TRANSFORMERS list, failing on unknown names. GeoIP
+// enrichment is added to the end of the chain when a GeoIP database is configured.
+func parseTransformers(value string) []namedTransformer {
+	var chain []namedTransformer
+	if value != "" {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			transformer, ok := builtinTransformers[name]
+			if !ok {
+				log.Fatalf("TRANSFORMERS contains unknown transformer %q", name)
+			}
+			chain = append(chain, namedTransformer{Transformer: transformer, name: name})
+		}
+	}
+
+	if geoIPDBPath != "" || geoIPASNDBPath != "" {
+		chain = append(chain, namedTransformer{Transformer: geoIPLazyTransformer{}, name: "geoip"})
+	}
+	return chain
+}
+
+// protocolNames maps the IANA protocol numbers seen most in flow logs to their names
+var protocolNames = map[string]string{
+	"1":   "ICMP",
+	"6":   "TCP",
+	"17":  "UDP",
+	"47":  "GRE",
+	"50":  "ESP",
+	"51":  "AH",
+	"58":  "ICMPv6",
+	"132": "SCTP",
+}
+
+// protocolNameTransformer adds a "protocolName" field with the name of the record's protocol
+// number, or the number itself when it has no well-known name
+type protocolNameTransformer struct{}
+
+func (protocolNameTransformer) Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	protocol := vpcLog.Get("protocol")
+	name, ok := protocolNames[protocol]
+	if !ok {
+		name = protocol
+	}
+	vpcLog.Set("protocolName", name)
+	return vpcLog, nil
+}
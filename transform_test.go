@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// transformerFunc adapts a func to a Transformer
+type transformerFunc func(vpcLog *VPCFlowLog) (*VPCFlowLog, error)
+
+func (f transformerFunc) Transform(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+	return f(vpcLog)
+}
+
+func TestTransformerChainRunsInOrder(t *testing.T) {
+	matchAllSources(t)
+	label := transformerFunc(func(vpcLog *VPCFlowLog) (*VPCFlowLog, error) {
+		// Runs after protocol-name, so it sees its field
+		vpcLog.Set("sourceKey", "label-"+vpcLog.Get("protocolName"))
+		return vpcLog, nil
+	})
+	setForTest(t, &transformers, []namedTransformer{
+		{Transformer: protocolNameTransformer{}, name: "protocol-name"},
+		{Transformer: label, name: "label"},
+	})
+
+	records, _, err := filterLines(t, recordLine("protocol=17"), recordLine("protocol=99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Get("protocolName") != "UDP" || records[1].Get("protocolName") != "99" {
+		t.Errorf("protocol names %q and %q", records[0].Get("protocolName"), records[1].Get("protocolName"))
+	}
+	if records[0].Get("sourceKey") != "label-UDP" {
+		t.Errorf("chained transformer wrote %q", records[0].Get("sourceKey"))
+	}
+}
+
+func TestTransformerErrorFailsRun(t *testing.T) {
+	matchAllSources(t)
+	failure := errors.New("lookup failed")
+	setForTest(t, &transformers, []namedTransformer{
+		{Transformer: transformerFunc(func(*VPCFlowLog) (*VPCFlowLog, error) { return nil, failure }), name: "broken"},
+	})
+
+	records, _, err := filterLines(t, testFlowLogLine)
+	if !errors.Is(err, failure) || err.Error() != "Transformer broken failed: lookup failed" {
+		t.Fatalf("filter returned %v, want the transformer's error", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("%d records written after the transformer failed", len(records))
+	}
+}
+
+func TestNoTransformersLeavesRecord(t *testing.T) {
+	setForTest(t, &transformers, nil)
+	vpcLog := testFlowLog(t)
+	transformed, err := transform(vpcLog)
+	if err != nil || transformed != vpcLog || len(transformed.Fields) != len(defaultLogFields) {
+		t.Fatalf("transform without transformers returned %v, %v", transformed, err)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	outputSinkS3       = "s3"
+	outputSinkFirehose = "firehose"
+
+	outputCompressionGzip = "gzip"
+	outputCompressionBGZF = "bgzf"
+)
+
+// streamingUpload streams an object to S3 as it is written. Writes go through a pipe to an
+// s3manager upload running in the background, which sends each part as soon as it has filled up,
+// so memory is bounded by the uploader's part buffers rather than the size of the output.
+type streamingUpload struct {
+	pipeWriter *io.PipeWriter
+	body       *countingWriter
+	checksum   hash.Hash
+	compressor io.WriteCloser
+	done       chan error
+
+	// finished is set once the upload's result has been received from done, and kept in result
+	finished bool
+	result   error
+
+	object outputObject
+}
+
+// startStreamingUpload starts uploading to the given destination. When compression is "gzip" (or
+// "bgzf") the written bytes are compressed on the way into the pipe, so compressed parts are
+// flushed to the upload as the filter runs.
+func startStreamingUpload(uploader *s3manager.Uploader, input *s3manager.UploadInput, compression string) (*streamingUpload, error) {
+	if compression != "" && compression != outputCompressionGzip && compression != outputCompressionBGZF {
+		return nil, fmt.Errorf("Output compression %s not supported - expected one of gzip, bgzf", compression)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	input.Body = pipeReader
+
+	var body io.Writer = pipeWriter
+	var checksum hash.Hash
+	if checksumAlgo != "" {
+		checksum = newChecksum(checksumAlgo)
+		body = io.MultiWriter(pipeWriter, checksum)
+	}
+
+	upload := &streamingUpload{
+		pipeWriter: pipeWriter,
+		body:       &countingWriter{w: body},
+		checksum:   checksum,
+		done:       make(chan error, 1),
+		object:     outputObject{Bucket: aws.StringValue(input.Bucket), Key: aws.StringValue(input.Key)},
+	}
+	upload.compressor = newCompressor(upload.body, compression)
+
+	go func() {
+		_, err := uploader.Upload(input)
+		if isPreconditionFailed(err) {
+			err = &OutputExistsError{Bucket: upload.object.Bucket, Key: upload.object.Key}
+		}
+		// Unblock any pending write if the upload gave up before reading everything
+		pipeReader.CloseWithError(err)
+		upload.done <- err
+	}()
+
+	return upload, nil
+}
+
+// newCompressor returns the writer compressing into w for the output compression, or nil when it
+// is not compressed
+func newCompressor(w io.Writer, compression string) io.WriteCloser {
+	switch compression {
+	case outputCompressionGzip:
+		return gzip.NewWriter(w)
+	case outputCompressionBGZF:
+		return newBGZFWriter(w)
+	}
+	return nil
+}
+
+func (u *streamingUpload) Write(p []byte) (int, error) {
+	if u.compressor != nil {
+		return u.compressor.Write(p)
+	}
+	return u.body.Write(p)
+}
+
+// Close finalizes the compressed stream (writing its footer into the last part) before signalling EOF
+// to the uploader, then waits for the multipart upload to complete
+func (u *streamingUpload) Close() error {
+	if u.compressor != nil {
+		if err := u.compressor.Close(); err != nil {
+			u.pipeWriter.CloseWithError(err)
+			u.wait()
+			return err
+		}
+	}
+
+	u.pipeWriter.Close()
+	if err := u.wait(); err != nil {
+		return err
+	}
+
+	u.object.Size = u.body.n
+	u.object.LastModified = clock.Now()
+	if u.checksum != nil {
+		u.object.Checksum = hex.EncodeToString(u.checksum.Sum(nil))
+	}
+	committedOutputs = append(committedOutputs, u.object)
+	return nil
+}
+
+// Abort fails the upload with err. The uploader aborts the multipart upload when reading its body
+// fails, so no partial object is left behind. Aborting an upload that has already finished (been
+// closed, or aborted) does nothing.
+func (u *streamingUpload) Abort(err error) error {
+	u.pipeWriter.CloseWithError(err)
+	u.wait()
+	return err
+}
+
+// wait returns the result of the upload, waiting for it to finish the first time
+func (u *streamingUpload) wait() error {
+	if !u.finished {
+		u.result, u.finished = <-u.done, true
+	}
+	return u.result
+}
+
+// outputWriter writes records to the output object(s), which are committed by Close. Abort gives
+// up on the output, failing any upload still in progress, and returns err. Objects lists the
+// output objects committed so far.
+type outputWriter interface {
+	recordWriter
+	Abort(err error) error
+	Objects() []outputObject
+}
+
+// outputObject is an output object committed to the destination bucket
+type outputObject struct {
+	Bucket       string
+	Key          string
+	Size         int64
+	LastModified time.Time
+
+	// Checksum is the hex CHECKSUM_ALGO digest of the object's content, when one is configured
+	Checksum string
+}
+
+// objectWriter writes records to a single streamed output object
+type objectWriter struct {
+	recordWriter
+	upload    *streamingUpload
+	committed bool
+}
+
+// openObjectWriter starts streaming a new output object to key in the destination bucket
+func openObjectWriter(uploader *s3manager.Uploader, bucket, key string) (*objectWriter, error) {
+	if err := reserveOutputObject(key); err != nil {
+		return nil, err
+	}
+	upload, err := startStreamingUpload(uploader, newDestUploadInput(bucket, key), outputCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newRecordWriter(outputFormat, upload)
+	if err != nil {
+		return nil, upload.Abort(err)
+	}
+
+	return &objectWriter{recordWriter: writer, upload: upload}, nil
+}
+
+func (o *objectWriter) Close() error {
+	if err := o.recordWriter.Close(); err != nil {
+		return o.upload.Abort(err)
+	}
+	if err := o.upload.Close(); err != nil {
+		return err
+	}
+	o.committed = true
+	return nil
+}
+
+func (o *objectWriter) Objects() []outputObject {
+	if !o.committed {
+		return nil
+	}
+	return []outputObject{o.upload.object}
+}
+
+func (o *objectWriter) Abort(err error) error {
+	return o.upload.Abort(err)
+}
+
+// Sink is a destination the output of a run is written to (OUTPUT_SINK / OUTPUT_SINKS). Write
+// sends a record to it, and Flush sends on the records it has buffered.
+type Sink interface {
+	Write(ctx context.Context, vpcLog *VPCFlowLog) error
+	Flush() error
+}
+
+// sinkWriter is a Sink that is committed or given up on with the rest of the output, like an
+// outputWriter
+type sinkWriter interface {
+	Sink
+	Close() error
+	Abort(err error) error
+	Objects() []outputObject
+}
+
+// writerSink is the Sink writing to an outputWriter: the S3 objects of newS3Sink, or the Firehose
+// stream of newFirehoseSink. A record written once the run's context is done fails with its error.
+type writerSink struct {
+	outputWriter
+}
+
+func (w *writerSink) Write(ctx context.Context, vpcLog *VPCFlowLog) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return w.outputWriter.Write(vpcLog)
+}
+
+// newOutputWriter opens each of the OUTPUT_SINKS (or the single OUTPUT_SINK) for the output of a
+// run, and the writer fanning records out to them
+func newOutputWriter(ctx context.Context, destS3Client s3iface.S3API, bucket, key string) (outputWriter, error) {
+	names := outputSinks
+	if len(names) == 0 {
+		names = []string{outputSink}
+	}
+
+	var sinks []sinkWriter
+	for _, name := range names {
+		sink, err := newSink(name, destS3Client, bucket, key)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Abort(err)
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return &fanoutWriter{ctx: ctx, sinks: sinks}, nil
+}
+
+// newSink opens one output sink - at key in the destination bucket, or the Firehose stream for
+// "firehose"
+func newSink(name string, destS3Client s3iface.S3API, bucket, key string) (sinkWriter, error) {
+	switch name {
+	case "", outputSinkS3:
+		return newS3Sink(destS3Client, bucket, key)
+	case outputSinkFirehose:
+		return newFirehoseSink()
+	}
+	return nil, fmt.Errorf("Output sink %s not supported - expected one of s3, firehose", name)
+}
+
+// newS3Sink opens the output at key in the destination bucket - a single object, or the SPLIT_BY
+// parts and ROLL_MAX_* segments written in its place
+func newS3Sink(destS3Client s3iface.S3API, bucket, key string) (*writerSink, error) {
+	uploader := newUploader(destS3Client)
+	open := func(key string) (outputWriter, error) {
+		if rollMaxBytes > 0 || rollMaxSeconds > 0 {
+			return newRollingWriter(uploader, bucket, key, clock)
+		}
+		return openObjectWriter(uploader, bucket, key)
+	}
+	if splitBy != "" {
+		return &writerSink{newSplitWriter(key, open)}, nil
+	}
+	writer, err := open(key)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{writer}, nil
+}
+
+// newFirehoseSink opens the FIREHOSE_STREAM output, buffered by SINK_BUFFER_SIZE
+func newFirehoseSink() (*writerSink, error) {
+	firehoseClient, err := getFirehoseClient()
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newFirehoseWriter(firehoseClient, firehoseStream)
+	if err != nil {
+		return nil, err
+	}
+	if sinkBufferSize > 0 {
+		return &writerSink{newBufferedSinkWriter(writer, sinkBufferSize)}, nil
+	}
+	return &writerSink{writer}, nil
+}
+
+// fanoutWriter writes every record to each of its sinks, with the run's context. A failing sink
+// doesn't stop the record reaching the others; errors from all of them are joined.
+type fanoutWriter struct {
+	ctx   context.Context
+	sinks []sinkWriter
+}
+
+func (f *fanoutWriter) Write(vpcLog *VPCFlowLog) error {
+	var errs []error
+	for _, sink := range f.sinks {
+		errs = append(errs, sink.Write(f.ctx, vpcLog))
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fanoutWriter) Flush() error {
+	var errs []error
+	for _, sink := range f.sinks {
+		errs = append(errs, sink.Flush())
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fanoutWriter) Close() error {
+	var errs []error
+	for _, sink := range f.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fanoutWriter) Abort(err error) error {
+	for _, sink := range f.sinks {
+		sink.Abort(err)
+	}
+	return err
+}
+
+func (f *fanoutWriter) Objects() []outputObject {
+	var objects []outputObject
+	for _, sink := range f.sinks {
+		objects = append(objects, sink.Objects()...)
+	}
+	return objects
+}
+
+// parseOutputSinks parses the comma-separated OUTPUT_SINKS list
+func parseOutputSinks(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	var sinks []string
+	for _, sink := range strings.Split(value, ",") {
+		sinks = append(sinks, strings.TrimSpace(sink))
+	}
+	return sinks
+}
+
+// newUploader returns the uploader for output objects, sending UPLOAD_CONCURRENCY parts of
+// UPLOAD_PART_SIZE bytes at a time
+func newUploader(destS3Client s3iface.S3API) *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(destS3Client, func(u *s3manager.Uploader) {
+		u.Concurrency = uploadConcurrency
+		u.PartSize = uploadPartSize
+		if ifNoneMatch {
+			u.RequestOptions = append(u.RequestOptions, withIfNoneMatch)
+		}
+	})
+}
+
+// parseUploadPartSize parses UPLOAD_PART_SIZE, which S3 requires to be at least 5MB
+func parseUploadPartSize(name string) int64 {
+	size := int64(envIntOrDefault(name, int(s3manager.DefaultUploadPartSize)))
+	if size < s3manager.MinUploadPartSize {
+		log.Fatalf("Env var %s must be at least %d bytes (the S3 minimum part size), got %d", name, s3manager.MinUploadPartSize, size)
+	}
+	return size
+}
+
+// newDestUploadInput builds the input for streaming an object to the destination bucket, with the
+// same object settings as newDestPutObjectInput
+func newDestUploadInput(bucket, key string) *s3manager.UploadInput {
+	uploadInput := &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if destACL != "" {
+		uploadInput.ACL = aws.String(destACL)
+	}
+	if destTags != "" {
+		uploadInput.Tagging = aws.String(destTags)
+	}
+	if outputMetadata != nil {
+		uploadInput.Metadata = outputMetadata
+	}
+
+	return uploadInput
+}
+
+// outputObjectsOpened counts the output objects the current invocation has started, for
+// MAX_OUTPUT_OBJECTS
+var outputObjectsOpened int
+
+// reserveOutputObject counts a new output object, failing with a TooManyOutputObjectsError when it
+// would be one more than MAX_OUTPUT_OBJECTS - so a SPLIT_BY or DEST_KEY_REGEX with far more
+// distinct keys than expected fails the run rather than creating thousands of objects
+func reserveOutputObject(key string) error {
+	if maxOutputObjects > 0 && outputObjectsOpened >= maxOutputObjects {
+		return &TooManyOutputObjectsError{Key: key}
+	}
+	outputObjectsOpened++
+	return nil
+}
+
+// TooManyOutputObjectsError is returned when a run would write more than MAX_OUTPUT_OBJECTS objects
+type TooManyOutputObjectsError struct {
+	Key string
+}
+
+func (e *TooManyOutputObjectsError) Error() string {
+	return fmt.Sprintf("Output object %s would be over MAX_OUTPUT_OBJECTS (%d)", e.Key, maxOutputObjects)
+}
+
+// withIfNoneMatch makes the requests that create an object (PutObject, or the
+// CompleteMultipartUpload of a multipart upload) conditional on the key not existing yet
+func withIfNoneMatch(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// OutputExistsError is returned when IF_NONE_MATCH is set and the output object already exists,
+// e.g. because a newer invocation has already written it
+type OutputExistsError struct {
+	Bucket string
+	Key    string
+}
+
+func (e *OutputExistsError) Error() string {
+	return fmt.Sprintf("Output file s3://%s/%s already exists - not overwriting it", e.Bucket, e.Key)
+}
+
+// isPreconditionFailed reports whether err, or the error it wraps (s3manager wraps the
+// errors of multipart uploads), is S3's 412 response to a failed conditional request
+func isPreconditionFailed(err error) bool {
+	for err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusPreconditionFailed {
+			return true
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		if aerr.Code() == "PreconditionFailed" {
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestCompressedUploadStreamsParts(t *testing.T) {
+	fake, client := newFakeS3(t)
+
+	upload, err := startStreamingUpload(newUploader(client), newDestUploadInput("dest", "out.log.gz"), outputCompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Random hex only compresses to about half, so 24MB of it is several 5MB parts compressed
+	random := rand.New(rand.NewSource(1))
+	var written bytes.Buffer
+	raw, line := make([]byte, 31), make([]byte, 64)
+	for written.Len() < 24<<20 {
+		random.Read(raw)
+		hex.Encode(line, raw)
+		line[62], line[63] = ' ', '\n'
+		if _, err := upload.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		written.Write(line)
+	}
+
+	// Parts have to be on their way before the output is closed, rather than held until the end
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.count(http.MethodPut) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no part uploaded before Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if parts := fake.count(http.MethodPut); parts < 2 {
+		t.Errorf("uploaded in %d parts, want a multipart upload", parts)
+	}
+	body, ok := fake.get("dest", "out.log.gz")
+	if !ok {
+		t.Fatal("output not committed")
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatalf("reading the compressed output: %v", err)
+	}
+	if !bytes.Equal(content, written.Bytes()) {
+		t.Fatalf("output decompressed to %d bytes, want the %d written", len(content), written.Len())
+	}
+}
+
+func TestIfNoneMatchReportsExistingOutput(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &ifNoneMatch, true)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+	fake.put("dest", "out.log", "newer output\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	var exists *OutputExistsError
+	if !errors.As(err, &exists) || exists.Key != "out.log" {
+		t.Fatalf("run returned %v, want an OutputExistsError for out.log", err)
+	}
+	if output, _ := fake.get("dest", "out.log"); output != "newer output\n" {
+		t.Errorf("existing output overwritten with %q", output)
+	}
+}
+
+func TestNewUploaderConfiguration(t *testing.T) {
+	_, client := newFakeS3(t)
+	setForTest(t, &uploadConcurrency, 9)
+	setForTest(t, &uploadPartSize, 16*1024*1024)
+
+	uploader := newUploader(client)
+	if uploader.Concurrency != 9 {
+		t.Errorf("Concurrency = %d, want 9", uploader.Concurrency)
+	}
+	if uploader.PartSize != 16*1024*1024 {
+		t.Errorf("PartSize = %d, want %d", uploader.PartSize, 16*1024*1024)
+	}
+}
+
+func TestParseUploadPartSize(t *testing.T) {
+	t.Setenv("TEST_UPLOAD_PART_SIZE", "")
+	if size := parseUploadPartSize("TEST_UPLOAD_PART_SIZE"); size != s3manager.DefaultUploadPartSize {
+		t.Errorf("unset part size = %d, want the default %d", size, s3manager.DefaultUploadPartSize)
+	}
+
+	t.Setenv("TEST_UPLOAD_PART_SIZE", "10485760")
+	if size := parseUploadPartSize("TEST_UPLOAD_PART_SIZE"); size != 10485760 {
+		t.Errorf("part size = %d, want 10485760", size)
+	}
+}
+
+// fakeSink is an output sink keeping the records written to it, failing writes of records from
+// failSrcAddr
+type fakeSink struct {
+	recordingWriter
+	failSrcAddr string
+	aborted     error
+}
+
+func (s *fakeSink) Write(vpcLog *VPCFlowLog) error {
+	if vpcLog.Get("srcaddr") == s.failSrcAddr {
+		return errors.New("sink unavailable")
+	}
+	return s.recordingWriter.Write(vpcLog)
+}
+
+func (s *fakeSink) Abort(err error) error {
+	s.aborted = err
+	return err
+}
+
+func (s *fakeSink) Objects() []outputObject {
+	return nil
+}
+
+func TestFanoutWriterWritesEverySink(t *testing.T) {
+	first, second := &fakeSink{}, &fakeSink{}
+	writer := &fanoutWriter{ctx: context.Background(), sinks: []sinkWriter{&writerSink{first}, &writerSink{second}}}
+
+	lines := []string{
+		flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"),
+		flowLogLine("eni-2", "10.0.0.2", "8.8.8.8"),
+		flowLogLine("eni-3", "10.0.0.3", "8.8.8.8"),
+	}
+	for _, line := range lines {
+		if err := writer.Write(parseTestRecord(t, line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, sink := range map[string]*fakeSink{"first": first, "second": second} {
+		if len(sink.records) != len(lines) || !sink.closed {
+			t.Fatalf("%s sink got %d records (closed %v), want all %d", name, len(sink.records), sink.closed, len(lines))
+		}
+		for i, record := range sink.records {
+			if record.Raw != lines[i] {
+				t.Errorf("%s sink record %d is %q, want %q", name, i, record.Raw, lines[i])
+			}
+		}
+	}
+}
+
+func TestFanoutWriterJoinsErrors(t *testing.T) {
+	failing, healthy := &fakeSink{failSrcAddr: "10.0.0.2"}, &fakeSink{}
+	writer := &fanoutWriter{ctx: context.Background(), sinks: []sinkWriter{&writerSink{failing}, &writerSink{healthy}}}
+
+	if err := writer.Write(parseTestRecord(t, flowLogLine("eni-2", "10.0.0.2", "8.8.8.8"))); err == nil || err.Error() != "sink unavailable" {
+		t.Fatalf("write returned %v, want the failing sink's error", err)
+	}
+	if len(healthy.records) != 1 {
+		t.Errorf("the healthy sink got %d records, want the record the other sink failed", len(healthy.records))
+	}
+
+	abort := errors.New("run failed")
+	writer.Abort(abort)
+	if failing.aborted != abort || healthy.aborted != abort {
+		t.Errorf("abort reached sinks as %v and %v", failing.aborted, healthy.aborted)
+	}
+}
+
+func TestFanoutWriterStopsWithTheRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &fakeSink{}
+	writer := &fanoutWriter{ctx: ctx, sinks: []sinkWriter{&writerSink{sink}}}
+
+	cancel()
+	if err := writer.Write(parseTestRecord(t, testFlowLogLine)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("write after the run was canceled returned %v", err)
+	}
+	if len(sink.records) != 0 {
+		t.Errorf("sink got %d records after the run was canceled", len(sink.records))
+	}
+}
+
+func TestOutputSinksS3AndFirehose(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	firehoseClient := &fakeFirehose{}
+	firehoseClientOnce = sync.Once{}
+	firehoseClientOnce.Do(func() { cachedFirehoseClient = firehoseClient })
+	t.Cleanup(func() { firehoseClientOnce = sync.Once{} })
+
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &outputSinks, parseOutputSinks("s3,firehose"))
+	setForTest(t, &firehoseStream, "stream")
+	lines := []string{flowLogLine("eni-1", "10.0.0.1", "8.8.8.8"), flowLogLine("eni-2", "10.0.0.2", "8.8.8.8")}
+	fake.put("src", "in.log", strings.Join(lines, "\n")+"\n")
+
+	_, err := run(context.Background(), func(s3iface.S3API, string) ([]sourceObject, error) {
+		return []sourceObject{{Bucket: "src", Key: "in.log"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output, _ := fake.get("dest", "out.log"); output != strings.Join(lines, "\n")+"\n" {
+		t.Errorf("S3 output %q, want both records", output)
+	}
+	var sent []string
+	for _, batch := range firehoseClient.batches {
+		sent = append(sent, batch...)
+	}
+	if len(sent) != 2 || !strings.Contains(sent[0], "10.0.0.1") || !strings.Contains(sent[1], "10.0.0.2") {
+		t.Errorf("sent %q to Firehose, want both records", sent)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// warmupHandler answers warmup pings - a payload of {"warmup": true}, or one whose "source" is
+// WARMUP_SOURCE - without calling the handler, so scheduled warmers keep containers warm without
+// any S3 work. Every other payload is passed to the handler.
+type warmupHandler struct {
+	lambda.Handler
+}
+
+// warmupPing is the part of a payload looked at to tell a warmup ping
+type warmupPing struct {
+	Warmup bool   `json:"warmup"`
+	Source string `json:"source"`
+}
+
+func (h warmupHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	if !isWarmup(payload) {
+		return h.Handler.Invoke(ctx, payload)
+	}
+	log.Printf("Warmup ping - not processing\n")
+	return json.Marshal(Result{Warmup: true})
+}
+
+func isWarmup(payload []byte) bool {
+	var ping warmupPing
+	if err := json.Unmarshal(payload, &ping); err != nil {
+		return false
+	}
+	return ping.Warmup || (warmupSource != "" && ping.Source == warmupSource)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func TestWarmupPingShortCircuits(t *testing.T) {
+	fake, client := newFakeS3(t)
+	useFakeS3(t, client)
+	matchAllSources(t)
+	setForTest(t, &sourceBucketName, "src/in.log")
+	setForTest(t, &destBucketName, "dest/out.log")
+	setForTest(t, &warmupSource, "serverless-plugin-warmup")
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+
+	handled := 0
+	handler := warmupHandler{lambda.NewHandler(func(ctx context.Context) (Result, error) {
+		handled++
+		return HandleRequest(ctx)
+	})}
+
+	for _, payload := range []string{`{"warmup": true}`, `{"source": "serverless-plugin-warmup"}`} {
+		response, err := handler.Invoke(context.Background(), []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result Result
+		if err := json.Unmarshal(response, &result); err != nil || !result.Warmup {
+			t.Errorf("%s answered with %s, want a warmup result", payload, response)
+		}
+	}
+	if handled != 0 || len(fake.requests) != 0 {
+		t.Fatalf("warmup pings ran the handler %d times and made %d S3 requests", handled, len(fake.requests))
+	}
+
+	// Anything else is processed
+	for _, payload := range []string{`{}`, `{"warmup": false}`, `{"source": "aws.events"}`, `[]`} {
+		if _, err := handler.Invoke(context.Background(), []byte(payload)); err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+	}
+	if handled != 4 {
+		t.Errorf("handler ran %d times for the 4 other payloads", handled)
+	}
+}
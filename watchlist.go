@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// watchlistStatusActive is the status of the watchlist items that are matched
+const watchlistStatusActive = "active"
+
+// cachedWatchlist is the last WATCHLIST_TABLE scan of this container, reused by warm invocations
+// for WATCHLIST_CACHE_SECONDS so frequently-triggered runs don't scan the table every time
+var cachedWatchlist struct {
+	loaded time.Time
+	rules  []sourceRule
+}
+
+// loadWatchlist scans WATCHLIST_TABLE for the active IP address or CIDR block entries: items whose
+// "status" attribute is "active", with the entry in their WATCHLIST_IP_ATTRIBUTE attribute (default
+// "ip"). Items without the attribute are skipped.
+func loadWatchlist(dynamoDBClient dynamodbiface.DynamoDBAPI) ([]sourceRule, error) {
+	now := clock.Now()
+	if !cachedWatchlist.loaded.IsZero() && now.Sub(cachedWatchlist.loaded) < time.Duration(watchlistCacheSeconds)*time.Second {
+		return cachedWatchlist.rules, nil
+	}
+
+	var entries []string
+	err := dynamoDBClient.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(watchlistTable),
+		FilterExpression:     aws.String("#status = :active"),
+		ProjectionExpression: aws.String("#ip"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+			"#ip":     aws.String(watchlistIPAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":active": {S: aws.String(watchlistStatusActive)},
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if ip, ok := item[watchlistIPAttribute]; ok && ip.S != nil {
+				entries = append(entries, aws.StringValue(ip.S))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to scan watchlist table %s: %v", watchlistTable, err)
+	}
+
+	rules, err := parseSourceRules("Watchlist", entries)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedWatchlist.loaded, cachedWatchlist.rules = now, rules
+	log.Printf("Loaded %d active entries from watchlist table %s\n", len(rules), watchlistTable)
+	return rules, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeWatchlistTable serves its items a page at a time, applying the scan's status filter the way
+// DynamoDB evaluates the FilterExpression
+type fakeWatchlistTable struct {
+	dynamodbiface.DynamoDBAPI
+	pages [][]map[string]*dynamodb.AttributeValue
+	scans int
+	input *dynamodb.ScanInput
+}
+
+func (f *fakeWatchlistTable) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	f.scans++
+	f.input = input
+	active := aws.StringValue(input.ExpressionAttributeValues[":active"].S)
+
+	for i, items := range f.pages {
+		page := &dynamodb.ScanOutput{}
+		for _, item := range items {
+			if status, ok := item["status"]; ok && aws.StringValue(status.S) == active {
+				page.Items = append(page.Items, item)
+			}
+		}
+		if !fn(page, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func watchlistItem(ip, status string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{"status": {S: aws.String(status)}}
+	if ip != "" {
+		item["ip"] = &dynamodb.AttributeValue{S: aws.String(ip)}
+	}
+	return item
+}
+
+// useWatchlist points WATCHLIST_TABLE at a table that starts with an empty cache
+func useWatchlist(t *testing.T) *fakeClock {
+	t.Helper()
+	setForTest(t, &watchlistTable, "watchlist")
+	setForTest(t, &watchlistIPAttribute, "ip")
+	setForTest(t, &watchlistCacheSeconds, 60)
+	now := &fakeClock{now: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)}
+	setForTest[Clock](t, &clock, now)
+
+	saved := cachedWatchlist
+	cachedWatchlist.loaded, cachedWatchlist.rules = time.Time{}, nil
+	t.Cleanup(func() { cachedWatchlist = saved })
+	return now
+}
+
+func ruleNames(rules []sourceRule) string {
+	var names []string
+	for _, rule := range rules {
+		names = append(names, rule.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestLoadWatchlistActiveEntries(t *testing.T) {
+	useWatchlist(t)
+	table := &fakeWatchlistTable{pages: [][]map[string]*dynamodb.AttributeValue{
+		{
+			watchlistItem("10.1.0.0/16", "active"),
+			watchlistItem("10.2.0.1", "retired"),
+			watchlistItem("", "active"),
+		},
+		{
+			watchlistItem("192.168.7.7", "active"),
+		},
+	}}
+
+	rules, err := loadWatchlist(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ruleNames(rules); got != "10.1.0.0/16,192.168.7.7" {
+		t.Errorf("watchlist rules %q, want the two active entries", got)
+	}
+	if !rules[0].matches("10.1.2.3") || rules[1].matches("10.2.0.1") {
+		t.Errorf("watchlist rules do not match the active entries only")
+	}
+	if got := aws.StringValue(table.input.TableName); got != "watchlist" {
+		t.Errorf("scanned table %q, want watchlist", got)
+	}
+}
+
+func TestLoadWatchlistCached(t *testing.T) {
+	now := useWatchlist(t)
+	table := &fakeWatchlistTable{pages: [][]map[string]*dynamodb.AttributeValue{
+		{watchlistItem("10.1.0.0/16", "active")},
+	}}
+
+	if _, err := loadWatchlist(table); err != nil {
+		t.Fatal(err)
+	}
+	table.pages[0] = append(table.pages[0], watchlistItem("10.3.0.0/16", "active"))
+
+	now.advance(59 * time.Second)
+	rules, err := loadWatchlist(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.scans != 1 || ruleNames(rules) != "10.1.0.0/16" {
+		t.Errorf("within WATCHLIST_CACHE_SECONDS: %d scans and rules %q, want the cached scan", table.scans, ruleNames(rules))
+	}
+
+	now.advance(time.Second)
+	rules, err = loadWatchlist(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.scans != 2 || ruleNames(rules) != "10.1.0.0/16,10.3.0.0/16" {
+		t.Errorf("after WATCHLIST_CACHE_SECONDS: %d scans and rules %q, want a new scan", table.scans, ruleNames(rules))
+	}
+}
+
+func TestLoadWatchlistInvalidEntry(t *testing.T) {
+	useWatchlist(t)
+	table := &fakeWatchlistTable{pages: [][]map[string]*dynamodb.AttributeValue{
+		{watchlistItem("not-an-address", "active")},
+	}}
+
+	if _, err := loadWatchlist(table); err == nil {
+		t.Errorf("loading an invalid watchlist entry succeeded")
+	}
+	if !cachedWatchlist.loaded.IsZero() {
+		t.Errorf("a failed scan was cached")
+	}
+}
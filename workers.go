@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// workerSlots is the semaphore shared by everything that does work concurrently - the AWS requests
+// of every client (parallel download and upload parts, Firehose batches, ...) and reverse DNS
+// lookups - so that features enabled together cannot flood the function's connections. At most
+// MAX_GOROUTINES of them run at once; nil leaves them unbounded. An AWS request only holds its slot
+// while it is sent, up to its response headers - response bodies (e.g. download parts) are read
+// after the slot is released, so they are not bounded by it.
+var workerSlots = newWorkerSlots(maxGoroutines)
+
+func newWorkerSlots(size int) chan struct{} {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan struct{}, size)
+}
+
+// acquireWorker blocks until a worker slot is free
+func acquireWorker() {
+	if workerSlots != nil {
+		workerSlots <- struct{}{}
+	}
+}
+
+func releaseWorker() {
+	if workerSlots != nil {
+		<-workerSlots
+	}
+}
+
+// limitSends makes the session's requests take a worker slot while they are sent. The slot is held
+// for each attempt, so a request waiting to be retried does not hold one. It is released before the
+// response body is read: a streamed download part holding its slot until its body is consumed
+// would wait on the upload it feeds, which needs slots of its own.
+func limitSends(handlers *request.Handlers) {
+	if workerSlots == nil {
+		return
+	}
+	handlers.Send.PushFrontNamed(request.NamedHandler{Name: "vpclogfilter.AcquireWorker", Fn: func(*request.Request) { acquireWorker() }})
+	handlers.Send.PushBackNamed(request.NamedHandler{Name: "vpclogfilter.ReleaseWorker", Fn: func(*request.Request) { releaseWorker() }})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestLimitSendsReleasesSlotBeforeBodyIsRead(t *testing.T) {
+	fake, client := newFakeS3(t)
+	setForTest(t, &workerSlots, make(chan struct{}, 1))
+	limitSends(&client.Handlers)
+	fake.put("src", "in.log", testFlowLogLine+"\n")
+
+	object, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("src"), Key: aws.String("in.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Body.Close()
+	if len(workerSlots) != 0 {
+		t.Fatal("slot still held by a sent request")
+	}
+
+	// With the only slot free, a second request can be sent while the first body is unread
+	if _, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("src"), Key: aws.String("in.log")}); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(object.Body); string(body) != testFlowLogLine+"\n" {
+		t.Fatalf("read %q", body)
+	}
+}
+
+func TestAcquireWorkerBlocksWhenSlotsTaken(t *testing.T) {
+	setForTest(t, &workerSlots, make(chan struct{}, 1))
+	acquireWorker()
+
+	acquired := make(chan struct{})
+	go func() {
+		acquireWorker()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a second slot of one")
+	default:
+	}
+
+	releaseWorker()
+	<-acquired
+	releaseWorker()
+}